@@ -0,0 +1,88 @@
+package cluster
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Client writes events to a cluster, following redirects to the current leader.
+// It can be used concurrently.
+type Client struct {
+	Sender    Sender
+	Addresses []string
+	// Timeout limits the time spent looking for a leader that accepts the write.
+	Timeout time.Duration
+	m       sync.Mutex
+	leader  string
+	next    int
+}
+
+// address returns the address of the leader, if known, or the next of the addresses.
+func (c *Client) address() string {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.leader != "" {
+		return c.leader
+	}
+	address := c.Addresses[c.next%len(c.Addresses)]
+	c.next++
+	return address
+}
+
+func (c *Client) setLeader(address string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.leader = address
+}
+
+// WriteEvent writes the event to the topic through the current leader and
+// returns the event address. Writes are retried only while they are known
+// not to be applied: when the node can't be reached or is not the leader.
+// Other errors are returned right away, as the write may have been applied.
+func (c *Client) WriteEvent(topicName string, data []byte) (uint64, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+
+	lastErr := errors.New("No cluster addresses")
+
+	for time.Now().Before(deadline) && len(c.Addresses) > 0 {
+		address := c.address()
+
+		resp, err := c.Sender.Send(address, &Request{
+			Type:  requestWrite,
+			Topic: topicName,
+			Data:  data,
+		})
+
+		if err == nil && resp.Error == "" {
+			c.setLeader(address)
+			return resp.Address, nil
+		}
+
+		c.setLeader("")
+
+		if err != nil {
+			if err != ErrUnreachable {
+				return 0, err
+			}
+			lastErr = err
+		} else {
+			lastErr = errors.New(resp.Error)
+			if !resp.NotLeader {
+				return 0, lastErr
+			}
+			if resp.LeaderAddress != "" && resp.LeaderAddress != address {
+				c.setLeader(resp.LeaderAddress)
+				continue
+			}
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return 0, lastErr
+}
@@ -0,0 +1,456 @@
+package cluster_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/draganm/zathras/cluster"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestCluster(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Cluster Suite")
+}
+
+type countingSender struct {
+	calls int
+	resp  *cluster.Response
+	err   error
+}
+
+func (s *countingSender) Send(address string, req *cluster.Request) (*cluster.Response, error) {
+	s.calls++
+	return s.resp, s.err
+}
+
+var _ = Describe("Client", func() {
+	It("Should not retry writes that may have been applied", func() {
+		sender := &countingSender{err: errors.New("connection reset")}
+		client := &cluster.Client{Sender: sender, Addresses: []string{"a"}}
+		_, err := client.WriteEvent("t1", []byte("test"))
+		Expect(err).To(Equal(sender.err))
+		Expect(sender.calls).To(Equal(1))
+	})
+
+	It("Should not retry writes that failed permanently", func() {
+		sender := &countingSender{resp: &cluster.Response{Error: "Invalid topic name"}}
+		client := &cluster.Client{Sender: sender, Addresses: []string{"a"}}
+		_, err := client.WriteEvent("t1", []byte("test"))
+		Expect(err).To(MatchError("Invalid topic name"))
+		Expect(sender.calls).To(Equal(1))
+	})
+
+	It("Should retry writes rejected by a node that is not the leader", func() {
+		sender := &countingSender{resp: &cluster.Response{Error: "Not the leader, leader unknown", NotLeader: true}}
+		client := &cluster.Client{Sender: sender, Addresses: []string{"a"}, Timeout: 100 * time.Millisecond}
+		_, err := client.WriteEvent("t1", []byte("test"))
+		Expect(err).To(HaveOccurred())
+		Expect(sender.calls).To(BeNumerically(">", 1))
+	})
+})
+
+var _ = Describe("Cluster", func() {
+
+	var dirs []string
+	var nodes map[string]*cluster.Node
+	var nodeDirs map[string]string
+	var snapshotThreshold uint64
+
+	newDir := func() string {
+		dir, err := ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+		dirs = append(dirs, dir)
+		return dir
+	}
+
+	startNode := func(id string, transport cluster.Transport, dir string, members map[string]string) {
+		n, err := cluster.Start(cluster.Config{
+			ID:                id,
+			Dir:               dir,
+			SegmentSize:       1024,
+			Transport:         transport,
+			Members:           members,
+			HeartbeatInterval: 10 * time.Millisecond,
+			SnapshotThreshold: snapshotThreshold,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		nodes[id] = n
+		nodeDirs[id] = dir
+	}
+
+	leaderOf := func(ids ...string) string {
+		leader := ""
+		Eventually(func() int {
+			leaders := 0
+			for _, id := range ids {
+				if nodes[id].IsLeader() {
+					leader = id
+					leaders++
+				}
+			}
+			return leaders
+		}, 5*time.Second).Should(Equal(1))
+		return leader
+	}
+
+	events := func(id, topicName string) []string {
+		t, err := nodes[id].Store().Topic(topicName)
+		Expect(err).ToNot(HaveOccurred())
+		result := []string{}
+		Expect(t.ReadEvents(func(nextAddress uint64, data []byte) error {
+			result = append(result, fmt.Sprintf("%d:%s", nextAddress, data))
+			return nil
+		})).To(Succeed())
+		return result
+	}
+
+	BeforeEach(func() {
+		dirs = nil
+		nodes = map[string]*cluster.Node{}
+		nodeDirs = map[string]string{}
+		snapshotThreshold = 0
+	})
+
+	AfterEach(func() {
+		for _, n := range nodes {
+			Expect(n.Close()).To(Succeed())
+		}
+		for _, dir := range dirs {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		}
+	})
+
+	Context("With three nodes on an in-process network", func() {
+		var network *cluster.InmemNetwork
+		var members map[string]string
+		var client *cluster.Client
+
+		BeforeEach(func() {
+			network = cluster.NewInmemNetwork()
+			members = map[string]string{"n1": "a1", "n2": "a2", "n3": "a3"}
+			for id, address := range members {
+				startNode(id, network.Transport(address), newDir(), members)
+			}
+			client = &cluster.Client{
+				Sender:    network.Transport("client"),
+				Addresses: []string{"a1", "a2", "a3"},
+			}
+		})
+
+		It("Should elect a single leader", func() {
+			leaderOf("n1", "n2", "n3")
+		})
+
+		It("Should replicate written events to all nodes", func() {
+			for i := 0; i < 5; i++ {
+				_, err := client.WriteEvent("t1", []byte(fmt.Sprintf("e%d", i)))
+				Expect(err).ToNot(HaveOccurred())
+			}
+			expected := events(leaderOf("n1", "n2", "n3"), "t1")
+			Expect(expected).To(HaveLen(5))
+			for id := range members {
+				Eventually(func() []string {
+					return events(id, "t1")
+				}).Should(Equal(expected))
+			}
+		})
+
+		It("Should tell a client writing to a follower where the leader is", func() {
+			leader := leaderOf("n1", "n2", "n3")
+			for id, n := range nodes {
+				if id != leader {
+					Eventually(func() error {
+						_, err := n.WriteEvent(context.Background(), "t1", []byte("x"))
+						return err
+					}).Should(Equal(&cluster.NotLeaderError{LeaderID: leader, LeaderAddress: members[leader]}))
+					return
+				}
+			}
+		})
+
+		Context("When the leader is partitioned away", func() {
+			var oldLeader string
+			var majority []string
+
+			BeforeEach(func() {
+				_, err := client.WriteEvent("t1", []byte("before"))
+				Expect(err).ToNot(HaveOccurred())
+
+				oldLeader = leaderOf("n1", "n2", "n3")
+				majority = nil
+				majorityAddresses := []string{"client"}
+				for id, address := range members {
+					if id != oldLeader {
+						majority = append(majority, id)
+						majorityAddresses = append(majorityAddresses, address)
+					}
+				}
+				network.Partition([]string{members[oldLeader]}, majorityAddresses)
+			})
+
+			It("Should elect a new leader in the majority and accept writes", func() {
+				leaderOf(majority...)
+				_, err := client.WriteEvent("t1", []byte("after"))
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("Should not commit writes on the old leader", func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+				defer cancel()
+				_, err := nodes[oldLeader].WriteEvent(ctx, "t1", []byte("lost"))
+				Expect(err).To(HaveOccurred())
+				Expect(events(oldLeader, "t1")).To(HaveLen(1))
+			})
+
+			Context("When the partition heals", func() {
+				BeforeEach(func() {
+					leaderOf(majority...)
+					_, err := client.WriteEvent("t1", []byte("after"))
+					Expect(err).ToNot(HaveOccurred())
+					network.Heal()
+				})
+
+				It("Should bring the old leader up to date", func() {
+					expected := events(leaderOf(majority...), "t1")
+					Expect(expected).To(HaveLen(2))
+					Eventually(func() []string {
+						return events(oldLeader, "t1")
+					}).Should(Equal(expected))
+				})
+			})
+		})
+
+		Context("When a node is added", func() {
+			BeforeEach(func() {
+				_, err := client.WriteEvent("t1", []byte("before"))
+				Expect(err).ToNot(HaveOccurred())
+				startNode("n4", network.Transport("a4"), newDir(), nil)
+				leader := leaderOf("n1", "n2", "n3")
+				Expect(nodes[leader].AddMember(context.Background(), "n4", "a4")).To(Succeed())
+			})
+
+			It("Should catch up with the cluster", func() {
+				Eventually(func() []string {
+					return events("n4", "t1")
+				}).Should(HaveLen(1))
+				Expect(nodes["n4"].Members()).To(HaveLen(4))
+			})
+
+			Context("When the leader is removed", func() {
+				var removed string
+				BeforeEach(func() {
+					removed = leaderOf("n1", "n2", "n3")
+					Expect(nodes[removed].RemoveMember(context.Background(), removed)).To(Succeed())
+				})
+
+				It("Should elect a leader among the remaining nodes", func() {
+					remaining := []string{}
+					for _, id := range []string{"n1", "n2", "n3", "n4"} {
+						if id != removed {
+							remaining = append(remaining, id)
+						}
+					}
+					leaderOf(remaining...)
+					_, err := client.WriteEvent("t1", []byte("after"))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(nodes[removed].IsLeader()).To(BeFalse())
+				})
+			})
+		})
+	})
+
+	Context("With three nodes compacting their logs", func() {
+		var network *cluster.InmemNetwork
+		var client *cluster.Client
+		var expected []string
+
+		BeforeEach(func() {
+			snapshotThreshold = 4
+			network = cluster.NewInmemNetwork()
+			members := map[string]string{"n1": "a1", "n2": "a2", "n3": "a3"}
+			for id, address := range members {
+				startNode(id, network.Transport(address), newDir(), members)
+			}
+			client = &cluster.Client{
+				Sender:    network.Transport("client"),
+				Addresses: []string{"a1", "a2", "a3"},
+			}
+			for i := 0; i < 20; i++ {
+				_, err := client.WriteEvent(fmt.Sprintf("t%d", i%3), []byte(fmt.Sprintf("e%d", i)))
+				Expect(err).ToNot(HaveOccurred())
+			}
+			expected = events(leaderOf("n1", "n2", "n3"), "t1")
+			Expect(expected).To(HaveLen(7))
+		})
+
+		It("Should remove applied entries from the log", func() {
+			for _, id := range []string{"n1", "n2", "n3"} {
+				Eventually(func() int64 {
+					fi, err := os.Stat(filepath.Join(nodeDirs[id], "raft.log"))
+					Expect(err).ToNot(HaveOccurred())
+					return fi.Size()
+				}).Should(BeNumerically("<", 1000))
+			}
+		})
+
+		Context("When a node is added", func() {
+			BeforeEach(func() {
+				startNode("n4", network.Transport("a4"), newDir(), nil)
+				leader := leaderOf("n1", "n2", "n3")
+				Expect(nodes[leader].AddMember(context.Background(), "n4", "a4")).To(Succeed())
+			})
+
+			It("Should copy the topics to the node", func() {
+				Eventually(func() []string {
+					return events("n4", "t1")
+				}).Should(Equal(expected))
+				Eventually(nodes["n4"].Members).Should(HaveLen(4))
+				_, err := client.WriteEvent("t1", []byte("after"))
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(func() []string {
+					return events("n4", "t1")
+				}).Should(HaveLen(8))
+				Expect(events("n4", "t1")).To(Equal(events(leaderOf("n1", "n2", "n3"), "t1")))
+			})
+		})
+	})
+
+	Context("With three nodes on localhost TCP ports", func() {
+		BeforeEach(func() {
+			transports := map[string]*cluster.TCPTransport{}
+			members := map[string]string{}
+			for _, id := range []string{"n1", "n2", "n3"} {
+				t, err := cluster.ListenTCP("127.0.0.1:0")
+				Expect(err).ToNot(HaveOccurred())
+				transports[id] = t
+				members[id] = t.Addr()
+			}
+			for id, t := range transports {
+				startNode(id, t, newDir(), members)
+			}
+		})
+
+		It("Should replicate events written through a client", func() {
+			client := &cluster.Client{
+				Sender:    cluster.TCPSender{},
+				Addresses: []string{nodes["n1"].Members()["n1"]},
+			}
+			address, err := client.WriteEvent("t1", []byte("test"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(address).To(Equal(uint64(0)))
+			for _, id := range []string{"n1", "n2", "n3"} {
+				Eventually(func() []string {
+					return events(id, "t1")
+				}).Should(Equal([]string{"34:test"}))
+			}
+		})
+
+		Context("When a node is restarted", func() {
+			It("Should keep its data and not apply entries twice", func() {
+				client := &cluster.Client{
+					Sender:    cluster.TCPSender{},
+					Addresses: []string{nodes["n1"].Members()["n1"]},
+				}
+				_, err := client.WriteEvent("t1", []byte("test"))
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(func() []string {
+					return events("n2", "t1")
+				}).Should(HaveLen(1))
+
+				members := nodes["n2"].Members()
+				Expect(nodes["n2"].Close()).To(Succeed())
+				delete(nodes, "n2")
+				t, err := cluster.ListenTCP(members["n2"])
+				Expect(err).ToNot(HaveOccurred())
+				startNode("n2", t, nodeDirs["n2"], members)
+
+				_, err = client.WriteEvent("t1", []byte("test2"))
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(func() []string {
+					return events("n2", "t1")
+				}).Should(Equal([]string{"34:test", "69:test2"}))
+			})
+
+			It("Should not write events again when the applied index was lost", func() {
+				client := &cluster.Client{
+					Sender:    cluster.TCPSender{},
+					Addresses: []string{nodes["n1"].Members()["n1"]},
+				}
+				_, err := client.WriteEvent("t1", []byte("test"))
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(func() []string {
+					return events("n2", "t1")
+				}).Should(HaveLen(1))
+
+				members := nodes["n2"].Members()
+				Expect(nodes["n2"].Close()).To(Succeed())
+				delete(nodes, "n2")
+
+				stateFile := filepath.Join(nodeDirs["n2"], "raft.state")
+				state := map[string]interface{}{}
+				data, err := ioutil.ReadFile(stateFile)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(json.Unmarshal(data, &state)).To(Succeed())
+				state["Applied"] = 0
+				data, err = json.Marshal(state)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(ioutil.WriteFile(stateFile, data, 0700)).To(Succeed())
+
+				t, err := cluster.ListenTCP(members["n2"])
+				Expect(err).ToNot(HaveOccurred())
+				startNode("n2", t, nodeDirs["n2"], members)
+
+				_, err = client.WriteEvent("t1", []byte("test2"))
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(func() []string {
+					return events("n2", "t1")
+				}).Should(Equal([]string{"34:test", "69:test2"}))
+				Consistently(func() []string {
+					return events("n2", "t1")
+				}, 100*time.Millisecond).Should(HaveLen(2))
+			})
+
+			It("Should drop a log record torn by a crash", func() {
+				client := &cluster.Client{
+					Sender:    cluster.TCPSender{},
+					Addresses: []string{nodes["n1"].Members()["n1"]},
+				}
+				_, err := client.WriteEvent("t1", []byte("test"))
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(func() []string {
+					return events("n2", "t1")
+				}).Should(HaveLen(1))
+
+				members := nodes["n2"].Members()
+				Expect(nodes["n2"].Close()).To(Succeed())
+				delete(nodes, "n2")
+
+				logFile, err := os.OpenFile(filepath.Join(nodeDirs["n2"], "raft.log"), os.O_WRONLY|os.O_APPEND, 0700)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = logFile.Write([]byte{0, 0, 0, 100, '{', '"'})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logFile.Close()).To(Succeed())
+
+				t, err := cluster.ListenTCP(members["n2"])
+				Expect(err).ToNot(HaveOccurred())
+				startNode("n2", t, nodeDirs["n2"], members)
+
+				_, err = client.WriteEvent("t1", []byte("test2"))
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(func() []string {
+					return events("n2", "t1")
+				}).Should(Equal([]string{"34:test", "69:test2"}))
+			})
+		})
+	})
+})
@@ -0,0 +1,365 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/draganm/zathras/segment"
+)
+
+type entryType byte
+
+const (
+	entryNoop entryType = iota
+	entryEvent
+	entryConfig
+	// entrySnapshot is the first record of a compacted log. It holds index,
+	// term and membership of the last entry removed from the log.
+	entrySnapshot
+)
+
+// Entry is one entry of the replicated log.
+type Entry struct {
+	Term    uint64
+	Type    entryType
+	Topic   string
+	Data    []byte
+	Members map[string]string
+	// Index is only set for snapshot records.
+	Index uint64 `json:",omitempty"`
+}
+
+// raftLog keeps the replicated log in memory and in an append only file.
+// Entries up to the snapshot index are applied to the store and removed
+// from the log.
+type raftLog struct {
+	fileName string
+	file     *os.File
+	snapshot Entry
+	entries  []Entry
+	offsets  []int64
+	size     int64
+}
+
+func openLog(fileName string) (*raftLog, error) {
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &raftLog{
+		fileName: fileName,
+		file:     file,
+		snapshot: Entry{Type: entrySnapshot},
+	}
+
+	header := make([]byte, 4)
+	for {
+		_, err = io.ReadFull(file, header)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header))
+		_, err = io.ReadFull(file, data)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		e := Entry{}
+		err = json.Unmarshal(data, &e)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if e.Type == entrySnapshot && l.size == 0 {
+			l.snapshot = e
+		} else {
+			l.entries = append(l.entries, e)
+			l.offsets = append(l.offsets, l.size)
+		}
+		l.size += int64(4 + len(data))
+	}
+
+	// drop a record torn by a crash during an append
+	err = file.Truncate(l.size)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *raftLog) snapshotIndex() uint64 {
+	return l.snapshot.Index
+}
+
+func (l *raftLog) lastIndex() uint64 {
+	return l.snapshot.Index + uint64(len(l.entries))
+}
+
+func (l *raftLog) lastTerm() uint64 {
+	return l.term(l.lastIndex())
+}
+
+// term returns the term of the entry with the index. Index 0 and
+// compacted entries other than the last one have term 0.
+func (l *raftLog) term(index uint64) uint64 {
+	if index == l.snapshot.Index {
+		return l.snapshot.Term
+	}
+	if index < l.snapshot.Index || index > l.lastIndex() {
+		return 0
+	}
+	return l.entries[index-l.snapshot.Index-1].Term
+}
+
+// entry returns the entry with the index, which must not be compacted.
+func (l *raftLog) entry(index uint64) Entry {
+	return l.entries[index-l.snapshot.Index-1]
+}
+
+// slice returns at most max entries starting with the index, which must
+// not be compacted.
+func (l *raftLog) slice(index uint64, max int) []Entry {
+	if index > l.lastIndex() {
+		return nil
+	}
+	entries := l.entries[index-l.snapshot.Index-1:]
+	if len(entries) > max {
+		entries = entries[:max]
+	}
+	return append([]Entry{}, entries...)
+}
+
+func encodeEntry(e Entry) ([]byte, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	copy(record[4:], data)
+	return record, nil
+}
+
+// append writes the entries to the log file and syncs it.
+func (l *raftLog) append(entries ...Entry) error {
+	size := l.size
+	records := []byte{}
+	offsets := []int64{}
+	for _, e := range entries {
+		record, err := encodeEntry(e)
+		if err != nil {
+			return err
+		}
+		offsets = append(offsets, size)
+		records = append(records, record...)
+		size += int64(len(record))
+	}
+
+	_, err := l.file.WriteAt(records, l.size)
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		return err
+	}
+
+	l.entries = append(l.entries, entries...)
+	l.offsets = append(l.offsets, offsets...)
+	l.size = size
+	return nil
+}
+
+// truncate removes the entry with the index and all entries after it.
+// Compacted entries can't be removed.
+func (l *raftLog) truncate(index uint64) error {
+	if index > l.lastIndex() {
+		return nil
+	}
+	i := index - l.snapshot.Index - 1
+	err := l.file.Truncate(l.offsets[i])
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	l.size = l.offsets[i]
+	l.entries = l.entries[:i]
+	l.offsets = l.offsets[:i]
+	return nil
+}
+
+// membersAt returns the membership of the latest config entry up to the
+// index, or nil if there is none.
+func (l *raftLog) membersAt(index uint64) map[string]string {
+	for i := int(index-l.snapshot.Index) - 1; i >= 0; i-- {
+		if l.entries[i].Type == entryConfig {
+			return l.entries[i].Members
+		}
+	}
+	return l.snapshot.Members
+}
+
+// members returns the membership of the latest config entry, or nil if
+// there is none.
+func (l *raftLog) members() map[string]string {
+	return l.membersAt(l.lastIndex())
+}
+
+// compact removes the entries up to the index from the log. They must be
+// applied to the store.
+func (l *raftLog) compact(index uint64) error {
+	if index <= l.snapshot.Index {
+		return nil
+	}
+	snapshot := Entry{
+		Type:    entrySnapshot,
+		Index:   index,
+		Term:    l.term(index),
+		Members: l.membersAt(index),
+	}
+	return l.rewrite(snapshot, l.entries[index-l.snapshot.Index:])
+}
+
+// installSnapshot replaces the log up to the snapshot index with the
+// snapshot. Entries after it are kept if the log has the entry of the
+// snapshot, otherwise the whole log is replaced.
+func (l *raftLog) installSnapshot(index, term uint64, members map[string]string) error {
+	if index <= l.snapshot.Index {
+		return nil
+	}
+	entries := []Entry{}
+	if index <= l.lastIndex() && l.term(index) == term {
+		entries = l.entries[index-l.snapshot.Index:]
+	}
+	snapshot := Entry{
+		Type:    entrySnapshot,
+		Index:   index,
+		Term:    term,
+		Members: members,
+	}
+	return l.rewrite(snapshot, entries)
+}
+
+// rewrite atomically replaces the log file with one holding the snapshot
+// and the entries.
+func (l *raftLog) rewrite(snapshot Entry, entries []Entry) error {
+	tmpFileName := filepath.Join(filepath.Dir(l.fileName), "."+filepath.Base(l.fileName)+".tmp")
+	file, err := os.OpenFile(tmpFileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0700)
+	if err != nil {
+		return err
+	}
+
+	size := int64(0)
+	offsets := []int64{}
+	for i, e := range append([]Entry{snapshot}, entries...) {
+		var record []byte
+		record, err = encodeEntry(e)
+		if err != nil {
+			break
+		}
+		if i > 0 {
+			offsets = append(offsets, size)
+		}
+		_, err = file.Write(record)
+		if err != nil {
+			break
+		}
+		size += int64(len(record))
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpFileName, l.fileName)
+	}
+	if err == nil {
+		err = segment.SyncDir(filepath.Dir(l.fileName))
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmpFileName)
+		return err
+	}
+
+	l.file.Close()
+	l.file = file
+	l.snapshot = snapshot
+	l.entries = append([]Entry{}, entries...)
+	l.offsets = offsets
+	l.size = size
+	return nil
+}
+
+func (l *raftLog) close() error {
+	return l.file.Close()
+}
+
+// persistentState is the part of the node state that must survive restarts.
+type persistentState struct {
+	Term     uint64
+	VotedFor string
+	Applied  uint64
+}
+
+func loadState(fileName string) (persistentState, error) {
+	s := persistentState{}
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(data, &s)
+	return s, err
+}
+
+func saveState(fileName string, s persistentState) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmpFileName := filepath.Join(filepath.Dir(fileName), "."+filepath.Base(fileName)+".tmp")
+	f, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0700)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFileName)
+		return err
+	}
+
+	err = os.Rename(tmpFileName, fileName)
+	if err != nil {
+		return err
+	}
+
+	return segment.SyncDir(filepath.Dir(fileName))
+}
@@ -0,0 +1,1129 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/draganm/zathras/store"
+	"github.com/draganm/zathras/topic"
+)
+
+// ErrLeadershipLost is returned when the node stopped being the leader
+// before the written entry was committed.
+var ErrLeadershipLost = errors.New("Leadership lost")
+
+// ErrConfigChangeInProgress is returned when a membership change is requested
+// while the previous one is not committed yet.
+var ErrConfigChangeInProgress = errors.New("Membership change in progress")
+
+// ErrNodeClosed is returned when the node is closed while waiting for a write.
+var ErrNodeClosed = errors.New("Node closed")
+
+// ErrEventNotFound is returned when the event of an applied entry is missing from its topic
+var ErrEventNotFound = errors.New("Event of applied entry not found")
+
+// NotLeaderError is returned when a write is sent to a node that is not the
+// leader. It contains the current leader, if known.
+type NotLeaderError struct {
+	LeaderID      string
+	LeaderAddress string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.LeaderAddress == "" {
+		return "Not the leader, leader unknown"
+	}
+	return fmt.Sprintf("Not the leader, leader is %s at %s", e.LeaderID, e.LeaderAddress)
+}
+
+const maxAppendEntries = 64
+
+// maxSnapshotRecordsSize limits the size of the records copied to a
+// follower in one request.
+const maxSnapshotRecordsSize = 1024 * 1024
+
+// producerID tags the events written by the cluster. Their sequence number
+// is the index of the entry, so entries applied again after a restart don't
+// write the event twice.
+const producerID = "raft"
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+// Config is the configuration of a cluster node.
+type Config struct {
+	// ID uniquely identifies the node in the cluster.
+	ID string
+	// Dir holds the topics and the replicated log of the node.
+	Dir         string
+	SegmentSize uint64
+	Transport   Transport
+	// Members maps IDs of the initial cluster members to their addresses.
+	// It is ignored when the node already has a membership in its log.
+	// A node without members waits to be added to an existing cluster.
+	Members           map[string]string
+	HeartbeatInterval time.Duration
+	ElectionTimeout   time.Duration
+	// SnapshotThreshold is the number of applied entries after which the
+	// log is compacted. Defaults to 10000.
+	SnapshotThreshold uint64
+}
+
+type proposal struct {
+	term   uint64
+	result chan proposalResult
+}
+
+type proposalResult struct {
+	address uint64
+	err     error
+}
+
+// Node is a member of a cluster replicating topics with the Raft consensus algorithm.
+// Committed entries are appended to the topics of the node's store.
+type Node struct {
+	sync.Mutex
+	cfg       Config
+	store     *store.Store
+	log       *raftLog
+	stateFile string
+	members   map[string]string
+
+	role        role
+	currentTerm uint64
+	votedFor    string
+	leaderID    string
+	commitIndex uint64
+	lastApplied uint64
+
+	electionDeadline  time.Time
+	lastHeartbeat     time.Time
+	lastLeaderContact time.Time
+
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	replicating map[string]bool
+
+	snapshots map[string]*snapshotProgress
+
+	proposals map[uint64]*proposal
+	applyCond *sync.Cond
+	// applyLock is held while writing to the store
+	applyLock sync.Mutex
+	closed    bool
+	err       error
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// snapshotProgress tracks the copying of the store to a follower that is
+// missing compacted entries of the log.
+type snapshotProgress struct {
+	index   uint64
+	term    uint64
+	members map[string]string
+	// topics that are not copied yet
+	topics  []string
+	address uint64
+}
+
+// Start opens the node's store and log and starts taking part in the cluster.
+func Start(cfg Config) (*Node, error) {
+	if cfg.HeartbeatInterval == 0 {
+		cfg.HeartbeatInterval = 50 * time.Millisecond
+	}
+	if cfg.ElectionTimeout == 0 {
+		cfg.ElectionTimeout = 10 * cfg.HeartbeatInterval
+	}
+	if cfg.SnapshotThreshold == 0 {
+		cfg.SnapshotThreshold = 10000
+	}
+
+	s, err := store.Open(cfg.Dir, cfg.SegmentSize)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := openLog(filepath.Join(cfg.Dir, "raft.log"))
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	stateFile := filepath.Join(cfg.Dir, "raft.state")
+	state, err := loadState(stateFile)
+	if err != nil {
+		s.Close()
+		l.close()
+		return nil, err
+	}
+
+	applied := state.Applied
+	if applied < l.snapshotIndex() {
+		applied = l.snapshotIndex()
+	}
+
+	members := l.members()
+	if members == nil {
+		members = map[string]string{}
+		for id, address := range cfg.Members {
+			members[id] = address
+		}
+	}
+
+	n := &Node{
+		cfg:         cfg,
+		store:       s,
+		log:         l,
+		stateFile:   stateFile,
+		members:     members,
+		currentTerm: state.Term,
+		votedFor:    state.VotedFor,
+		commitIndex: applied,
+		lastApplied: applied,
+		proposals:   map[uint64]*proposal{},
+		done:        make(chan struct{}),
+	}
+	n.applyCond = sync.NewCond(&n.Mutex)
+	n.resetElectionDeadline()
+
+	cfg.Transport.Serve(n.handle)
+
+	n.wg.Add(2)
+	go n.run()
+	go n.apply()
+
+	return n, nil
+}
+
+// Store returns the store the committed events are written to.
+func (n *Node) Store() *store.Store {
+	return n.store
+}
+
+// IsLeader returns true if the node currently considers itself the leader.
+func (n *Node) IsLeader() bool {
+	n.Lock()
+	defer n.Unlock()
+	return n.role == leader
+}
+
+// Leader returns ID and address of the current leader, if known.
+func (n *Node) Leader() (string, string) {
+	n.Lock()
+	defer n.Unlock()
+	return n.leaderID, n.members[n.leaderID]
+}
+
+// Members returns the current cluster membership.
+func (n *Node) Members() map[string]string {
+	n.Lock()
+	defer n.Unlock()
+	members := map[string]string{}
+	for id, address := range n.members {
+		members[id] = address
+	}
+	return members
+}
+
+// Err returns the error that stopped the node, or nil.
+func (n *Node) Err() error {
+	n.Lock()
+	defer n.Unlock()
+	return n.err
+}
+
+func (n *Node) resetElectionDeadline() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// persistState durably saves term, vote and applied index. The node is
+// stopped if they can't be saved.
+func (n *Node) persistState() error {
+	err := saveState(n.stateFile, persistentState{
+		Term:     n.currentTerm,
+		VotedFor: n.votedFor,
+		Applied:  n.lastApplied,
+	})
+	if err != nil {
+		n.stop(err)
+	}
+	return err
+}
+
+// stop stops the node after an error that would let its state diverge
+// from the rest of the cluster, e.g. an entry that can't be applied.
+// Requests are rejected with the error until the node is closed.
+func (n *Node) stop(err error) {
+	if n.closed {
+		return
+	}
+	log.Println("Stopping node", n.cfg.ID, err)
+	n.err = err
+	n.role = follower
+	n.leaderID = ""
+	n.closed = true
+	close(n.done)
+	n.applyCond.Broadcast()
+}
+
+func (n *Node) quorum() int {
+	return len(n.members)/2 + 1
+}
+
+func (n *Node) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval / 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case now := <-ticker.C:
+			n.Lock()
+			switch n.role {
+			case leader:
+				if now.Sub(n.lastHeartbeat) >= n.cfg.HeartbeatInterval {
+					n.lastHeartbeat = now
+					n.replicateToAll()
+				}
+			default:
+				_, member := n.members[n.cfg.ID]
+				if member && now.After(n.electionDeadline) {
+					n.startElection()
+				}
+			}
+			n.Unlock()
+		}
+	}
+}
+
+func (n *Node) becomeFollower(term uint64) {
+	if term > n.currentTerm {
+		n.currentTerm = term
+		n.votedFor = ""
+		n.persistState()
+	}
+	n.role = follower
+}
+
+func (n *Node) startElection() {
+	n.role = candidate
+	n.currentTerm++
+	n.votedFor = n.cfg.ID
+	n.leaderID = ""
+	if n.persistState() != nil {
+		return
+	}
+	n.resetElectionDeadline()
+
+	term := n.currentTerm
+	votes := 1
+
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+
+	req := &Request{
+		Type:         requestVote,
+		Term:         term,
+		From:         n.cfg.ID,
+		LastLogIndex: n.log.lastIndex(),
+		LastLogTerm:  n.log.lastTerm(),
+	}
+
+	for id, address := range n.members {
+		if id == n.cfg.ID {
+			continue
+		}
+		go func(address string) {
+			resp, err := n.cfg.Transport.Send(address, req)
+			if err != nil {
+				return
+			}
+			n.Lock()
+			defer n.Unlock()
+			if resp.Term > n.currentTerm {
+				n.becomeFollower(resp.Term)
+				return
+			}
+			if n.role != candidate || n.currentTerm != term || !resp.Success {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(address)
+	}
+}
+
+func (n *Node) becomeLeader() {
+	n.role = leader
+	n.leaderID = n.cfg.ID
+	n.nextIndex = map[string]uint64{}
+	n.matchIndex = map[string]uint64{}
+	n.replicating = map[string]bool{}
+	n.snapshots = map[string]*snapshotProgress{}
+	for id := range n.members {
+		n.nextIndex[id] = n.log.lastIndex() + 1
+	}
+
+	// a no-op entry commits entries of previous terms
+	err := n.appendEntries(Entry{Term: n.currentTerm, Type: entryNoop})
+	if err != nil {
+		log.Println("Could not append no-op entry", err)
+	}
+
+	n.lastHeartbeat = time.Now()
+	n.replicateToAll()
+}
+
+func (n *Node) appendEntries(entries ...Entry) error {
+	err := n.log.append(entries...)
+	if err != nil {
+		return err
+	}
+	n.updateMembers()
+	n.advanceCommitIndex()
+	return nil
+}
+
+func (n *Node) updateMembers() {
+	members := n.log.members()
+	if members == nil {
+		return
+	}
+	n.members = members
+	if n.role == leader {
+		for id := range members {
+			_, found := n.nextIndex[id]
+			if !found {
+				n.nextIndex[id] = n.log.lastIndex()
+			}
+		}
+	}
+}
+
+func (n *Node) replicateToAll() {
+	for id := range n.members {
+		if id != n.cfg.ID {
+			go n.replicate(id)
+		}
+	}
+}
+
+func (n *Node) replicate(id string) {
+	n.Lock()
+	defer n.Unlock()
+
+	address, member := n.members[id]
+
+	if n.role != leader || !member || n.replicating[id] {
+		return
+	}
+
+	next := n.nextIndex[id]
+	if next == 0 {
+		next = 1
+	}
+
+	if next <= n.log.snapshotIndex() {
+		n.sendSnapshot(id, address)
+		return
+	}
+
+	prevLogIndex := next - 1
+	entries := n.log.slice(next, maxAppendEntries)
+
+	req := &Request{
+		Type:         requestAppendEntries,
+		Term:         n.currentTerm,
+		From:         n.cfg.ID,
+		PrevLogIndex: prevLogIndex,
+		PrevLogTerm:  n.log.term(prevLogIndex),
+		Entries:      entries,
+		LeaderCommit: n.commitIndex,
+	}
+
+	term := n.currentTerm
+	n.replicating[id] = true
+
+	n.Unlock()
+	resp, err := n.cfg.Transport.Send(address, req)
+	n.Lock()
+
+	n.replicating[id] = false
+
+	if err != nil {
+		return
+	}
+
+	if resp.Term > n.currentTerm {
+		n.becomeFollower(resp.Term)
+		return
+	}
+
+	if n.role != leader || n.currentTerm != term {
+		return
+	}
+
+	if !resp.Success {
+		next = prevLogIndex
+		if resp.LastLogIndex+1 < next {
+			next = resp.LastLogIndex + 1
+		}
+		if next < 1 {
+			next = 1
+		}
+		n.nextIndex[id] = next
+		go n.replicate(id)
+		return
+	}
+
+	match := prevLogIndex + uint64(len(entries))
+	if match > n.matchIndex[id] {
+		n.matchIndex[id] = match
+	}
+	n.nextIndex[id] = match + 1
+	n.advanceCommitIndex()
+
+	if n.nextIndex[id] <= n.log.lastIndex() {
+		go n.replicate(id)
+	}
+}
+
+func (n *Node) advanceCommitIndex() {
+	if n.role != leader {
+		return
+	}
+	for index := n.log.lastIndex(); index > n.commitIndex; index-- {
+		if n.log.term(index) != n.currentTerm {
+			break
+		}
+		replicas := 0
+		for id := range n.members {
+			if id == n.cfg.ID || n.matchIndex[id] >= index {
+				replicas++
+			}
+		}
+		if replicas >= n.quorum() {
+			n.commitIndex = index
+			n.applyCond.Broadcast()
+			break
+		}
+	}
+}
+
+func (n *Node) apply() {
+	defer n.wg.Done()
+	n.Lock()
+	defer n.Unlock()
+	for {
+		for !n.closed && n.lastApplied >= n.commitIndex {
+			n.applyCond.Wait()
+		}
+		if n.closed {
+			return
+		}
+
+		index := n.lastApplied + 1
+		e := n.log.entry(index)
+
+		var address uint64
+		var err error
+
+		if e.Type == entryEvent {
+			n.Unlock()
+			n.applyLock.Lock()
+			address, err = n.writeEvent(index, e)
+			n.applyLock.Unlock()
+			n.Lock()
+			if err != nil {
+				log.Println("Could not apply entry", index, err)
+				n.stop(err)
+				return
+			}
+			if n.closed {
+				return
+			}
+			if index <= n.lastApplied {
+				// a snapshot was installed meanwhile
+				continue
+			}
+		}
+
+		n.lastApplied = index
+		if n.persistState() != nil {
+			return
+		}
+
+		if e.Type == entryConfig && n.role == leader {
+			_, member := n.members[n.cfg.ID]
+			if !member {
+				n.role = follower
+				n.leaderID = ""
+			}
+		}
+
+		p, found := n.proposals[index]
+		if found {
+			delete(n.proposals, index)
+			if p.term != e.Term {
+				err = ErrLeadershipLost
+			}
+			p.result <- proposalResult{address, err}
+		}
+
+		if n.lastApplied-n.log.snapshotIndex() >= n.cfg.SnapshotThreshold {
+			n.compact()
+		}
+	}
+}
+
+// writeEvent writes the event of the entry with the index and syncs it, so
+// that the applied index persisted afterwards is never ahead of the topic.
+// An entry that was applied before is not written again.
+func (n *Node) writeEvent(index uint64, e Entry) (uint64, error) {
+	t, err := n.store.Topic(e.Topic)
+	if err != nil {
+		return 0, err
+	}
+	address, err := t.WriteProducerEvent(producerID, index, e.Data)
+	if err == topic.ErrOutOfOrderSequence {
+		// applied and already out of the deduplication window
+		address, err = appliedAddress(t, index)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return address, t.Sync()
+}
+
+// appliedAddress looks up the address of the event written by the entry with
+// the index. Events of later entries come after it, so the topic is searched
+// backwards.
+func appliedAddress(t *topic.Topic, index uint64) (uint64, error) {
+	found := false
+	address := uint64(0)
+	err := t.ReadBackward(t.NextAddress(), func(a, nextAddress uint64, data []byte) error {
+		id, sequence, err := t.Producer(a)
+		if err != nil {
+			return err
+		}
+		if id != producerID || sequence > index {
+			return nil
+		}
+		found = sequence == index
+		address = a
+		return topic.ErrStop
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, ErrEventNotFound
+	}
+	return address, nil
+}
+
+// compact removes the applied entries from the log once the events they
+// wrote are synced to disk. Called with the lock held.
+func (n *Node) compact() {
+	index := n.lastApplied
+
+	n.Unlock()
+	err := n.syncStore()
+	n.Lock()
+
+	if err == nil {
+		err = n.log.compact(index)
+	}
+
+	if err != nil {
+		log.Println("Could not compact log", err)
+		n.stop(err)
+	}
+}
+
+func (n *Node) syncStore() error {
+	for _, name := range n.store.Names() {
+		t, err := n.store.Topic(name)
+		if err != nil {
+			return err
+		}
+		err = t.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendSnapshot copies the topics of the store, topic after topic, to a
+// follower that is missing compacted entries. Once all topics are copied,
+// the snapshot is installed in the follower's log. Events written after the
+// snapshot are copied as well; the follower skips their entries when
+// applying them. Called with the lock held.
+func (n *Node) sendSnapshot(id, address string) {
+	p := n.snapshots[id]
+	if p == nil || p.index != n.log.snapshotIndex() {
+		p = &snapshotProgress{
+			index:   n.log.snapshotIndex(),
+			term:    n.log.term(n.log.snapshotIndex()),
+			members: n.log.snapshot.Members,
+			topics:  n.store.Names(),
+		}
+		n.snapshots[id] = p
+	}
+
+	req := &Request{
+		Type:         requestInstallSnapshot,
+		Term:         n.currentTerm,
+		From:         n.cfg.ID,
+		PrevLogIndex: p.index,
+		PrevLogTerm:  p.term,
+		Members:      p.members,
+	}
+
+	var end uint64
+	if len(p.topics) > 0 {
+		records, next, err := n.readRecords(p.topics[0], p.address)
+		if err != nil {
+			log.Println("Could not read snapshot records", p.topics[0], err)
+			return
+		}
+		end = next
+		req = &Request{
+			Type:    requestSnapshotRecords,
+			Term:    n.currentTerm,
+			From:    n.cfg.ID,
+			Topic:   p.topics[0],
+			Address: p.address,
+			Records: records,
+		}
+	}
+
+	term := n.currentTerm
+	n.replicating[id] = true
+
+	n.Unlock()
+	resp, err := n.cfg.Transport.Send(address, req)
+	n.Lock()
+
+	n.replicating[id] = false
+
+	if err != nil {
+		return
+	}
+
+	if resp.Term > n.currentTerm {
+		n.becomeFollower(resp.Term)
+		return
+	}
+
+	// failed requests are retried with the next heartbeat
+	if n.role != leader || n.currentTerm != term || n.snapshots[id] != p || !resp.Success {
+		return
+	}
+
+	if req.Type == requestInstallSnapshot {
+		delete(n.snapshots, id)
+		if p.index > n.matchIndex[id] {
+			n.matchIndex[id] = p.index
+		}
+		n.nextIndex[id] = p.index + 1
+		n.advanceCommitIndex()
+	} else {
+		p.address = resp.Address
+		if p.address >= end && len(req.Records) == 0 {
+			p.topics = p.topics[1:]
+			p.address = 0
+		}
+	}
+
+	go n.replicate(id)
+}
+
+// readRecords returns the records of the topic from the address on and the
+// address after them.
+func (n *Node) readRecords(topicName string, address uint64) ([][]byte, uint64, error) {
+	t, err := n.store.Topic(topicName)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	end := t.NextAddress()
+	records := [][]byte{}
+	size := 0
+	for address < end && len(records) < maxAppendEntries && size < maxSnapshotRecordsSize {
+		record, next, lease, err := t.ReadRecord(address)
+		if err != nil {
+			return nil, 0, err
+		}
+		records = append(records, append([]byte(nil), record...))
+		lease.Release()
+		size += len(record)
+		address = next
+	}
+
+	return records, address, nil
+}
+
+func (n *Node) handle(req *Request) *Response {
+	ctx, cancel := context.WithTimeout(context.Background(), 4*n.cfg.ElectionTimeout)
+	defer cancel()
+
+	n.Lock()
+	err := n.err
+	n.Unlock()
+	if err != nil {
+		return &Response{Error: err.Error()}
+	}
+
+	switch req.Type {
+	case requestVote:
+		return n.handleVote(req)
+	case requestAppendEntries:
+		return n.handleAppendEntries(req)
+	case requestWrite:
+		address, err := n.WriteEvent(ctx, req.Topic, req.Data)
+		return n.errorResponse(&Response{Address: address, Success: err == nil}, err)
+	case requestAddMember:
+		err := n.AddMember(ctx, req.MemberID, req.MemberAddress)
+		return n.errorResponse(&Response{Success: err == nil}, err)
+	case requestRemoveMember:
+		err := n.RemoveMember(ctx, req.MemberID)
+		return n.errorResponse(&Response{Success: err == nil}, err)
+	case requestSnapshotRecords:
+		return n.handleSnapshotRecords(req)
+	case requestInstallSnapshot:
+		return n.handleInstallSnapshot(req)
+	}
+	return &Response{Error: "unknown request"}
+}
+
+func (n *Node) errorResponse(resp *Response, err error) *Response {
+	if err == nil {
+		return resp
+	}
+	resp.Error = err.Error()
+	nle, isNotLeader := err.(*NotLeaderError)
+	if isNotLeader {
+		resp.NotLeader = true
+		resp.LeaderID = nle.LeaderID
+		resp.LeaderAddress = nle.LeaderAddress
+	}
+	return resp
+}
+
+func (n *Node) handleVote(req *Request) *Response {
+	n.Lock()
+	defer n.Unlock()
+
+	if req.Term < n.currentTerm {
+		return &Response{Term: n.currentTerm}
+	}
+
+	// ignore nodes that have been removed from the cluster and time out
+	// while there is a working leader
+	if n.role == leader || (n.leaderID != "" && time.Since(n.lastLeaderContact) < n.cfg.ElectionTimeout) {
+		return &Response{Term: n.currentTerm}
+	}
+
+	if req.Term > n.currentTerm {
+		n.becomeFollower(req.Term)
+	}
+
+	upToDate := req.LastLogTerm > n.log.lastTerm() ||
+		(req.LastLogTerm == n.log.lastTerm() && req.LastLogIndex >= n.log.lastIndex())
+
+	if (n.votedFor == "" || n.votedFor == req.From) && upToDate {
+		n.votedFor = req.From
+		if n.persistState() != nil {
+			return &Response{Term: n.currentTerm}
+		}
+		n.resetElectionDeadline()
+		return &Response{Term: n.currentTerm, Success: true}
+	}
+
+	return &Response{Term: n.currentTerm}
+}
+
+// fromLeader follows the leader that sent the request. It returns false if
+// the request is from an older term.
+func (n *Node) fromLeader(req *Request) bool {
+	if req.Term < n.currentTerm {
+		return false
+	}
+
+	n.becomeFollower(req.Term)
+	n.leaderID = req.From
+	n.lastLeaderContact = time.Now()
+	n.resetElectionDeadline()
+	return true
+}
+
+func (n *Node) handleAppendEntries(req *Request) *Response {
+	n.Lock()
+	defer n.Unlock()
+
+	if !n.fromLeader(req) {
+		return &Response{Term: n.currentTerm}
+	}
+
+	prevLogIndex := req.PrevLogIndex
+	prevLogTerm := req.PrevLogTerm
+	entries := req.Entries
+
+	// compacted entries are committed, they match the leader's
+	if prevLogIndex < n.log.snapshotIndex() {
+		skip := n.log.snapshotIndex() - prevLogIndex
+		if skip > uint64(len(entries)) {
+			skip = uint64(len(entries))
+		}
+		entries = entries[skip:]
+		prevLogIndex += skip
+		prevLogTerm = n.log.term(prevLogIndex)
+	}
+
+	if prevLogIndex > n.log.lastIndex() || n.log.term(prevLogIndex) != prevLogTerm {
+		lastIndex := n.log.lastIndex()
+		if prevLogIndex > 0 && prevLogIndex-1 < lastIndex {
+			lastIndex = prevLogIndex - 1
+		}
+		return &Response{Term: n.currentTerm, LastLogIndex: lastIndex}
+	}
+
+	for i, e := range entries {
+		index := prevLogIndex + 1 + uint64(i)
+		if index <= n.log.lastIndex() {
+			if n.log.term(index) == e.Term {
+				continue
+			}
+			err := n.log.truncate(index)
+			if err != nil {
+				log.Println("Could not truncate log", err)
+				return &Response{Term: n.currentTerm}
+			}
+		}
+		err := n.appendEntries(entries[i:]...)
+		if err != nil {
+			log.Println("Could not append to log", err)
+			return &Response{Term: n.currentTerm}
+		}
+		break
+	}
+
+	commitIndex := req.LeaderCommit
+	lastNewIndex := req.PrevLogIndex + uint64(len(req.Entries))
+	if lastNewIndex < commitIndex {
+		commitIndex = lastNewIndex
+	}
+	if commitIndex > n.commitIndex {
+		n.commitIndex = commitIndex
+		n.applyCond.Broadcast()
+	}
+
+	return &Response{Term: n.currentTerm, Success: true, LastLogIndex: n.log.lastIndex()}
+}
+
+// handleSnapshotRecords appends the records of a snapshot sent by the leader
+// to the topic. Records are only appended at the end of the topic; the
+// response holds the address the leader has to continue with.
+func (n *Node) handleSnapshotRecords(req *Request) *Response {
+	n.Lock()
+	if !n.fromLeader(req) {
+		defer n.Unlock()
+		return &Response{Term: n.currentTerm}
+	}
+	term := n.currentTerm
+	n.Unlock()
+
+	n.applyLock.Lock()
+	defer n.applyLock.Unlock()
+
+	t, err := n.store.Topic(req.Topic)
+	if err != nil {
+		return &Response{Term: term, Error: err.Error()}
+	}
+
+	if t.AppendAddress() != req.Address {
+		return &Response{Term: term, Success: true, Address: t.AppendAddress()}
+	}
+
+	for _, record := range req.Records {
+		_, _, err = t.AppendRecord(record)
+		if err != nil {
+			n.Lock()
+			n.stop(err)
+			n.Unlock()
+			return &Response{Term: term, Error: err.Error()}
+		}
+	}
+
+	return &Response{Term: term, Success: true, Address: t.AppendAddress()}
+}
+
+// handleInstallSnapshot replaces the log up to the snapshot index with the
+// snapshot once the leader has copied its topics.
+func (n *Node) handleInstallSnapshot(req *Request) *Response {
+	n.Lock()
+	defer n.Unlock()
+
+	if !n.fromLeader(req) {
+		return &Response{Term: n.currentTerm}
+	}
+
+	if req.PrevLogIndex > n.lastApplied {
+		err := n.log.installSnapshot(req.PrevLogIndex, req.PrevLogTerm, req.Members)
+		if err != nil {
+			n.stop(err)
+			return &Response{Term: n.currentTerm, Error: err.Error()}
+		}
+		n.lastApplied = req.PrevLogIndex
+		if n.commitIndex < n.lastApplied {
+			n.commitIndex = n.lastApplied
+		}
+		n.updateMembers()
+		err = n.persistState()
+		if err != nil {
+			return &Response{Term: n.currentTerm, Error: err.Error()}
+		}
+	}
+
+	return &Response{Term: n.currentTerm, Success: true, LastLogIndex: n.log.lastIndex()}
+}
+
+func (n *Node) notLeader() error {
+	return &NotLeaderError{
+		LeaderID:      n.leaderID,
+		LeaderAddress: n.members[n.leaderID],
+	}
+}
+
+// propose appends the entry to the log of the leader and waits for it to be applied.
+func (n *Node) propose(ctx context.Context, e Entry) (uint64, error) {
+	n.Lock()
+
+	if n.role != leader {
+		err := n.notLeader()
+		n.Unlock()
+		return 0, err
+	}
+
+	e.Term = n.currentTerm
+	err := n.appendEntries(e)
+	if err != nil {
+		n.Unlock()
+		return 0, err
+	}
+
+	p := &proposal{
+		term:   e.Term,
+		result: make(chan proposalResult, 1),
+	}
+	n.proposals[n.log.lastIndex()] = p
+	n.replicateToAll()
+	n.Unlock()
+
+	select {
+	case r := <-p.result:
+		return r.address, r.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-n.done:
+		n.Lock()
+		defer n.Unlock()
+		if n.err != nil {
+			return 0, n.err
+		}
+		return 0, ErrNodeClosed
+	}
+}
+
+// WriteEvent writes the event to the topic once it is committed by the
+// majority of the cluster. It returns a *NotLeaderError if the node is not
+// the leader.
+func (n *Node) WriteEvent(ctx context.Context, topicName string, data []byte) (uint64, error) {
+	return n.propose(ctx, Entry{Type: entryEvent, Topic: topicName, Data: data})
+}
+
+func (n *Node) changeMembers(ctx context.Context, change func(members map[string]string)) error {
+	n.Lock()
+	if n.role != leader {
+		err := n.notLeader()
+		n.Unlock()
+		return err
+	}
+	for index := n.commitIndex + 1; index <= n.log.lastIndex(); index++ {
+		if n.log.entry(index).Type == entryConfig {
+			n.Unlock()
+			return ErrConfigChangeInProgress
+		}
+	}
+	members := map[string]string{}
+	for id, address := range n.members {
+		members[id] = address
+	}
+	n.Unlock()
+
+	change(members)
+
+	_, err := n.propose(ctx, Entry{Type: entryConfig, Members: members})
+	return err
+}
+
+// AddMember adds a node to the cluster. The new node is started without
+// members and catches up with the log once added.
+func (n *Node) AddMember(ctx context.Context, id, address string) error {
+	return n.changeMembers(ctx, func(members map[string]string) {
+		members[id] = address
+	})
+}
+
+// RemoveMember removes a node from the cluster.
+func (n *Node) RemoveMember(ctx context.Context, id string) error {
+	return n.changeMembers(ctx, func(members map[string]string) {
+		delete(members, id)
+	})
+}
+
+// Close stops the node and closes its store.
+func (n *Node) Close() error {
+	n.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.done)
+		n.applyCond.Broadcast()
+	}
+	n.Unlock()
+
+	err := n.cfg.Transport.Close()
+	n.wg.Wait()
+
+	n.Lock()
+	defer n.Unlock()
+	logErr := n.log.close()
+	storeErr := n.store.Close()
+	if err != nil {
+		return err
+	}
+	if logErr != nil {
+		return logErr
+	}
+	return storeErr
+}
@@ -0,0 +1,260 @@
+package cluster
+
+import (
+	"encoding/gob"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+type requestType byte
+
+const (
+	requestVote requestType = iota + 1
+	requestAppendEntries
+	requestWrite
+	requestAddMember
+	requestRemoveMember
+	requestSnapshotRecords
+	requestInstallSnapshot
+)
+
+// Request is a message sent between nodes of a cluster or from a client to a node.
+type Request struct {
+	Type requestType
+	Term uint64
+	From string
+
+	LastLogIndex uint64
+	LastLogTerm  uint64
+
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+
+	Topic string
+	Data  []byte
+
+	MemberID      string
+	MemberAddress string
+
+	// Address and Records are the records of the topic copied to a
+	// follower that is missing compacted entries.
+	Address uint64
+	Records [][]byte
+	// Members is the membership of an installed snapshot.
+	Members map[string]string
+}
+
+// Response is the reply to a Request.
+type Response struct {
+	Term          uint64
+	Success       bool
+	LastLogIndex  uint64
+	Address       uint64
+	LeaderID      string
+	LeaderAddress string
+	// NotLeader is set when the request was rejected by a node that is not
+	// the leader, the request was not applied then.
+	NotLeader bool
+	Error     string
+}
+
+// Handler handles requests received by a transport.
+type Handler func(req *Request) *Response
+
+// Sender sends requests to nodes.
+type Sender interface {
+	Send(address string, req *Request) (*Response, error)
+}
+
+// Transport connects a node to the other nodes of the cluster.
+type Transport interface {
+	Sender
+	// Addr returns the address other nodes use to reach this transport.
+	Addr() string
+	// Serve starts passing received requests to the handler.
+	Serve(h Handler)
+	Close() error
+}
+
+// ErrUnreachable is returned when the target node can't be reached.
+var ErrUnreachable = errors.New("Node unreachable")
+
+// TCPSender sends requests over TCP, one connection per request.
+type TCPSender struct {
+	Timeout time.Duration
+}
+
+// Send sends the request to the node listening on the address.
+func (s TCPSender) Send(address string, req *Request) (*Response, error) {
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, ErrUnreachable
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	err = gob.NewEncoder(conn).Encode(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &Response{}
+	err = gob.NewDecoder(conn).Decode(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// TCPTransport is a Transport using TCP connections.
+type TCPTransport struct {
+	TCPSender
+	listener net.Listener
+	wg       sync.WaitGroup
+}
+
+// ListenTCP creates a new TCP transport listening on the address.
+func ListenTCP(address string) (*TCPTransport, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &TCPTransport{listener: listener}, nil
+}
+
+// Addr returns the address the transport is listening on.
+func (t *TCPTransport) Addr() string {
+	return t.listener.Addr().String()
+}
+
+// Serve accepts connections and passes received requests to the handler.
+func (t *TCPTransport) Serve(h Handler) {
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		for {
+			conn, err := t.listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req := &Request{}
+				err := gob.NewDecoder(conn).Decode(req)
+				if err != nil {
+					return
+				}
+				gob.NewEncoder(conn).Encode(h(req))
+			}()
+		}
+	}()
+}
+
+// Close stops accepting connections.
+func (t *TCPTransport) Close() error {
+	err := t.listener.Close()
+	t.wg.Wait()
+	return err
+}
+
+// InmemNetwork connects in-process transports and can simulate network partitions.
+type InmemNetwork struct {
+	sync.RWMutex
+	handlers  map[string]Handler
+	partition map[string]int
+}
+
+// NewInmemNetwork creates a new in-process network.
+func NewInmemNetwork() *InmemNetwork {
+	return &InmemNetwork{
+		handlers: map[string]Handler{},
+	}
+}
+
+// Transport creates a new transport on the network using the address.
+func (n *InmemNetwork) Transport(address string) *InmemTransport {
+	return &InmemTransport{network: n, address: address}
+}
+
+// Partition splits the network into groups of addresses. Only addresses in
+// the same group can reach each other. Addresses not in any group are isolated.
+func (n *InmemNetwork) Partition(groups ...[]string) {
+	n.Lock()
+	defer n.Unlock()
+	n.partition = map[string]int{}
+	for i, g := range groups {
+		for _, address := range g {
+			n.partition[address] = i
+		}
+	}
+}
+
+// Heal removes all partitions.
+func (n *InmemNetwork) Heal() {
+	n.Lock()
+	defer n.Unlock()
+	n.partition = nil
+}
+
+func (n *InmemNetwork) send(from, to string, req *Request) (*Response, error) {
+	n.RLock()
+	h, found := n.handlers[to]
+	reachable := true
+	if n.partition != nil {
+		fromGroup, fromFound := n.partition[from]
+		toGroup, toFound := n.partition[to]
+		reachable = fromFound && toFound && fromGroup == toGroup
+	}
+	n.RUnlock()
+
+	if !found || !reachable {
+		return nil, ErrUnreachable
+	}
+
+	return h(req), nil
+}
+
+// InmemTransport is a Transport on an InmemNetwork.
+type InmemTransport struct {
+	network *InmemNetwork
+	address string
+}
+
+// Addr returns the address of the transport on the network.
+func (t *InmemTransport) Addr() string {
+	return t.address
+}
+
+// Send passes the request to the transport with the address if it is reachable.
+func (t *InmemTransport) Send(address string, req *Request) (*Response, error) {
+	return t.network.send(t.address, address, req)
+}
+
+// Serve registers the handler with the network.
+func (t *InmemTransport) Serve(h Handler) {
+	t.network.Lock()
+	defer t.network.Unlock()
+	t.network.handlers[t.address] = h
+}
+
+// Close removes the transport from the network.
+func (t *InmemTransport) Close() error {
+	t.network.Lock()
+	defer t.network.Unlock()
+	delete(t.network.handlers, t.address)
+	return nil
+}
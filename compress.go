@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/draganm/zathras/topic"
+)
+
+// compress stores the sealed segments of a topic compressed with the codec.
+// Events keep their addresses.
+func compress(args []string) error {
+	flags := flag.NewFlagSet("compress", flag.ExitOnError)
+	dir := flags.String("dir", "", "directory of the topic")
+	codecName := flags.String("codec", "zstd", "codec used to compress segments")
+	segmentSize := flags.Uint64("segment-size", 64*1024*1024, "size of a segment file after which a new segment is started")
+	flags.Parse(args)
+
+	if *dir == "" {
+		return errors.New("-dir is required")
+	}
+
+	codec, found := topic.CodecByName(*codecName)
+	if !found {
+		return topic.ErrUnknownCodec
+	}
+
+	t, err := topic.New(*dir, *segmentSize)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+
+	count, err := t.CompressSegments(codec)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("compressed %d segments\n", count)
+	return nil
+}
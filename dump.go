@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/draganm/zathras/server"
+	"github.com/draganm/zathras/topic"
+)
+
+// pollInterval is the time between checks for new events when following a topic directory.
+const pollInterval = time.Second
+
+// errStop stops reading events before the end of the range.
+var errStop = errors.New("stop")
+
+// readFlags select a topic in a directory or on a server and a range of its events.
+type readFlags struct {
+	dir         *string
+	server      *string
+	topic       *string
+	segmentSize *uint64
+	from        *uint64
+	to          *uint64
+	since       *string
+	until       *string
+}
+
+func addReadFlags(flags *flag.FlagSet) *readFlags {
+	return &readFlags{
+		dir:         flags.String("dir", "", "directory of the topic, opened read only"),
+		server:      flags.String("server", "", "client protocol address of a server, instead of -dir"),
+		topic:       flags.String("topic", "", "name of the topic on the server"),
+		segmentSize: flags.Uint64("segment-size", 64*1024*1024, "segment size of the topic in -dir"),
+		from:        flags.Uint64("from", 0, "address of the first event"),
+		to:          flags.Uint64("to", math.MaxUint64, "address after the last event"),
+		since:       flags.String("since", "", "only events written at or after the time, RFC3339 or a duration before now"),
+		until:       flags.String("until", "", "only events written before the time, RFC3339 or a duration before now"),
+	}
+}
+
+// eventRange is a range of addresses and timestamps. Zero times are open ends.
+type eventRange struct {
+	from  uint64
+	to    uint64
+	since time.Time
+	until time.Time
+}
+
+func (r eventRange) timed() bool {
+	return !r.since.IsZero() || !r.until.IsZero()
+}
+
+func (r eventRange) containsTime(t time.Time) bool {
+	if t.IsZero() {
+		return !r.timed()
+	}
+	return (r.since.IsZero() || !t.Before(r.since)) && (r.until.IsZero() || t.Before(r.until))
+}
+
+func (f *readFlags) validate() error {
+	if (*f.dir == "") == (*f.server == "") {
+		return errors.New("Either -dir or -server is required")
+	}
+	if *f.server != "" && *f.topic == "" {
+		return errors.New("-topic is required with -server")
+	}
+	return nil
+}
+
+func (f *readFlags) eventRange() (eventRange, error) {
+	r := eventRange{from: *f.from, to: *f.to}
+	var err error
+	r.since, err = parseTime(*f.since, time.Now())
+	if err != nil {
+		return r, err
+	}
+	r.until, err = parseTime(*f.until, time.Now())
+	return r, err
+}
+
+// parseTime parses an RFC3339 time or a duration before now. An empty string is the zero time.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err == nil {
+		return t, nil
+	}
+	d, durationErr := time.ParseDuration(s)
+	if durationErr != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q: %s", s, err)
+	}
+	return now.Add(-d), nil
+}
+
+// printedEvent is an event as printed by dump and tail.
+type printedEvent struct {
+	Address     uint64          `json:"address"`
+	NextAddress uint64          `json:"next_address"`
+	Timestamp   *time.Time      `json:"timestamp,omitempty"`
+	Data        json.RawMessage `json:"data"`
+	data        []byte
+}
+
+func newPrintedEvent(address, nextAddress uint64, timestamp time.Time, data []byte) printedEvent {
+	e := printedEvent{Address: address, NextAddress: nextAddress, data: data}
+	if !timestamp.IsZero() {
+		e.Timestamp = &timestamp
+	}
+	return e
+}
+
+// formatter returns the function printing events in the format.
+// JSON formats embed JSON data as is and other data as a string.
+func formatter(format string) (func(w io.Writer, e printedEvent) error, error) {
+	switch format {
+	case "raw":
+		return func(w io.Writer, e printedEvent) error {
+			_, err := w.Write(e.data)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write([]byte{'\n'})
+			return err
+		}, nil
+	case "hex":
+		return func(w io.Writer, e printedEvent) error {
+			_, err := fmt.Fprintf(w, "%d-%d:\n%s", e.Address, e.NextAddress, hex.Dump(e.data))
+			return err
+		}, nil
+	case "json", "pretty":
+		return func(w io.Writer, e printedEvent) error {
+			e.Data = e.data
+			if !json.Valid(e.data) {
+				e.Data, _ = json.Marshal(string(e.data))
+			}
+			var data []byte
+			var err error
+			if format == "pretty" {
+				data, err = json.MarshalIndent(e, "", "  ")
+			} else {
+				data, err = json.Marshal(e)
+			}
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(append(data, '\n'))
+			return err
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// readEvents calls fn with the events in the range. When following, it waits
+// for new events until the context is done.
+func (f *readFlags) readEvents(ctx context.Context, r eventRange, follow bool, fn func(e printedEvent) error) error {
+	var err error
+	if *f.dir != "" {
+		err = readDirectory(ctx, *f.dir, *f.segmentSize, r, follow, fn)
+	} else {
+		err = readServer(ctx, *f.server, *f.topic, r, follow, fn)
+	}
+	if err == errStop || err == context.Canceled {
+		return nil
+	}
+	return err
+}
+
+func openReadOnly(dir string, segmentSize uint64) (*topic.Topic, error) {
+	return topic.New(dir, segmentSize, topic.WithReadOnly())
+}
+
+// readDirectory reads events of a topic directory. A read only topic doesn't
+// see events written after it was opened, so it is opened again to follow new events.
+func readDirectory(ctx context.Context, dir string, segmentSize uint64, r eventRange, follow bool, fn func(e printedEvent) error) error {
+	position := r.from
+	for {
+		t, err := openReadOnly(dir, segmentSize)
+		if err != nil {
+			return err
+		}
+
+		c := t.NewRangeCursor(position, r.to)
+		for c.Next() {
+			e := c.Event()
+			position = e.NextAddress
+			timestamp, err := t.Timestamp(c.Address())
+			if err == nil && !r.containsTime(timestamp) {
+				continue
+			}
+			if err == nil {
+				err = fn(newPrintedEvent(c.Address(), e.NextAddress, timestamp, e.Data))
+			}
+			if err != nil {
+				t.Close()
+				return err
+			}
+		}
+
+		err = c.Err()
+		if err == nil && t.NextAddress() > position {
+			// markers and events of aborted transactions at the end
+			position = t.NextAddress()
+		}
+		closeErr := t.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+
+		if !follow || position >= r.to {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// readServer reads events of a topic on a server. The time range is
+// evaluated on the server with a filter on the timestamp header.
+func readServer(ctx context.Context, address, topicName string, r eventRange, follow bool, fn func(e printedEvent) error) error {
+	client, err := server.Dial(address)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if !follow {
+		end, err := client.NextAddress(topicName)
+		if err != nil {
+			return err
+		}
+		if end < r.to {
+			r.to = end
+		}
+	}
+
+	if r.from >= r.to {
+		return nil
+	}
+
+	expression := ""
+	if !r.since.IsZero() {
+		expression = fmt.Sprintf("header.timestamp >= %d", r.since.UnixNano())
+	}
+	if !r.until.IsZero() {
+		if expression != "" {
+			expression += " && "
+		}
+		expression += fmt.Sprintf("header.timestamp < %d", r.until.UnixNano())
+	}
+
+	return client.Subscribe(ctx, topicName, r.from, expression, func(e server.SubscriptionEvent) error {
+		if e.Address >= r.to {
+			return errStop
+		}
+		if !e.Skipped {
+			timestamp := time.Time{}
+			if e.Timestamp != 0 {
+				timestamp = time.Unix(0, e.Timestamp)
+			}
+			err := fn(newPrintedEvent(e.Address, e.NextAddress, timestamp, e.Data))
+			if err != nil {
+				return err
+			}
+		}
+		if e.NextAddress >= r.to {
+			return errStop
+		}
+		return nil
+	})
+}
+
+// dump prints the events of a topic in a range of addresses and times.
+func dump(args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	rf := addReadFlags(flags)
+	format := flags.String("format", "json", "output format: raw, hex, json or pretty")
+	flags.Parse(args)
+
+	err := rf.validate()
+	if err != nil {
+		return err
+	}
+
+	print, err := formatter(*format)
+	if err != nil {
+		return err
+	}
+
+	r, err := rf.eventRange()
+	if err != nil {
+		return err
+	}
+
+	return rf.readEvents(context.Background(), r, false, func(e printedEvent) error {
+		return print(os.Stdout, e)
+	})
+}
+
+// tail prints the last events of a topic and, with -f, follows new events
+// until interrupted.
+func tail(args []string) error {
+	flags := flag.NewFlagSet("tail", flag.ExitOnError)
+	rf := addReadFlags(flags)
+	format := flags.String("format", "json", "output format: raw, hex, json or pretty")
+	follow := flags.Bool("f", false, "follow new events")
+	n := flags.Int("n", 10, "number of last events to print, only for -dir; with -server tail starts at -from or the end")
+	flags.Parse(args)
+
+	err := rf.validate()
+	if err != nil {
+		return err
+	}
+
+	print, err := formatter(*format)
+	if err != nil {
+		return err
+	}
+
+	r, err := rf.eventRange()
+	if err != nil {
+		return err
+	}
+
+	fromSet, nSet := false, false
+	flags.Visit(func(f *flag.Flag) {
+		fromSet = fromSet || f.Name == "from"
+		nSet = nSet || f.Name == "n"
+	})
+
+	if nSet && *rf.server != "" {
+		return errors.New("-n is not supported with -server")
+	}
+
+	if !fromSet {
+		r.from, err = rf.lastEvents(*n)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt)
+	defer signal.Stop(interrupts)
+	go func() {
+		select {
+		case <-interrupts:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return rf.readEvents(ctx, r, *follow, func(e printedEvent) error {
+		return print(os.Stdout, e)
+	})
+}
+
+// lastEvents returns the address of the n-th last event, or the end of the topic on a server.
+func (f *readFlags) lastEvents(n int) (uint64, error) {
+	if *f.server != "" {
+		client, err := server.Dial(*f.server)
+		if err != nil {
+			return 0, err
+		}
+		defer client.Close()
+		return client.NextAddress(*f.topic)
+	}
+
+	t, err := openReadOnly(*f.dir, *f.segmentSize)
+	if err != nil {
+		return 0, err
+	}
+	defer t.Close()
+
+	from := t.NextAddress()
+	c := t.NewCursor().Reverse()
+	for i := 0; i < n && c.Next(); i++ {
+		from = c.Address()
+	}
+
+	return from, c.Err()
+}
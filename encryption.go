@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/draganm/zathras/segment"
+	"github.com/draganm/zathras/topic"
+)
+
+// rotateKey adds a new current key to the keyring file, creating the file if needed.
+func rotateKey(args []string) error {
+	flags := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	keyringFile := flags.String("keyring", "keyring.json", "keyring file")
+	flags.Parse(args)
+
+	keys, err := segment.LoadKeyring(*keyringFile)
+	if os.IsNotExist(err) {
+		keys = segment.NewKeyring()
+	} else if err != nil {
+		return err
+	}
+
+	id, err := keys.Rotate()
+	if err != nil {
+		return err
+	}
+
+	err = keys.Save(*keyringFile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("current key: %d\n", id)
+	return nil
+}
+
+// reencrypt re-encrypts the old segments of a topic with the current key.
+func reencrypt(args []string) error {
+	flags := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+	dir := flags.String("dir", "", "directory of the topic")
+	keyringFile := flags.String("keyring", "keyring.json", "keyring file")
+	segmentSize := flags.Uint64("segment-size", 64*1024*1024, "size of a segment file after which a new segment is started")
+	flags.Parse(args)
+
+	if *dir == "" {
+		return errors.New("-dir is required")
+	}
+
+	keys, err := segment.LoadKeyring(*keyringFile)
+	if err != nil {
+		return err
+	}
+
+	t, err := topic.New(*dir, *segmentSize, topic.WithEncryption(keys))
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+
+	count, err := t.Reencrypt()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("re-encrypted %d records\n", count)
+	return nil
+}
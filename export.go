@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/draganm/zathras/topic"
+)
+
+// eventStreamMagic starts a binary event stream. It is followed by events
+// encoded as [u64 address][u64 next address][u64 timestamp][u32 length][data],
+// with the timestamp in nanoseconds since epoch or zero when unknown.
+const eventStreamMagic = "ZTHREVT1"
+
+const eventStreamHeaderSize = 8 + 8 + 8 + 4
+
+// exportedEvent is an event of a JSON Lines export. Data that is compact JSON
+// is embedded as is, other data is base64 encoded, so that import restores
+// the data exactly.
+type exportedEvent struct {
+	Address     uint64          `json:"address"`
+	NextAddress uint64          `json:"next_address"`
+	Timestamp   *time.Time      `json:"timestamp,omitempty"`
+	Data        json.RawMessage `json:"data,omitempty"`
+	DataBase64  []byte          `json:"data_base64,omitempty"`
+}
+
+// eventEncoder returns the function writing events in the format of a
+// stream export.
+func eventEncoder(format string, w io.Writer) (func(e printedEvent) error, error) {
+	switch format {
+	case "jsonl":
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		return func(e printedEvent) error {
+			exported := exportedEvent{
+				Address:     e.Address,
+				NextAddress: e.NextAddress,
+				Timestamp:   e.Timestamp,
+			}
+			compact := &bytes.Buffer{}
+			if json.Compact(compact, e.data) == nil && bytes.Equal(compact.Bytes(), e.data) {
+				exported.Data = e.data
+			} else {
+				exported.DataBase64 = e.data
+			}
+			return enc.Encode(exported)
+		}, nil
+	case "binary":
+		_, err := io.WriteString(w, eventStreamMagic)
+		if err != nil {
+			return nil, err
+		}
+		return func(e printedEvent) error {
+			header := make([]byte, eventStreamHeaderSize)
+			binary.BigEndian.PutUint64(header, e.Address)
+			binary.BigEndian.PutUint64(header[8:], e.NextAddress)
+			if e.Timestamp != nil {
+				binary.BigEndian.PutUint64(header[16:], uint64(e.Timestamp.UnixNano()))
+			}
+			binary.BigEndian.PutUint32(header[24:], uint32(len(e.data)))
+			_, err := w.Write(header)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(e.data)
+			return err
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// export writes events of a topic, or a range of them, to a file as JSON
+// Lines or as a binary stream, or writes the segments of a topic directory
+// holding the range as a tar archive.
+func export(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	rf := addReadFlags(flags)
+	format := flags.String("format", "jsonl", "export format: jsonl, binary or tar")
+	out := flags.String("out", "", "file to write, stdout when empty")
+	flags.Parse(args)
+
+	err := rf.validate()
+	if err != nil {
+		return err
+	}
+
+	r, err := rf.eventRange()
+	if err != nil {
+		return err
+	}
+
+	if *format == "tar" && *rf.server != "" {
+		return errors.New("-format tar needs -dir")
+	}
+
+	if *format == "tar" && r.timed() {
+		return errors.New("-since and -until are not supported with -format tar")
+	}
+
+	f := os.Stdout
+	if *out != "" {
+		f, err = os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+
+	w := bufio.NewWriter(f)
+
+	if *format == "tar" {
+		var t *topic.Topic
+		t, err = openReadOnly(*rf.dir, *rf.segmentSize)
+		if err != nil {
+			return err
+		}
+		defer t.Close()
+
+		var m *topic.Manifest
+		m, err = t.ExportArchive(w, r.from, r.to)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "exported %d segments with addresses %d to %d\n", len(m.Segments), m.StartAddress, m.EndAddress)
+	} else {
+		var encode func(e printedEvent) error
+		encode, err = eventEncoder(*format, w)
+		if err != nil {
+			return err
+		}
+
+		events := 0
+		err = rf.readEvents(context.Background(), r, false, func(e printedEvent) error {
+			events++
+			return encode(e)
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "exported %d events\n", events)
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	if *out != "" {
+		return f.Sync()
+	}
+
+	return nil
+}
@@ -0,0 +1,410 @@
+// Package filter compiles and evaluates filter expressions over events, e.g.
+//
+//	header.producer == "shop" && data.amount > 100
+//
+// An expression compares fields of the event with literals or other fields.
+// Fields are header.<name> for headers, key for the key and data.<path> for
+// fields of JSON data, where the path can index arrays (data.items.0.sku).
+// Which headers and keys events have is up to the caller; topics served by
+// the server package have no keys and only the headers of their records.
+// Missing fields are null. Literals are strings in double quotes, numbers,
+// true, false and null. Comparisons (==, !=, <, <=, >, >=) can be combined
+// with &&, || and ! and grouped with parentheses. Strings that hold numbers
+// compare as numbers with numbers; other comparisons of different types are
+// false, except for !=.
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SyntaxError is returned when an expression can't be compiled.
+type SyntaxError struct {
+	// Position is the byte offset of the error in the expression.
+	Position int
+	Message  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("Invalid filter at %d: %s", e.Position, e.Message)
+}
+
+// Event holds the parts of an event that expressions can refer to.
+type Event struct {
+	Headers map[string]string
+	Key     []byte
+	Data    []byte
+}
+
+// Filter is a compiled expression.
+type Filter struct {
+	root node
+	// data is true when the expression refers to JSON data.
+	data bool
+}
+
+// Compile parses the expression.
+func Compile(expression string) (*Filter, error) {
+	p := &parser{lexer: lexer{input: expression}}
+	p.next()
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.token.kind != tokenEOF {
+		return nil, p.errorf("unexpected %s", p.token)
+	}
+
+	return &Filter{root: root, data: p.data}, nil
+}
+
+// Match returns true when the event matches the expression. JSON data is
+// decoded only when the expression refers to it; events whose data isn't
+// JSON have only null data fields.
+func (f *Filter) Match(e Event) bool {
+	c := &evalContext{event: e}
+	if f.data {
+		d := json.NewDecoder(bytes.NewReader(e.Data))
+		d.UseNumber()
+		err := d.Decode(&c.data)
+		if err != nil {
+			c.data = nil
+		}
+	}
+	return truthy(f.root.eval(c))
+}
+
+type evalContext struct {
+	event Event
+	data  interface{}
+}
+
+type node interface {
+	eval(c *evalContext) interface{}
+}
+
+type literal struct {
+	value interface{}
+}
+
+func (l literal) eval(c *evalContext) interface{} {
+	return l.value
+}
+
+type headerField struct {
+	name string
+}
+
+func (h headerField) eval(c *evalContext) interface{} {
+	v, found := c.event.Headers[h.name]
+	if !found {
+		return nil
+	}
+	return v
+}
+
+type keyField struct{}
+
+func (keyField) eval(c *evalContext) interface{} {
+	if c.event.Key == nil {
+		return nil
+	}
+	return string(c.event.Key)
+}
+
+type dataField struct {
+	path []string
+}
+
+func (d dataField) eval(c *evalContext) interface{} {
+	v := c.data
+	for _, p := range d.path {
+		switch o := v.(type) {
+		case map[string]interface{}:
+			v = o[p]
+		case []interface{}:
+			i, err := strconv.Atoi(p)
+			if err != nil || i < 0 || i >= len(o) {
+				return nil
+			}
+			v = o[i]
+		default:
+			return nil
+		}
+	}
+	if n, isNumber := v.(json.Number); isNumber {
+		f, err := n.Float64()
+		if err != nil {
+			return nil
+		}
+		return f
+	}
+	return v
+}
+
+type not struct {
+	operand node
+}
+
+func (n not) eval(c *evalContext) interface{} {
+	return !truthy(n.operand.eval(c))
+}
+
+type and struct {
+	left, right node
+}
+
+func (a and) eval(c *evalContext) interface{} {
+	return truthy(a.left.eval(c)) && truthy(a.right.eval(c))
+}
+
+type or struct {
+	left, right node
+}
+
+func (o or) eval(c *evalContext) interface{} {
+	return truthy(o.left.eval(c)) || truthy(o.right.eval(c))
+}
+
+type comparison struct {
+	operator    string
+	left, right node
+}
+
+func (cmp comparison) eval(c *evalContext) interface{} {
+	order, comparable, ordered := compare(cmp.left.eval(c), cmp.right.eval(c))
+	switch cmp.operator {
+	case "==":
+		return comparable && order == 0
+	case "!=":
+		return !comparable || order != 0
+	case "<":
+		return ordered && order < 0
+	case "<=":
+		return ordered && order <= 0
+	case ">":
+		return ordered && order > 0
+	case ">=":
+		return ordered && order >= 0
+	}
+	return false
+}
+
+// compare returns the order of the values. Values of different types are
+// not comparable; booleans and null are comparable only for equality.
+func compare(left, right interface{}) (int, bool, bool) {
+	if ls, isString := left.(string); isString {
+		if rf, isNumber := right.(float64); isNumber {
+			lf, err := strconv.ParseFloat(ls, 64)
+			if err != nil {
+				return 0, false, false
+			}
+			return compareNumbers(lf, rf), true, true
+		}
+	}
+
+	if _, isString := right.(string); isString {
+		if _, isNumber := left.(float64); isNumber {
+			order, comparable, ordered := compare(right, left)
+			return -order, comparable, ordered
+		}
+	}
+
+	switch l := left.(type) {
+	case nil:
+		if right == nil {
+			return 0, true, false
+		}
+	case bool:
+		if r, isBool := right.(bool); isBool {
+			if l == r {
+				return 0, true, false
+			}
+			return 1, true, false
+		}
+	case float64:
+		if r, isNumber := right.(float64); isNumber {
+			return compareNumbers(l, r), true, true
+		}
+	case string:
+		if r, isString := right.(string); isString {
+			return strings.Compare(l, r), true, true
+		}
+	}
+
+	return 0, false, false
+}
+
+func compareNumbers(l, r float64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+// truthy returns true only for the boolean true.
+func truthy(v interface{}) bool {
+	b, isBool := v.(bool)
+	return isBool && b
+}
+
+type parser struct {
+	lexer lexer
+	token token
+	data  bool
+}
+
+func (p *parser) next() {
+	p.token = p.lexer.next()
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Position: p.token.position, Message: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.token.kind == tokenOperator && p.token.text == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = or{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.token.kind == tokenOperator && p.token.text == "&&" {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = and{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.token.kind == tokenOperator && p.token.text == "!" {
+		p.next()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return not{operand}, nil
+	}
+	return p.parseComparison()
+}
+
+var comparisonOperators = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+func (p *parser) parseComparison() (node, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if p.token.kind == tokenOperator && comparisonOperators[p.token.text] {
+		operator := p.token.text
+		p.next()
+		right, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return comparison{operator, left, right}, nil
+	}
+	return left, nil
+}
+
+func (p *parser) parseOperand() (node, error) {
+	t := p.token
+	switch t.kind {
+	case tokenString:
+		p.next()
+		return literal{t.text}, nil
+	case tokenNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %s", t.text)
+		}
+		p.next()
+		return literal{f}, nil
+	case tokenIdentifier:
+		return p.parseField()
+	case tokenOperator:
+		if t.text == "(" {
+			p.next()
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if p.token.kind != tokenOperator || p.token.text != ")" {
+				return nil, p.errorf("expected )")
+			}
+			p.next()
+			return n, nil
+		}
+	case tokenError:
+		return nil, p.errorf("%s", t.text)
+	}
+	return nil, p.errorf("unexpected %s", t)
+}
+
+func (p *parser) parseField() (node, error) {
+	name := p.token.text
+	position := p.token.position
+	p.next()
+
+	switch name {
+	case "true":
+		return literal{true}, nil
+	case "false":
+		return literal{false}, nil
+	case "null":
+		return literal{nil}, nil
+	case "key":
+		return keyField{}, nil
+	case "header", "data":
+	default:
+		return nil, &SyntaxError{Position: position, Message: fmt.Sprintf("unknown field %s", name)}
+	}
+
+	path := []string{}
+	for p.token.kind == tokenOperator && p.token.text == "." {
+		p.next()
+		if p.token.kind != tokenIdentifier && p.token.kind != tokenNumber {
+			return nil, p.errorf("expected field name")
+		}
+		// indexes of nested arrays are lexed as one number, e.g. 0.1
+		path = append(path, strings.Split(p.token.text, ".")...)
+		p.next()
+	}
+
+	if name == "header" {
+		if len(path) != 1 {
+			return nil, p.errorf("expected header.<name>")
+		}
+		return headerField{path[0]}, nil
+	}
+
+	p.data = true
+	return dataField{path}, nil
+}
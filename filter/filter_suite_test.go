@@ -0,0 +1,88 @@
+package filter_test
+
+import (
+	"github.com/draganm/zathras/filter"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Filter Suite")
+}
+
+var _ = Describe("Filter", func() {
+	event := filter.Event{
+		Headers: map[string]string{"type": "OrderPlaced", "sequence": "7"},
+		Key:     []byte("order-1"),
+		Data:    []byte(`{"amount":150,"customer":{"name":"Ann"},"items":[{"sku":"a"},{"sku":"b"}],"paid":true,"note":null}`),
+	}
+
+	matches := []struct {
+		name       string
+		expression string
+		expected   bool
+	}{
+		{"header equality", `header.type == "OrderPlaced"`, true},
+		{"header inequality", `header.type != "OrderPlaced"`, false},
+		{"numeric header", `header.sequence > 5`, true},
+		{"missing header", `header.missing == null`, true},
+		{"key", `key == "order-1"`, true},
+		{"number comparison", `data.amount > 100`, true},
+		{"number comparison with a negative number", `data.amount >= -1.5e2`, true},
+		{"nested field", `data.customer.name == "Ann"`, true},
+		{"array index", `data.items.1.sku == "b"`, true},
+		{"array index out of range", `data.items.2.sku == "b"`, false},
+		{"boolean field", `data.paid`, true},
+		{"negation", `!data.paid`, false},
+		{"null field", `data.note == null`, true},
+		{"missing field", `data.missing != 1`, true},
+		{"different types", `data.amount == "x"`, false},
+		{"ordering of booleans", `data.paid > false`, false},
+		{"and", `header.type == "OrderPlaced" && data.amount > 100`, true},
+		{"or", `data.amount < 100 || data.customer.name == "Ann"`, true},
+		{"precedence", `data.amount < 100 && data.paid || key == "order-1"`, true},
+		{"parentheses", `data.amount < 100 && (data.paid || key == "order-1")`, false},
+		{"escaped string", `"a\"b" == "a\"b"`, true},
+	}
+
+	for _, m := range matches {
+		m := m
+		It("Should evaluate "+m.name, func() {
+			f, err := filter.Compile(m.expression)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f.Match(event)).To(Equal(m.expected))
+		})
+	}
+
+	It("Should not match data fields of events that aren't JSON", func() {
+		f, err := filter.Compile(`data.amount > 100 || data == null`)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Match(filter.Event{Data: []byte("not json")})).To(BeTrue())
+	})
+
+	syntaxErrors := []struct {
+		name       string
+		expression string
+		position   int
+	}{
+		{"a missing operand", `data.amount >`, 13},
+		{"an unknown field", `amount > 1`, 0},
+		{"an unterminated string", `key == "a`, 7},
+		{"a missing parenthesis", `(key == "a"`, 11},
+		{"a header without name", `header == "a"`, 7},
+		{"trailing tokens", `key == "a" "b"`, 11},
+		{"an unexpected character", `key = "a"`, 4},
+	}
+
+	for _, e := range syntaxErrors {
+		e := e
+		It("Should reject "+e.name, func() {
+			_, err := filter.Compile(e.expression)
+			Expect(err).To(BeAssignableToTypeOf(&filter.SyntaxError{}))
+			Expect(err.(*filter.SyntaxError).Position).To(Equal(e.position))
+		})
+	}
+})
@@ -0,0 +1,131 @@
+package filter
+
+import (
+	"fmt"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	tokenEOF = iota
+	tokenError
+	tokenIdentifier
+	tokenString
+	tokenNumber
+	tokenOperator
+)
+
+type token struct {
+	kind     int
+	text     string
+	position int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of expression"
+	case tokenString:
+		return strconv.Quote(t.text)
+	}
+	return t.text
+}
+
+// operators are ordered so that longer operators are matched first.
+var operators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "."}
+
+type lexer struct {
+	input    string
+	position int
+}
+
+func (l *lexer) next() token {
+	for l.position < len(l.input) {
+		r, size := utf8.DecodeRuneInString(l.input[l.position:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		l.position += size
+	}
+
+	start := l.position
+	if start >= len(l.input) {
+		return token{kind: tokenEOF, position: start}
+	}
+
+	c := l.input[start]
+	switch {
+	case c == '"':
+		return l.string()
+	case c >= '0' && c <= '9' || c == '-':
+		l.position++
+		l.digits()
+		// a dot is part of the number only when a digit follows, so that
+		// array indexes can be followed by field names
+		if l.position+1 < len(l.input) && l.input[l.position] == '.' && isDigit(l.input[l.position+1]) {
+			l.position++
+			l.digits()
+		}
+		if l.position < len(l.input) && (l.input[l.position] == 'e' || l.input[l.position] == 'E') {
+			l.position++
+			if l.position < len(l.input) && (l.input[l.position] == '-' || l.input[l.position] == '+') {
+				l.position++
+			}
+			l.digits()
+		}
+		return token{kind: tokenNumber, text: l.input[start:l.position], position: start}
+	case c == '_' || unicode.IsLetter(rune(c)):
+		for l.position < len(l.input) {
+			c := l.input[l.position]
+			if c != '_' && c != '-' && !isDigit(c) && !unicode.IsLetter(rune(c)) {
+				break
+			}
+			l.position++
+		}
+		return token{kind: tokenIdentifier, text: l.input[start:l.position], position: start}
+	}
+
+	for _, o := range operators {
+		if len(l.input)-start >= len(o) && l.input[start:start+len(o)] == o {
+			l.position += len(o)
+			return token{kind: tokenOperator, text: o, position: start}
+		}
+	}
+
+	l.position = len(l.input)
+	return token{kind: tokenError, text: fmt.Sprintf("unexpected character %q", c), position: start}
+}
+
+func (l *lexer) string() token {
+	start := l.position
+	l.position++
+	escaped := false
+	for l.position < len(l.input) {
+		c := l.input[l.position]
+		l.position++
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			s, err := strconv.Unquote(l.input[start:l.position])
+			if err != nil {
+				return token{kind: tokenError, text: "invalid string", position: start}
+			}
+			return token{kind: tokenString, text: s, position: start}
+		}
+	}
+	return token{kind: tokenError, text: "unterminated string", position: start}
+}
+
+func (l *lexer) digits() {
+	for l.position < len(l.input) && isDigit(l.input[l.position]) {
+		l.position++
+	}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
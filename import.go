@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"time"
+
+	"github.com/draganm/zathras/server"
+	"github.com/draganm/zathras/topic"
+)
+
+// eventDecoder returns the function reading the next event of a stream
+// export. It returns io.EOF at the end of the stream.
+func eventDecoder(format string, r *bufio.Reader) (func() (printedEvent, error), error) {
+	switch format {
+	case "jsonl":
+		return func() (printedEvent, error) {
+			for {
+				line, err := r.ReadBytes('\n')
+				if err == io.EOF && len(line) > 0 {
+					err = nil
+				}
+				if err != nil {
+					return printedEvent{}, err
+				}
+				if len(bytes.TrimSpace(line)) == 0 {
+					continue
+				}
+				exported := exportedEvent{}
+				err = json.Unmarshal(line, &exported)
+				if err != nil {
+					return printedEvent{}, err
+				}
+				e := printedEvent{
+					Address:     exported.Address,
+					NextAddress: exported.NextAddress,
+					Timestamp:   exported.Timestamp,
+					data:        exported.DataBase64,
+				}
+				if exported.Data != nil {
+					e.data = exported.Data
+				}
+				return e, nil
+			}
+		}, nil
+	case "binary":
+		magic := make([]byte, len(eventStreamMagic))
+		_, err := io.ReadFull(r, magic)
+		if err != nil {
+			return nil, err
+		}
+		if string(magic) != eventStreamMagic {
+			return nil, errors.New("Not a binary event stream")
+		}
+		return func() (printedEvent, error) {
+			header := make([]byte, eventStreamHeaderSize)
+			_, err := io.ReadFull(r, header)
+			if err != nil {
+				return printedEvent{}, err
+			}
+			e := printedEvent{
+				Address:     binary.BigEndian.Uint64(header),
+				NextAddress: binary.BigEndian.Uint64(header[8:]),
+				data:        make([]byte, binary.BigEndian.Uint32(header[24:])),
+			}
+			if timestamp := int64(binary.BigEndian.Uint64(header[16:])); timestamp != 0 {
+				t := time.Unix(0, timestamp)
+				e.Timestamp = &t
+			}
+			_, err = io.ReadFull(r, e.data)
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return e, err
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// importEvents appends the events of an export to a topic directory or to a
+// topic on a server. With -keep-addresses every event has to get its
+// original address, which holds for topics written without transactions,
+// compression, producers or schemas; archives always keep addresses.
+func importEvents(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dir := flags.String("dir", "", "directory of the topic")
+	serverAddress := flags.String("server", "", "client protocol address of a server, instead of -dir")
+	topicName := flags.String("topic", "", "name of the topic on the server")
+	segmentSize := flags.Uint64("segment-size", 64*1024*1024, "size of a segment file after which a new segment is started")
+	format := flags.String("format", "jsonl", "import format: jsonl, binary or tar")
+	in := flags.String("in", "", "file to read, stdin when empty, can also be given as argument")
+	keepAddresses := flags.Bool("keep-addresses", false, "fail instead of writing an event at a different address")
+	flags.Parse(args)
+
+	if *in == "" && flags.NArg() == 1 {
+		*in = flags.Arg(0)
+	}
+
+	if (*dir == "") == (*serverAddress == "") {
+		return errors.New("Either -dir or -server is required")
+	}
+
+	if *serverAddress != "" && *topicName == "" {
+		return errors.New("-topic is required with -server")
+	}
+
+	f := os.Stdin
+	if *in != "" {
+		var err error
+		f, err = os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+
+	r := bufio.NewReader(f)
+
+	if *format == "tar" && *keepAddresses {
+		if *dir == "" {
+			return errors.New("-format tar with -keep-addresses needs -dir")
+		}
+		err := os.MkdirAll(*dir, 0700)
+		if err != nil {
+			return err
+		}
+		m, err := topic.ImportArchive(r, *dir)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("imported %d segments with addresses %d to %d\n", len(m.Segments), m.StartAddress, m.EndAddress)
+		return nil
+	}
+
+	w, err := newImportWriter(*dir, *serverAddress, *topicName, *segmentSize, *keepAddresses)
+	if err != nil {
+		return err
+	}
+	defer w.close()
+
+	events := 0
+	write := func(e printedEvent) error {
+		events++
+		return w.write(e)
+	}
+
+	if *format == "tar" {
+		err = importArchiveEvents(r, *segmentSize, write)
+	} else {
+		var next func() (printedEvent, error)
+		next, err = eventDecoder(*format, r)
+		for err == nil {
+			var e printedEvent
+			e, err = next()
+			if err == nil {
+				err = write(e)
+			}
+		}
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("imported %d events\n", events)
+
+	return w.close()
+}
+
+// importArchiveEvents extracts an archive into a temporary directory and
+// calls fn with its events.
+func importArchiveEvents(r io.Reader, segmentSize uint64, fn func(e printedEvent) error) error {
+	tmpDir, err := ioutil.TempDir("", "zathras-import")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	_, err = topic.ImportArchive(r, tmpDir)
+	if err != nil {
+		return err
+	}
+
+	return readDirectory(context.Background(), tmpDir, segmentSize, eventRange{to: math.MaxUint64}, false, fn)
+}
+
+// importWriter writes imported events to a topic directory or to a topic on a server.
+type importWriter struct {
+	dir           string
+	segmentSize   uint64
+	keepAddresses bool
+	topic         *topic.Topic
+	client        *server.Client
+	topicName     string
+	// timestamp is the time the topic stamps the next written event with.
+	timestamp time.Time
+}
+
+func newImportWriter(dir, serverAddress, topicName string, segmentSize uint64, keepAddresses bool) (*importWriter, error) {
+	w := &importWriter{
+		dir:           dir,
+		segmentSize:   segmentSize,
+		keepAddresses: keepAddresses,
+		topicName:     topicName,
+	}
+
+	if serverAddress == "" {
+		return w, os.MkdirAll(dir, 0700)
+	}
+
+	var err error
+	w.client, err = server.Dial(serverAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// write writes the event. Events written to a directory keep their
+// timestamps. The topic of a directory is opened with the first event, so
+// that a new topic can start at its address.
+func (w *importWriter) write(e printedEvent) error {
+	if w.client != nil {
+		if !w.keepAddresses {
+			_, err := w.client.WriteEvent(w.topicName, e.data)
+			return err
+		}
+		_, err := w.client.WriteEventIfNextAddress(w.topicName, e.Address, e.data)
+		if err == topic.ErrConcurrencyConflict {
+			return fmt.Errorf("event at %d can't keep its address", e.Address)
+		}
+		return err
+	}
+
+	if w.topic == nil {
+		options := []topic.Option{
+			topic.WithClock(func() time.Time {
+				return w.timestamp
+			}),
+		}
+		if w.keepAddresses {
+			options = append(options, topic.WithStartAddress(e.Address))
+		}
+		var err error
+		w.topic, err = topic.New(w.dir, w.segmentSize, options...)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.timestamp = time.Now()
+	if e.Timestamp != nil {
+		w.timestamp = *e.Timestamp
+	}
+
+	if !w.keepAddresses {
+		_, err := w.topic.WriteEvent(e.data)
+		return err
+	}
+
+	_, err := w.topic.WriteEventIfNextAddress(e.Address, e.data)
+	if err == topic.ErrConcurrencyConflict {
+		return fmt.Errorf("event at %d can't keep its address, the topic ends at %d", e.Address, w.topic.NextAddress())
+	}
+	return err
+}
+
+func (w *importWriter) close() error {
+	if w.client != nil {
+		client := w.client
+		w.client = nil
+		return client.Close()
+	}
+	if w.topic != nil {
+		t := w.topic
+		w.topic = nil
+		return t.Close()
+	}
+	return nil
+}
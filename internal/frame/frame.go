@@ -0,0 +1,44 @@
+// Package frame reads and writes the frames of the binary protocols of
+// zathras. A frame is [u8 message type][u32 length][payload].
+package frame
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// MaxSize is the maximal size of the payload of a frame.
+const MaxSize = 1 << 30
+
+// ErrTooLarge is returned when a received frame is larger than MaxSize
+var ErrTooLarge = errors.New("Frame too large")
+
+// Write writes the frame with the message type and the payload.
+func Write(w io.Writer, msgType byte, payload []byte) error {
+	frame := make([]byte, 5+len(payload))
+	frame[0] = msgType
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	copy(frame[5:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+// Read reads a frame and returns its message type and payload.
+func Read(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > MaxSize {
+		return 0, nil, ErrTooLarge
+	}
+	payload := make([]byte, size)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
@@ -1,6 +1,7 @@
 package limiter
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
@@ -13,17 +14,17 @@ type Limiter struct {
 	current uint64
 	closed  bool
 	m       *sync.Mutex
-	cond    *sync.Cond
+	// changed is closed and replaced when current changes or the limiter is closed
+	changed chan struct{}
 }
 
 // New creates a new instance of a Limiter
 func New(initial uint64) *Limiter {
-	m := &sync.Mutex{}
 	return &Limiter{
 		current: initial,
 		closed:  false,
-		m:       m,
-		cond:    sync.NewCond(m),
+		m:       &sync.Mutex{},
+		changed: make(chan struct{}),
 	}
 }
 
@@ -40,31 +41,53 @@ func (l *Limiter) UpdateCurrent(current uint64) {
 
 	l.current = current
 
-	l.cond.Broadcast()
+	l.notify()
 
 }
 
+// notify wakes up all waiters. Must be called with the lock held.
+func (l *Limiter) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
 // WaitForCurrentToBeGreaterThan waits for current value to go past the from value.
 // It returns an error when the limiter is closed.
 func (l *Limiter) WaitForCurrentToBeGreaterThan(from uint64) (uint64, error) {
-	l.m.Lock()
-	defer l.m.Unlock()
+	return l.WaitContext(context.Background(), from)
+}
 
+// WaitContext waits for current value to go past the from value.
+// It returns an error when the limiter is closed or the context is done.
+func (l *Limiter) WaitContext(ctx context.Context, from uint64) (uint64, error) {
 	for {
-		if l.closed {
+		l.m.Lock()
+		closed, current, changed := l.closed, l.current, l.changed
+		l.m.Unlock()
+
+		if closed {
 			return 0, ErrClosed
 		}
-		if l.current > from {
-			return l.current, nil
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if current > from {
+			return current, nil
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-changed:
 		}
-		l.cond.Wait()
 	}
 }
 
 // Close closes the limiter.
 func (l *Limiter) Close() {
 	l.m.Lock()
-	l.closed = true
-	l.m.Unlock()
-	l.cond.Broadcast()
+	defer l.m.Unlock()
+	if !l.closed {
+		l.closed = true
+		l.notify()
+	}
 }
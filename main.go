@@ -1,5 +1,55 @@
 package main
 
-func main() {
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+var commands = map[string]func(args []string) error{
+	"serve":      serve,
+	"promote":    promote,
+	"skew":       skew,
+	"compress":   compress,
+	"rotate-key": rotateKey,
+	"reencrypt":  reencrypt,
+	"verify":     verify,
+	"repair":     repair,
+	"dump":       dump,
+	"tail":       tail,
+	"produce":    produce,
+	"export":     export,
+	"import":     importEvents,
+	"upgrade":    upgrade,
+}
+
+func usage() {
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", os.Args[0])
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", name)
+	}
 }
 
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	command, found := commands[os.Args[1]]
+	if !found {
+		usage()
+		os.Exit(2)
+	}
+
+	err := command(os.Args[2:])
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,175 @@
+// Package merkle implements the Merkle tree hashing, inclusion proofs and
+// consistency proofs of RFC 6962 (Certificate Transparency) using SHA-256.
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+// ErrIndexOutOfRange is returned when a proof is requested for a leaf or tree size outside of the tree
+var ErrIndexOutOfRange = errors.New("Index out of range")
+
+// LeafHash returns the hash of a leaf with the data.
+func LeafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// NodeHash returns the hash of an inner node with the left and right child hashes.
+func NodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// split returns the largest power of two smaller than n.
+func split(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// Root returns the root hash of the tree with the leaf hashes.
+func Root(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		h := sha256.Sum256(nil)
+		return h[:]
+	case 1:
+		return leaves[0]
+	}
+	k := split(len(leaves))
+	return NodeHash(Root(leaves[:k]), Root(leaves[k:]))
+}
+
+// InclusionProof returns the audit path of the leaf with the index in the tree with the leaf hashes.
+func InclusionProof(leaves [][]byte, index int) ([][]byte, error) {
+	if index < 0 || index >= len(leaves) {
+		return nil, ErrIndexOutOfRange
+	}
+	return path(index, leaves), nil
+}
+
+func path(m int, leaves [][]byte) [][]byte {
+	if len(leaves) <= 1 {
+		return [][]byte{}
+	}
+	k := split(len(leaves))
+	if m < k {
+		return append(path(m, leaves[:k]), Root(leaves[k:]))
+	}
+	return append(path(m-k, leaves[k:]), Root(leaves[:k]))
+}
+
+// ConsistencyProof returns the proof that the tree of the first size is a
+// prefix of the tree with the leaf hashes.
+func ConsistencyProof(leaves [][]byte, size int) ([][]byte, error) {
+	if size < 0 || size > len(leaves) {
+		return nil, ErrIndexOutOfRange
+	}
+	if size == 0 {
+		return [][]byte{}, nil
+	}
+	return subproof(size, leaves, true), nil
+}
+
+func subproof(m int, leaves [][]byte, complete bool) [][]byte {
+	n := len(leaves)
+	if m == n {
+		if complete {
+			return [][]byte{}
+		}
+		return [][]byte{Root(leaves)}
+	}
+	k := split(n)
+	if m <= k {
+		return append(subproof(m, leaves[:k], complete), Root(leaves[k:]))
+	}
+	return append(subproof(m-k, leaves[k:], false), Root(leaves[:k]))
+}
+
+// VerifyInclusion checks that the leaf hash is at the index of the tree with the size and root.
+func VerifyInclusion(leaf []byte, index, size uint64, proof [][]byte, root []byte) bool {
+	if index >= size {
+		return false
+	}
+
+	fn, sn := index, size-1
+	r := leaf
+
+	for _, p := range proof {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = NodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = NodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	return sn == 0 && bytes.Equal(r, root)
+}
+
+// VerifyConsistency checks that the tree with the first size and root is a
+// prefix of the tree with the second size and root.
+func VerifyConsistency(firstSize, secondSize uint64, firstRoot, secondRoot []byte, proof [][]byte) bool {
+	switch {
+	case firstSize > secondSize:
+		return false
+	case firstSize == secondSize:
+		return len(proof) == 0 && bytes.Equal(firstRoot, secondRoot)
+	case firstSize == 0:
+		return len(proof) == 0
+	}
+
+	if firstSize&(firstSize-1) == 0 {
+		proof = append([][]byte{firstRoot}, proof...)
+	}
+
+	if len(proof) == 0 {
+		return false
+	}
+
+	fn, sn := firstSize-1, secondSize-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+
+	fr, sr := proof[0], proof[0]
+
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = NodeHash(c, fr)
+			sr = NodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = NodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	return sn == 0 && bytes.Equal(fr, firstRoot) && bytes.Equal(sr, secondRoot)
+}
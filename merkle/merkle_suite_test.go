@@ -0,0 +1,91 @@
+package merkle_test
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/draganm/zathras/merkle"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestMerkle(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Merkle Suite")
+}
+
+var _ = Describe("Merkle", func() {
+	var leaves [][]byte
+	BeforeEach(func() {
+		leaves = nil
+		for i := 0; i < 20; i++ {
+			leaves = append(leaves, merkle.LeafHash([]byte(fmt.Sprintf("event %d", i))))
+		}
+	})
+
+	Describe("Root()", func() {
+		It("Should return the hash of an empty string for an empty tree", func() {
+			Expect(hex.EncodeToString(merkle.Root(nil))).To(Equal("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"))
+		})
+	})
+
+	Describe("InclusionProof()", func() {
+		It("Should produce proofs that verify for every leaf and tree size", func() {
+			for size := 1; size <= len(leaves); size++ {
+				root := merkle.Root(leaves[:size])
+				for index := 0; index < size; index++ {
+					proof, err := merkle.InclusionProof(leaves[:size], index)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(merkle.VerifyInclusion(leaves[index], uint64(index), uint64(size), proof, root)).To(BeTrue(), "index %d size %d", index, size)
+				}
+			}
+		})
+
+		It("Should produce proofs that don't verify for another leaf", func() {
+			root := merkle.Root(leaves)
+			proof, err := merkle.InclusionProof(leaves, 3)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(merkle.VerifyInclusion(leaves[4], 3, uint64(len(leaves)), proof, root)).To(BeFalse())
+		})
+
+		It("Should reject an index outside of the tree", func() {
+			_, err := merkle.InclusionProof(leaves, 20)
+			Expect(err).To(Equal(merkle.ErrIndexOutOfRange))
+		})
+	})
+
+	Describe("ConsistencyProof()", func() {
+		It("Should produce proofs that verify for every pair of tree sizes", func() {
+			for second := 1; second <= len(leaves); second++ {
+				secondRoot := merkle.Root(leaves[:second])
+				for first := 1; first <= second; first++ {
+					proof, err := merkle.ConsistencyProof(leaves[:second], first)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(merkle.VerifyConsistency(uint64(first), uint64(second), merkle.Root(leaves[:first]), secondRoot, proof)).To(BeTrue(), "first %d second %d", first, second)
+				}
+			}
+		})
+
+		It("Should produce proofs that don't verify for a rewritten history", func() {
+			proof, err := merkle.ConsistencyProof(leaves, 7)
+			Expect(err).ToNot(HaveOccurred())
+			rewritten := append([][]byte{merkle.LeafHash([]byte("forged"))}, leaves[1:7]...)
+			Expect(merkle.VerifyConsistency(7, 20, merkle.Root(rewritten), merkle.Root(leaves), proof)).To(BeFalse())
+		})
+	})
+
+	Describe("TreeHead", func() {
+		It("Should verify signed tree heads", func() {
+			public, private, err := ed25519.GenerateKey(nil)
+			Expect(err).ToNot(HaveOccurred())
+			h := &merkle.TreeHead{Size: 20, RootHash: merkle.Root(leaves), Timestamp: 1}
+			h.Sign(private)
+			Expect(h.Verify(public)).To(BeTrue())
+			h.Size = 19
+			Expect(h.Verify(public)).To(BeFalse())
+		})
+	})
+})
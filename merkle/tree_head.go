@@ -0,0 +1,31 @@
+package merkle
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+)
+
+// TreeHead describes a Merkle tree by its size and root hash.
+type TreeHead struct {
+	Size      uint64 `json:"size"`
+	RootHash  []byte `json:"root_hash"`
+	Timestamp int64  `json:"timestamp"`
+	Signature []byte `json:"signature,omitempty"`
+}
+
+func (h *TreeHead) signedData() []byte {
+	data := make([]byte, 16, 16+len(h.RootHash))
+	binary.BigEndian.PutUint64(data, h.Size)
+	binary.BigEndian.PutUint64(data[8:], uint64(h.Timestamp))
+	return append(data, h.RootHash...)
+}
+
+// Sign signs the tree head with the key.
+func (h *TreeHead) Sign(key ed25519.PrivateKey) {
+	h.Signature = ed25519.Sign(key, h.signedData())
+}
+
+// Verify checks the signature of the tree head.
+func (h *TreeHead) Verify(key ed25519.PublicKey) bool {
+	return ed25519.Verify(key, h.signedData(), h.Signature)
+}
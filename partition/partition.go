@@ -0,0 +1,263 @@
+package partition
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+
+	"github.com/draganm/zathras/topic"
+)
+
+// ErrPartitionCountMismatch is returned when the directory contains a different number of partitions than requested
+var ErrPartitionCountMismatch = errors.New("Partition count does not match existing partitions")
+
+// ErrNoPartitions is returned when opening a directory without partitions
+var ErrNoPartitions = errors.New("No partitions found")
+
+// ErrWrongPartition is returned when the partition number is out of range
+var ErrWrongPartition = errors.New("Wrong partition")
+
+// ErrWrongPartitionCount is returned when the number of partitions is less than one
+var ErrWrongPartitionCount = errors.New("Partition count must be at least one")
+
+// ErrWrongMember is returned when the member or the number of members of a consumer group is out of range
+var ErrWrongMember = errors.New("Wrong member")
+
+// ErrMissingPartition is returned when the directory contains partitions that are not numbered contiguously from zero
+var ErrMissingPartition = errors.New("Missing partition")
+
+var partitionMatcher = regexp.MustCompile(`^[0-9]{4}$`)
+
+// Topic is a topic split into a number of independent partitions, each one
+// being a topic.Topic stored in a subdirectory. Every partition has its own
+// addresses.
+type Topic struct {
+	partitions []*topic.Topic
+	next       uint64
+}
+
+func existingPartitions(dir string) (int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, fi := range files {
+		if fi.IsDir() && partitionMatcher.MatchString(fi.Name()) {
+			// ReadDir returns sorted names, so contiguous partitions are numbered by their position.
+			if fi.Name() != fmt.Sprintf("%04d", count) {
+				return 0, ErrMissingPartition
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// New opens or creates a partitioned topic with the given number of partitions in the dir.
+// The options are applied to every partition.
+func New(dir string, partitions int, segmentSize uint64, options ...topic.Option) (*Topic, error) {
+	if partitions < 1 {
+		return nil, ErrWrongPartitionCount
+	}
+
+	existing, err := existingPartitions(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing != 0 && existing != partitions {
+		return nil, ErrPartitionCountMismatch
+	}
+
+	t := &Topic{}
+
+	for i := 0; i < partitions; i++ {
+		partitionDir := filepath.Join(dir, fmt.Sprintf("%04d", i))
+		err = os.MkdirAll(partitionDir, 0700)
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		var p *topic.Topic
+		p, err = topic.New(partitionDir, segmentSize, options...)
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+		t.partitions = append(t.partitions, p)
+	}
+
+	return t, nil
+}
+
+// Open opens an existing partitioned topic in the dir.
+func Open(dir string, segmentSize uint64, options ...topic.Option) (*Topic, error) {
+	existing, err := existingPartitions(dir)
+	if err != nil {
+		return nil, err
+	}
+	if existing == 0 {
+		return nil, ErrNoPartitions
+	}
+	return New(dir, existing, segmentSize, options...)
+}
+
+// Partitions returns the number of partitions.
+func (t *Topic) Partitions() int {
+	return len(t.partitions)
+}
+
+// Partition returns the topic of a single partition.
+func (t *Topic) Partition(partition int) (*topic.Topic, error) {
+	if partition < 0 || partition >= len(t.partitions) {
+		return nil, ErrWrongPartition
+	}
+	return t.partitions[partition], nil
+}
+
+// PartitionForKey returns the partition events with the key are written to.
+func (t *Topic) PartitionForKey(key []byte) int {
+	h := fnv.New32a()
+	h.Write(key)
+	return int(h.Sum32() % uint32(len(t.partitions)))
+}
+
+// WriteEventTo writes the event to the partition and returns its address.
+func (t *Topic) WriteEventTo(partition int, data []byte) (uint64, error) {
+	p, err := t.Partition(partition)
+	if err != nil {
+		return 0, err
+	}
+	return p.WriteEvent(data)
+}
+
+// WriteEvent writes the event to the partition chosen by hash of the key.
+// It returns the partition and the address of the event.
+func (t *Topic) WriteEvent(key []byte, data []byte) (int, uint64, error) {
+	partition := t.PartitionForKey(key)
+	address, err := t.WriteEventTo(partition, data)
+	return partition, address, err
+}
+
+// WriteEventRoundRobin writes the event to the next partition in turn.
+// It returns the partition and the address of the event.
+func (t *Topic) WriteEventRoundRobin(data []byte) (int, uint64, error) {
+	partition := int((atomic.AddUint64(&t.next, 1) - 1) % uint64(len(t.partitions)))
+	address, err := t.WriteEventTo(partition, data)
+	return partition, address, err
+}
+
+// Assign returns the partitions assigned to one of the members of a consumer group.
+// Partitions are spread evenly among members.
+func (t *Topic) Assign(member, members int) ([]int, error) {
+	if members < 1 || member < 0 || member >= members {
+		return nil, ErrWrongMember
+	}
+	assigned := []int{}
+	for p := range t.partitions {
+		if p%members == member {
+			assigned = append(assigned, p)
+		}
+	}
+	return assigned, nil
+}
+
+// Subscribe merges events of the partitions, starting each partition from
+// the address in from (missing partitions start at zero). Calls of fn are
+// never concurrent. It returns when fn returns an error, a partition can't
+// be read or the context is done.
+func (t *Topic) Subscribe(ctx context.Context, partitions []int, from map[int]uint64, fn func(partition int, nextAddress uint64, data []byte) error) error {
+	for _, p := range partitions {
+		if p < 0 || p >= len(t.partitions) {
+			return ErrWrongPartition
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	m := &sync.Mutex{}
+	errs := make(chan error, len(partitions))
+
+	for _, p := range partitions {
+		go func(p int) {
+			errs <- t.partitions[p].SubscribeContext(ctx, from[p], func(nextAddress uint64, data []byte) error {
+				m.Lock()
+				defer m.Unlock()
+				return fn(p, nextAddress, data)
+			})
+		}(p)
+	}
+
+	var firstErr error
+	for range partitions {
+		err := <-errs
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	return firstErr
+}
+
+// SubscribeAll merges events of all partitions. See Subscribe.
+func (t *Topic) SubscribeAll(ctx context.Context, from map[int]uint64, fn func(partition int, nextAddress uint64, data []byte) error) error {
+	partitions := make([]int, len(t.partitions))
+	for i := range partitions {
+		partitions[i] = i
+	}
+	return t.Subscribe(ctx, partitions, from, fn)
+}
+
+// SkewReport describes how evenly data is spread among partitions.
+type SkewReport struct {
+	// Sizes contains number of bytes stored in each partition.
+	Sizes []uint64
+	Total uint64
+	Max   uint64
+	Min   uint64
+	// Ratio of the largest partition to the average partition size.
+	// It is 1 for perfectly balanced partitions.
+	Ratio float64
+}
+
+// Skew reports the sizes of the partitions.
+func (t *Topic) Skew() SkewReport {
+	r := SkewReport{}
+	for i, p := range t.partitions {
+		size := p.NextAddress()
+		r.Sizes = append(r.Sizes, size)
+		r.Total += size
+		if size > r.Max {
+			r.Max = size
+		}
+		if i == 0 || size < r.Min {
+			r.Min = size
+		}
+	}
+	if r.Total > 0 {
+		r.Ratio = float64(r.Max) / (float64(r.Total) / float64(len(t.partitions)))
+	}
+	return r
+}
+
+// Close closes all partitions.
+func (t *Topic) Close() error {
+	var firstErr error
+	for _, p := range t.partitions {
+		err := p.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
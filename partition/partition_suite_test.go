@@ -0,0 +1,147 @@
+package partition_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/draganm/zathras/partition"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestPartition(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Partition Suite")
+}
+
+var _ = Describe("Partitioned topic", func() {
+	var dir string
+	var t *partition.Topic
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+		t, err = partition.New(dir, 4, 1024)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(t.Close()).To(Succeed())
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	Describe("WriteEvent()", func() {
+		It("Should route events with the same key to the same partition", func() {
+			p1, a1, err := t.WriteEvent([]byte("order-1"), []byte("a"))
+			Expect(err).ToNot(HaveOccurred())
+			p2, a2, err := t.WriteEvent([]byte("order-1"), []byte("b"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p2).To(Equal(p1))
+			Expect(a1).To(Equal(uint64(0)))
+			Expect(a2).To(Equal(uint64(18)))
+		})
+	})
+
+	Describe("WriteEventRoundRobin()", func() {
+		It("Should spread events over all partitions", func() {
+			for i := 0; i < 8; i++ {
+				p, _, err := t.WriteEventRoundRobin([]byte("x"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(p).To(Equal(i % 4))
+			}
+			Expect(t.Skew().Ratio).To(Equal(1.0))
+		})
+	})
+
+	Describe("WriteEventTo()", func() {
+		It("Should reject a partition out of range", func() {
+			_, err := t.WriteEventTo(4, []byte("x"))
+			Expect(err).To(Equal(partition.ErrWrongPartition))
+		})
+	})
+
+	Describe("Skew()", func() {
+		It("Should report the partition sizes", func() {
+			_, err := t.WriteEventTo(1, make([]byte, 83))
+			Expect(err).ToNot(HaveOccurred())
+			r := t.Skew()
+			Expect(r.Sizes).To(Equal([]uint64{0, 100, 0, 0}))
+			Expect(r.Ratio).To(Equal(4.0))
+		})
+	})
+
+	Describe("Assign()", func() {
+		It("Should assign every partition to exactly one member", func() {
+			Expect(t.Assign(0, 3)).To(Equal([]int{0, 3}))
+			Expect(t.Assign(1, 3)).To(Equal([]int{1}))
+			Expect(t.Assign(2, 3)).To(Equal([]int{2}))
+		})
+
+		It("Should reject a member out of range", func() {
+			_, err := t.Assign(0, 0)
+			Expect(err).To(Equal(partition.ErrWrongMember))
+			_, err = t.Assign(3, 3)
+			Expect(err).To(Equal(partition.ErrWrongMember))
+		})
+	})
+
+	Describe("SubscribeAll()", func() {
+		It("Should merge events of all partitions", func() {
+			for i := 0; i < 4; i++ {
+				_, err := t.WriteEventTo(i, []byte("x"))
+				Expect(err).ToNot(HaveOccurred())
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			seen := map[int]bool{}
+			err := t.SubscribeAll(ctx, nil, func(p int, nextAddress uint64, data []byte) error {
+				seen[p] = true
+				if len(seen) == 4 {
+					cancel()
+				}
+				return nil
+			})
+			Expect(err).To(Equal(context.Canceled))
+			Expect(seen).To(HaveLen(4))
+		})
+	})
+
+	Context("When reopened with a different partition count", func() {
+		It("Should return ErrPartitionCountMismatch", func() {
+			_, err := partition.New(dir, 3, 1024)
+			Expect(err).To(Equal(partition.ErrPartitionCountMismatch))
+		})
+	})
+
+	Context("When created without partitions", func() {
+		It("Should return ErrWrongPartitionCount", func() {
+			_, err := partition.New(dir, 0, 1024)
+			Expect(err).To(Equal(partition.ErrWrongPartitionCount))
+		})
+	})
+
+	Context("When a partition directory is missing", func() {
+		var otherDir string
+
+		BeforeEach(func() {
+			var err error
+			otherDir, err = ioutil.TempDir("", "")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(os.Mkdir(filepath.Join(otherDir, "0000"), 0700)).To(Succeed())
+			Expect(os.Mkdir(filepath.Join(otherDir, "0002"), 0700)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(otherDir)).To(Succeed())
+		})
+
+		It("Should return ErrMissingPartition", func() {
+			_, err := partition.Open(otherDir, 1024)
+			Expect(err).To(Equal(partition.ErrMissingPartition))
+		})
+	})
+})
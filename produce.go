@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/draganm/zathras/server"
+	"github.com/draganm/zathras/topic"
+)
+
+// maxLineSize is the size of the largest event produce reads from a line of stdin.
+const maxLineSize = 64 * 1024 * 1024
+
+// produce writes events to a topic directory or to a topic on a server and
+// prints their addresses. Every file given as argument is one event; without
+// files every line of stdin is one event.
+func produce(args []string) error {
+	flags := flag.NewFlagSet("produce", flag.ExitOnError)
+	dir := flags.String("dir", "", "directory of the topic")
+	serverAddress := flags.String("server", "", "client protocol address of a server, instead of -dir")
+	topicName := flags.String("topic", "", "name of the topic on the server")
+	segmentSize := flags.Uint64("segment-size", 64*1024*1024, "size of a segment file after which a new segment is started")
+	flags.Parse(args)
+
+	if (*dir == "") == (*serverAddress == "") {
+		return errors.New("Either -dir or -server is required")
+	}
+
+	var write func(data []byte) (uint64, error)
+
+	if *dir != "" {
+		t, err := topic.New(*dir, *segmentSize)
+		if err != nil {
+			return err
+		}
+		defer t.Close()
+		write = t.WriteEvent
+	} else {
+		if *topicName == "" {
+			return errors.New("-topic is required with -server")
+		}
+		client, err := server.Dial(*serverAddress)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		write = func(data []byte) (uint64, error) {
+			return client.WriteEvent(*topicName, data)
+		}
+	}
+
+	writeAndPrint := func(data []byte) error {
+		address, err := write(data)
+		if err != nil {
+			return err
+		}
+		fmt.Println(address)
+		return nil
+	}
+
+	if flags.NArg() > 0 {
+		for _, fileName := range flags.Args() {
+			data, err := ioutil.ReadFile(fileName)
+			if err != nil {
+				return err
+			}
+			err = writeAndPrint(data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(nil, maxLineSize)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		err := writeAndPrint(scanner.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
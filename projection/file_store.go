@@ -0,0 +1,267 @@
+package projection
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/draganm/zathras/segment"
+)
+
+// Every commit is appended to the file as a frame [u32 length][u32 crc32][payload]
+// with the payload [u64 position][u32 count]([u8 op][u32 key length][key][u32 value length][value])*.
+// A torn frame at the end of the file is dropped when the file is opened.
+const (
+	opPut byte = iota + 1
+	opDelete
+)
+
+// minCompactionSize is the file size below which the file is never compacted.
+const minCompactionSize = 1024 * 1024
+
+// FileStore is a Store that keeps the state in memory and appends every
+// commit to a file. The file is compacted when it gets much larger than the state.
+type FileStore struct {
+	sync.RWMutex
+	fileName string
+	file     *os.File
+	size     int64
+	values   map[string][]byte
+	position uint64
+}
+
+// OpenFileStore opens or creates the file of a FileStore.
+func OpenFileStore(fileName string) (*FileStore, error) {
+	f := &FileStore{
+		fileName: fileName,
+		values:   map[string][]byte{},
+	}
+
+	err := f.load()
+	if err != nil {
+		return nil, err
+	}
+
+	f.file, err = os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	// drop a torn frame
+	err = f.file.Truncate(f.size)
+	if err == nil {
+		_, err = f.file.Seek(f.size, io.SeekStart)
+	}
+	if err != nil {
+		f.file.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *FileStore) load() error {
+	file, err := os.Open(f.fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	header := make([]byte, 8)
+	for {
+		_, err = io.ReadFull(r, header)
+		if err != nil {
+			return nil
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header))
+		_, err = io.ReadFull(r, payload)
+		if err != nil || crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			return nil
+		}
+		changes, position, ok := decodeCommit(payload)
+		if !ok {
+			return nil
+		}
+		apply(f.values, changes)
+		f.position = position
+		f.size += int64(len(header) + len(payload))
+	}
+}
+
+func encodeCommit(changes map[string][]byte, position uint64) []byte {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint64(payload, position)
+	binary.BigEndian.PutUint32(payload[8:], uint32(len(changes)))
+	buf := make([]byte, 4)
+	for k, v := range changes {
+		op := opPut
+		if v == nil {
+			op = opDelete
+		}
+		payload = append(payload, op)
+		binary.BigEndian.PutUint32(buf, uint32(len(k)))
+		payload = append(payload, buf...)
+		payload = append(payload, k...)
+		binary.BigEndian.PutUint32(buf, uint32(len(v)))
+		payload = append(payload, buf...)
+		payload = append(payload, v...)
+	}
+
+	frame := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(payload))
+	return append(frame, payload...)
+}
+
+func decodeCommit(payload []byte) (map[string][]byte, uint64, bool) {
+	if len(payload) < 12 {
+		return nil, 0, false
+	}
+	position := binary.BigEndian.Uint64(payload)
+	count := binary.BigEndian.Uint32(payload[8:])
+	payload = payload[12:]
+
+	changes := map[string][]byte{}
+	for i := uint32(0); i < count; i++ {
+		if len(payload) < 5 {
+			return nil, 0, false
+		}
+		op := payload[0]
+		keyLength := binary.BigEndian.Uint32(payload[1:])
+		payload = payload[5:]
+		if uint32(len(payload)) < keyLength+4 {
+			return nil, 0, false
+		}
+		key := string(payload[:keyLength])
+		valueLength := binary.BigEndian.Uint32(payload[keyLength:])
+		payload = payload[keyLength+4:]
+		if uint32(len(payload)) < valueLength {
+			return nil, 0, false
+		}
+		if op == opDelete {
+			changes[key] = nil
+		} else {
+			changes[key] = append([]byte{}, payload[:valueLength]...)
+		}
+		payload = payload[valueLength:]
+	}
+
+	return changes, position, true
+}
+
+// Get returns the value of the key.
+func (f *FileStore) Get(key string) ([]byte, bool, error) {
+	f.RLock()
+	defer f.RUnlock()
+	v, found := f.values[key]
+	return v, found, nil
+}
+
+// Commit appends the changes and the position to the file and syncs it.
+func (f *FileStore) Commit(changes map[string][]byte, position uint64) error {
+	f.Lock()
+	defer f.Unlock()
+
+	frame := encodeCommit(changes, position)
+	_, err := f.file.Write(frame)
+	if err == nil {
+		err = f.file.Sync()
+	}
+	if err != nil {
+		return err
+	}
+
+	f.size += int64(len(frame))
+	apply(f.values, changes)
+	f.position = position
+
+	if f.size > minCompactionSize && f.size > 2*f.stateSize() {
+		// the commit is durable, a failed compaction is retried by the next commit
+		err = f.compact()
+		if err != nil {
+			log.Println("Could not compact", f.fileName, err)
+		}
+	}
+
+	return nil
+}
+
+func (f *FileStore) stateSize() int64 {
+	size := int64(20)
+	for k, v := range f.values {
+		size += int64(9 + len(k) + len(v))
+	}
+	return size
+}
+
+// compact replaces the file with a single commit of the whole state.
+// Must be called with the lock held.
+func (f *FileStore) compact() error {
+	return f.rewrite(f.values, f.position)
+}
+
+// rewrite replaces the file and the state with a single commit. Must be called
+// with the lock held.
+func (f *FileStore) rewrite(values map[string][]byte, position uint64) error {
+	tmpFileName := f.fileName + ".tmp"
+	tmp, err := os.OpenFile(tmpFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0700)
+	if err != nil {
+		return err
+	}
+
+	frame := encodeCommit(values, position)
+	_, err = tmp.Write(frame)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpFileName)
+		return err
+	}
+
+	err = os.Rename(tmpFileName, f.fileName)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpFileName)
+		return err
+	}
+
+	f.file.Close()
+	f.file = tmp
+	f.size = int64(len(frame))
+	f.values = values
+	f.position = position
+
+	return segment.SyncDir(filepath.Dir(f.fileName))
+}
+
+// Position returns the position stored with the last commit.
+func (f *FileStore) Position() (uint64, error) {
+	f.RLock()
+	defer f.RUnlock()
+	return f.position, nil
+}
+
+// Reset deletes all keys and sets the position to zero.
+func (f *FileStore) Reset() error {
+	f.Lock()
+	defer f.Unlock()
+	return f.rewrite(map[string][]byte{}, 0)
+}
+
+// Close closes the file.
+func (f *FileStore) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,176 @@
+// Package projection builds read models from topics. A projection folds
+// every event of a topic into a Store and stores the address of the next
+// event together with the changes, so that it continues where it stopped.
+package projection
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/draganm/zathras/limiter"
+	"github.com/draganm/zathras/topic"
+)
+
+// ErrRunning is returned when rebuilding a projection that is running
+var ErrRunning = errors.New("Projection is running")
+
+// maxBatchSize is the maximal number of events folded before a commit.
+const maxBatchSize = 1000
+
+// State is the state of a projection as seen by the fold function.
+type State interface {
+	Get(key string) ([]byte, bool, error)
+	Put(key string, value []byte) error
+	Delete(key string) error
+}
+
+// Fold folds the event at the address into the state.
+type Fold func(s State, address uint64, data []byte) error
+
+// Projection folds events of a topic into a store.
+type Projection struct {
+	sync.Mutex
+	topic   *topic.Topic
+	store   Store
+	fold    Fold
+	limiter *limiter.Limiter
+	running bool
+}
+
+// New returns a projection of the topic into the store.
+func New(t *topic.Topic, s Store, fold Fold) (*Projection, error) {
+	position, err := s.Position()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Projection{
+		topic:   t,
+		store:   s,
+		fold:    fold,
+		limiter: limiter.New(position),
+	}, nil
+}
+
+// Get returns the value of the key in the store.
+func (p *Projection) Get(key string) ([]byte, bool, error) {
+	return p.store.Get(key)
+}
+
+// Position returns the address of the next event to fold.
+func (p *Projection) Position() (uint64, error) {
+	return p.store.Position()
+}
+
+// WaitFor waits until the event at the address is folded, e.g. to read
+// the results of an event written by the caller.
+func (p *Projection) WaitFor(ctx context.Context, address uint64) error {
+	p.Lock()
+	l := p.limiter
+	p.Unlock()
+	_, err := l.WaitContext(ctx, address)
+	return err
+}
+
+// Rebuild resets the store, so that the next Run folds all events from the
+// start of the topic.
+func (p *Projection) Rebuild() error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.running {
+		return ErrRunning
+	}
+
+	err := p.store.Reset()
+	if err != nil {
+		return err
+	}
+
+	p.limiter.Close()
+	p.limiter = limiter.New(0)
+
+	return nil
+}
+
+// Run folds events into the store until the context is done or the fold
+// function returns an error. Events that are available are folded in
+// batches, each committed together with its position.
+func (p *Projection) Run(ctx context.Context) error {
+	p.Lock()
+	if p.running {
+		p.Unlock()
+		return ErrRunning
+	}
+	p.running = true
+	l := p.limiter
+	p.Unlock()
+
+	defer func() {
+		p.Lock()
+		p.running = false
+		p.Unlock()
+	}()
+
+	position, err := p.store.Position()
+	if err != nil {
+		return err
+	}
+
+	c := p.topic.NewCursor()
+	c.Seek(position)
+
+	for c.NextWait(ctx) {
+		b := &batch{store: p.store, changes: map[string][]byte{}}
+		for n := 0; ; n++ {
+			err = p.fold(b, c.Address(), c.Event().Data)
+			if err != nil {
+				return err
+			}
+			position = c.Event().NextAddress
+			if n+1 >= maxBatchSize || !c.Next() {
+				break
+			}
+		}
+
+		err = p.store.Commit(b.changes, position)
+		if err != nil {
+			return err
+		}
+
+		l.UpdateCurrent(position)
+	}
+
+	if c.Err() != nil {
+		return c.Err()
+	}
+
+	return ctx.Err()
+}
+
+// batch collects changes of the fold function until they are committed.
+type batch struct {
+	store   Store
+	changes map[string][]byte
+}
+
+func (b *batch) Get(key string) ([]byte, bool, error) {
+	v, changed := b.changes[key]
+	if changed {
+		return v, v != nil, nil
+	}
+	return b.store.Get(key)
+}
+
+// Put copies the value, since event data passed to the fold function may be
+// only valid until the next event.
+func (b *batch) Put(key string, value []byte) error {
+	b.changes[key] = append([]byte{}, value...)
+	return nil
+}
+
+func (b *batch) Delete(key string) error {
+	b.changes[key] = nil
+	return nil
+}
@@ -0,0 +1,240 @@
+package projection_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/draganm/zathras/projection"
+	"github.com/draganm/zathras/topic"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestProjection(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Projection Suite")
+}
+
+type getter interface {
+	Get(key string) ([]byte, bool, error)
+}
+
+func get(g getter, key string) string {
+	v, found, err := g.Get(key)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(found).To(BeTrue())
+	return string(v)
+}
+
+// count counts events per data.
+func count(s projection.State, address uint64, data []byte) error {
+	v, _, err := s.Get(string(data))
+	if err != nil {
+		return err
+	}
+	n, _ := strconv.Atoi(string(v))
+	return s.Put(string(data), []byte(strconv.Itoa(n+1)))
+}
+
+var _ = Describe("FileStore", func() {
+	var dir string
+	var fileName string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+		fileName = filepath.Join(dir, "state")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("should restore keys and position after reopening", func() {
+		f, err := projection.OpenFileStore(fileName)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Commit(map[string][]byte{"a": []byte("1"), "b": []byte("2")}, 10)).To(Succeed())
+		Expect(f.Commit(map[string][]byte{"a": nil, "c": []byte("3")}, 20)).To(Succeed())
+		Expect(f.Close()).To(Succeed())
+
+		f, err = projection.OpenFileStore(fileName)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+
+		Expect(f.Position()).To(Equal(uint64(20)))
+		_, found, err := f.Get("a")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(BeFalse())
+		Expect(get(f, "c")).To(Equal("3"))
+	})
+
+	It("should drop a torn commit at the end of the file", func() {
+		f, err := projection.OpenFileStore(fileName)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Commit(map[string][]byte{"a": []byte("1")}, 10)).To(Succeed())
+		Expect(f.Commit(map[string][]byte{"a": []byte("2")}, 20)).To(Succeed())
+		Expect(f.Close()).To(Succeed())
+
+		info, err := os.Stat(fileName)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.Truncate(fileName, info.Size()-1)).To(Succeed())
+
+		f, err = projection.OpenFileStore(fileName)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Position()).To(Equal(uint64(10)))
+		Expect(get(f, "a")).To(Equal("1"))
+
+		Expect(f.Commit(map[string][]byte{"a": []byte("3")}, 30)).To(Succeed())
+		Expect(f.Close()).To(Succeed())
+
+		f, err = projection.OpenFileStore(fileName)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		Expect(f.Position()).To(Equal(uint64(30)))
+		Expect(get(f, "a")).To(Equal("3"))
+	})
+
+	It("should compact the file", func() {
+		f, err := projection.OpenFileStore(fileName)
+		Expect(err).ToNot(HaveOccurred())
+		value := make([]byte, 1024)
+		for i := 0; i < 2048; i++ {
+			Expect(f.Commit(map[string][]byte{"a": value}, uint64(i+1))).To(Succeed())
+		}
+		Expect(f.Close()).To(Succeed())
+
+		info, err := os.Stat(fileName)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Size()).To(BeNumerically("<", 2*1024*1024))
+
+		f, err = projection.OpenFileStore(fileName)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		Expect(f.Position()).To(Equal(uint64(2048)))
+		Expect(get(f, "a")).To(Equal(string(value)))
+	})
+})
+
+var _ = Describe("Projection", func() {
+	var dir string
+	var t *topic.Topic
+	var store *projection.FileStore
+	var p *projection.Projection
+	var cancel context.CancelFunc
+	var done chan error
+
+	start := func() {
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		done = make(chan error, 1)
+		go func() {
+			done <- p.Run(ctx)
+		}()
+	}
+
+	stop := func() {
+		cancel()
+		Eventually(done).Should(Receive(Equal(context.Canceled)))
+	}
+
+	write := func(events ...string) uint64 {
+		var address uint64
+		for _, e := range events {
+			var err error
+			address, err = t.WriteEvent([]byte(e))
+			Expect(err).ToNot(HaveOccurred())
+		}
+		return address
+	}
+
+	waitFor := func(address uint64) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		Expect(p.WaitFor(ctx, address)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.Mkdir(filepath.Join(dir, "topic"), 0700)).To(Succeed())
+		t, err = topic.New(filepath.Join(dir, "topic"), 1024)
+		Expect(err).ToNot(HaveOccurred())
+		store, err = projection.OpenFileStore(filepath.Join(dir, "state"))
+		Expect(err).ToNot(HaveOccurred())
+		p, err = projection.New(t, store, count)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(store.Close()).To(Succeed())
+		Expect(t.Close()).To(Succeed())
+		Expect(os.RemoveAll(dir)).To(Succeed())
+	})
+
+	It("should fold events and wait until they are folded", func() {
+		start()
+		defer stop()
+
+		waitFor(write("a", "b", "a"))
+		Expect(get(p, "a")).To(Equal("2"))
+		Expect(get(p, "b")).To(Equal("1"))
+		Expect(p.Position()).To(Equal(t.NextAddress()))
+	})
+
+	It("should continue from the stored position after a restart", func() {
+		start()
+		waitFor(write("a", "a"))
+		stop()
+
+		Expect(store.Close()).To(Succeed())
+		var err error
+		store, err = projection.OpenFileStore(filepath.Join(dir, "state"))
+		Expect(err).ToNot(HaveOccurred())
+		p, err = projection.New(t, store, count)
+		Expect(err).ToNot(HaveOccurred())
+
+		start()
+		defer stop()
+		waitFor(write("a"))
+		Expect(get(p, "a")).To(Equal("3"))
+	})
+
+	It("should rebuild from the start of the topic", func() {
+		start()
+		waitFor(write("a", "b"))
+		Expect(p.Rebuild()).To(Equal(projection.ErrRunning))
+		stop()
+
+		Expect(p.Rebuild()).To(Succeed())
+		Expect(p.Position()).To(Equal(uint64(0)))
+		_, found, err := p.Get("a")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(found).To(BeFalse())
+
+		start()
+		defer stop()
+		waitFor(write("a"))
+		Expect(get(p, "a")).To(Equal("2"))
+		Expect(get(p, "b")).To(Equal("1"))
+	})
+
+	It("should stop with the error of the fold function", func() {
+		failed := context.DeadlineExceeded
+		var err error
+		p, err = projection.New(t, projection.NewMemoryStore(), func(s projection.State, address uint64, data []byte) error {
+			return failed
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		write("a")
+		Expect(p.Run(context.Background())).To(Equal(failed))
+	})
+})
@@ -0,0 +1,79 @@
+package projection
+
+import "sync"
+
+// Store keeps the state of a projection together with its position, the
+// address of the next event to fold.
+type Store interface {
+	// Get returns the value of the key.
+	Get(key string) ([]byte, bool, error)
+	// Commit applies the changes and stores the position atomically. Nil
+	// values delete their keys.
+	Commit(changes map[string][]byte, position uint64) error
+	// Position returns the position stored with the last commit.
+	Position() (uint64, error)
+	// Reset deletes all keys and sets the position to zero.
+	Reset() error
+	Close() error
+}
+
+// MemoryStore is a Store that keeps everything in memory. A projection
+// using it is rebuilt from the start of the topic when the process restarts.
+type MemoryStore struct {
+	sync.RWMutex
+	values   map[string][]byte
+	position uint64
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{values: map[string][]byte{}}
+}
+
+// Get returns the value of the key.
+func (m *MemoryStore) Get(key string) ([]byte, bool, error) {
+	m.RLock()
+	defer m.RUnlock()
+	v, found := m.values[key]
+	return v, found, nil
+}
+
+// Commit applies the changes and stores the position.
+func (m *MemoryStore) Commit(changes map[string][]byte, position uint64) error {
+	m.Lock()
+	defer m.Unlock()
+	apply(m.values, changes)
+	m.position = position
+	return nil
+}
+
+// Position returns the position stored with the last commit.
+func (m *MemoryStore) Position() (uint64, error) {
+	m.RLock()
+	defer m.RUnlock()
+	return m.position, nil
+}
+
+// Reset deletes all keys and sets the position to zero.
+func (m *MemoryStore) Reset() error {
+	m.Lock()
+	defer m.Unlock()
+	m.values = map[string][]byte{}
+	m.position = 0
+	return nil
+}
+
+// Close does nothing.
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+func apply(values, changes map[string][]byte) {
+	for k, v := range changes {
+		if v == nil {
+			delete(values, k)
+		} else {
+			values[k] = v
+		}
+	}
+}
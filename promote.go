@@ -0,0 +1,27 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+func promote(args []string) error {
+	flags := flag.NewFlagSet("promote", flag.ExitOnError)
+	admin := flags.String("admin", "localhost:7001", "admin HTTP address of the follower")
+	flags.Parse(args)
+
+	res, err := http.Post(fmt.Sprintf("http://%s/promote", *admin), "text/plain", nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("promotion failed: %s", body)
+	}
+
+	return nil
+}
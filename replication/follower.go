@@ -0,0 +1,299 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/draganm/zathras/internal/frame"
+	"github.com/draganm/zathras/store"
+)
+
+// RetryInterval is the time follower waits before reconnecting to the leader
+// and between two checks for new topics on the leader.
+var RetryInterval = 500 * time.Millisecond
+
+// MaxRetryInterval limits the time follower waits before reconnecting to the
+// leader. The wait doubles from RetryInterval with every failed attempt.
+var MaxRetryInterval = 30 * time.Second
+
+// backoff is the time to wait before the next attempt to reach the leader.
+type backoff struct {
+	delay time.Duration
+}
+
+// next returns the time to wait after a failed attempt.
+func (b *backoff) next() time.Duration {
+	if b.delay == 0 {
+		b.delay = RetryInterval
+	} else {
+		b.delay *= 2
+	}
+	if b.delay > MaxRetryInterval {
+		b.delay = MaxRetryInterval
+	}
+	return b.delay
+}
+
+// reset starts over after a successful attempt.
+func (b *backoff) reset() {
+	b.delay = 0
+}
+
+// Follower replicates all topics of a leader into a local store.
+type Follower struct {
+	sync.Mutex
+	store         *store.Store
+	leaderAddress string
+	ctx           context.Context
+	cancel        context.CancelFunc
+	wg            sync.WaitGroup
+	leaderNext    map[string]uint64
+}
+
+// NewFollower creates a new follower and starts replicating from the leader.
+// The store should be opened with store.OpenReplica.
+func NewFollower(s *store.Store, leaderAddress string) *Follower {
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Follower{
+		store:         s,
+		leaderAddress: leaderAddress,
+		ctx:           ctx,
+		cancel:        cancel,
+		leaderNext:    map[string]uint64{},
+	}
+
+	f.wg.Add(1)
+	go f.discover()
+
+	return f
+}
+
+// dial connects to the leader and returns the connection with a function
+// closing it. The connection is also closed when the follower is closed.
+func (f *Follower) dial() (net.Conn, func(), error) {
+	var d net.Dialer
+	conn, err := d.DialContext(f.ctx, "tcp", f.leaderAddress)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-f.ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	return conn, func() {
+		close(done)
+		conn.Close()
+	}, nil
+}
+
+func (f *Follower) wait(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-f.ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (f *Follower) discover() {
+	defer f.wg.Done()
+	following := map[string]bool{}
+	var b backoff
+	for {
+		delay := RetryInterval
+		names, err := f.listTopics()
+		if err != nil && f.ctx.Err() == nil {
+			log.Println("Follower could not list topics", err)
+		}
+		if err != nil {
+			delay = b.next()
+		} else {
+			b.reset()
+		}
+		for _, name := range names {
+			if !following[name] {
+				following[name] = true
+				f.wg.Add(1)
+				go f.follow(name)
+			}
+		}
+		if !f.wait(delay) {
+			return
+		}
+	}
+}
+
+func (f *Follower) listTopics() ([]string, error) {
+	conn, closeConn, err := f.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer closeConn()
+
+	err = frame.Write(conn, msgListTopics, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	msgType, payload, err := frame.Read(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if msgType != msgTopics {
+		return nil, ErrUnexpectedMessage
+	}
+
+	return decodeTopics(payload), nil
+}
+
+func (f *Follower) follow(topicName string) {
+	defer f.wg.Done()
+	var b backoff
+	for {
+		err := f.replicate(topicName, &b)
+		if err != nil && f.ctx.Err() == nil {
+			log.Println("Follower replication error", topicName, err)
+		}
+		if err == ErrDiverged {
+			return
+		}
+		if !f.wait(b.next()) {
+			return
+		}
+	}
+}
+
+// replicate follows the topic on the leader until an error occurs. The
+// backoff is reset once the leader responds.
+func (f *Follower) replicate(topicName string, b *backoff) error {
+	t, err := f.store.Replicated(topicName)
+	if err != nil {
+		return err
+	}
+
+	conn, closeConn, err := f.dial()
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+
+	err = frame.Write(conn, msgFollow, encodeFollow(topicName, t.AppendAddress()))
+	if err != nil {
+		return err
+	}
+
+	for {
+		msgType, payload, err := frame.Read(conn)
+		if err != nil {
+			return err
+		}
+
+		if msgType != msgError {
+			b.reset()
+		}
+
+		switch msgType {
+		case msgHeartbeat:
+			leaderNext, err := decodeAddress(payload)
+			if err != nil {
+				return err
+			}
+			f.setLeaderNext(topicName, leaderNext)
+		case msgRecord:
+			leaderNext, nextAddress, data, err := decodeRecord(payload)
+			if err != nil {
+				return err
+			}
+			_, appended, err := t.AppendRecord(data)
+			if err != nil {
+				return err
+			}
+			if appended != nextAddress {
+				return ErrDiverged
+			}
+			f.setLeaderNext(topicName, leaderNext)
+			// only complete events are acknowledged
+			err = frame.Write(conn, msgAck, encodeAddress(t.NextAddress()))
+			if err != nil {
+				return err
+			}
+		case msgSchemas:
+			versions, err := decodeSchemas(payload)
+			if err != nil {
+				return err
+			}
+			err = t.ReplicateSchemas(versions)
+			if err != nil {
+				return err
+			}
+		case msgError:
+			if string(payload) == ErrDiverged.Error() {
+				return ErrDiverged
+			}
+			return errors.New(string(payload))
+		default:
+			return ErrUnexpectedMessage
+		}
+	}
+}
+
+func (f *Follower) setLeaderNext(topicName string, leaderNext uint64) {
+	f.Lock()
+	defer f.Unlock()
+	f.leaderNext[topicName] = leaderNext
+}
+
+// Lag returns the number of bytes the local copy of the topic is behind the
+// leader, as last reported by the leader.
+func (f *Follower) Lag(topicName string) (uint64, error) {
+	t, err := f.store.Replicated(topicName)
+	if err != nil {
+		return 0, err
+	}
+
+	f.Lock()
+	leaderNext := f.leaderNext[topicName]
+	f.Unlock()
+
+	nextAddress := t.NextAddress()
+	if leaderNext < nextAddress {
+		return 0, nil
+	}
+	return leaderNext - nextAddress, nil
+}
+
+// Close stops replication.
+func (f *Follower) Close() error {
+	f.cancel()
+	f.wg.Wait()
+	return nil
+}
+
+// Promote stops replication and starts serving the store as a leader on the
+// listener. Transactions that are still pending are resolved with the
+// replicated transaction log.
+func (f *Follower) Promote(listener net.Listener) (*Leader, error) {
+	err := f.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = f.store.ResolveTransactions()
+	if err != nil {
+		return nil, err
+	}
+	return NewLeader(f.store, listener), nil
+}
@@ -0,0 +1,313 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/draganm/zathras/internal/frame"
+	"github.com/draganm/zathras/store"
+)
+
+// ErrLeaderClosed is returned when writing to a leader that has been closed
+var ErrLeaderClosed = errors.New("Leader closed")
+
+type followerConn struct {
+	conn      net.Conn
+	topicName string
+	acked     uint64
+}
+
+// Leader serves topics of a store to followers connecting over TCP.
+type Leader struct {
+	store    *store.Store
+	listener net.Listener
+	m        *sync.Mutex
+	// changed is closed and replaced when followers ack or disconnect
+	changed   chan struct{}
+	followers map[*followerConn]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewLeader creates a new leader and starts accepting followers on the listener.
+func NewLeader(s *store.Store, listener net.Listener) *Leader {
+	l := &Leader{
+		store:     s,
+		listener:  listener,
+		m:         &sync.Mutex{},
+		changed:   make(chan struct{}),
+		followers: map[*followerConn]struct{}{},
+		conns:     map[net.Conn]struct{}{},
+	}
+
+	l.wg.Add(1)
+	go l.accept()
+
+	return l
+}
+
+// notify wakes up writers waiting for acks. Must be called with the lock held.
+func (l *Leader) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Addr returns the address the leader is listening on.
+func (l *Leader) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+func (l *Leader) accept() {
+	defer l.wg.Done()
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		l.m.Lock()
+		if l.closed {
+			l.m.Unlock()
+			conn.Close()
+			return
+		}
+		l.conns[conn] = struct{}{}
+		l.wg.Add(1)
+		l.m.Unlock()
+
+		go func() {
+			defer l.wg.Done()
+			err := l.serve(conn)
+			if err != nil {
+				log.Println("Replication connection error", err)
+			}
+			l.m.Lock()
+			delete(l.conns, conn)
+			l.m.Unlock()
+		}()
+	}
+}
+
+func (l *Leader) serve(conn net.Conn) error {
+	defer conn.Close()
+	for {
+		msgType, payload, err := frame.Read(conn)
+		if err != nil {
+			return nil
+		}
+		switch msgType {
+		case msgListTopics:
+			names := append(l.store.Names(), store.TransactionLogName)
+			err = frame.Write(conn, msgTopics, encodeTopics(names))
+			if err != nil {
+				return err
+			}
+		case msgFollow:
+			topicName, from, err := decodeFollow(payload)
+			if err != nil {
+				return err
+			}
+			return l.stream(conn, topicName, from)
+		default:
+			return ErrUnexpectedMessage
+		}
+	}
+}
+
+func (l *Leader) stream(conn net.Conn, topicName string, from uint64) error {
+	t, err := l.store.Replicated(topicName)
+	if err != nil {
+		frame.Write(conn, msgError, []byte(err.Error()))
+		return err
+	}
+
+	if from > t.NextAddress() {
+		frame.Write(conn, msgError, []byte(ErrDiverged.Error()))
+		return ErrDiverged
+	}
+
+	fc := &followerConn{
+		conn:      conn,
+		topicName: topicName,
+		acked:     from,
+	}
+
+	l.m.Lock()
+	l.followers[fc] = struct{}{}
+	l.notify()
+	l.m.Unlock()
+
+	defer func() {
+		l.m.Lock()
+		delete(l.followers, fc)
+		l.notify()
+		l.m.Unlock()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		defer cancel()
+		for {
+			msgType, payload, err := frame.Read(conn)
+			if err != nil {
+				return
+			}
+			if msgType != msgAck {
+				return
+			}
+			acked, err := decodeAddress(payload)
+			if err != nil {
+				return
+			}
+			l.m.Lock()
+			fc.acked = acked
+			l.notify()
+			l.m.Unlock()
+		}
+	}()
+
+	err = frame.Write(conn, msgHeartbeat, encodeAddress(t.NextAddress()))
+	if err != nil {
+		return err
+	}
+
+	// schema versions are registered before the events validated with them
+	// are written, so sending new versions before each record makes the
+	// follower have the schemas of all replicated events
+	schemaID := uint32(0)
+	sendSchemas := func() error {
+		current := t.CurrentSchemaID()
+		if current == schemaID {
+			return nil
+		}
+		payload, err := encodeSchemas(t.Schemas())
+		if err != nil {
+			return err
+		}
+		schemaID = current
+		return frame.Write(conn, msgSchemas, payload)
+	}
+
+	err = sendSchemas()
+	if err != nil {
+		return err
+	}
+
+	err = t.SubscribeRecords(ctx, from, func(nextAddress uint64, record []byte) error {
+		err := sendSchemas()
+		if err != nil {
+			return err
+		}
+		return frame.Write(conn, msgRecord, encodeRecord(t.NextAddress(), nextAddress, record))
+	})
+
+	if err == context.Canceled {
+		return nil
+	}
+
+	return err
+}
+
+// WriteEvent writes an event to the named topic. When followers is greater
+// than zero, WriteEvent returns only after that many followers have
+// acknowledged the event or the context is done.
+func (l *Leader) WriteEvent(ctx context.Context, topicName string, data []byte, followers int) (uint64, error) {
+	t, err := l.store.Topic(topicName)
+	if err != nil {
+		return 0, err
+	}
+
+	address, err := t.WriteEvent(data)
+	if err != nil {
+		return 0, err
+	}
+
+	err = l.WaitForAcks(ctx, topicName, address, followers)
+	if err != nil {
+		return 0, err
+	}
+
+	return address, nil
+}
+
+// WaitForAcks returns once that many followers of the topic have
+// acknowledged the event at the address, or the context is done.
+func (l *Leader) WaitForAcks(ctx context.Context, topicName string, address uint64, followers int) error {
+	for followers > 0 {
+		l.m.Lock()
+		closed, changed := l.closed, l.changed
+		acks := 0
+		for fc := range l.followers {
+			if fc.topicName == topicName && fc.acked > address {
+				acks++
+			}
+		}
+		l.m.Unlock()
+
+		if closed {
+			return ErrLeaderClosed
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if acks >= followers {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-changed:
+		}
+	}
+	return nil
+}
+
+// Lag returns the number of bytes each follower of the topic is behind the
+// leader, keyed by the follower's address.
+func (l *Leader) Lag(topicName string) (map[string]uint64, error) {
+	t, err := l.store.Topic(topicName)
+	if err != nil {
+		return nil, err
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	nextAddress := t.NextAddress()
+
+	lag := map[string]uint64{}
+	for fc := range l.followers {
+		if fc.topicName != topicName {
+			continue
+		}
+		// a follower can ack past the leader, e.g. after the leader restarted
+		if fc.acked >= nextAddress {
+			lag[fc.conn.RemoteAddr().String()] = 0
+			continue
+		}
+		lag[fc.conn.RemoteAddr().String()] = nextAddress - fc.acked
+	}
+
+	return lag, nil
+}
+
+// Close stops accepting followers and disconnects the connected ones.
+func (l *Leader) Close() error {
+	l.m.Lock()
+	l.closed = true
+	for conn := range l.conns {
+		conn.Close()
+	}
+	l.notify()
+	l.m.Unlock()
+
+	err := l.listener.Close()
+	l.wg.Wait()
+	return err
+}
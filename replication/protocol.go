@@ -0,0 +1,97 @@
+package replication
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/draganm/zathras/internal/frame"
+	"github.com/draganm/zathras/topic"
+)
+
+const (
+	msgListTopics byte = iota + 1
+	msgTopics
+	msgFollow
+	msgHeartbeat
+	msgRecord
+	msgAck
+	msgError
+	msgSchemas
+)
+
+// ErrFrameTooLarge is returned when a received frame is larger than the maximal frame size
+var ErrFrameTooLarge = frame.ErrTooLarge
+
+// ErrUnexpectedMessage is returned when the peer sends a message that is not valid at that point of the conversation
+var ErrUnexpectedMessage = errors.New("Unexpected message")
+
+// ErrDiverged is returned when the follower's copy of a topic does not match the leader's
+var ErrDiverged = errors.New("Follower diverged from leader")
+
+func encodeTopics(names []string) []byte {
+	return []byte(strings.Join(names, "\n"))
+}
+
+func decodeTopics(payload []byte) []string {
+	if len(payload) == 0 {
+		return nil
+	}
+	return strings.Split(string(payload), "\n")
+}
+
+func encodeFollow(topicName string, from uint64) []byte {
+	payload := make([]byte, 8+len(topicName))
+	binary.BigEndian.PutUint64(payload, from)
+	copy(payload[8:], topicName)
+	return payload
+}
+
+func decodeFollow(payload []byte) (string, uint64, error) {
+	if len(payload) < 8 {
+		return "", 0, ErrUnexpectedMessage
+	}
+	return string(payload[8:]), binary.BigEndian.Uint64(payload), nil
+}
+
+func encodeAddress(address uint64) []byte {
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, address)
+	return payload
+}
+
+func decodeAddress(payload []byte) (uint64, error) {
+	if len(payload) != 8 {
+		return 0, ErrUnexpectedMessage
+	}
+	return binary.BigEndian.Uint64(payload), nil
+}
+
+func encodeRecord(leaderNextAddress, nextAddress uint64, data []byte) []byte {
+	payload := make([]byte, 16+len(data))
+	binary.BigEndian.PutUint64(payload, leaderNextAddress)
+	binary.BigEndian.PutUint64(payload[8:], nextAddress)
+	copy(payload[16:], data)
+	return payload
+}
+
+func decodeRecord(payload []byte) (uint64, uint64, []byte, error) {
+	if len(payload) < 16 {
+		return 0, 0, nil, ErrUnexpectedMessage
+	}
+	return binary.BigEndian.Uint64(payload), binary.BigEndian.Uint64(payload[8:]), payload[16:], nil
+}
+
+func encodeSchemas(versions []topic.SchemaVersion) ([]byte, error) {
+	return json.Marshal(versions)
+}
+
+func decodeSchemas(payload []byte) ([]topic.SchemaVersion, error) {
+	versions := []topic.SchemaVersion{}
+	err := json.Unmarshal(payload, &versions)
+	if err != nil {
+		return nil, ErrUnexpectedMessage
+	}
+	return versions, nil
+}
@@ -0,0 +1,266 @@
+package replication_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"time"
+
+	"github.com/draganm/zathras/internal/frame"
+	"github.com/draganm/zathras/replication"
+	"github.com/draganm/zathras/schema"
+	"github.com/draganm/zathras/store"
+	"github.com/draganm/zathras/topic"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestReplication(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Replication Suite")
+}
+
+var _ = Describe("Replication", func() {
+	var leaderDir, followerDir string
+	var leaderStore, followerStore *store.Store
+	var leader *replication.Leader
+	var follower *replication.Follower
+
+	BeforeEach(func() {
+		replication.RetryInterval = 20 * time.Millisecond
+
+		var err error
+		leaderDir, err = ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+		followerDir, err = ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+
+		leaderStore, err = store.Open(leaderDir, 1024)
+		Expect(err).ToNot(HaveOccurred())
+		followerStore, err = store.OpenReplica(followerDir, 1024)
+		Expect(err).ToNot(HaveOccurred())
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+		leader = replication.NewLeader(leaderStore, listener)
+	})
+
+	AfterEach(func() {
+		if follower != nil {
+			Expect(follower.Close()).To(Succeed())
+			follower = nil
+		}
+		Expect(leader.Close()).To(Succeed())
+		Expect(leaderStore.Close()).To(Succeed())
+		Expect(followerStore.Close()).To(Succeed())
+		Expect(os.RemoveAll(leaderDir)).To(Succeed())
+		Expect(os.RemoveAll(followerDir)).To(Succeed())
+	})
+
+	readAll := func(s *store.Store, name string) []uint64 {
+		t, err := s.Topic(name)
+		Expect(err).ToNot(HaveOccurred())
+		addresses := []uint64{}
+		Expect(t.ReadEvents(func(nextAddress uint64, data []byte) error {
+			addresses = append(addresses, nextAddress)
+			return nil
+		})).To(Succeed())
+		return addresses
+	}
+
+	Context("When a follower acks past the end of the topic", func() {
+		It("Should report no lag", func() {
+			_, err := leader.WriteEvent(context.Background(), "t1", []byte("a"), 0)
+			Expect(err).ToNot(HaveOccurred())
+
+			conn, err := net.Dial("tcp", leader.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+
+			// follow t1 from 0, then ack an address the leader doesn't have
+			follow := make([]byte, 8, 10)
+			follow = append(follow, "t1"...)
+			Expect(frame.Write(conn, 3, follow)).To(Succeed())
+			ack := make([]byte, 8)
+			binary.BigEndian.PutUint64(ack, 1<<40)
+			Expect(frame.Write(conn, 6, ack)).To(Succeed())
+
+			Eventually(func() map[string]uint64 {
+				lag, err := leader.Lag("t1")
+				Expect(err).ToNot(HaveOccurred())
+				return lag
+			}).Should(ConsistOf(uint64(0)))
+		})
+	})
+
+	Context("When the leader has events before the follower starts", func() {
+		BeforeEach(func() {
+			for i := 0; i < 10; i++ {
+				_, err := leader.WriteEvent(context.Background(), "t1", make([]byte, 200), 0)
+				Expect(err).ToNot(HaveOccurred())
+			}
+			follower = replication.NewFollower(followerStore, leader.Addr().String())
+		})
+
+		It("Should replicate all events with the same addresses", func() {
+			Eventually(func() []uint64 {
+				return readAll(followerStore, "t1")
+			}).Should(Equal(readAll(leaderStore, "t1")))
+		})
+
+		It("Should eventually report no lag", func() {
+			Eventually(func() []uint64 {
+				return readAll(followerStore, "t1")
+			}).Should(HaveLen(10))
+			Expect(follower.Lag("t1")).To(Equal(uint64(0)))
+			Eventually(func() map[string]uint64 {
+				lag, err := leader.Lag("t1")
+				Expect(err).ToNot(HaveOccurred())
+				return lag
+			}).Should(ConsistOf(uint64(0)))
+		})
+
+		Context("When an event larger than a segment is written", func() {
+			It("Should replicate the whole event", func() {
+				large := make([]byte, 3000)
+				large[2999] = 1
+				address, err := leader.WriteEvent(context.Background(), "t1", large, 0)
+				Expect(err).ToNot(HaveOccurred())
+				t, err := followerStore.Topic("t1")
+				Expect(err).ToNot(HaveOccurred())
+				Eventually(func() []byte {
+					data, _, _ := t.Read(address)
+					return data
+				}).Should(Equal(large))
+			})
+		})
+
+		Context("When an event is written with one follower ack", func() {
+			It("Should be present on the follower when WriteEvent returns", func() {
+				Eventually(func() []uint64 {
+					return readAll(followerStore, "t1")
+				}).Should(HaveLen(10))
+
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				address, err := leader.WriteEvent(ctx, "t1", []byte("acked"), 1)
+				Expect(err).ToNot(HaveOccurred())
+
+				t, err := followerStore.Topic("t1")
+				Expect(err).ToNot(HaveOccurred())
+				data, _, err := t.Read(address)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(data).To(Equal([]byte("acked")))
+			})
+		})
+
+		Context("When the follower is promoted", func() {
+			var promoted *replication.Leader
+			BeforeEach(func() {
+				Eventually(func() []uint64 {
+					return readAll(followerStore, "t1")
+				}).Should(HaveLen(10))
+				listener, err := net.Listen("tcp", "127.0.0.1:0")
+				Expect(err).ToNot(HaveOccurred())
+				promoted, err = follower.Promote(listener)
+				Expect(err).ToNot(HaveOccurred())
+				follower = nil
+			})
+
+			AfterEach(func() {
+				Expect(promoted.Close()).To(Succeed())
+			})
+
+			It("Should stop replicating from the old leader", func() {
+				_, err := leader.WriteEvent(context.Background(), "t1", []byte("x"), 0)
+				Expect(err).ToNot(HaveOccurred())
+				Consistently(func() []uint64 {
+					return readAll(followerStore, "t1")
+				}, 100*time.Millisecond).Should(HaveLen(10))
+			})
+
+			It("Should accept writes", func() {
+				_, err := promoted.WriteEvent(context.Background(), "t1", []byte("x"), 0)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(readAll(followerStore, "t1")).To(HaveLen(11))
+			})
+		})
+	})
+
+	Context("When a transaction is committed on the leader", func() {
+		BeforeEach(func() {
+			tx := leaderStore.Begin()
+			Expect(tx.WriteEvent("t1", []byte("a"))).To(Succeed())
+			Expect(tx.WriteEvent("t2", []byte("b"))).To(Succeed())
+			_, err := tx.Commit()
+			Expect(err).ToNot(HaveOccurred())
+			follower = replication.NewFollower(followerStore, leader.Addr().String())
+		})
+
+		It("Should replicate the transaction log", func() {
+			transactions, err := followerStore.Replicated(store.TransactionLogName)
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(transactions.NextAddress).Should(BeNumerically(">", 0))
+			Eventually(func() []uint64 {
+				return readAll(followerStore, "t2")
+			}).Should(Equal(readAll(leaderStore, "t2")))
+		})
+	})
+
+	Context("When the topic on the leader has a schema", func() {
+		var id uint32
+		BeforeEach(func() {
+			t, err := leaderStore.Topic("t1")
+			Expect(err).ToNot(HaveOccurred())
+			id, err = t.RegisterSchema(schema.JSON, []byte(`{"type": "object", "required": ["id"]}`), schema.Backward)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = leader.WriteEvent(context.Background(), "t1", []byte(`{"id": 1}`), 0)
+			Expect(err).ToNot(HaveOccurred())
+			follower = replication.NewFollower(followerStore, leader.Addr().String())
+			Eventually(func() []uint64 {
+				return readAll(followerStore, "t1")
+			}).Should(HaveLen(1))
+		})
+
+		It("Should replicate the schema", func() {
+			t, err := followerStore.Topic("t1")
+			Expect(err).ToNot(HaveOccurred())
+			v, err := t.Schema(id)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(v.Definition).To(Equal([]byte(`{"type": "object", "required": ["id"]}`)))
+		})
+
+		Context("When the follower is promoted", func() {
+			var promoted *replication.Leader
+			BeforeEach(func() {
+				listener, err := net.Listen("tcp", "127.0.0.1:0")
+				Expect(err).ToNot(HaveOccurred())
+				promoted, err = follower.Promote(listener)
+				Expect(err).ToNot(HaveOccurred())
+				follower = nil
+			})
+
+			AfterEach(func() {
+				Expect(promoted.Close()).To(Succeed())
+			})
+
+			It("Should reject events not matching the schema", func() {
+				_, err := promoted.WriteEvent(context.Background(), "t1", []byte(`{}`), 0)
+				Expect(err).To(BeAssignableToTypeOf(&topic.InvalidEventError{}))
+			})
+		})
+	})
+
+	Context("When waiting for an ack without followers", func() {
+		It("Should return the context error", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, err := leader.WriteEvent(ctx, "t1", []byte("x"), 1)
+			Expect(err).To(Equal(context.DeadlineExceeded))
+		})
+	})
+})
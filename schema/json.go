@@ -0,0 +1,571 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// JSON is the type of JSON Schema schemas. The supported keywords are type,
+// enum, const, properties, required, additionalProperties, items, minimum,
+// maximum, exclusiveMinimum, exclusiveMaximum, minLength, maxLength,
+// pattern, minItems and maxItems. Annotations such as title and description
+// are ignored; other keywords are rejected.
+const JSON = "json"
+
+func init() {
+	Register(JSON, ParseJSON)
+}
+
+var jsonTypes = map[string]bool{
+	"null":    true,
+	"boolean": true,
+	"object":  true,
+	"array":   true,
+	"number":  true,
+	"integer": true,
+	"string":  true,
+}
+
+var jsonAnnotations = map[string]bool{
+	"$schema":     true,
+	"$id":         true,
+	"$comment":    true,
+	"title":       true,
+	"description": true,
+	"default":     true,
+	"examples":    true,
+	"format":      true,
+	"readOnly":    true,
+	"writeOnly":   true,
+	"deprecated":  true,
+}
+
+type jsonSchema struct {
+	// never is true for the false schema that matches nothing.
+	never bool
+	// types is nil when values of all types are allowed.
+	types []string
+	// enum is nil when all values are allowed. const is stored as a one value enum.
+	enum       []interface{}
+	properties map[string]*jsonSchema
+	required   []string
+	// noAdditional is true when properties other than the defined ones are
+	// not allowed; otherwise additional is their schema, nil for any value.
+	noAdditional     bool
+	additional       *jsonSchema
+	items            *jsonSchema
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	minLength        *int
+	maxLength        *int
+	pattern          *regexp.Regexp
+	minItems         *int
+	maxItems         *int
+}
+
+// ParseJSON parses a JSON Schema definition.
+func ParseJSON(definition []byte) (Schema, error) {
+	var v interface{}
+	err := json.Unmarshal(definition, &v)
+	if err != nil {
+		return nil, &DefinitionError{Path: "$", Message: err.Error()}
+	}
+	return parseJSONSchema(v, "$")
+}
+
+func parseJSONSchema(v interface{}, path string) (*jsonSchema, error) {
+	switch v := v.(type) {
+	case bool:
+		return &jsonSchema{never: !v}, nil
+	case map[string]interface{}:
+		s := &jsonSchema{}
+		keywords := make([]string, 0, len(v))
+		for k := range v {
+			keywords = append(keywords, k)
+		}
+		sort.Strings(keywords)
+		for _, k := range keywords {
+			err := s.parseKeyword(k, v[k], path)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	}
+	return nil, &DefinitionError{Path: path, Message: "schema must be an object or a boolean"}
+}
+
+func (s *jsonSchema) parseKeyword(keyword string, v interface{}, path string) error {
+	invalid := func(message string) error {
+		return &DefinitionError{Path: path, Message: fmt.Sprintf("%s %s", keyword, message)}
+	}
+
+	var err error
+	switch keyword {
+	case "type":
+		switch t := v.(type) {
+		case string:
+			s.types = []string{t}
+		case []interface{}:
+			s.types = []string{}
+			for _, e := range t {
+				name, isString := e.(string)
+				if !isString {
+					return invalid("must be a string or an array of strings")
+				}
+				s.types = append(s.types, name)
+			}
+		default:
+			return invalid("must be a string or an array of strings")
+		}
+		for _, t := range s.types {
+			if !jsonTypes[t] {
+				return invalid("has an unknown type " + t)
+			}
+		}
+	case "enum":
+		values, isArray := v.([]interface{})
+		if !isArray {
+			return invalid("must be an array")
+		}
+		s.enum = values
+	case "const":
+		s.enum = []interface{}{v}
+	case "properties":
+		properties, isObject := v.(map[string]interface{})
+		if !isObject {
+			return invalid("must be an object")
+		}
+		s.properties = map[string]*jsonSchema{}
+		for name, p := range properties {
+			s.properties[name], err = parseJSONSchema(p, path+"."+name)
+			if err != nil {
+				return err
+			}
+		}
+	case "required":
+		names, isArray := v.([]interface{})
+		if !isArray {
+			return invalid("must be an array of strings")
+		}
+		for _, n := range names {
+			name, isString := n.(string)
+			if !isString {
+				return invalid("must be an array of strings")
+			}
+			s.required = append(s.required, name)
+		}
+	case "additionalProperties":
+		if allowed, isBool := v.(bool); isBool {
+			s.noAdditional = !allowed
+			return nil
+		}
+		s.additional, err = parseJSONSchema(v, path+".*")
+		return err
+	case "items":
+		s.items, err = parseJSONSchema(v, path+"[]")
+		return err
+	case "minimum":
+		s.minimum, err = parseNumber(v, invalid)
+	case "maximum":
+		s.maximum, err = parseNumber(v, invalid)
+	case "exclusiveMinimum":
+		s.exclusiveMinimum, err = parseNumber(v, invalid)
+	case "exclusiveMaximum":
+		s.exclusiveMaximum, err = parseNumber(v, invalid)
+	case "minLength":
+		s.minLength, err = parseCount(v, invalid)
+	case "maxLength":
+		s.maxLength, err = parseCount(v, invalid)
+	case "minItems":
+		s.minItems, err = parseCount(v, invalid)
+	case "maxItems":
+		s.maxItems, err = parseCount(v, invalid)
+	case "pattern":
+		source, isString := v.(string)
+		if !isString {
+			return invalid("must be a string")
+		}
+		s.pattern, err = regexp.Compile(source)
+		if err != nil {
+			return invalid(err.Error())
+		}
+	default:
+		if !jsonAnnotations[keyword] {
+			return invalid("is not supported")
+		}
+	}
+	return err
+}
+
+func parseNumber(v interface{}, invalid func(string) error) (*float64, error) {
+	f, isNumber := v.(float64)
+	if !isNumber {
+		return nil, invalid("must be a number")
+	}
+	return &f, nil
+}
+
+func parseCount(v interface{}, invalid func(string) error) (*int, error) {
+	f, isNumber := v.(float64)
+	if !isNumber || f < 0 || f != math.Trunc(f) {
+		return nil, invalid("must be a non-negative integer")
+	}
+	n := int(f)
+	return &n, nil
+}
+
+// Validate checks that the data is JSON matching the schema.
+func (s *jsonSchema) Validate(data []byte) error {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	err := d.Decode(&v)
+	if err == nil && d.More() {
+		err = fmt.Errorf("data after the JSON value")
+	}
+	if err != nil {
+		return &ValidationError{Path: "$", Message: err.Error()}
+	}
+	return s.validate(v, "$")
+}
+
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	}
+	return "string"
+}
+
+// allows returns true when values of the type are allowed.
+func (s *jsonSchema) allows(t string) bool {
+	if s.never {
+		return false
+	}
+	if s.types == nil {
+		return true
+	}
+	for _, allowed := range s.types {
+		if allowed == t || allowed == "number" && t == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *jsonSchema) validate(v interface{}, path string) error {
+	invalid := func(format string, args ...interface{}) error {
+		return &ValidationError{Path: path, Message: fmt.Sprintf(format, args...)}
+	}
+
+	if s.never {
+		return invalid("no value is allowed")
+	}
+
+	t := jsonType(v)
+	if !s.allows(t) {
+		return invalid("%s is not one of the types %v", t, s.types)
+	}
+
+	if s.enum != nil {
+		found := false
+		for _, e := range s.enum {
+			if reflect.DeepEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return invalid("value is not one of the allowed values")
+		}
+	}
+
+	switch v := v.(type) {
+	case float64:
+		if s.minimum != nil && v < *s.minimum {
+			return invalid("%v is less than %v", v, *s.minimum)
+		}
+		if s.exclusiveMinimum != nil && v <= *s.exclusiveMinimum {
+			return invalid("%v is not greater than %v", v, *s.exclusiveMinimum)
+		}
+		if s.maximum != nil && v > *s.maximum {
+			return invalid("%v is greater than %v", v, *s.maximum)
+		}
+		if s.exclusiveMaximum != nil && v >= *s.exclusiveMaximum {
+			return invalid("%v is not less than %v", v, *s.exclusiveMaximum)
+		}
+	case string:
+		length := utf8.RuneCountInString(v)
+		if s.minLength != nil && length < *s.minLength {
+			return invalid("string is shorter than %d", *s.minLength)
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			return invalid("string is longer than %d", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return invalid("string does not match %s", s.pattern)
+		}
+	case []interface{}:
+		if s.minItems != nil && len(v) < *s.minItems {
+			return invalid("array has less than %d items", *s.minItems)
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			return invalid("array has more than %d items", *s.maxItems)
+		}
+		if s.items != nil {
+			for i, e := range v {
+				err := s.items.validate(e, path+"["+strconv.Itoa(i)+"]")
+				if err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, found := v[name]; !found {
+				return invalid("required property %s is missing", name)
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			p, defined := s.properties[name]
+			switch {
+			case defined:
+				err := p.validate(v[name], path+"."+name)
+				if err != nil {
+					return err
+				}
+			case s.noAdditional:
+				return invalid("property %s is not allowed", name)
+			case s.additional != nil:
+				err := s.additional.validate(v[name], path+"."+name)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// anything is the schema that allows all values.
+var anything = &jsonSchema{}
+
+// Accepts checks that all values valid under the other schema are valid under this one.
+func (s *jsonSchema) Accepts(other Schema) error {
+	o, isJSON := other.(*jsonSchema)
+	if !isJSON {
+		return &IncompatibleError{Path: "$", Message: "schemas have different types"}
+	}
+	return s.accepts(o, "$")
+}
+
+func (s *jsonSchema) accepts(o *jsonSchema, path string) error {
+	incompatible := func(format string, args ...interface{}) error {
+		return &IncompatibleError{Path: path, Message: fmt.Sprintf(format, args...)}
+	}
+
+	if o.never {
+		return nil
+	}
+
+	// the values of an enum can be checked one by one
+	if o.enum != nil {
+		for _, e := range o.enum {
+			if o.validate(e, path) != nil {
+				continue
+			}
+			if s.validate(e, path) != nil {
+				return incompatible("value %v is not allowed", e)
+			}
+		}
+		return nil
+	}
+
+	if s.never {
+		return incompatible("no value is allowed")
+	}
+
+	if s.enum != nil {
+		return incompatible("values are limited to an enum")
+	}
+
+	for t := range jsonTypes {
+		if o.allows(t) && !s.allows(t) {
+			return incompatible("%s values are not allowed", t)
+		}
+	}
+
+	if o.allows("integer") {
+		err := acceptsLowerBound(s, o)
+		if err == nil {
+			err = acceptsUpperBound(s, o)
+		}
+		if err != nil {
+			return incompatible("%s", err)
+		}
+	}
+
+	if o.allows("string") {
+		if !acceptsMin(s.minLength, o.minLength) || !acceptsMax(s.maxLength, o.maxLength) {
+			return incompatible("string length is more limited")
+		}
+		if s.pattern != nil && (o.pattern == nil || o.pattern.String() != s.pattern.String()) {
+			return incompatible("strings must match %s", s.pattern)
+		}
+	}
+
+	if o.allows("array") {
+		if !acceptsMin(s.minItems, o.minItems) || !acceptsMax(s.maxItems, o.maxItems) {
+			return incompatible("number of items is more limited")
+		}
+		if s.items != nil {
+			items := o.items
+			if items == nil {
+				items = anything
+			}
+			err := s.items.accepts(items, path+"[]")
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if o.allows("object") {
+		return s.acceptsObject(o, path)
+	}
+
+	return nil
+}
+
+// acceptsObject checks the properties of objects. Like in other schema
+// registries, properties that a schema doesn't define and doesn't give an
+// additionalProperties schema for are assumed not to be used, so that
+// optional properties can be added without breaking compatibility.
+func (s *jsonSchema) acceptsObject(o *jsonSchema, path string) error {
+	incompatible := func(format string, args ...interface{}) error {
+		return &IncompatibleError{Path: path, Message: fmt.Sprintf(format, args...)}
+	}
+
+	for _, name := range s.required {
+		if !contains(o.required, name) {
+			return incompatible("property %s is required", name)
+		}
+	}
+
+	names := []string{}
+	for name := range s.properties {
+		names = append(names, name)
+	}
+	for name := range o.properties {
+		if _, found := s.properties[name]; !found {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		// the schemas of the property, or of additional properties when it is not defined
+		p, defined := s.properties[name]
+		if !defined {
+			if s.noAdditional {
+				return incompatible("property %s is not allowed", name)
+			}
+			p = s.additional
+		}
+		op, otherDefined := o.properties[name]
+		if !otherDefined {
+			if o.additional == nil {
+				continue
+			}
+			op = o.additional
+		}
+		if p == nil {
+			continue
+		}
+		err := p.accepts(op, path+"."+name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if o.additional == nil {
+		return nil
+	}
+
+	if s.noAdditional {
+		return incompatible("additional properties are not allowed")
+	}
+
+	if s.additional != nil {
+		return s.additional.accepts(o.additional, path+".*")
+	}
+
+	return nil
+}
+
+// acceptsLowerBound checks that the lower bound of o is not below the one of s.
+func acceptsLowerBound(s, o *jsonSchema) error {
+	if s.minimum != nil && !(o.minimum != nil && *o.minimum >= *s.minimum || o.exclusiveMinimum != nil && *o.exclusiveMinimum >= *s.minimum) {
+		return fmt.Errorf("numbers must not be less than %v", *s.minimum)
+	}
+	if s.exclusiveMinimum != nil && !(o.minimum != nil && *o.minimum > *s.exclusiveMinimum || o.exclusiveMinimum != nil && *o.exclusiveMinimum >= *s.exclusiveMinimum) {
+		return fmt.Errorf("numbers must be greater than %v", *s.exclusiveMinimum)
+	}
+	return nil
+}
+
+// acceptsUpperBound checks that the upper bound of o is not above the one of s.
+func acceptsUpperBound(s, o *jsonSchema) error {
+	if s.maximum != nil && !(o.maximum != nil && *o.maximum <= *s.maximum || o.exclusiveMaximum != nil && *o.exclusiveMaximum <= *s.maximum) {
+		return fmt.Errorf("numbers must not be greater than %v", *s.maximum)
+	}
+	if s.exclusiveMaximum != nil && !(o.maximum != nil && *o.maximum < *s.exclusiveMaximum || o.exclusiveMaximum != nil && *o.exclusiveMaximum <= *s.exclusiveMaximum) {
+		return fmt.Errorf("numbers must be less than %v", *s.exclusiveMaximum)
+	}
+	return nil
+}
+
+// acceptsMin checks that the minimum of o is not below the minimum of s.
+func acceptsMin(s, o *int) bool {
+	return s == nil || o != nil && *o >= *s
+}
+
+// acceptsMax checks that the maximum of o is not above the maximum of s.
+func acceptsMax(s, o *int) bool {
+	return s == nil || o != nil && *o <= *s
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+// Package schema validates events against schemas and checks whether a new
+// version of a schema is compatible with the previous one. JSON Schema is
+// built in, other schema types can be added with Register.
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrUnknownType is returned when parsing a schema of a type that is not registered
+var ErrUnknownType = errors.New("Unknown schema type")
+
+// DefinitionError is returned when a schema definition can't be parsed.
+type DefinitionError struct {
+	Path    string
+	Message string
+}
+
+func (e *DefinitionError) Error() string {
+	return fmt.Sprintf("Invalid schema at %s: %s", e.Path, e.Message)
+}
+
+// ValidationError is returned when data does not match a schema.
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("Invalid value at %s: %s", e.Path, e.Message)
+}
+
+// IncompatibleError is returned when a schema is not compatible with the previous version.
+type IncompatibleError struct {
+	Path    string
+	Message string
+}
+
+func (e *IncompatibleError) Error() string {
+	return fmt.Sprintf("Incompatible schema at %s: %s", e.Path, e.Message)
+}
+
+// Schema validates data.
+type Schema interface {
+	// Validate returns a *ValidationError when the data does not match the schema.
+	Validate(data []byte) error
+	// Accepts returns nil when all data valid under the other schema is valid
+	// under this one, and an *IncompatibleError otherwise. Schema types
+	// document where their check is more lenient or stricter than that.
+	Accepts(other Schema) error
+}
+
+// Parser parses a schema definition.
+type Parser func(definition []byte) (Schema, error)
+
+var parsersLock sync.RWMutex
+var parsers = map[string]Parser{}
+
+// Register makes schemas of the type available. It panics if the type is already registered.
+func Register(schemaType string, p Parser) {
+	parsersLock.Lock()
+	defer parsersLock.Unlock()
+	if _, found := parsers[schemaType]; found {
+		panic(fmt.Sprintf("schema: type %s registered twice", schemaType))
+	}
+	parsers[schemaType] = p
+}
+
+// Parse parses the definition of a schema of the type.
+func Parse(schemaType string, definition []byte) (Schema, error) {
+	parsersLock.RLock()
+	p, found := parsers[schemaType]
+	parsersLock.RUnlock()
+	if !found {
+		return nil, ErrUnknownType
+	}
+	return p(definition)
+}
+
+// Compatibility is the relation a new version of a schema must have with the previous one.
+type Compatibility string
+
+const (
+	// None accepts any new version.
+	None Compatibility = "none"
+	// Backward requires that data written with the previous version is valid
+	// under the new one, so that consumers can be upgraded first.
+	Backward Compatibility = "backward"
+	// Forward requires that data written with the new version is valid under
+	// the previous one, so that producers can be upgraded first.
+	Forward Compatibility = "forward"
+	// Full requires backward and forward compatibility.
+	Full Compatibility = "full"
+)
+
+// ErrUnknownCompatibility is returned for compatibilities other than the defined ones
+var ErrUnknownCompatibility = errors.New("Unknown compatibility")
+
+// Check checks that the next version of a schema has the compatibility with the previous one.
+func Check(c Compatibility, previous, next Schema) error {
+	switch c {
+	case None:
+		return nil
+	case Backward:
+		return next.Accepts(previous)
+	case Forward:
+		return previous.Accepts(next)
+	case Full:
+		err := next.Accepts(previous)
+		if err != nil {
+			return err
+		}
+		return previous.Accepts(next)
+	}
+	return ErrUnknownCompatibility
+}
@@ -0,0 +1,140 @@
+package schema_test
+
+import (
+	"github.com/draganm/zathras/schema"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestSchema(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Schema Suite")
+}
+
+func parse(definition string) schema.Schema {
+	s, err := schema.Parse(schema.JSON, []byte(definition))
+	Expect(err).ToNot(HaveOccurred())
+	return s
+}
+
+var _ = Describe("JSON schemas", func() {
+	order := `{
+		"type": "object",
+		"properties": {
+			"id": {"type": "integer", "minimum": 1},
+			"status": {"enum": ["placed", "shipped"]},
+			"customer": {"type": "string", "minLength": 1, "pattern": "^c-"},
+			"items": {"type": "array", "items": {"type": "string"}, "maxItems": 2}
+		},
+		"required": ["id"],
+		"additionalProperties": false
+	}`
+
+	Describe("Validate()", func() {
+		valid := []string{
+			`{"id": 1}`,
+			`{"id": 2, "status": "shipped", "customer": "c-1", "items": ["a", "b"]}`,
+		}
+
+		invalid := map[string]string{
+			`{"status": "placed"}`:                "$",
+			`{"id": 1.5}`:                         "$.id",
+			`{"id": 0}`:                           "$.id",
+			`{"id": 1, "status": "x"}`:            "$.status",
+			`{"id": 1, "customer": ""}`:           "$.customer",
+			`{"id": 1, "customer": "x"}`:          "$.customer",
+			`{"id": 1, "items": [1]}`:             "$.items[0]",
+			`{"id": 1, "items": ["a", "b", "c"]}`: "$.items",
+			`{"id": 1, "other": true}`:            "$",
+			`[]`:                                  "$",
+			`not json`:                            "$",
+		}
+
+		It("Should accept valid values", func() {
+			s := parse(order)
+			for _, v := range valid {
+				Expect(s.Validate([]byte(v))).To(Succeed(), v)
+			}
+		})
+
+		It("Should reject invalid values with the path of the error", func() {
+			s := parse(order)
+			for v, path := range invalid {
+				err := s.Validate([]byte(v))
+				Expect(err).To(BeAssignableToTypeOf(&schema.ValidationError{}), v)
+				Expect(err.(*schema.ValidationError).Path).To(Equal(path), v)
+			}
+		})
+	})
+
+	Describe("Parse()", func() {
+		It("Should reject unsupported keywords", func() {
+			_, err := schema.Parse(schema.JSON, []byte(`{"properties": {"a": {"$ref": "#/b"}}}`))
+			Expect(err).To(Equal(&schema.DefinitionError{Path: "$.a", Message: "$ref is not supported"}))
+		})
+
+		It("Should reject unknown types", func() {
+			_, err := schema.Parse("avro", []byte(`{}`))
+			Expect(err).To(Equal(schema.ErrUnknownType))
+		})
+	})
+
+	Describe("Check()", func() {
+		compatible := func(c schema.Compatibility, previous, next string) error {
+			return schema.Check(c, parse(previous), parse(next))
+		}
+
+		It("Should allow adding an optional property when backward compatible", func() {
+			Expect(compatible(schema.Backward,
+				`{"type": "object", "properties": {"id": {"type": "integer"}}, "required": ["id"]}`,
+				`{"type": "object", "properties": {"id": {"type": "integer"}, "note": {"type": "string"}}, "required": ["id"]}`,
+			)).To(Succeed())
+		})
+
+		It("Should reject adding a required property when backward compatible", func() {
+			err := compatible(schema.Backward,
+				`{"type": "object", "properties": {"id": {"type": "integer"}}}`,
+				`{"type": "object", "properties": {"id": {"type": "integer"}, "note": {"type": "string"}}, "required": ["note"]}`,
+			)
+			Expect(err).To(Equal(&schema.IncompatibleError{Path: "$", Message: "property note is required"}))
+		})
+
+		It("Should allow adding a required property when forward compatible", func() {
+			Expect(compatible(schema.Forward,
+				`{"type": "object", "properties": {"id": {"type": "integer"}}}`,
+				`{"type": "object", "properties": {"id": {"type": "integer"}, "note": {"type": "string"}}, "required": ["note"]}`,
+			)).To(Succeed())
+		})
+
+		It("Should reject removing an enum value when backward compatible", func() {
+			err := compatible(schema.Backward,
+				`{"type": "object", "properties": {"status": {"enum": ["placed", "shipped"]}}}`,
+				`{"type": "object", "properties": {"status": {"enum": ["placed"]}}}`,
+			)
+			Expect(err).To(BeAssignableToTypeOf(&schema.IncompatibleError{}))
+			Expect(err.(*schema.IncompatibleError).Path).To(Equal("$.status"))
+		})
+
+		It("Should reject narrowing a number type", func() {
+			err := compatible(schema.Backward,
+				`{"type": "number", "minimum": 0}`,
+				`{"type": "integer", "minimum": 0}`,
+			)
+			Expect(err).To(HaveOccurred())
+			Expect(compatible(schema.Forward,
+				`{"type": "number", "minimum": 0}`,
+				`{"type": "integer", "minimum": 0}`,
+			)).To(Succeed())
+		})
+
+		It("Should require both directions when fully compatible", func() {
+			previous := `{"type": "object", "properties": {"a": {"type": "string"}}, "additionalProperties": false}`
+			next := `{"type": "object", "properties": {"a": {"type": "string"}, "b": {"type": "string"}}, "additionalProperties": false}`
+			Expect(compatible(schema.Backward, previous, next)).To(Succeed())
+			Expect(compatible(schema.Full, previous, next)).To(HaveOccurred())
+			Expect(compatible(schema.None, previous, next)).To(Succeed())
+		})
+	})
+})
@@ -0,0 +1,215 @@
+package segment
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ErrDecryptionFailed is returned when an encrypted record can't be authenticated with its key
+var ErrDecryptionFailed = errors.New("Record decryption failed")
+
+// KeyNotFoundError is returned when a record is encrypted with a key the key provider does not have.
+type KeyNotFoundError struct {
+	KeyID uint32
+}
+
+func (e *KeyNotFoundError) Error() string {
+	return fmt.Sprintf("Encryption key %d not found", e.KeyID)
+}
+
+// KeyProvider provides AES keys (16, 24 or 32 bytes long) for encryption of records.
+type KeyProvider interface {
+	// CurrentKey returns the key used to encrypt new records.
+	CurrentKey() (uint32, []byte, error)
+	// Key returns the key with the id or a *KeyNotFoundError.
+	Key(id uint32) ([]byte, error)
+}
+
+// encryptedFlag is set in the length of encrypted records.
+// An encrypted record is [u32 key id][nonce][ciphertext with tag].
+const encryptedFlag = 1 << 31
+
+const nonceSize = 12
+
+// encryptionOverhead is the number of bytes encryption adds to a record.
+const encryptionOverhead = 4 + nonceSize + 16
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// additionalData binds the record to its address in the topic, the start
+// address of the segment plus the address of the record in the segment.
+func additionalData(address uint64) []byte {
+	ad := make([]byte, 8)
+	binary.BigEndian.PutUint64(ad, address)
+	return ad
+}
+
+// encrypt returns the encrypted record data for the address in the topic with the current key.
+func encrypt(keys KeyProvider, address uint64, plain []byte) ([]byte, error) {
+	id, key, err := keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, nonceSize)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, 4, encryptionOverhead+len(plain))
+	binary.BigEndian.PutUint32(data, id)
+	data = append(data, nonce...)
+
+	return gcm.Seal(data, nonce, plain, additionalData(address)), nil
+}
+
+func decrypt(keys KeyProvider, address uint64, data []byte) ([]byte, error) {
+	if len(data) < encryptionOverhead {
+		return nil, ErrSegmentCorrupted
+	}
+
+	id := binary.BigEndian.Uint32(data)
+	if keys == nil {
+		return nil, &KeyNotFoundError{KeyID: id}
+	}
+
+	key, err := keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := gcm.Open(nil, data[4:4+nonceSize], data[4+nonceSize:], additionalData(address))
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+
+	return plain, nil
+}
+
+// Reencrypt rewrites all encrypted records of a segment file starting at the
+// address in its topic with the current key of the provider. Unencrypted
+// records are kept as they are, so that all records stay at their addresses.
+// The segment must not be open for writing. It returns the number of
+// re-encrypted records.
+func Reencrypt(fileName string, startAddress uint64, keys KeyProvider) (int, error) {
+	tmpFileName := fileName + ".tmp"
+	count, err := ReencryptTo(fileName, tmpFileName, startAddress, keys)
+	if err != nil || count == 0 {
+		return 0, err
+	}
+
+	err = os.Rename(tmpFileName, fileName)
+	if err != nil {
+		return 0, err
+	}
+
+	err = SyncDir(filepath.Dir(fileName))
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// ReencryptTo writes the segment file starting at the address in its topic
+// with all encrypted records re-encrypted with the current key to the synced
+// file toFileName, which replaces the
+// segment file once renamed. Nothing is written when no record has to be
+// re-encrypted. It returns the number of re-encrypted records.
+func ReencryptTo(fileName, toFileName string, startAddress uint64, keys KeyProvider) (int, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := ReencryptData(data, startAddress, keys)
+	if err != nil || count == 0 {
+		return 0, err
+	}
+
+	f, err := os.OpenFile(toFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0700)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(toFileName)
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// ReencryptData re-encrypts the encrypted records of the segment data starting
+// at the address in its topic in place with the current key of the provider.
+// It returns the number of re-encrypted records.
+func ReencryptData(data []byte, startAddress uint64, keys KeyProvider) (int, error) {
+	currentID, _, err := keys.CurrentKey()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for address := uint64(0); address < uint64(len(data)); {
+		if address+4 > uint64(len(data)) {
+			return 0, ErrSegmentCorrupted
+		}
+		raw := binary.BigEndian.Uint32(data[address:])
+		sz := uint64(raw & lengthMask)
+		next := address + 4 + sz
+		if raw&trailerFlag != 0 {
+			next += 4
+		}
+		if next > uint64(len(data)) {
+			return 0, ErrSegmentCorrupted
+		}
+		record := data[address+4 : address+4+sz]
+		if raw&encryptedFlag != 0 && len(record) >= 4 && binary.BigEndian.Uint32(record) != currentID {
+			plain, err := decrypt(keys, startAddress+address, record)
+			if err != nil {
+				return 0, err
+			}
+			encrypted, err := encrypt(keys, startAddress+address, plain)
+			if err != nil {
+				return 0, err
+			}
+			copy(record, encrypted)
+			count++
+		}
+		address = next
+	}
+
+	return count, nil
+}
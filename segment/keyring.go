@@ -0,0 +1,164 @@
+package segment
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// ErrNoCurrentKey is returned when encrypting with a keyring without keys
+var ErrNoCurrentKey = errors.New("No current encryption key")
+
+// ErrInvalidKey is returned when adding a key that is not a valid AES key
+var ErrInvalidKey = errors.New("Invalid encryption key")
+
+// Keyring is a KeyProvider holding keys in memory. It can be stored in a file.
+// Rotating the keyring changes the key of new records immediately.
+type Keyring struct {
+	sync.RWMutex
+	current uint32
+	keys    map[uint32][]byte
+}
+
+type keyringFile struct {
+	Current uint32            `json:"current"`
+	Keys    map[uint32][]byte `json:"keys"`
+}
+
+// NewKeyring returns an empty keyring.
+func NewKeyring() *Keyring {
+	return &Keyring{keys: map[uint32][]byte{}}
+}
+
+// LoadKeyring reads the keyring from the file.
+func LoadKeyring(fileName string) (*Keyring, error) {
+	k := NewKeyring()
+	err := k.Load(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Load replaces the keys with the keys stored in the file.
+func (k *Keyring) Load(fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+
+	kf := keyringFile{}
+	err = json.Unmarshal(data, &kf)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range kf.Keys {
+		if !validKey(key) {
+			return ErrInvalidKey
+		}
+	}
+
+	if kf.Keys == nil {
+		kf.Keys = map[uint32][]byte{}
+	}
+
+	k.Lock()
+	defer k.Unlock()
+	k.current = kf.Current
+	k.keys = kf.Keys
+	return nil
+}
+
+// Save writes the keyring to the file.
+func (k *Keyring) Save(fileName string) error {
+	k.RLock()
+	data, err := json.Marshal(keyringFile{Current: k.current, Keys: k.keys})
+	k.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	tmpFileName := fileName + ".tmp"
+	err = ioutil.WriteFile(tmpFileName, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFileName, fileName)
+}
+
+func validKey(key []byte) bool {
+	switch len(key) {
+	case 16, 24, 32:
+		return true
+	}
+	return false
+}
+
+// Add adds the key with the id and makes it the current key.
+func (k *Keyring) Add(id uint32, key []byte) error {
+	if !validKey(key) {
+		return ErrInvalidKey
+	}
+	k.Lock()
+	defer k.Unlock()
+	k.keys[id] = append([]byte(nil), key...)
+	k.current = id
+	return nil
+}
+
+// Rotate adds a new random 256 bit key and makes it the current key.
+// It returns the id of the new key.
+func (k *Keyring) Rotate() (uint32, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return 0, err
+	}
+
+	k.Lock()
+	defer k.Unlock()
+
+	id := uint32(1)
+	for existing := range k.keys {
+		if existing >= id {
+			id = existing + 1
+		}
+	}
+
+	k.keys[id] = key
+	k.current = id
+	return id, nil
+}
+
+// Remove removes the key. Records encrypted with it can't be read anymore.
+func (k *Keyring) Remove(id uint32) {
+	k.Lock()
+	defer k.Unlock()
+	delete(k.keys, id)
+}
+
+// CurrentKey returns the key used to encrypt new records.
+func (k *Keyring) CurrentKey() (uint32, []byte, error) {
+	k.RLock()
+	defer k.RUnlock()
+	key, found := k.keys[k.current]
+	if !found {
+		return 0, nil, ErrNoCurrentKey
+	}
+	return k.current, key, nil
+}
+
+// Key returns the key with the id.
+func (k *Keyring) Key(id uint32) ([]byte, error) {
+	k.RLock()
+	defer k.RUnlock()
+	key, found := k.keys[id]
+	if !found {
+		return nil, &KeyNotFoundError{KeyID: id}
+	}
+	return key, nil
+}
@@ -0,0 +1,40 @@
+package segment
+
+// Option configures optional behaviour of a Segment.
+type Option func(*Segment)
+
+// WithPreallocate reserves size bytes of disk space (at most maxSize) when the
+// segment file is created. It reduces fragmentation and the number of file
+// metadata updates while appending. The file size is not changed.
+func WithPreallocate(size uint64) Option {
+	return func(s *Segment) {
+		s.preallocate = size
+	}
+}
+
+// WithEncryption encrypts appended records with AES-GCM using the current key
+// of the provider and decrypts encrypted records on read. Records appended
+// without encryption stay readable.
+func WithEncryption(keys KeyProvider) Option {
+	return func(s *Segment) {
+		s.keys = keys
+	}
+}
+
+// WithStartAddress sets the address of the segment in its topic. Encrypted
+// records are bound to their address in the topic, so that they can't be
+// moved to another segment.
+func WithStartAddress(address uint64) Option {
+	return func(s *Segment) {
+		s.startAddress = address
+	}
+}
+
+// WithReadOnly opens an existing segment file for reading only, e.g. while
+// another process appends to it. Records appended after the segment was
+// opened are not visible.
+func WithReadOnly() Option {
+	return func(s *Segment) {
+		s.readOnly = true
+	}
+}
@@ -0,0 +1,17 @@
+package segment
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE, preallocated blocks don't change the file size.
+const fallocKeepSize = 0x01
+
+func preallocate(file *os.File, size int64) error {
+	err := syscall.Fallocate(int(file.Fd()), fallocKeepSize, 0, size)
+	if err == syscall.EOPNOTSUPP {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package segment
+
+import "os"
+
+func preallocate(file *os.File, size int64) error {
+	return nil
+}
@@ -18,17 +18,61 @@ var ErrWrongAddress = errors.New("Wrong data address")
 // ErrSegmentCorrupted is returned when the data to be read is not aligned with the segment size
 var ErrSegmentCorrupted = errors.New("Segment corrupted!")
 
+// ErrReadOnly is returned when appending to a segment opened read only
+var ErrReadOnly = errors.New("Segment is read only")
+
+// ErrClosed is returned when acquiring a lease on a closed segment
+var ErrClosed = errors.New("Segment closed")
+
+// trailerFlag is set in the length of records that repeat the length after
+// the data, so that the segment can be read backwards.
+const trailerFlag = 1 << 30
+
+const lengthMask = trailerFlag - 1
+
+// minMappingSize is the size of the smallest mapping of a segment.
+// Mappings grow by doubling in size up to the max size of the segment.
+const minMappingSize = 1024 * 1024
+
 // Segment represents one segment of events on the disk.
+// Only the part of the file that is in use is mapped into memory. The mapping
+// grows with the file, previous mappings are kept until the segment is closed
+// so that data read from them stays valid.
 type Segment struct {
 	sync.Mutex
-	file     *os.File
-	data     []byte
-	fileSize uint64
-	maxSize  uint64
+	name        string
+	file        *os.File
+	data        atomic.Value
+	mappings    [][]byte
+	fileSize    uint64
+	maxSize     uint64
+	leases      int
+	closed      bool
+	preallocate uint64
+	readOnly    bool
+	keys        KeyProvider
+	// startAddress is the address of the segment in its topic.
+	startAddress uint64
+}
+
+// Lease keeps the segment mapped in memory until it is released,
+// so that data read from the segment stays valid after the segment is closed.
+type Lease struct {
+	segment  *Segment
+	released int32
 }
 
 // New creates a new Segment file in the provided dir
-func New(fileName string, maxSize uint64) (*Segment, error) {
+func New(fileName string, maxSize uint64, options ...Option) (*Segment, error) {
+
+	s := &Segment{
+		name:    fileName,
+		maxSize: uint64(maxSize),
+	}
+
+	for _, o := range options {
+		o(s)
+	}
 
 	exists := true
 
@@ -41,7 +85,9 @@ func New(fileName string, maxSize uint64) (*Segment, error) {
 
 	flags := os.O_RDWR
 
-	if !exists {
+	if s.readOnly {
+		flags = os.O_RDONLY
+	} else if !exists {
 		flags = os.O_RDWR | os.O_CREATE
 	}
 
@@ -52,42 +98,158 @@ func New(fileName string, maxSize uint64) (*Segment, error) {
 
 	pos, err := file.Seek(0, 2)
 	if err != nil {
+		file.Close()
 		return nil, err
 	}
 
-	data, err := syscall.Mmap(int(file.Fd()), 0, int(maxSize), syscall.PROT_READ, syscall.MAP_SHARED)
+	s.file = file
+	s.fileSize = uint64(pos)
+
+	if s.preallocate > 0 && !exists {
+		size := s.preallocate
+		if size > maxSize {
+			size = maxSize
+		}
+		err = preallocate(file, int64(size))
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	err = s.remap(s.fileSize)
 	if err != nil {
+		file.Close()
 		return nil, err
 	}
 
-	return &Segment{
-		file:     file,
-		data:     data,
-		fileSize: uint64(pos),
-		maxSize:  uint64(maxSize),
-	}, nil
+	return s, nil
+}
+
+// NewFromData returns a read only segment holding the data of a segment file
+// that is not mapped, e.g. because it was stored compressed. The name is
+// returned by Name.
+func NewFromData(name string, data []byte, options ...Option) *Segment {
+	s := &Segment{
+		name:     name,
+		maxSize:  uint64(len(data)),
+		fileSize: uint64(len(data)),
+	}
+
+	for _, o := range options {
+		o(s)
+	}
+
+	s.readOnly = true
+	s.data.Store(data)
+
+	return s
+}
+
+// mappingSize returns the size of the mapping needed for a file of the given
+// size. Files larger than maxSize, e.g. opened with a smaller maxSize than they
+// were written with, are mapped whole.
+func (s *Segment) mappingSize(fileSize uint64) uint64 {
+	size := uint64(minMappingSize)
+	for size < fileSize {
+		size *= 2
+	}
+	limit := s.maxSize
+	if fileSize > limit {
+		limit = fileSize
+	}
+	if size > limit {
+		size = limit
+	}
+	return size
+}
+
+// remap maps a larger part of the file if the current mapping can't hold
+// fileSize bytes. Must be called with the lock held or before the segment is shared.
+func (s *Segment) remap(fileSize uint64) error {
+	current, _ := s.data.Load().([]byte)
+	if current != nil && uint64(len(current)) >= fileSize {
+		return nil
+	}
+
+	data, err := syscall.Mmap(int(s.file.Fd()), 0, int(s.mappingSize(fileSize)), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+
+	s.mappings = append(s.mappings, data)
+	s.data.Store(data)
+
+	return nil
+}
+
+// MappedSize returns the number of bytes of the file currently mapped into memory.
+func (s *Segment) MappedSize() uint64 {
+	return uint64(len(s.data.Load().([]byte)))
+}
+
+func (s *Segment) unmap() error {
+	for _, m := range s.mappings {
+		err := syscall.Munmap(m)
+		if err != nil {
+			return err
+		}
+	}
+	s.mappings = nil
+	return nil
+}
+
+// Name returns the file name of the segment
+func (s *Segment) Name() string {
+	return s.name
 }
 
 func (s *Segment) FileSize() uint64 {
 	return atomic.LoadUint64(&s.fileSize)
 }
 
-// Append appends data to the segment
-func (s *Segment) Append(d []byte) (uint64, uint64, error) {
+// Append appends a record made of the concatenated parts to the segment
+func (s *Segment) Append(parts ...[]byte) (uint64, uint64, error) {
 	s.Lock()
 	defer s.Unlock()
 
+	if s.readOnly {
+		return 0, 0, ErrReadOnly
+	}
+
 	eventAddress := s.fileSize
 
-	if s.fileSize+4+uint64(len(d)) > s.maxSize {
+	size := 0
+	for _, p := range parts {
+		size += len(p)
+	}
+
+	if s.keys != nil {
+		size += encryptionOverhead
+	}
+
+	if s.fileSize+8+uint64(size) > s.maxSize || size > lengthMask {
 		return 0, 0, ErrDataTooLarge
 	}
 
-	size := len(d)
-	data := make([]byte, size+4)
+	data := make([]byte, 4, size+8)
 	binary.BigEndian.PutUint32(data, uint32(size))
 
-	copy(data[4:], d)
+	for _, p := range parts {
+		data = append(data, p...)
+	}
+
+	if s.keys != nil {
+		encrypted, err := encrypt(s.keys, s.startAddress+eventAddress, data[4:])
+		if err != nil {
+			return 0, 0, err
+		}
+		binary.BigEndian.PutUint32(data, uint32(len(encrypted))|encryptedFlag)
+		data = append(data[:4], encrypted...)
+	}
+
+	binary.BigEndian.PutUint32(data, binary.BigEndian.Uint32(data)|trailerFlag)
+	data = append(data, data[:4]...)
 
 	written, err := s.file.Write(data)
 
@@ -95,38 +257,208 @@ func (s *Segment) Append(d []byte) (uint64, uint64, error) {
 		return 0, 0, err
 	}
 
-	s.fileSize += uint64(written)
+	fileSize := s.fileSize + uint64(written)
+
+	// the mapping must cover the new data before readers can see it
+	err = s.remap(fileSize)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	atomic.StoreUint64(&s.fileSize, fileSize)
+
+	return eventAddress, fileSize, nil
+}
+
+// Truncate removes all records from the size on, e.g. to roll back records
+// of a failed write. Data read from the removed records must not be used.
+func (s *Segment) Truncate(size uint64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.readOnly {
+		return ErrReadOnly
+	}
+
+	if size > s.fileSize {
+		return ErrWrongAddress
+	}
 
-	return eventAddress, s.fileSize, nil
+	err := s.file.Truncate(int64(size))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.file.Seek(int64(size), 0)
+	if err != nil {
+		return err
+	}
+
+	atomic.StoreUint64(&s.fileSize, size)
+
+	return nil
 }
 
-// ReadAll calls callback for each value in the file
+// Read returns the record at the address and the address of the next record.
+// Encrypted records are decrypted into a new buffer.
 func (s *Segment) Read(address uint64) ([]byte, uint64, error) {
 
 	fileSize := atomic.LoadUint64(&s.fileSize)
+	data := s.data.Load().([]byte)
 
 	if address+4 > fileSize {
 		return nil, 0, ErrWrongAddress
 	}
 
-	sz := uint64(binary.BigEndian.Uint32(s.data[address:]))
+	raw := binary.BigEndian.Uint32(data[address:])
+	sz := uint64(raw & lengthMask)
+
+	nextAddress := address + 4 + sz
+	if raw&trailerFlag != 0 {
+		nextAddress += 4
+	}
 
-	if address+sz+4 > fileSize {
+	if nextAddress > fileSize {
 		return nil, 0, ErrSegmentCorrupted
 	}
 
-	return s.data[address+4 : address+4+sz], address + 4 + sz, nil
+	record := data[address+4 : address+4+sz]
+
+	if raw&encryptedFlag != 0 {
+		plain, err := decrypt(s.keys, s.startAddress+address, record)
+		if err != nil {
+			return nil, 0, err
+		}
+		record = plain
+	}
+
+	return record, nextAddress, nil
+
+}
+
+// ValidSize returns the size of the complete records at the start of the
+// segment and their number. A record is incomplete when its length points
+// past the end of the file or its trailer does not repeat the length, e.g.
+// after a crash while appending.
+func (s *Segment) ValidSize() (uint64, uint64) {
+	fileSize := atomic.LoadUint64(&s.fileSize)
+	data := s.data.Load().([]byte)
+
+	address := uint64(0)
+	records := uint64(0)
+	for address+4 <= fileSize {
+		raw := binary.BigEndian.Uint32(data[address:])
+		next := address + 4 + uint64(raw&lengthMask)
+		if raw&trailerFlag != 0 {
+			next += 4
+		}
+		if next > fileSize {
+			break
+		}
+		if raw&trailerFlag != 0 && binary.BigEndian.Uint32(data[next-4:]) != raw {
+			break
+		}
+		address = next
+		records++
+	}
+
+	return address, records
+}
+
+// Previous returns the address of the record before the address.
+// Records are read backwards using their trailers.
+func (s *Segment) Previous(address uint64) (uint64, error) {
+	fileSize := atomic.LoadUint64(&s.fileSize)
+	if address == 0 || address > fileSize {
+		return 0, ErrWrongAddress
+	}
+
+	data := s.data.Load().([]byte)
+	raw := binary.BigEndian.Uint32(data[address-4:])
+	sz := uint64(raw & lengthMask)
+	if raw&trailerFlag == 0 || address < sz+8 {
+		return 0, ErrSegmentCorrupted
+	}
+
+	previous := address - sz - 8
+	if binary.BigEndian.Uint32(data[previous:]) != raw {
+		return 0, ErrSegmentCorrupted
+	}
+
+	return previous, nil
+}
+
+// Sync commits the segment file to stable storage.
+func (s *Segment) Sync() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Sync()
+}
+
+// SyncDir makes renames of files in the dir durable.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	closeErr := d.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Acquire returns a new lease on the segment.
+func (s *Segment) Acquire() (*Lease, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	s.leases++
+	return &Lease{segment: s}, nil
+}
 
+// Release releases the lease. When the segment is closed and this was the
+// last lease, the segment is unmapped. Releasing a nil lease or a lease
+// more than once has no effect.
+func (l *Lease) Release() error {
+	if l == nil || !atomic.CompareAndSwapInt32(&l.released, 0, 1) {
+		return nil
+	}
+	s := l.segment
+	s.Lock()
+	defer s.Unlock()
+	s.leases--
+	if s.closed && s.leases == 0 {
+		return s.unmap()
+	}
+	return nil
 }
 
-// Close unmaps the mmaped file and closes the FD
+// Close closes the FD and unmaps the mmaped file.
+// Unmapping waits until all leases are released.
 func (s *Segment) Close() error {
 	s.Lock()
 	defer s.Unlock()
 
-	err := syscall.Munmap(s.data)
-	if err != nil {
-		return err
+	if s.closed {
+		return ErrClosed
+	}
+	s.closed = true
+
+	if s.file != nil {
+		err := s.file.Close()
+		if err != nil {
+			return err
+		}
 	}
-	return s.file.Close()
+
+	if s.leases == 0 {
+		return s.unmap()
+	}
+
+	return nil
 }
@@ -33,7 +33,9 @@ var _ = Describe("Segment", func() {
 	})
 
 	AfterEach(func() {
-		Expect(s.Close()).To(Succeed())
+		if s != nil {
+			Expect(s.Close()).To(Succeed())
+		}
 		Expect(os.Remove(segmentFileName)).To(Succeed())
 	})
 
@@ -56,7 +58,7 @@ var _ = Describe("Segment", func() {
 			})
 
 			It("Should return the next segment Address", func() {
-				Expect(nextAddress).To(Equal(uint64(8)))
+				Expect(nextAddress).To(Equal(uint64(12)))
 			})
 		})
 
@@ -87,7 +89,7 @@ var _ = Describe("Segment", func() {
 			It("Should read the appended data", func() {
 				data, nextAdddress, err := s.Read(0)
 				Expect(err).ToNot(HaveOccurred())
-				Expect(nextAdddress).To(Equal(uint64(9)))
+				Expect(nextAdddress).To(Equal(uint64(13)))
 
 				Expect(data).To(Equal([]byte("test1")))
 			})
@@ -96,4 +98,262 @@ var _ = Describe("Segment", func() {
 
 	})
 
+	Describe("Previous()", func() {
+		It("Should walk records backwards", func() {
+			addresses := []uint64{}
+			for _, d := range []string{"a", "bb", "ccc"} {
+				address, _, err := s.Append([]byte(d))
+				Expect(err).ToNot(HaveOccurred())
+				addresses = append(addresses, address)
+			}
+			address := s.FileSize()
+			for i := len(addresses) - 1; i >= 0; i-- {
+				var err error
+				address, err = s.Previous(address)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(address).To(Equal(addresses[i]))
+			}
+			_, err := s.Previous(0)
+			Expect(err).To(Equal(segment.ErrWrongAddress))
+		})
+	})
+
+	Describe("ValidSize()", func() {
+		It("Should return the size of complete records", func() {
+			_, _, err := s.Append([]byte("a"))
+			Expect(err).ToNot(HaveOccurred())
+			_, end, err := s.Append([]byte("bb"))
+			Expect(err).ToNot(HaveOccurred())
+			size, records := s.ValidSize()
+			Expect(size).To(Equal(end))
+			Expect(records).To(Equal(uint64(2)))
+		})
+
+		Context("When the last record is torn", func() {
+			It("Should stop before the torn record", func() {
+				_, end, err := s.Append([]byte("a"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(s.Close()).To(Succeed())
+				f, err := os.OpenFile(segmentFileName, os.O_WRONLY|os.O_APPEND, 0700)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = f.Write([]byte{0x40, 0, 0, 3, 'c', 'c', 'c', 0x40})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(f.Close()).To(Succeed())
+				s, err = segment.New(segmentFileName, 1024)
+				Expect(err).ToNot(HaveOccurred())
+				size, records := s.ValidSize()
+				Expect(size).To(Equal(end))
+				Expect(records).To(Equal(uint64(1)))
+			})
+		})
+	})
+
+	Describe("Acquire()", func() {
+		Context("When the segment is closed while a lease is held", func() {
+			var lease *segment.Lease
+			var data []byte
+			BeforeEach(func() {
+				_, _, err := s.Append([]byte("test1"))
+				Expect(err).ToNot(HaveOccurred())
+				lease, err = s.Acquire()
+				Expect(err).ToNot(HaveOccurred())
+				data, _, err = s.Read(0)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(s.Close()).To(Succeed())
+				s = nil
+			})
+
+			It("Should keep the data readable until the lease is released", func() {
+				Expect(data).To(Equal([]byte("test1")))
+				Expect(lease.Release()).To(Succeed())
+			})
+		})
+
+		Context("When the segment is closed", func() {
+			It("Should return ErrClosed", func() {
+				Expect(s.Close()).To(Succeed())
+				_, err := s.Acquire()
+				s = nil
+				Expect(err).To(Equal(segment.ErrClosed))
+			})
+		})
+	})
+
+	Describe("MappedSize()", func() {
+		Context("When the segment is large", func() {
+			var large *segment.Segment
+			var largeFileName string
+
+			BeforeEach(func() {
+				largeFileName = segmentFileName + ".large"
+				var err error
+				large, err = segment.New(largeFileName, 1<<30, segment.WithPreallocate(1<<30))
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			AfterEach(func() {
+				Expect(large.Close()).To(Succeed())
+				Expect(os.Remove(largeFileName)).To(Succeed())
+			})
+
+			It("Should not map the whole segment up front", func() {
+				Expect(large.MappedSize()).To(BeNumerically("<", 1<<30))
+				Expect(large.FileSize()).To(Equal(uint64(0)))
+			})
+
+			Context("When more data than the initial mapping is appended", func() {
+				var first []byte
+				BeforeEach(func() {
+					var err error
+					_, _, err = large.Append([]byte("first"))
+					Expect(err).ToNot(HaveOccurred())
+					first, _, err = large.Read(0)
+					Expect(err).ToNot(HaveOccurred())
+					for i := 0; i < 4; i++ {
+						_, _, err = large.Append(make([]byte, 1024*1024))
+						Expect(err).ToNot(HaveOccurred())
+					}
+				})
+
+				It("Should grow the mapping", func() {
+					Expect(large.MappedSize()).To(BeNumerically(">=", large.FileSize()))
+					_, nextAddress, err := large.Read(13 + 3*(8+1024*1024))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(nextAddress).To(Equal(large.FileSize()))
+				})
+
+				It("Should keep previously read data valid", func() {
+					Expect(first).To(Equal([]byte("first")))
+				})
+
+				Context("When the segment is reopened with a smaller maximum size", func() {
+					BeforeEach(func() {
+						Expect(large.Close()).To(Succeed())
+						var err error
+						large, err = segment.New(largeFileName, 1024*1024)
+						Expect(err).ToNot(HaveOccurred())
+					})
+
+					It("Should map the whole file", func() {
+						Expect(large.MappedSize()).To(BeNumerically(">=", large.FileSize()))
+						_, nextAddress, err := large.Read(13 + 3*(8+1024*1024))
+						Expect(err).ToNot(HaveOccurred())
+						Expect(nextAddress).To(Equal(large.FileSize()))
+					})
+				})
+			})
+		})
+	})
+
+	Describe("WithEncryption()", func() {
+		var keys *segment.Keyring
+		var encrypted *segment.Segment
+		BeforeEach(func() {
+			Expect(s.Close()).To(Succeed())
+			s = nil
+			keys = segment.NewKeyring()
+			_, err := keys.Rotate()
+			Expect(err).ToNot(HaveOccurred())
+			encrypted, err = segment.New(segmentFileName, 1024, segment.WithEncryption(keys))
+			Expect(err).ToNot(HaveOccurred())
+			_, _, err = encrypted.Append([]byte("secret"))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			if encrypted != nil {
+				Expect(encrypted.Close()).To(Succeed())
+			}
+		})
+
+		It("Should not store the data in plain text", func() {
+			data, err := ioutil.ReadFile(segmentFileName)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).ToNot(ContainSubstring("secret"))
+		})
+
+		It("Should read the decrypted data", func() {
+			data, _, err := encrypted.Read(0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).To(Equal([]byte("secret")))
+		})
+
+		Context("When the key is missing", func() {
+			It("Should return KeyNotFoundError", func() {
+				keys.Remove(1)
+				_, _, err := encrypted.Read(0)
+				Expect(err).To(Equal(&segment.KeyNotFoundError{KeyID: 1}))
+			})
+		})
+
+		Context("When the record is moved to a segment at another address", func() {
+			It("Should return ErrDecryptionFailed", func() {
+				data, err := ioutil.ReadFile(segmentFileName)
+				Expect(err).ToNot(HaveOccurred())
+				movedFileName := segmentFileName + ".moved"
+				Expect(ioutil.WriteFile(movedFileName, data, 0700)).To(Succeed())
+				defer os.Remove(movedFileName)
+
+				moved, err := segment.New(movedFileName, 1024, segment.WithEncryption(keys), segment.WithStartAddress(1024))
+				Expect(err).ToNot(HaveOccurred())
+				defer moved.Close()
+				_, _, err = moved.Read(0)
+				Expect(err).To(Equal(segment.ErrDecryptionFailed))
+			})
+		})
+
+		Context("When the key is rotated", func() {
+			var nextAddress uint64
+			BeforeEach(func() {
+				_, err := keys.Rotate()
+				Expect(err).ToNot(HaveOccurred())
+				_, nextAddress, err = encrypted.Append([]byte("new secret"))
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("Should encrypt new records with the new key", func() {
+				keys.Remove(1)
+				_, _, err := encrypted.Read(0)
+				Expect(err).To(Equal(&segment.KeyNotFoundError{KeyID: 1}))
+				data, _, err := encrypted.Read(nextAddress - 8 - 10 - 32)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(data).To(Equal([]byte("new secret")))
+			})
+
+			Context("When the segment is re-encrypted", func() {
+				It("Should be readable without the old key", func() {
+					Expect(encrypted.Close()).To(Succeed())
+					encrypted = nil
+					count, err := segment.Reencrypt(segmentFileName, 0, keys)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(count).To(Equal(1))
+					keys.Remove(1)
+					encrypted, err = segment.New(segmentFileName, 1024, segment.WithEncryption(keys))
+					Expect(err).ToNot(HaveOccurred())
+					data, _, err := encrypted.Read(0)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(data).To(Equal([]byte("secret")))
+				})
+			})
+		})
+
+		Context("When the keyring is saved and loaded", func() {
+			It("Should keep the keys", func() {
+				keyringFile, err := ioutil.TempFile("", "")
+				Expect(err).ToNot(HaveOccurred())
+				keyringFile.Close()
+				defer os.Remove(keyringFile.Name())
+				Expect(keys.Save(keyringFile.Name())).To(Succeed())
+				loaded, err := segment.LoadKeyring(keyringFile.Name())
+				Expect(err).ToNot(HaveOccurred())
+				id, _, err := loaded.CurrentKey()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(id).To(Equal(uint32(1)))
+				key, err := keys.Key(1)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(loaded.Key(1)).To(Equal(key))
+			})
+		})
+	})
+
 })
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/draganm/zathras/replication"
+	"github.com/draganm/zathras/segment"
+	"github.com/draganm/zathras/server"
+	"github.com/draganm/zathras/store"
+	"github.com/draganm/zathras/stream"
+	"github.com/draganm/zathras/topic"
+)
+
+// node is either a leader or a follower of the replicated store.
+type node struct {
+	sync.Mutex
+	store         *store.Store
+	listenAddress string
+	leader        *replication.Leader
+	follower      *replication.Follower
+	server        *server.Server
+	// stopPipelines stops registered stream pipelines, which run on the leader only.
+	stopPipelines context.CancelFunc
+}
+
+// startPipelines runs all registered stream pipelines. Must be called with the lock held.
+func (n *node) startPipelines() {
+	ctx, cancel := context.WithCancel(context.Background())
+	n.stopPipelines = cancel
+	for _, p := range stream.Registered() {
+		go func(p *stream.Pipeline) {
+			err := stream.Run(ctx, n.store, p)
+			if err != nil && err != context.Canceled {
+				log.Println("Pipeline", p.Name(), "stopped:", err)
+			}
+		}(p)
+	}
+}
+
+func (n *node) promote() error {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.follower == nil {
+		return errors.New("Not a follower")
+	}
+
+	listener, err := net.Listen("tcp", n.listenAddress)
+	if err != nil {
+		return err
+	}
+
+	n.leader, err = n.follower.Promote(listener)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	n.follower = nil
+	n.server.SetAckWaiter(n.leader)
+	n.server.SetReadOnly(false)
+	n.startPipelines()
+	return nil
+}
+
+func (n *node) lag() (map[string]interface{}, error) {
+	n.Lock()
+	defer n.Unlock()
+
+	lag := map[string]interface{}{}
+	for _, name := range n.store.Names() {
+		var err error
+		if n.follower != nil {
+			lag[name], err = n.follower.Lag(name)
+		} else {
+			lag[name], err = n.leader.Lag(name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return lag, nil
+}
+
+func (n *node) close() error {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.stopPipelines != nil {
+		n.stopPipelines()
+	}
+	if n.follower != nil {
+		n.follower.Close()
+	}
+	if n.leader != nil {
+		n.leader.Close()
+	}
+	n.server.Close()
+	return n.store.Close()
+}
+
+func (n *node) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/promote", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		err := n.promote()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/lag", func(w http.ResponseWriter, r *http.Request) {
+		lag, err := n.lag()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(lag)
+	})
+	return mux
+}
+
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	dir := flags.String("dir", ".", "directory holding the topics")
+	segmentSize := flags.Uint64("segment-size", 64*1024*1024, "size of a segment file after which a new segment is started")
+	listen := flags.String("listen", ":7000", "replication listen address")
+	follow := flags.String("follow", "", "address of the leader to follow")
+	admin := flags.String("admin", ":7001", "admin HTTP listen address")
+	httpAddress := flags.String("http", "", "client HTTP API listen address, empty to disable")
+	clientListen := flags.String("client-listen", "", "client binary protocol listen address, empty to disable")
+	maxOpenSegments := flags.Int("max-open-segments", 0, "maximal number of old segments kept open per topic, 0 for no limit")
+	preallocate := flags.Bool("preallocate", false, "reserve disk space for new segments")
+	compression := flags.String("compression", "", "codec used to compress new events, empty for no compression")
+	keyringFile := flags.String("keyring", "", "keyring file used to encrypt new records, reloaded on SIGHUP")
+	flags.Parse(args)
+
+	options := []topic.Option{topic.WithMaxOpenSegments(*maxOpenSegments)}
+	if *preallocate {
+		options = append(options, topic.WithPreallocate())
+	}
+	if *compression != "" {
+		codec, found := topic.CodecByName(*compression)
+		if !found {
+			return topic.ErrUnknownCodec
+		}
+		options = append(options, topic.WithCompression(codec))
+	}
+
+	var keys *segment.Keyring
+	if *keyringFile != "" {
+		var err error
+		keys, err = segment.LoadKeyring(*keyringFile)
+		if err != nil {
+			return err
+		}
+		options = append(options, topic.WithEncryption(keys))
+	}
+
+	open := store.Open
+	if *follow != "" {
+		open = store.OpenReplica
+	}
+
+	s, err := open(*dir, *segmentSize, options...)
+	if err != nil {
+		return err
+	}
+
+	n := &node{
+		store:         s,
+		listenAddress: *listen,
+		server:        server.New(s),
+	}
+
+	if *follow == "" {
+		listener, err := net.Listen("tcp", *listen)
+		if err != nil {
+			s.Close()
+			return err
+		}
+		n.leader = replication.NewLeader(s, listener)
+		n.server.SetAckWaiter(n.leader)
+		n.startPipelines()
+	} else {
+		n.follower = replication.NewFollower(s, *follow)
+		n.server.SetReadOnly(true)
+	}
+
+	adminListener, err := net.Listen("tcp", *admin)
+	if err != nil {
+		n.close()
+		return err
+	}
+
+	go http.Serve(adminListener, n.adminHandler())
+
+	listeners := []net.Listener{adminListener}
+
+	if *httpAddress != "" {
+		httpListener, err := net.Listen("tcp", *httpAddress)
+		if err != nil {
+			adminListener.Close()
+			n.close()
+			return err
+		}
+		listeners = append(listeners, httpListener)
+		go http.Serve(httpListener, n.server.HTTPHandler())
+	}
+
+	if *clientListen != "" {
+		clientListener, err := net.Listen("tcp", *clientListen)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			n.close()
+			return err
+		}
+		listeners = append(listeners, clientListener)
+		go n.server.Serve(clientListener)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			log.Println("Received", sig, "shutting down")
+			break
+		}
+		if keys != nil {
+			err = keys.Load(*keyringFile)
+			if err != nil {
+				log.Println("Could not reload keyring", err)
+			}
+		}
+	}
+
+	for _, l := range listeners {
+		l.Close()
+	}
+	return n.close()
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/draganm/zathras/internal/frame"
+)
+
+// Client talks to a server over the binary protocol. It is safe for
+// concurrent use, requests are sent one at a time.
+type Client struct {
+	sync.Mutex
+	conn net.Conn
+	acks int32
+}
+
+// Dial connects to the binary protocol listener of a server.
+func Dial(address string) (*Client, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn}, nil
+}
+
+// SetAcks makes writes return only after that many followers of the server
+// have acknowledged them, see Server.SetAckWaiter.
+func (c *Client) SetAcks(followers uint8) {
+	atomic.StoreInt32(&c.acks, int32(followers))
+}
+
+func (c *Client) request(msgType byte, payload []byte, responseType byte) ([]byte, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	err := frame.Write(c.conn, msgType, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	t, response, err := frame.Read(c.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	if t == msgError {
+		return nil, decodeError(response)
+	}
+
+	if t != responseType {
+		return nil, ErrMalformedMessage
+	}
+
+	return response, nil
+}
+
+func (c *Client) write(req writeRequest) ([]uint64, error) {
+	req.acks = uint8(atomic.LoadInt32(&c.acks))
+	response, err := c.request(msgWrite, encodeWrite(req), msgWritten)
+	if err != nil {
+		return nil, err
+	}
+	_, addresses, err := decodeWritten(response)
+	if err != nil {
+		return nil, err
+	}
+	if len(addresses) != len(req.events) {
+		return nil, ErrMalformedMessage
+	}
+	return addresses, nil
+}
+
+// WriteEvent writes the event to the topic and returns its address.
+func (c *Client) WriteEvent(topicName string, data []byte) (uint64, error) {
+	addresses, err := c.write(writeRequest{topicName: topicName, events: [][]byte{data}})
+	if err != nil {
+		return 0, err
+	}
+	return addresses[0], nil
+}
+
+// WriteEvents writes the events to the topic and returns their addresses.
+func (c *Client) WriteEvents(topicName string, events [][]byte) ([]uint64, error) {
+	return c.write(writeRequest{topicName: topicName, events: events})
+}
+
+// WriteEventIfNextAddress writes the event only if the topic has the expected
+// next address. It returns topic.ErrConcurrencyConflict otherwise.
+func (c *Client) WriteEventIfNextAddress(topicName string, expected uint64, data []byte) (uint64, error) {
+	addresses, err := c.write(writeRequest{topicName: topicName, conditional: true, expected: expected, events: [][]byte{data}})
+	if err != nil {
+		return 0, err
+	}
+	return addresses[0], nil
+}
+
+// WriteEventsIfNextAddress writes all events only if the topic has the expected next address.
+func (c *Client) WriteEventsIfNextAddress(topicName string, expected uint64, events [][]byte) ([]uint64, error) {
+	return c.write(writeRequest{topicName: topicName, conditional: true, expected: expected, events: events})
+}
+
+// WriteProducerEvent writes the event tagged with the producer ID and the
+// sequence number. Retrying a write returns the address of the original event,
+// see topic.Topic.WriteProducerEvent.
+func (c *Client) WriteProducerEvent(topicName, producerID string, sequence uint64, data []byte) (uint64, error) {
+	addresses, err := c.write(writeRequest{topicName: topicName, producerID: producerID, sequence: sequence, events: [][]byte{data}})
+	if err != nil {
+		return 0, err
+	}
+	return addresses[0], nil
+}
+
+// NextAddress returns the next address of the topic.
+func (c *Client) NextAddress(topicName string) (uint64, error) {
+	response, err := c.request(msgNextAddress, []byte(topicName), msgAddress)
+	if err != nil {
+		return 0, err
+	}
+	address, _, err := decodeAddressAndData(response)
+	return address, err
+}
+
+// Read returns the event at the address of the topic and the address of the next event.
+func (c *Client) Read(topicName string, address uint64) ([]byte, uint64, error) {
+	response, err := c.request(msgRead, encodeAddressAndData(address, []byte(topicName)), msgEvent)
+	if err != nil {
+		return nil, 0, err
+	}
+	nextAddress, data, err := decodeAddressAndData(response)
+	return data, nextAddress, err
+}
+
+// Subscribe calls fn with the events of the topic from the address that
+// match the filter, until the context is done or fn returns an error. The
+// filter is evaluated by the server, see package filter; an empty filter
+// matches all events. Events that don't match are skipped, fn gets position
+// updates for them. Subscribe takes over the connection and closes it when it
+// returns, so the client can't be used afterwards.
+func (c *Client) Subscribe(ctx context.Context, topicName string, from uint64, filter string, fn func(SubscriptionEvent) error) error {
+	c.Lock()
+	defer c.Unlock()
+	defer c.conn.Close()
+
+	err := frame.Write(c.conn, msgSubscribe, encodeSubscribe(subscribeRequest{topicName: topicName, from: from, filter: filter}))
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		t, payload, err := frame.Read(c.conn)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t {
+		case msgError:
+			return decodeError(payload)
+		case msgMatched, msgPosition:
+			e, err := decodeSubscriptionEvent(payload)
+			if err != nil {
+				return err
+			}
+			e.Skipped = t == msgPosition
+			err = fn(e)
+			if err != nil {
+				return err
+			}
+		default:
+			return ErrMalformedMessage
+		}
+	}
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
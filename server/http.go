@@ -0,0 +1,279 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/draganm/zathras/filter"
+	"github.com/draganm/zathras/schema"
+	"github.com/draganm/zathras/segment"
+	"github.com/draganm/zathras/store"
+	"github.com/draganm/zathras/topic"
+)
+
+// IfNextAddressHeader makes a write conditional on the next address of the topic.
+const IfNextAddressHeader = "If-Next-Address"
+
+// ProducerIDHeader and ProducerSequenceHeader tag a write with the producer
+// and its sequence number, so that retried writes are not duplicated.
+const (
+	ProducerIDHeader       = "Producer-ID"
+	ProducerSequenceHeader = "Producer-Sequence"
+)
+
+// AcksHeader makes a write wait until that many followers have acknowledged
+// its events.
+const AcksHeader = "Acks"
+
+// NextAddressHeader holds the next address of the topic after a write or a
+// conflict, or the address of the event after a read one.
+const NextAddressHeader = "Next-Address"
+
+type writeResponse struct {
+	Addresses   []uint64 `json:"addresses"`
+	NextAddress uint64   `json:"next_address"`
+}
+
+type batchRequest struct {
+	Events [][]byte `json:"events"`
+}
+
+// HTTPHandler returns the HTTP API of the server:
+//
+//	GET  /topics/<name>                  next address of the topic
+//	POST /topics/<name>/events           write the request body as an event
+//	POST /topics/<name>/batch            write {"events": [base64, ...]}
+//	GET  /topics/<name>/events/<address> read an event
+//	GET  /topics/<name>/subscribe        stream events as JSON lines
+//	GET  /topics/<name>/schemas          versions of the schema of the topic
+//	POST /topics/<name>/schemas          register the request body as a new version
+//
+// Writes with the If-Next-Address header fail with 409 Conflict when the
+// topic has a different next address. Events written with the Producer-ID
+// and Producer-Sequence headers are written only once. Writes with the Acks
+// header wait until that many followers have acknowledged them and fail with
+// 504 Gateway Timeout when they don't within AckTimeout. Subscriptions start at
+// the address in the from parameter and stream SubscriptionEvent lines of
+// events matching the filter parameter until the client disconnects. Schemas
+// are registered with the type (json by default) and compatibility (backward
+// by default) parameters; events that don't match the schema are rejected
+// with 400 Bad Request. Writes create topics, reading a topic that doesn't
+// exist fails with 404 Not Found.
+func (s *Server) HTTPHandler() http.Handler {
+	return http.HandlerFunc(s.serveHTTP)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "topics" {
+		http.NotFound(w, r)
+		return
+	}
+
+	topicName := parts[1]
+
+	switch {
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		nextAddress, err := s.nextAddress(topicName)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]uint64{"next_address": nextAddress})
+	case len(parts) == 3 && parts[2] == "events" && r.Method == http.MethodPost:
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.serveWrite(w, r, topicName, [][]byte{data})
+	case len(parts) == 3 && parts[2] == "batch" && r.Method == http.MethodPost:
+		req := batchRequest{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.serveWrite(w, r, topicName, req.Events)
+	case len(parts) == 4 && parts[2] == "events" && r.Method == http.MethodGet:
+		address, err := strconv.ParseUint(parts[3], 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, nextAddress, err := s.read(topicName, address)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		w.Header().Set(NextAddressHeader, strconv.FormatUint(nextAddress, 10))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+	case len(parts) == 3 && parts[2] == "schemas" && r.Method == http.MethodGet:
+		versions, err := s.schemas(topicName)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, versions)
+	case len(parts) == 3 && parts[2] == "schemas" && r.Method == http.MethodPost:
+		definition, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		schemaType := r.URL.Query().Get("type")
+		if schemaType == "" {
+			schemaType = schema.JSON
+		}
+		compatibility := schema.Compatibility(r.URL.Query().Get("compatibility"))
+		if compatibility == "" {
+			compatibility = schema.Backward
+		}
+		id, err := s.registerSchema(topicName, schemaType, definition, compatibility)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]uint32{"id": id})
+	case len(parts) == 3 && parts[2] == "subscribe" && r.Method == http.MethodGet:
+		s.serveSubscribe(w, r, topicName)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveSubscribe(w http.ResponseWriter, r *http.Request, topicName string) {
+	req := subscribeRequest{
+		topicName: topicName,
+		filter:    r.URL.Query().Get("filter"),
+	}
+
+	if v := r.URL.Query().Get("from"); v != "" {
+		var err error
+		req.from, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	f, err := compileFilter(req.filter)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	_, err = s.store.Lookup(topicName)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	encoder := json.NewEncoder(w)
+	s.subscribe(r.Context(), req, f, func(e SubscriptionEvent) error {
+		err := encoder.Encode(e)
+		if err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+}
+
+func (s *Server) serveWrite(w http.ResponseWriter, r *http.Request, topicName string, events [][]byte) {
+	req := writeRequest{
+		topicName:  topicName,
+		producerID: r.Header.Get(ProducerIDHeader),
+		events:     events,
+	}
+
+	if v := r.Header.Get(IfNextAddressHeader); v != "" {
+		var err error
+		req.expected, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.conditional = true
+	}
+
+	if req.producerID != "" {
+		var err error
+		req.sequence, err = strconv.ParseUint(r.Header.Get(ProducerSequenceHeader), 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if v := r.Header.Get(AcksHeader); v != "" {
+		acks, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.acks = uint8(acks)
+	}
+
+	addresses, err := s.write(r.Context(), req)
+
+	nextAddress, nextErr := s.nextAddress(topicName)
+	if nextErr == nil {
+		w.Header().Set(NextAddressHeader, strconv.FormatUint(nextAddress, 10))
+	}
+
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, writeResponse{Addresses: addresses, NextAddress: nextAddress})
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch err.(type) {
+	case *filter.SyntaxError, *topic.InvalidEventError, *schema.DefinitionError:
+		status = http.StatusBadRequest
+	case *schema.IncompatibleError:
+		status = http.StatusConflict
+	}
+	switch err {
+	case topic.ErrConcurrencyConflict:
+		status = http.StatusConflict
+	case ErrReadOnly:
+		status = http.StatusServiceUnavailable
+	case store.ErrInvalidTopicName, topic.ErrInvalidProducerID, ErrMalformedMessage, schema.ErrUnknownType, schema.ErrUnknownCompatibility:
+		status = http.StatusBadRequest
+	case topic.ErrOutOfOrderSequence:
+		status = http.StatusConflict
+	case topic.ErrTooLargeEvent:
+		status = http.StatusRequestEntityTooLarge
+	case ErrNotReplicated:
+		status = http.StatusNotImplemented
+	case ErrNotAcknowledged:
+		status = http.StatusGatewayTimeout
+	case segment.ErrWrongAddress, store.ErrTopicNotFound:
+		status = http.StatusNotFound
+	}
+	http.Error(w, err.Error(), status)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/draganm/zathras/internal/frame"
+)
+
+// Frames of the binary protocol are [u8 message type][u32 length][payload].
+// Every request is answered with exactly one response, except for msgSubscribe
+// that is answered with a msgError or a stream of msgMatched and msgPosition
+// messages until the connection is closed.
+const (
+	// msgWrite is [u8 flags][u64 expected next address][u16 topic length][topic]
+	// {[u8 producer length][producer ID][u64 sequence]}{[u8 acks]}[u32 count]([u32 length][data])*
+	// where the producer is only present with the producer flag and the number
+	// of follower acks only with the acks flag.
+	msgWrite byte = iota + 1
+	// msgWritten is [u64 next address][u32 count]([u64 address])*
+	msgWritten
+	// msgNextAddress is [topic]
+	msgNextAddress
+	// msgAddress is [u64 address]
+	msgAddress
+	// msgRead is [u64 address][topic]
+	msgRead
+	// msgEvent is [u64 next address][data]
+	msgEvent
+	// msgError is [u8 error code][message]
+	msgError
+	// msgSubscribe is [u64 from][u16 topic length][topic][filter]
+	msgSubscribe
+	// msgMatched is [u64 address][u64 next address][i64 timestamp][data]
+	msgMatched
+	// msgPosition is [u64 address of the last skipped event][u64 next address][i64 0]
+	msgPosition
+)
+
+// Flags of write messages.
+const (
+	flagConditional byte = 1 << iota
+	flagProducer
+	flagAcks
+)
+
+// ErrFrameTooLarge is returned when a received frame is larger than the maximal frame size
+var ErrFrameTooLarge = frame.ErrTooLarge
+
+// ErrMalformedMessage is returned when a message can't be decoded
+var ErrMalformedMessage = errors.New("Malformed message")
+
+type writeRequest struct {
+	topicName   string
+	conditional bool
+	expected    uint64
+	producerID  string
+	sequence    uint64
+	acks        uint8
+	events      [][]byte
+}
+
+func encodeWrite(req writeRequest) []byte {
+	size := 1 + 8 + 2 + len(req.topicName) + 1 + len(req.producerID) + 8 + 1 + 4
+	for _, e := range req.events {
+		size += 4 + len(e)
+	}
+
+	payload := make([]byte, 11, size)
+	if req.conditional {
+		payload[0] |= flagConditional
+	}
+	binary.BigEndian.PutUint64(payload[1:], req.expected)
+	binary.BigEndian.PutUint16(payload[9:], uint16(len(req.topicName)))
+	payload = append(payload, req.topicName...)
+	if req.producerID != "" {
+		payload[0] |= flagProducer
+		payload = append(payload, byte(len(req.producerID)))
+		payload = append(payload, req.producerID...)
+		payload = appendUint64(payload, req.sequence)
+	}
+	if req.acks > 0 {
+		payload[0] |= flagAcks
+		payload = append(payload, req.acks)
+	}
+	payload = appendUint32(payload, uint32(len(req.events)))
+	for _, e := range req.events {
+		payload = appendUint32(payload, uint32(len(e)))
+		payload = append(payload, e...)
+	}
+	return payload
+}
+
+func decodeWrite(payload []byte) (writeRequest, error) {
+	req := writeRequest{}
+	if len(payload) < 11 {
+		return req, ErrMalformedMessage
+	}
+	flags := payload[0]
+	req.conditional = flags&flagConditional != 0
+	req.expected = binary.BigEndian.Uint64(payload[1:])
+	topicLength := int(binary.BigEndian.Uint16(payload[9:]))
+	payload = payload[11:]
+	if len(payload) < topicLength {
+		return req, ErrMalformedMessage
+	}
+	req.topicName = string(payload[:topicLength])
+	payload = payload[topicLength:]
+	if flags&flagProducer != 0 {
+		if len(payload) < 1 || len(payload) < 1+int(payload[0])+8 {
+			return req, ErrMalformedMessage
+		}
+		producerLength := int(payload[0])
+		req.producerID = string(payload[1 : 1+producerLength])
+		req.sequence = binary.BigEndian.Uint64(payload[1+producerLength:])
+		payload = payload[1+producerLength+8:]
+	}
+	if flags&flagAcks != 0 {
+		if len(payload) < 1 {
+			return req, ErrMalformedMessage
+		}
+		req.acks = payload[0]
+		payload = payload[1:]
+	}
+	if len(payload) < 4 {
+		return req, ErrMalformedMessage
+	}
+	count := binary.BigEndian.Uint32(payload)
+	payload = payload[4:]
+	for i := uint32(0); i < count; i++ {
+		if len(payload) < 4 {
+			return req, ErrMalformedMessage
+		}
+		length := binary.BigEndian.Uint32(payload)
+		payload = payload[4:]
+		if uint32(len(payload)) < length {
+			return req, ErrMalformedMessage
+		}
+		req.events = append(req.events, payload[:length])
+		payload = payload[length:]
+	}
+	return req, nil
+}
+
+func encodeWritten(nextAddress uint64, addresses []uint64) []byte {
+	payload := make([]byte, 12, 12+8*len(addresses))
+	binary.BigEndian.PutUint64(payload, nextAddress)
+	binary.BigEndian.PutUint32(payload[8:], uint32(len(addresses)))
+	for _, a := range addresses {
+		payload = appendUint64(payload, a)
+	}
+	return payload
+}
+
+func decodeWritten(payload []byte) (uint64, []uint64, error) {
+	if len(payload) < 12 {
+		return 0, nil, ErrMalformedMessage
+	}
+	nextAddress := binary.BigEndian.Uint64(payload)
+	count := binary.BigEndian.Uint32(payload[8:])
+	if uint64(len(payload)) != 12+8*uint64(count) {
+		return 0, nil, ErrMalformedMessage
+	}
+	addresses := make([]uint64, count)
+	for i := range addresses {
+		addresses[i] = binary.BigEndian.Uint64(payload[12+8*i:])
+	}
+	return nextAddress, addresses, nil
+}
+
+func encodeAddressAndData(address uint64, data []byte) []byte {
+	payload := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint64(payload, address)
+	return append(payload, data...)
+}
+
+func decodeAddressAndData(payload []byte) (uint64, []byte, error) {
+	if len(payload) < 8 {
+		return 0, nil, ErrMalformedMessage
+	}
+	return binary.BigEndian.Uint64(payload), payload[8:], nil
+}
+
+type subscribeRequest struct {
+	topicName string
+	from      uint64
+	filter    string
+}
+
+func encodeSubscribe(req subscribeRequest) []byte {
+	payload := make([]byte, 10, 10+len(req.topicName)+len(req.filter))
+	binary.BigEndian.PutUint64(payload, req.from)
+	binary.BigEndian.PutUint16(payload[8:], uint16(len(req.topicName)))
+	payload = append(payload, req.topicName...)
+	return append(payload, req.filter...)
+}
+
+func decodeSubscribe(payload []byte) (subscribeRequest, error) {
+	req := subscribeRequest{}
+	if len(payload) < 10 {
+		return req, ErrMalformedMessage
+	}
+	req.from = binary.BigEndian.Uint64(payload)
+	topicLength := int(binary.BigEndian.Uint16(payload[8:]))
+	payload = payload[10:]
+	if len(payload) < topicLength {
+		return req, ErrMalformedMessage
+	}
+	req.topicName = string(payload[:topicLength])
+	req.filter = string(payload[topicLength:])
+	return req, nil
+}
+
+func encodeSubscriptionEvent(e SubscriptionEvent) []byte {
+	payload := make([]byte, 24, 24+len(e.Data))
+	binary.BigEndian.PutUint64(payload, e.Address)
+	binary.BigEndian.PutUint64(payload[8:], e.NextAddress)
+	binary.BigEndian.PutUint64(payload[16:], uint64(e.Timestamp))
+	return append(payload, e.Data...)
+}
+
+func decodeSubscriptionEvent(payload []byte) (SubscriptionEvent, error) {
+	if len(payload) < 24 {
+		return SubscriptionEvent{}, ErrMalformedMessage
+	}
+	return SubscriptionEvent{
+		Address:     binary.BigEndian.Uint64(payload),
+		NextAddress: binary.BigEndian.Uint64(payload[8:]),
+		Timestamp:   int64(binary.BigEndian.Uint64(payload[16:])),
+		Data:        payload[24:],
+	}, nil
+}
+
+func encodeError(err error) []byte {
+	return append([]byte{errorCode(err)}, err.Error()...)
+}
+
+func decodeError(payload []byte) error {
+	if len(payload) == 0 {
+		return ErrMalformedMessage
+	}
+	return errorForCode(payload[0], string(payload[1:]))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, v)
+	return append(b, buf...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, v)
+	return append(b, buf...)
+}
@@ -0,0 +1,192 @@
+// Package server exposes the topics of a store to clients over HTTP and a
+// binary TCP protocol.
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/draganm/zathras/schema"
+	"github.com/draganm/zathras/segment"
+	"github.com/draganm/zathras/store"
+	"github.com/draganm/zathras/topic"
+)
+
+// ErrReadOnly is returned when writing to a server that does not accept writes
+var ErrReadOnly = errors.New("Server is read only")
+
+// ErrNotReplicated is returned when a write asks for follower acks from a
+// server that doesn't replicate its topics
+var ErrNotReplicated = errors.New("Server does not replicate")
+
+// ErrNotAcknowledged is returned when followers didn't acknowledge a write
+// within AckTimeout. The events are written nevertheless.
+var ErrNotAcknowledged = errors.New("Write not acknowledged by followers")
+
+// AckTimeout is the time writes wait for acks of followers.
+var AckTimeout = 10 * time.Second
+
+// AckWaiter waits for followers to acknowledge written events, e.g. a
+// replication.Leader.
+type AckWaiter interface {
+	// WaitForAcks returns once that many followers of the topic have
+	// acknowledged the event at the address, or the context is done.
+	WaitForAcks(ctx context.Context, topicName string, address uint64, followers int) error
+}
+
+// Server serves topics of a store.
+type Server struct {
+	sync.Mutex
+	store    *store.Store
+	readOnly int32
+	conns    map[net.Conn]struct{}
+	acks     AckWaiter
+}
+
+// New returns a server for the store.
+func New(s *store.Store) *Server {
+	return &Server{store: s}
+}
+
+// SetReadOnly makes the server reject writes, e.g. while the store follows a leader.
+func (s *Server) SetReadOnly(readOnly bool) {
+	value := int32(0)
+	if readOnly {
+		value = 1
+	}
+	atomic.StoreInt32(&s.readOnly, value)
+}
+
+// SetAckWaiter makes writes asking for follower acks wait for them with a,
+// nil rejects such writes with ErrNotReplicated.
+func (s *Server) SetAckWaiter(a AckWaiter) {
+	s.Lock()
+	defer s.Unlock()
+	s.acks = a
+}
+
+// write writes the events of the request to the topic and waits for the
+// requested number of follower acks of the last event.
+func (s *Server) write(ctx context.Context, req writeRequest) ([]uint64, error) {
+	if atomic.LoadInt32(&s.readOnly) != 0 {
+		return nil, ErrReadOnly
+	}
+
+	s.Lock()
+	acks := s.acks
+	s.Unlock()
+
+	if req.acks > 0 && acks == nil {
+		return nil, ErrNotReplicated
+	}
+
+	addresses, err := s.writeEvents(req)
+	if err != nil || req.acks == 0 || len(addresses) == 0 {
+		return addresses, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, AckTimeout)
+	defer cancel()
+
+	err = acks.WaitForAcks(ctx, req.topicName, addresses[len(addresses)-1], int(req.acks))
+	if err == context.DeadlineExceeded {
+		return nil, ErrNotAcknowledged
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return addresses, nil
+}
+
+func (s *Server) writeEvents(req writeRequest) ([]uint64, error) {
+	t, err := s.store.Topic(req.topicName)
+	if err != nil {
+		return nil, err
+	}
+
+	if req.producerID != "" {
+		if req.conditional || len(req.events) != 1 {
+			return nil, ErrMalformedMessage
+		}
+		address, err := t.WriteProducerEvent(req.producerID, req.sequence, req.events[0])
+		if err != nil {
+			return nil, err
+		}
+		return []uint64{address}, nil
+	}
+
+	if req.conditional {
+		return t.WriteEventsIfNextAddress(req.expected, req.events)
+	}
+
+	return t.WriteEvents(req.events)
+}
+
+func (s *Server) nextAddress(topicName string) (uint64, error) {
+	t, err := s.store.Lookup(topicName)
+	if err != nil {
+		return 0, err
+	}
+	return t.NextAddress(), nil
+}
+
+func (s *Server) read(topicName string, address uint64) ([]byte, uint64, error) {
+	t, err := s.store.Lookup(topicName)
+	if err != nil {
+		return nil, 0, err
+	}
+	return t.Read(address)
+}
+
+func (s *Server) schemas(topicName string) ([]topic.SchemaVersion, error) {
+	t, err := s.store.Lookup(topicName)
+	if err != nil {
+		return nil, err
+	}
+	return t.Schemas(), nil
+}
+
+func (s *Server) registerSchema(topicName, schemaType string, definition []byte, c schema.Compatibility) (uint32, error) {
+	if atomic.LoadInt32(&s.readOnly) != 0 {
+		return 0, ErrReadOnly
+	}
+
+	t, err := s.store.Topic(topicName)
+	if err != nil {
+		return 0, err
+	}
+	return t.RegisterSchema(schemaType, definition, c)
+}
+
+// errorCodes identify errors that clients can handle.
+var errorCodes = map[error]byte{
+	topic.ErrConcurrencyConflict: 1,
+	ErrReadOnly:                  2,
+	store.ErrInvalidTopicName:    3,
+	topic.ErrTooLargeEvent:       4,
+	segment.ErrWrongAddress:      5,
+	ErrMalformedMessage:          6,
+	topic.ErrOutOfOrderSequence:  7,
+	topic.ErrInvalidProducerID:   8,
+	store.ErrTopicNotFound:       9,
+	ErrNotReplicated:             10,
+	ErrNotAcknowledged:           11,
+}
+
+func errorCode(err error) byte {
+	return errorCodes[err]
+}
+
+func errorForCode(code byte, message string) error {
+	for err, c := range errorCodes {
+		if c == code {
+			return err
+		}
+	}
+	return errors.New(message)
+}
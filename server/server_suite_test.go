@@ -0,0 +1,459 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/draganm/zathras/server"
+	"github.com/draganm/zathras/store"
+	"github.com/draganm/zathras/topic"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Server Suite")
+}
+
+type fakeAckWaiter struct {
+	topicName string
+	address   uint64
+	followers int
+	err       error
+}
+
+func (f *fakeAckWaiter) WaitForAcks(ctx context.Context, topicName string, address uint64, followers int) error {
+	f.topicName, f.address, f.followers = topicName, address, followers
+	return f.err
+}
+
+var _ = Describe("Server", func() {
+	var storeDir string
+	var s *store.Store
+	var srv *server.Server
+
+	BeforeEach(func() {
+		var err error
+		storeDir, err = ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+		s, err = store.Open(storeDir, 1024)
+		Expect(err).ToNot(HaveOccurred())
+		srv = server.New(s)
+	})
+
+	AfterEach(func() {
+		Expect(srv.Close()).To(Succeed())
+		Expect(s.Close()).To(Succeed())
+		Expect(os.RemoveAll(storeDir)).To(Succeed())
+	})
+
+	Describe("HTTPHandler()", func() {
+		var httpServer *httptest.Server
+
+		BeforeEach(func() {
+			httpServer = httptest.NewServer(srv.HTTPHandler())
+		})
+
+		AfterEach(func() {
+			httpServer.Close()
+		})
+
+		postWithHeaders := func(path string, headers map[string]string, body string) *http.Response {
+			req, err := http.NewRequest(http.MethodPost, httpServer.URL+path, strings.NewReader(body))
+			Expect(err).ToNot(HaveOccurred())
+			for k, v := range headers {
+				req.Header.Set(k, v)
+			}
+			res, err := http.DefaultClient.Do(req)
+			Expect(err).ToNot(HaveOccurred())
+			return res
+		}
+
+		post := func(path, ifNextAddress, body string) *http.Response {
+			headers := map[string]string{}
+			if ifNextAddress != "" {
+				headers[server.IfNextAddressHeader] = ifNextAddress
+			}
+			return postWithHeaders(path, headers, body)
+		}
+
+		Context("When a producer retries a write", func() {
+			It("Should write the event once", func() {
+				headers := map[string]string{
+					server.ProducerIDHeader:       "p1",
+					server.ProducerSequenceHeader: "7",
+				}
+				for i := 0; i < 2; i++ {
+					res := postWithHeaders("/topics/t1/events", headers, "test")
+					res.Body.Close()
+					Expect(res.StatusCode).To(Equal(http.StatusOK))
+					Expect(res.Header.Get(server.NextAddressHeader)).To(Equal("32"))
+				}
+			})
+		})
+
+		Context("When an event is written", func() {
+			BeforeEach(func() {
+				res := post("/topics/t1/events", "", "test")
+				defer res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+				Expect(res.Header.Get(server.NextAddressHeader)).To(Equal("21"))
+			})
+
+			It("Should be readable", func() {
+				res, err := http.Get(httpServer.URL + "/topics/t1/events/0")
+				Expect(err).ToNot(HaveOccurred())
+				defer res.Body.Close()
+				data, err := ioutil.ReadAll(res.Body)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(data)).To(Equal("test"))
+				Expect(res.Header.Get(server.NextAddressHeader)).To(Equal("21"))
+			})
+
+			It("Should reject a write with a stale next address", func() {
+				res := post("/topics/t1/events", "0", "test2")
+				defer res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusConflict))
+				Expect(res.Header.Get(server.NextAddressHeader)).To(Equal("21"))
+			})
+
+			It("Should write a batch at the current next address", func() {
+				res := post("/topics/t1/batch", "21", `{"events":["YQ==","Yg=="]}`)
+				defer res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+				result := struct {
+					Addresses   []uint64 `json:"addresses"`
+					NextAddress uint64   `json:"next_address"`
+				}{}
+				Expect(json.NewDecoder(res.Body).Decode(&result)).To(Succeed())
+				Expect(result.Addresses).To(Equal([]uint64{21, 39}))
+				Expect(result.NextAddress).To(Equal(uint64(57)))
+			})
+		})
+
+		Context("When subscribing with a filter", func() {
+			It("Should stream matching events and the position after skipped ones", func() {
+				for _, e := range []string{`{"amount":50}`, `{"amount":150}`, `{"amount":10}`} {
+					res := post("/topics/t1/events", "", e)
+					res.Body.Close()
+				}
+
+				res, err := http.Get(httpServer.URL + "/topics/t1/subscribe?from=0&filter=" + url.QueryEscape("data.amount > 100"))
+				Expect(err).ToNot(HaveOccurred())
+				defer res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+				d := json.NewDecoder(res.Body)
+				events := []server.SubscriptionEvent{}
+				for len(events) < 2 {
+					e := server.SubscriptionEvent{}
+					Expect(d.Decode(&e)).To(Succeed())
+					events = append(events, e)
+				}
+				Expect(string(events[0].Data)).To(Equal(`{"amount":150}`))
+				Expect(events[0].Skipped).To(BeFalse())
+				Expect(events[1].Skipped).To(BeTrue())
+				Expect(events[1].Address).To(Equal(uint64(61)))
+				Expect(events[1].NextAddress).To(Equal(uint64(91)))
+			})
+
+			It("Should expose record headers but no keys or user-defined headers", func() {
+				res := postWithHeaders("/topics/t1/events", map[string]string{server.ProducerIDHeader: "shop", server.ProducerSequenceHeader: "1"}, `{"type":"OrderPlaced"}`)
+				res.Body.Close()
+				res = post("/topics/t1/events", "", `{"type":"OrderPlaced"}`)
+				res.Body.Close()
+
+				filter := `header.producer == "shop" && key == null && header.type == null && data.type == "OrderPlaced"`
+				res, err := http.Get(httpServer.URL + "/topics/t1/subscribe?from=0&filter=" + url.QueryEscape(filter))
+				Expect(err).ToNot(HaveOccurred())
+				defer res.Body.Close()
+
+				d := json.NewDecoder(res.Body)
+				events := []server.SubscriptionEvent{}
+				for len(events) < 2 {
+					e := server.SubscriptionEvent{}
+					Expect(d.Decode(&e)).To(Succeed())
+					events = append(events, e)
+				}
+				Expect(events[0].Skipped).To(BeFalse())
+				Expect(events[0].Address).To(Equal(uint64(0)))
+				Expect(events[1].Skipped).To(BeTrue())
+			})
+
+			It("Should reject an invalid filter", func() {
+				res, err := http.Get(httpServer.URL + "/topics/t1/subscribe?filter=" + url.QueryEscape("data.amount >"))
+				Expect(err).ToNot(HaveOccurred())
+				res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+			})
+		})
+
+		Context("When the topic has a schema", func() {
+			BeforeEach(func() {
+				res := post("/topics/t1/schemas", "", `{"type": "object", "required": ["id"]}`)
+				defer res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+			})
+
+			It("Should reject invalid events", func() {
+				res := post("/topics/t1/events", "", `{"name": "x"}`)
+				res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+				res = post("/topics/t1/events", "", `{"id": 1}`)
+				res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+			})
+
+			It("Should reject incompatible versions", func() {
+				res := post("/topics/t1/schemas?compatibility=backward", "", `{"type": "object", "required": ["id", "name"]}`)
+				res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusConflict))
+
+				res, err := http.Get(httpServer.URL + "/topics/t1/schemas")
+				Expect(err).ToNot(HaveOccurred())
+				defer res.Body.Close()
+				versions := []topic.SchemaVersion{}
+				Expect(json.NewDecoder(res.Body).Decode(&versions)).To(Succeed())
+				Expect(versions).To(HaveLen(1))
+				Expect(versions[0].ID).To(Equal(uint32(1)))
+			})
+		})
+
+		Context("When the topic does not exist", func() {
+			It("Should return 404 without creating the topic", func() {
+				for _, path := range []string{"/topics/t1", "/topics/t1/events/0", "/topics/t1/subscribe", "/topics/t1/schemas"} {
+					res, err := http.Get(httpServer.URL + path)
+					Expect(err).ToNot(HaveOccurred())
+					res.Body.Close()
+					Expect(res.StatusCode).To(Equal(http.StatusNotFound))
+				}
+				Expect(s.Names()).To(BeEmpty())
+			})
+		})
+
+		Context("When a write asks for follower acks", func() {
+			It("Should wait for acks of the last event", func() {
+				acks := &fakeAckWaiter{}
+				srv.SetAckWaiter(acks)
+				res := postWithHeaders("/topics/t1/batch", map[string]string{server.AcksHeader: "2"}, `{"events": ["YQ==", "Yg=="]}`)
+				defer res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+				var written struct {
+					Addresses []uint64 `json:"addresses"`
+				}
+				Expect(json.NewDecoder(res.Body).Decode(&written)).To(Succeed())
+				Expect(written.Addresses).To(HaveLen(2))
+				Expect(acks.topicName).To(Equal("t1"))
+				Expect(acks.address).To(Equal(written.Addresses[1]))
+				Expect(acks.followers).To(Equal(2))
+			})
+
+			It("Should reject the write when the server does not replicate", func() {
+				res := postWithHeaders("/topics/t1/events", map[string]string{server.AcksHeader: "1"}, "test")
+				defer res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusNotImplemented))
+				Expect(s.Names()).To(BeEmpty())
+			})
+		})
+
+		Context("When the server is read only", func() {
+			It("Should reject writes", func() {
+				srv.SetReadOnly(true)
+				res := post("/topics/t1/events", "", "test")
+				defer res.Body.Close()
+				Expect(res.StatusCode).To(Equal(http.StatusServiceUnavailable))
+			})
+		})
+	})
+
+	Describe("Serve()", func() {
+		var listener net.Listener
+		var client *server.Client
+
+		BeforeEach(func() {
+			var err error
+			listener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			go srv.Serve(listener)
+			client, err = server.Dial(listener.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(client.Close()).To(Succeed())
+			Expect(listener.Close()).To(Succeed())
+		})
+
+		Context("When an event is written", func() {
+			BeforeEach(func() {
+				address, err := client.WriteEvent("t1", []byte("test"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(address).To(Equal(uint64(0)))
+			})
+
+			It("Should be readable", func() {
+				data, nextAddress, err := client.Read("t1", 0)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(data)).To(Equal("test"))
+				Expect(nextAddress).To(Equal(uint64(21)))
+			})
+
+			It("Should write events at the current next address", func() {
+				nextAddress, err := client.NextAddress("t1")
+				Expect(err).ToNot(HaveOccurred())
+				addresses, err := client.WriteEventsIfNextAddress("t1", nextAddress, [][]byte{[]byte("a"), []byte("b")})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(addresses).To(Equal([]uint64{21, 39}))
+			})
+
+			It("Should not duplicate a retried producer write", func() {
+				address, err := client.WriteProducerEvent("t1", "p1", 1, []byte("a"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(address).To(Equal(uint64(21)))
+				address, err = client.WriteProducerEvent("t1", "p1", 1, []byte("a"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(address).To(Equal(uint64(21)))
+				_, err = client.WriteProducerEvent("t1", "p1", 0, []byte("a"))
+				Expect(err).To(Equal(topic.ErrOutOfOrderSequence))
+			})
+
+			It("Should return ErrConcurrencyConflict for a stale next address", func() {
+				_, err := client.WriteEventIfNextAddress("t1", 0, []byte("test2"))
+				Expect(err).To(Equal(topic.ErrConcurrencyConflict))
+			})
+		})
+
+		Context("When subscribing with a filter", func() {
+			var subscriber *server.Client
+
+			BeforeEach(func() {
+				var err error
+				subscriber, err = server.Dial(listener.Addr().String())
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("Should receive matching events written later", func() {
+				_, err := client.WriteProducerEvent("t1", "p1", 1, []byte(`{"type":"OrderPlaced"}`))
+				Expect(err).ToNot(HaveOccurred())
+
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				events := make(chan server.SubscriptionEvent, 10)
+				done := make(chan error, 1)
+				go func() {
+					done <- subscriber.Subscribe(ctx, "t1", 0, `header.producer == "p2" && data.type == "OrderPlaced"`, func(e server.SubscriptionEvent) error {
+						events <- e
+						return nil
+					})
+				}()
+
+				skipped := server.SubscriptionEvent{}
+				Eventually(events).Should(Receive(&skipped))
+				Expect(skipped.Skipped).To(BeTrue())
+				Expect(skipped.Address).To(Equal(uint64(0)))
+
+				_, err = client.WriteProducerEvent("t1", "p2", 1, []byte(`{"type":"OrderShipped"}`))
+				Expect(err).ToNot(HaveOccurred())
+				address, err := client.WriteProducerEvent("t1", "p2", 2, []byte(`{"type":"OrderPlaced"}`))
+				Expect(err).ToNot(HaveOccurred())
+
+				matched := server.SubscriptionEvent{}
+				Eventually(events).Should(Receive(&matched))
+				Expect(matched.Skipped).To(BeTrue())
+				Eventually(events).Should(Receive(&matched))
+				Expect(matched.Skipped).To(BeFalse())
+				Expect(matched.Address).To(Equal(address))
+				Expect(string(matched.Data)).To(Equal(`{"type":"OrderPlaced"}`))
+
+				cancel()
+				Eventually(done).Should(Receive(Equal(context.Canceled)))
+			})
+
+			Context("When the topic ends with transaction markers", func() {
+				It("Should send the position after the markers", func() {
+					tx := s.Begin()
+					Expect(tx.WriteEvent("t1", []byte(`{"type":"OrderPlaced"}`))).To(Succeed())
+					_, err := tx.Commit()
+					Expect(err).ToNot(HaveOccurred())
+					t, err := s.Topic("t1")
+					Expect(err).ToNot(HaveOccurred())
+
+					ctx, cancel := context.WithCancel(context.Background())
+					defer cancel()
+					events := make(chan server.SubscriptionEvent, 10)
+					go subscriber.Subscribe(ctx, "t1", 0, "", func(e server.SubscriptionEvent) error {
+						events <- e
+						return nil
+					})
+
+					matched := server.SubscriptionEvent{}
+					Eventually(events).Should(Receive(&matched))
+					Expect(matched.Skipped).To(BeFalse())
+					Expect(matched.Timestamp).ToNot(BeZero())
+
+					position := server.SubscriptionEvent{}
+					Eventually(events).Should(Receive(&position))
+					Expect(position.Skipped).To(BeTrue())
+					Expect(position.NextAddress).To(Equal(t.NextAddress()))
+					Expect(position.NextAddress).To(BeNumerically(">", matched.NextAddress))
+				})
+			})
+
+			It("Should return the error of an invalid filter", func() {
+				err := subscriber.Subscribe(context.Background(), "t1", 0, "data.type ==", func(e server.SubscriptionEvent) error {
+					return nil
+				})
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Context("When the topic does not exist", func() {
+			It("Should return ErrTopicNotFound", func() {
+				_, err := client.NextAddress("t1")
+				Expect(err).To(Equal(store.ErrTopicNotFound))
+				_, _, err = client.Read("t1", 0)
+				Expect(err).To(Equal(store.ErrTopicNotFound))
+				Expect(s.Names()).To(BeEmpty())
+			})
+		})
+
+		Context("When the topic name is not valid", func() {
+			It("Should return ErrInvalidTopicName", func() {
+				_, err := client.WriteEvent("../x", []byte("test"))
+				Expect(err).To(Equal(store.ErrInvalidTopicName))
+			})
+		})
+
+		Context("When the client asks for follower acks", func() {
+			var acks *fakeAckWaiter
+			BeforeEach(func() {
+				acks = &fakeAckWaiter{}
+				srv.SetAckWaiter(acks)
+				client.SetAcks(1)
+			})
+
+			It("Should wait for the acks", func() {
+				address, err := client.WriteEvent("t1", []byte("test"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(acks.address).To(Equal(address))
+				Expect(acks.followers).To(Equal(1))
+			})
+
+			It("Should return ErrNotAcknowledged when the followers don't ack in time", func() {
+				acks.err = context.DeadlineExceeded
+				_, err := client.WriteEvent("t1", []byte("test"))
+				Expect(err).To(Equal(server.ErrNotAcknowledged))
+			})
+		})
+	})
+})
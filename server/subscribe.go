@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/draganm/zathras/filter"
+	"github.com/draganm/zathras/topic"
+)
+
+// maxSkippedEvents is the number of events that don't match a filter after
+// which the position of the subscription is sent anyway.
+const maxSkippedEvents = 1000
+
+// SubscriptionEvent is an event that matched the filter of a subscription,
+// or, when Skipped is set, a position update after events that didn't match
+// or transaction markers. Position updates carry the address of the last
+// skipped event, or the next address when only markers were skipped, and
+// no data.
+type SubscriptionEvent struct {
+	Address     uint64 `json:"address"`
+	NextAddress uint64 `json:"next_address"`
+	// Timestamp is in nanoseconds since epoch, zero when unknown.
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Data      []byte `json:"data,omitempty"`
+	Skipped   bool   `json:"skipped,omitempty"`
+}
+
+// compileFilter compiles the filter of a subscription. An empty filter matches all events.
+func compileFilter(expression string) (*filter.Filter, error) {
+	if expression == "" {
+		return nil, nil
+	}
+	return filter.Compile(expression)
+}
+
+// subscribe sends events of the topic from the address that match the
+// filter until the context is done or send fails. Skipped events and
+// transaction markers move the position forward with a position update
+// before the subscription waits for new events.
+//
+// The headers filters can refer to are the address, timestamp (nanoseconds
+// since epoch), producer, sequence and schema ID of the event. Events have no
+// keys or user-defined headers, so filters on them never match non-null values.
+func (s *Server) subscribe(ctx context.Context, req subscribeRequest, f *filter.Filter, send func(SubscriptionEvent) error) error {
+	t, err := s.store.Lookup(req.topicName)
+	if err != nil {
+		return err
+	}
+
+	c := t.NewCursor()
+	c.Seek(req.from)
+
+	skipped := SubscriptionEvent{Skipped: true}
+	skippedEvents := 0
+	// position after the last sent event or update
+	sent := req.from
+
+	for {
+		found := c.Next()
+		if !found && c.Err() == nil {
+			if skippedEvents > 0 || c.Position() > sent {
+				if skippedEvents == 0 {
+					skipped.Address = c.Position()
+				}
+				skipped.NextAddress = c.Position()
+				err = send(skipped)
+				if err != nil {
+					return err
+				}
+				sent = skipped.NextAddress
+				skippedEvents = 0
+			}
+			found = c.NextWait(ctx)
+		}
+		if !found {
+			return c.Err()
+		}
+
+		e := SubscriptionEvent{
+			Address:     c.Address(),
+			NextAddress: c.Event().NextAddress,
+			Data:        c.Event().Data,
+		}
+
+		timestamp, err := t.Timestamp(e.Address)
+		if err != nil {
+			return err
+		}
+		if !timestamp.IsZero() {
+			e.Timestamp = timestamp.UnixNano()
+		}
+
+		if f != nil {
+			headers, err := eventHeaders(t, e.Address)
+			if err != nil {
+				return err
+			}
+			if !f.Match(filter.Event{Headers: headers, Data: e.Data}) {
+				skipped.Address = e.Address
+				skipped.NextAddress = e.NextAddress
+				skippedEvents++
+				if skippedEvents < maxSkippedEvents {
+					continue
+				}
+				e = skipped
+				skippedEvents = 0
+			}
+		}
+
+		err = send(e)
+		if err != nil {
+			return err
+		}
+		sent = e.NextAddress
+	}
+}
+
+func eventHeaders(t *topic.Topic, address uint64) (map[string]string, error) {
+	headers := map[string]string{
+		"address": strconv.FormatUint(address, 10),
+	}
+
+	timestamp, err := t.Timestamp(address)
+	if err != nil {
+		return nil, err
+	}
+	if !timestamp.IsZero() {
+		headers["timestamp"] = strconv.FormatInt(timestamp.UnixNano(), 10)
+	}
+
+	producerID, sequence, err := t.Producer(address)
+	if err != nil {
+		return nil, err
+	}
+	if producerID != "" {
+		headers["producer"] = producerID
+		headers["sequence"] = strconv.FormatUint(sequence, 10)
+	}
+
+	schemaID, err := t.SchemaID(address)
+	if err != nil {
+		return nil, err
+	}
+	if schemaID != 0 {
+		headers["schema"] = strconv.FormatUint(uint64(schemaID), 10)
+	}
+
+	return headers, nil
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+
+	"github.com/draganm/zathras/internal/frame"
+)
+
+// Serve accepts binary protocol connections on the listener until it is closed.
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		s.Lock()
+		if s.conns == nil {
+			s.conns = map[net.Conn]struct{}{}
+		}
+		s.conns[conn] = struct{}{}
+		s.Unlock()
+
+		go func() {
+			err := s.serveConn(conn)
+			if err != nil && err != io.EOF {
+				log.Println("Client connection error", err)
+			}
+			s.Lock()
+			delete(s.conns, conn)
+			s.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// Close closes all binary protocol connections.
+func (s *Server) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+func (s *Server) serveConn(conn net.Conn) error {
+	for {
+		msgType, payload, err := frame.Read(conn)
+		if err != nil {
+			return err
+		}
+
+		if msgType == msgSubscribe {
+			return s.serveSubscription(conn, payload)
+		}
+
+		responseType, response := s.handle(msgType, payload)
+
+		err = frame.Write(conn, responseType, response)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// serveSubscription streams events to the connection until it is closed.
+func (s *Server) serveSubscription(conn net.Conn, payload []byte) error {
+	req, err := decodeSubscribe(payload)
+	if err != nil {
+		return frame.Write(conn, msgError, encodeError(err))
+	}
+
+	f, err := compileFilter(req.filter)
+	if err != nil {
+		return frame.Write(conn, msgError, encodeError(err))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// clients don't send anything while subscribed, reading only detects a closed connection
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		cancel()
+	}()
+
+	err = s.subscribe(ctx, req, f, func(e SubscriptionEvent) error {
+		if e.Skipped {
+			return frame.Write(conn, msgPosition, encodeSubscriptionEvent(SubscriptionEvent{Address: e.Address, NextAddress: e.NextAddress}))
+		}
+		return frame.Write(conn, msgMatched, encodeSubscriptionEvent(e))
+	})
+	if err == context.Canceled {
+		return io.EOF
+	}
+	if err != nil {
+		frame.Write(conn, msgError, encodeError(err))
+	}
+	return err
+}
+
+func (s *Server) handle(msgType byte, payload []byte) (byte, []byte) {
+	switch msgType {
+	case msgWrite:
+		req, err := decodeWrite(payload)
+		if err != nil {
+			return msgError, encodeError(err)
+		}
+		addresses, err := s.write(context.Background(), req)
+		if err != nil {
+			return msgError, encodeError(err)
+		}
+		nextAddress, err := s.nextAddress(req.topicName)
+		if err != nil {
+			return msgError, encodeError(err)
+		}
+		return msgWritten, encodeWritten(nextAddress, addresses)
+	case msgNextAddress:
+		nextAddress, err := s.nextAddress(string(payload))
+		if err != nil {
+			return msgError, encodeError(err)
+		}
+		return msgAddress, encodeAddressAndData(nextAddress, nil)
+	case msgRead:
+		address, topicName, err := decodeAddressAndData(payload)
+		if err != nil {
+			return msgError, encodeError(err)
+		}
+		data, nextAddress, err := s.read(string(topicName), address)
+		if err != nil {
+			return msgError, encodeError(err)
+		}
+		return msgEvent, encodeAddressAndData(nextAddress, data)
+	}
+	return msgError, encodeError(ErrMalformedMessage)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/draganm/zathras/partition"
+)
+
+func skew(args []string) error {
+	flags := flag.NewFlagSet("skew", flag.ExitOnError)
+	dir := flags.String("dir", ".", "directory of the partitioned topic")
+	segmentSize := flags.Uint64("segment-size", 64*1024*1024, "size of a segment file after which a new segment is started")
+	flags.Parse(args)
+
+	t, err := partition.Open(*dir, *segmentSize)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+
+	r := t.Skew()
+	for p, size := range r.Sizes {
+		fmt.Printf("partition %04d: %d bytes\n", p, size)
+	}
+	fmt.Printf("total: %d bytes, min: %d, max: %d, skew ratio: %.2f\n", r.Total, r.Min, r.Max, r.Ratio)
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package store
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/draganm/zathras/topic"
+)
+
+// ErrInvalidTopicName is returned when the topic name can't be used as a directory name
+var ErrInvalidTopicName = errors.New("Invalid topic name")
+
+// ErrTopicNotFound is returned when looking up a topic that does not exist
+var ErrTopicNotFound = errors.New("Topic not found")
+
+var topicNameMatcher = regexp.MustCompile(`^[a-zA-Z0-9_\-]+$`)
+
+// Store manages a set of named topics, each one stored in a subdirectory of
+// the store directory.
+type Store struct {
+	sync.Mutex
+	dir         string
+	segmentSize uint64
+	options     []topic.Option
+	topics      map[string]*topic.Topic
+	// transactions is the log of committed transaction IDs.
+	transactions      *topic.Topic
+	lastTransactionID uint64
+}
+
+// Open opens all topics found in the dir and creates new topics with
+// the provided segment size. The options are applied to every topic.
+func Open(dir string, segmentSize uint64, options ...topic.Option) (*Store, error) {
+	return open(dir, segmentSize, true, options)
+}
+
+// OpenReplica opens the store of a follower like Open. Transactions pending
+// in its topics stay pending until their markers are replicated from the
+// leader, or until ResolveTransactions is called on promotion.
+func OpenReplica(dir string, segmentSize uint64, options ...topic.Option) (*Store, error) {
+	return open(dir, segmentSize, false, options)
+}
+
+func open(dir string, segmentSize uint64, resolve bool, options []topic.Option) (*Store, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		dir:         dir,
+		segmentSize: segmentSize,
+		options:     options,
+		topics:      map[string]*topic.Topic{},
+	}
+
+	for _, fi := range files {
+		if fi.IsDir() && topicNameMatcher.MatchString(fi.Name()) {
+			_, err = s.Topic(fi.Name())
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+	}
+
+	err = s.openTransactionLog()
+	if err == nil && resolve {
+		err = s.ResolveTransactions()
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Topic returns the topic with the given name, creating it if it does not exist.
+func (s *Store) Topic(name string) (*topic.Topic, error) {
+	if !topicNameMatcher.MatchString(name) {
+		return nil, ErrInvalidTopicName
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	t, found := s.topics[name]
+	if found {
+		return t, nil
+	}
+
+	topicDir := filepath.Join(s.dir, name)
+	err := os.MkdirAll(topicDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err = topic.New(topicDir, s.segmentSize, s.options...)
+	if err != nil {
+		return nil, err
+	}
+
+	s.topics[name] = t
+
+	return t, nil
+}
+
+// Lookup returns the existing topic with the given name, ErrTopicNotFound
+// when there is none.
+func (s *Store) Lookup(name string) (*topic.Topic, error) {
+	if !topicNameMatcher.MatchString(name) {
+		return nil, ErrInvalidTopicName
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	t, found := s.topics[name]
+	if !found {
+		return nil, ErrTopicNotFound
+	}
+
+	return t, nil
+}
+
+// Replicated returns the topic with the name like Topic, or the transaction
+// log of the store for TransactionLogName. Replication copies both.
+func (s *Store) Replicated(name string) (*topic.Topic, error) {
+	if name == TransactionLogName {
+		return s.transactions, nil
+	}
+	return s.Topic(name)
+}
+
+// Names returns sorted names of all topics in the store.
+func (s *Store) Names() []string {
+	s.Lock()
+	defer s.Unlock()
+	names := []string{}
+	for n := range s.topics {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close closes all topics of the store.
+func (s *Store) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	var firstErr error
+	for n, t := range s.topics {
+		err := t.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(s.topics, n)
+	}
+	if s.transactions != nil {
+		err := s.transactions.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		s.transactions = nil
+	}
+	return firstErr
+}
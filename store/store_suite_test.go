@@ -0,0 +1,191 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/draganm/zathras/store"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Store Suite")
+}
+
+var _ = Describe("Store", func() {
+	var storeDir string
+	var s *store.Store
+
+	BeforeEach(func() {
+		var err error
+		storeDir, err = ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+		s, err = store.Open(storeDir, 1024)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(s.Close()).To(Succeed())
+		Expect(os.RemoveAll(storeDir)).To(Succeed())
+	})
+
+	Describe("Topic()", func() {
+		Context("When the topic name is not valid", func() {
+			It("Should return ErrInvalidTopicName", func() {
+				_, err := s.Topic("../x")
+				Expect(err).To(Equal(store.ErrInvalidTopicName))
+			})
+		})
+
+		Context("When an event is written to a new topic", func() {
+			BeforeEach(func() {
+				t, err := s.Topic("t1")
+				Expect(err).ToNot(HaveOccurred())
+				_, err = t.WriteEvent([]byte("test"))
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("Should list the topic", func() {
+				Expect(s.Names()).To(Equal([]string{"t1"}))
+			})
+
+			Context("When the store is reopened", func() {
+				BeforeEach(func() {
+					Expect(s.Close()).To(Succeed())
+					var err error
+					s, err = store.Open(storeDir, 1024)
+					Expect(err).ToNot(HaveOccurred())
+				})
+
+				It("Should retain the topic and its data", func() {
+					Expect(s.Names()).To(Equal([]string{"t1"}))
+					t, err := s.Topic("t1")
+					Expect(err).ToNot(HaveOccurred())
+					data, _, err := t.Read(0)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(data).To(Equal([]byte("test")))
+				})
+			})
+		})
+	})
+})
+
+var _ = Describe("Transaction", func() {
+	var storeDir string
+	var s *store.Store
+
+	BeforeEach(func() {
+		var err error
+		storeDir, err = ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+		s, err = store.Open(storeDir, 1024)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(s.Close()).To(Succeed())
+		Expect(os.RemoveAll(storeDir)).To(Succeed())
+	})
+
+	readAll := func(name string) []string {
+		t, err := s.Topic(name)
+		Expect(err).ToNot(HaveOccurred())
+		events := []string{}
+		Expect(t.ReadEvents(func(nextAddress uint64, data []byte) error {
+			events = append(events, string(data))
+			return nil
+		})).To(Succeed())
+		return events
+	}
+
+	Context("When a transaction is committed", func() {
+		BeforeEach(func() {
+			tx := s.Begin()
+			Expect(tx.WriteEvent("t1", []byte("a"))).To(Succeed())
+			Expect(tx.WriteEvent("t2", []byte("b"))).To(Succeed())
+			Expect(tx.WriteEvent("t1", []byte("c"))).To(Succeed())
+			addresses, err := tx.Commit()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(addresses).To(HaveKeyWithValue("t1", []uint64{34, 52}))
+			Expect(addresses).To(HaveKeyWithValue("t2", []uint64{34}))
+			_, err = tx.Commit()
+			Expect(err).To(Equal(store.ErrTransactionDone))
+		})
+
+		It("Should write the events to all topics", func() {
+			Expect(readAll("t1")).To(Equal([]string{"a", "c"}))
+			Expect(readAll("t2")).To(Equal([]string{"b"}))
+			Expect(s.Names()).To(Equal([]string{"t1", "t2"}))
+		})
+	})
+
+	Context("When a transaction is aborted", func() {
+		It("Should not write any events", func() {
+			tx := s.Begin()
+			Expect(tx.WriteEvent("t1", []byte("a"))).To(Succeed())
+			tx.Abort()
+			Expect(tx.WriteEvent("t1", []byte("a"))).To(Equal(store.ErrTransactionDone))
+			Expect(s.Names()).To(BeEmpty())
+		})
+	})
+
+	Context("When the store is reopened with a prepared transaction", func() {
+		BeforeEach(func() {
+			t, err := s.Topic("t1")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = t.PrepareTransaction(1, [][]byte{[]byte("a")})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.Close()).To(Succeed())
+			s, err = store.Open(storeDir, 1024)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should abort the transaction", func() {
+			Expect(readAll("t1")).To(BeEmpty())
+			t, err := s.Topic("t1")
+			Expect(err).ToNot(HaveOccurred())
+			_, pending := t.PendingTransaction()
+			Expect(pending).To(BeFalse())
+			_, err = t.WriteEvent([]byte("b"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(readAll("t1")).To(Equal([]string{"b"}))
+		})
+	})
+
+	Context("When a replica is reopened with a transaction committed on the leader", func() {
+		BeforeEach(func() {
+			t, err := s.Topic("t1")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = t.PrepareTransaction(1, [][]byte{[]byte("a")})
+			Expect(err).ToNot(HaveOccurred())
+			transactions, err := s.Replicated(store.TransactionLogName)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = transactions.WriteEvent([]byte{0, 0, 0, 0, 0, 0, 0, 1})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(s.Close()).To(Succeed())
+			s, err = store.OpenReplica(storeDir, 1024)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should keep the transaction pending", func() {
+			t, err := s.Topic("t1")
+			Expect(err).ToNot(HaveOccurred())
+			_, pending := t.PendingTransaction()
+			Expect(pending).To(BeTrue())
+		})
+
+		It("Should commit the transaction when it is resolved", func() {
+			Expect(s.ResolveTransactions()).To(Succeed())
+			Expect(readAll("t1")).To(Equal([]string{"a"}))
+			tx := s.Begin()
+			Expect(tx.WriteEvent("t1", []byte("b"))).To(Succeed())
+			_, err := tx.Commit()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(readAll("t1")).To(Equal([]string{"a", "b"}))
+		})
+	})
+})
@@ -0,0 +1,230 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/draganm/zathras/topic"
+)
+
+// ErrTransactionDone is returned when using a transaction that was already committed or aborted
+var ErrTransactionDone = errors.New("Transaction is already done")
+
+// transactionLogDir holds IDs of committed transactions. The name is not a
+// valid topic name, so the log is not listed as a topic.
+const transactionLogDir = ".transactions"
+
+// TransactionLogName is the name the transaction log is replicated with.
+const TransactionLogName = transactionLogDir
+
+// Transaction collects events for several topics that are written together
+// on commit. Events of a transaction are invisible to readers until all of
+// them are written, and never become visible when the transaction is aborted
+// or the process crashes before commit.
+type Transaction struct {
+	store  *Store
+	events map[string][][]byte
+	done   bool
+}
+
+// Begin starts a new transaction.
+func (s *Store) Begin() *Transaction {
+	return &Transaction{
+		store:  s,
+		events: map[string][][]byte{},
+	}
+}
+
+// WriteEvent adds an event for the topic to the transaction.
+func (tx *Transaction) WriteEvent(topicName string, data []byte) error {
+	if tx.done {
+		return ErrTransactionDone
+	}
+	if !topicNameMatcher.MatchString(topicName) {
+		return ErrInvalidTopicName
+	}
+	tx.events[topicName] = append(tx.events[topicName], data)
+	return nil
+}
+
+// Abort discards the events of the transaction.
+func (tx *Transaction) Abort() {
+	tx.done = true
+	tx.events = nil
+}
+
+// Commit writes all events of the transaction and returns their addresses per topic.
+// Topics are prepared one after the other, the transaction is committed once
+// its ID is written to the transaction log of the store. Topics that can't be
+// finished afterwards stay pending until ResolveTransactions is called, or
+// the store is opened again.
+func (tx *Transaction) Commit() (map[string][]uint64, error) {
+	if tx.done {
+		return nil, ErrTransactionDone
+	}
+	tx.done = true
+
+	if len(tx.events) == 0 {
+		return map[string][]uint64{}, nil
+	}
+
+	names := []string{}
+	for name := range tx.events {
+		names = append(names, name)
+	}
+	// topics are always prepared in the same order so that concurrent
+	// transactions don't deadlock
+	sort.Strings(names)
+
+	topics := []*topic.Topic{}
+	for _, name := range names {
+		t, err := tx.store.Topic(name)
+		if err != nil {
+			return nil, err
+		}
+		topics = append(topics, t)
+	}
+
+	id := tx.store.nextTransactionID()
+
+	addresses := map[string][]uint64{}
+	for i, t := range topics {
+		a, err := t.PrepareTransaction(id, tx.events[names[i]])
+		if err != nil {
+			abortTransaction(topics[:i], id)
+			return nil, err
+		}
+		addresses[names[i]] = a
+	}
+
+	idData := make([]byte, 8)
+	binary.BigEndian.PutUint64(idData, id)
+	_, err := tx.store.transactions.WriteEvent(idData)
+	if err != nil {
+		abortTransaction(topics, id)
+		return nil, err
+	}
+
+	for i, t := range topics {
+		err = t.CommitTransaction(id)
+		if err != nil {
+			log.Println("Could not finish committed transaction", id, "in", names[i], err)
+		}
+	}
+
+	return addresses, nil
+}
+
+// Sync flushes the topics with the names and the transaction log to disk, so
+// that transactions committed to the topics survive a crash.
+func (s *Store) Sync(names ...string) error {
+	for _, name := range names {
+		t, err := s.Lookup(name)
+		if err != nil {
+			return err
+		}
+		err = t.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return s.transactions.Sync()
+}
+
+func abortTransaction(topics []*topic.Topic, id uint64) {
+	for _, t := range topics {
+		t.AbortTransaction(id)
+	}
+}
+
+func (s *Store) nextTransactionID() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	s.lastTransactionID++
+	return s.lastTransactionID
+}
+
+func (s *Store) openTransactionLog() error {
+	dir := filepath.Join(s.dir, transactionLogDir)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	s.transactions, err = topic.New(dir, s.segmentSize)
+	return err
+}
+
+// ResolveTransactions finishes transactions that are pending in the topics:
+// those in the transaction log are committed, all others are aborted. It is
+// called when the store is opened; a replica has to call it when promoted.
+// It must not be called while transactions are committed.
+func (s *Store) ResolveTransactions() error {
+	last, err := s.transactions.Last(1)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	if len(last) == 1 {
+		id := binary.BigEndian.Uint64(last[0].Data)
+		if id > s.lastTransactionID {
+			s.lastTransactionID = id
+		}
+	}
+	topics := []*topic.Topic{}
+	for _, t := range s.topics {
+		topics = append(topics, t)
+	}
+	s.Unlock()
+
+	for _, t := range topics {
+		id, pending := t.PendingTransaction()
+		if !pending {
+			continue
+		}
+
+		s.Lock()
+		if id > s.lastTransactionID {
+			s.lastTransactionID = id
+		}
+		s.Unlock()
+
+		committed, err := s.committed(id)
+		if err != nil {
+			return err
+		}
+
+		if committed {
+			err = t.CommitTransaction(id)
+		} else {
+			err = t.AbortTransaction(id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// committed returns true when the ID is in the transaction log. IDs are
+// increasing, so the log is searched from the end.
+func (s *Store) committed(id uint64) (bool, error) {
+	found := false
+	err := s.transactions.ReadBackward(s.transactions.NextAddress(), func(address, nextAddress uint64, data []byte) error {
+		logged := binary.BigEndian.Uint64(data)
+		if logged == id {
+			found = true
+		}
+		if logged <= id {
+			return topic.ErrStop
+		}
+		return nil
+	})
+	return found, err
+}
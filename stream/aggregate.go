@@ -0,0 +1,578 @@
+package stream
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/draganm/zathras/store"
+	"github.com/draganm/zathras/topic"
+)
+
+// ErrInvalidAggregation is returned when running an aggregation without a valid name, source or output
+var ErrInvalidAggregation = errors.New("Invalid aggregation")
+
+// snapshotInterval is the number of source events between full snapshots of
+// the state. Changelog segments before a snapshot are deleted.
+const snapshotInterval = 1000
+
+// Aggregator folds event data of a window into an accumulator. Accumulators
+// are JSON values.
+type Aggregator struct {
+	// Init returns the accumulator of an empty window.
+	Init func() json.RawMessage
+	// Add adds event data to the accumulator.
+	Add func(acc json.RawMessage, data []byte) (json.RawMessage, error)
+	// Merge combines accumulators of two session windows that are merged.
+	Merge func(a, b json.RawMessage) (json.RawMessage, error)
+}
+
+// Count counts events.
+func Count() Aggregator {
+	return Sum(func(data []byte) (float64, error) {
+		return 1, nil
+	})
+}
+
+// Sum sums the values of events.
+func Sum(value func(data []byte) (float64, error)) Aggregator {
+	parse := func(acc json.RawMessage) (float64, error) {
+		return strconv.ParseFloat(string(acc), 64)
+	}
+	format := func(v float64) json.RawMessage {
+		return json.RawMessage(strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	return Aggregator{
+		Init: func() json.RawMessage {
+			return format(0)
+		},
+		Add: func(acc json.RawMessage, data []byte) (json.RawMessage, error) {
+			sum, err := parse(acc)
+			if err != nil {
+				return nil, err
+			}
+			v, err := value(data)
+			if err != nil {
+				return nil, err
+			}
+			return format(sum + v), nil
+		},
+		Merge: func(a, b json.RawMessage) (json.RawMessage, error) {
+			x, err := parse(a)
+			if err != nil {
+				return nil, err
+			}
+			y, err := parse(b)
+			if err != nil {
+				return nil, err
+			}
+			return format(x + y), nil
+		},
+	}
+}
+
+// WindowResult is written to the output topic when a window closes.
+type WindowResult struct {
+	Key   string          `json:"key"`
+	Start time.Time       `json:"start"`
+	End   time.Time       `json:"end"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Aggregation folds events of a source topic per key and window.
+type Aggregation struct {
+	name       string
+	source     string
+	output     string
+	window     Window
+	aggregator Aggregator
+	key        func(data []byte) string
+	lateness   time.Duration
+}
+
+// Aggregate returns an aggregation of events of the source topic into the
+// windows. The name identifies the aggregation and its state.
+func Aggregate(name, source string, w Window, a Aggregator) *Aggregation {
+	return &Aggregation{
+		name:       name,
+		source:     source,
+		window:     w,
+		aggregator: a,
+		key: func(data []byte) string {
+			return ""
+		},
+	}
+}
+
+// KeyBy aggregates events with different keys separately.
+func (a *Aggregation) KeyBy(fn func(data []byte) string) *Aggregation {
+	a.key = fn
+	return a
+}
+
+// AllowLateness keeps windows open for events arriving up to d after the
+// latest event time seen. The watermark is the latest event time minus d.
+// Windows are closed when the watermark passes their end, later events for
+// closed windows are dropped.
+func (a *Aggregation) AllowLateness(d time.Duration) *Aggregation {
+	a.lateness = d
+	return a
+}
+
+// To writes a WindowResult to the output topic for every closed window.
+func (a *Aggregation) To(output string) *Aggregation {
+	a.output = output
+	return a
+}
+
+// ChangelogTopic returns the name of the topic backing the state of the aggregation.
+func ChangelogTopic(name string) string {
+	return "stream-" + name + "-changelog"
+}
+
+type windowState struct {
+	Key   string          `json:"key"`
+	Start int64           `json:"start"`
+	End   int64           `json:"end"`
+	Value json.RawMessage `json:"value"`
+}
+
+func stateID(key string, start int64) string {
+	return key + "\x00" + strconv.FormatInt(start, 10)
+}
+
+// changelogEntry records changes of the state caused by a batch of source events.
+type changelogEntry struct {
+	// Position is the address of the next unprocessed source event.
+	Position uint64 `json:"position"`
+	// MaxTime is the latest event time seen.
+	MaxTime int64 `json:"max_time"`
+	// Updates holds changed windows, nil for closed windows.
+	Updates map[string]*windowState `json:"updates,omitempty"`
+	// IsSnapshot is set when Snapshot holds the whole state instead of
+	// updates. The state of a snapshot can be empty.
+	IsSnapshot bool                    `json:"is_snapshot,omitempty"`
+	Snapshot   map[string]*windowState `json:"snapshot,omitempty"`
+}
+
+// snapshot returns true when the entry holds the whole state. Entries
+// written before IsSnapshot only have a non empty Snapshot.
+func (e *changelogEntry) snapshot() bool {
+	return e.IsSnapshot || e.Snapshot != nil
+}
+
+// windowEnd is the end of a window in the ends heap of the runner.
+type windowEnd struct {
+	end int64
+	id  string
+}
+
+// windowEnds is a heap of window ends, earliest first. Ends of windows
+// that were closed or extended since stay in the heap and are skipped.
+type windowEnds []windowEnd
+
+func (h windowEnds) Len() int            { return len(h) }
+func (h windowEnds) Less(i, j int) bool  { return h[i].end < h[j].end }
+func (h windowEnds) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *windowEnds) Push(x interface{}) { *h = append(*h, x.(windowEnd)) }
+func (h *windowEnds) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+type aggregationRunner struct {
+	store       *store.Store
+	aggregation *Aggregation
+	state       map[string]*windowState
+	// ends and keys index the windows of the state by end and by key.
+	ends     windowEnds
+	keys     map[string]map[string]bool
+	position uint64
+	started  bool
+	maxTime  int64
+	// events is the number of events processed since the last snapshot.
+	events int
+}
+
+// aggregationBatch collects the changes of the state and the closed windows
+// of events that are committed together.
+type aggregationBatch struct {
+	updates map[string]*windowState
+	closed  []*windowState
+}
+
+// RunAggregation aggregates events of the source, starting with the state
+// restored from the changelog topic, until the context is done or an error
+// occurs. Events written without a timestamp get the processing time.
+func RunAggregation(ctx context.Context, s *store.Store, a *Aggregation) error {
+	if !nameMatcher.MatchString(a.name) || !nameMatcher.MatchString(a.source) || !nameMatcher.MatchString(a.output) || a.window == nil || !a.window.valid() {
+		return ErrInvalidAggregation
+	}
+
+	r := &aggregationRunner{
+		store:       s,
+		aggregation: a,
+		state:       map[string]*windowState{},
+		keys:        map[string]map[string]bool{},
+	}
+
+	err := r.restore()
+	if err != nil {
+		return err
+	}
+
+	t, err := s.Topic(a.source)
+	if err != nil {
+		return err
+	}
+
+	c := t.NewCursor()
+	if r.started {
+		c.Seek(r.position)
+	}
+
+	for c.NextWait(ctx) {
+		b := &aggregationBatch{updates: map[string]*windowState{}}
+		for n := 0; ; n++ {
+			ts, err := t.Timestamp(c.Address())
+			if err != nil {
+				return err
+			}
+			if ts.IsZero() {
+				ts = time.Now()
+			}
+
+			e := c.Event()
+			err = r.process(b, ts.UnixNano(), e.NextAddress, e.Data)
+			if err != nil {
+				return err
+			}
+			if n+1 >= maxBatchSize || !c.Next() {
+				break
+			}
+		}
+
+		err = r.commit(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Err() != nil {
+		return c.Err()
+	}
+
+	return ctx.Err()
+}
+
+// restore rebuilds the state from the last snapshot and the following changelog entries.
+func (r *aggregationRunner) restore() error {
+	t, err := r.store.Topic(ChangelogTopic(r.aggregation.name))
+	if err != nil {
+		return err
+	}
+
+	entries := []*changelogEntry{}
+	err = t.ReadBackward(t.NextAddress(), func(address, nextAddress uint64, data []byte) error {
+		e := &changelogEntry{}
+		err := json.Unmarshal(data, e)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, e)
+		if e.snapshot() {
+			return topic.ErrStop
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.snapshot() {
+			r.state = map[string]*windowState{}
+			r.ends = nil
+			r.keys = map[string]map[string]bool{}
+			r.apply(e.Snapshot)
+		}
+		r.apply(e.Updates)
+		r.position = e.Position
+		r.maxTime = e.MaxTime
+		r.started = true
+	}
+
+	return nil
+}
+
+func (r *aggregationRunner) apply(updates map[string]*windowState) {
+	for id, ws := range updates {
+		if ws == nil {
+			r.remove(id)
+		} else {
+			r.set(id, ws)
+		}
+	}
+}
+
+func (r *aggregationRunner) set(id string, ws *windowState) {
+	old := r.state[id]
+	r.state[id] = ws
+	if old == nil || old.End != ws.End {
+		heap.Push(&r.ends, windowEnd{end: ws.End, id: id})
+	}
+	if old == nil {
+		ids := r.keys[ws.Key]
+		if ids == nil {
+			ids = map[string]bool{}
+			r.keys[ws.Key] = ids
+		}
+		ids[id] = true
+	}
+}
+
+func (r *aggregationRunner) remove(id string) {
+	ws := r.state[id]
+	if ws == nil {
+		return
+	}
+	delete(r.state, id)
+	delete(r.keys[ws.Key], id)
+	if len(r.keys[ws.Key]) == 0 {
+		delete(r.keys, ws.Key)
+	}
+}
+
+// closeWindows removes the windows passed by the watermark from the state
+// and returns them.
+func (r *aggregationRunner) closeWindows(watermark int64) []*windowState {
+	closed := []*windowState{}
+	for len(r.ends) > 0 && r.ends[0].end <= watermark {
+		e := heap.Pop(&r.ends).(windowEnd)
+		ws := r.state[e.id]
+		if ws == nil || ws.End != e.end {
+			continue
+		}
+		closed = append(closed, ws)
+		r.remove(e.id)
+	}
+	return closed
+}
+
+func (r *aggregationRunner) watermark() int64 {
+	return r.maxTime - int64(r.aggregation.lateness)
+}
+
+// process adds the event to its windows, closes windows passed by the
+// watermark and adds the changes to the batch.
+func (r *aggregationRunner) process(b *aggregationBatch, ts int64, nextAddress uint64, data []byte) error {
+	a := r.aggregation
+	if ts > r.maxTime {
+		r.maxTime = ts
+	}
+	watermark := r.watermark()
+
+	updates := map[string]*windowState{}
+	key := a.key(data)
+
+	ranges := a.window.windows(ts)
+	if _, isSession := a.window.(session); isSession {
+		merged, err := r.mergeSessions(key, ranges[0], updates)
+		if err != nil {
+			return err
+		}
+		ranges = []timeRange{merged}
+	}
+
+	for _, w := range ranges {
+		if w.end <= watermark {
+			// late event for a closed window
+			continue
+		}
+		id := stateID(key, w.start)
+		ws := updates[id]
+		if ws == nil {
+			ws = r.state[id]
+		}
+		if ws == nil {
+			ws = &windowState{Key: key, Start: w.start, End: w.end, Value: a.aggregator.Init()}
+		}
+		value, err := a.aggregator.Add(ws.Value, data)
+		if err != nil {
+			return err
+		}
+		updates[id] = &windowState{Key: key, Start: w.start, End: w.end, Value: value}
+	}
+
+	r.apply(updates)
+
+	closed := r.closeWindows(watermark)
+	for _, ws := range closed {
+		updates[stateID(ws.Key, ws.Start)] = nil
+	}
+	sort.Slice(closed, func(i, j int) bool {
+		if closed[i].End != closed[j].End {
+			return closed[i].End < closed[j].End
+		}
+		return closed[i].Key < closed[j].Key
+	})
+
+	for id, ws := range updates {
+		b.updates[id] = ws
+	}
+	b.closed = append(b.closed, closed...)
+
+	r.position = nextAddress
+	r.events++
+
+	return nil
+}
+
+// commit writes the results and the changelog entry of the batch. Every
+// snapshotInterval events the entry is a snapshot, once it is synced the
+// changelog segments before it are deleted.
+func (r *aggregationRunner) commit(b *aggregationBatch) error {
+	entry := &changelogEntry{
+		Position: r.position,
+		MaxTime:  r.maxTime,
+		Updates:  b.updates,
+	}
+	if r.events >= snapshotInterval {
+		entry.Updates = nil
+		entry.IsSnapshot = true
+		entry.Snapshot = r.state
+		r.events = 0
+	}
+
+	address, err := r.write(b.closed, entry)
+	if err != nil {
+		return err
+	}
+
+	if entry.IsSnapshot {
+		// the snapshot is committed, failing to compact only keeps the changelog longer
+		err = r.compactChangelog(address)
+		if err != nil {
+			log.Println("Could not compact changelog of aggregation", r.aggregation.name, err)
+		}
+	}
+
+	return nil
+}
+
+// compactChangelog deletes the changelog segments before the snapshot at the address.
+func (r *aggregationRunner) compactChangelog(address uint64) error {
+	name := ChangelogTopic(r.aggregation.name)
+	err := r.store.Sync(name)
+	if err != nil {
+		return err
+	}
+
+	t, err := r.store.Topic(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.DeleteSegmentsBefore(address)
+	return err
+}
+
+// mergeSessions merges the new session range with existing overlapping
+// sessions of the key, earliest first, and returns the merged range.
+func (r *aggregationRunner) mergeSessions(key string, w timeRange, updates map[string]*windowState) (timeRange, error) {
+	a := r.aggregation
+
+	ids := []string{}
+	for id := range r.keys[key] {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return r.state[ids[i]].Start < r.state[ids[j]].Start
+	})
+
+	var value json.RawMessage
+	merged := false
+	for _, id := range ids {
+		ws := r.state[id]
+		if ws.Start >= w.end || ws.End <= w.start {
+			continue
+		}
+		if ws.Start < w.start {
+			w.start = ws.Start
+		}
+		if ws.End > w.end {
+			w.end = ws.End
+		}
+		if !merged {
+			value = ws.Value
+			merged = true
+		} else {
+			var err error
+			value, err = a.aggregator.Merge(value, ws.Value)
+			if err != nil {
+				return timeRange{}, err
+			}
+		}
+		r.remove(id)
+		updates[id] = nil
+	}
+
+	if merged {
+		// the merged session continues with the accumulated value
+		updates[stateID(key, w.start)] = &windowState{Key: key, Start: w.start, End: w.end, Value: value}
+	}
+
+	return w, nil
+}
+
+// write writes the results of the closed windows and the changelog entry in
+// one transaction and returns the address of the entry.
+func (r *aggregationRunner) write(closed []*windowState, entry *changelogEntry) (uint64, error) {
+	a := r.aggregation
+	tx := r.store.Begin()
+
+	for _, ws := range closed {
+		result, err := json.Marshal(WindowResult{
+			Key:   ws.Key,
+			Start: time.Unix(0, ws.Start).UTC(),
+			End:   time.Unix(0, ws.End).UTC(),
+			Value: ws.Value,
+		})
+		if err != nil {
+			tx.Abort()
+			return 0, err
+		}
+		err = tx.WriteEvent(a.output, result)
+		if err != nil {
+			tx.Abort()
+			return 0, err
+		}
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		tx.Abort()
+		return 0, err
+	}
+
+	err = tx.WriteEvent(ChangelogTopic(a.name), data)
+	if err != nil {
+		tx.Abort()
+		return 0, err
+	}
+
+	addresses, err := tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return addresses[ChangelogTopic(a.name)][0], nil
+}
@@ -0,0 +1,180 @@
+// Package stream derives topics from other topics. A pipeline reads events
+// of its source topics, passes them through filter, map, flat map and branch
+// stages and writes the results to sink topics. Results are written in the
+// same store transaction as the position of the source, so every source
+// event is processed effectively once, even when the process crashes.
+//
+//	p := stream.From("enrich", "orders").
+//		Filter(isValid).
+//		Map(enrich).
+//		Branch(isLarge, "large-orders").
+//		To("enriched-orders")
+//	err := stream.Run(ctx, s, p)
+package stream
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// ErrInvalidPipeline is returned when running a pipeline without a valid name or sources
+var ErrInvalidPipeline = errors.New("Invalid pipeline")
+
+var nameMatcher = regexp.MustCompile(`^[a-zA-Z0-9_\-]+$`)
+
+// record is data flowing through a pipeline. Records routed to a sink skip
+// the following stages.
+type record struct {
+	sink string
+	data []byte
+}
+
+type stage func(data []byte) ([]record, error)
+
+// Pipeline is a sequence of stages from source topics to sink topics.
+type Pipeline struct {
+	name    string
+	sources []string
+	stages  []stage
+}
+
+// From starts a pipeline reading the source topics. The name identifies the
+// pipeline and its checkpoints, it must stay the same across restarts.
+func From(name string, sources ...string) *Pipeline {
+	return &Pipeline{
+		name:    name,
+		sources: sources,
+	}
+}
+
+// Name returns the name of the pipeline.
+func (p *Pipeline) Name() string {
+	return p.name
+}
+
+// Filter drops data for which fn returns false.
+func (p *Pipeline) Filter(fn func(data []byte) bool) *Pipeline {
+	return p.add(func(data []byte) ([]record, error) {
+		if !fn(data) {
+			return nil, nil
+		}
+		return []record{{data: data}}, nil
+	})
+}
+
+// Map replaces data with the result of fn.
+func (p *Pipeline) Map(fn func(data []byte) ([]byte, error)) *Pipeline {
+	return p.add(func(data []byte) ([]record, error) {
+		mapped, err := fn(data)
+		if err != nil {
+			return nil, err
+		}
+		return []record{{data: mapped}}, nil
+	})
+}
+
+// FlatMap replaces data with any number of results of fn.
+func (p *Pipeline) FlatMap(fn func(data []byte) ([][]byte, error)) *Pipeline {
+	return p.add(func(data []byte) ([]record, error) {
+		results, err := fn(data)
+		if err != nil {
+			return nil, err
+		}
+		records := make([]record, len(results))
+		for i, r := range results {
+			records[i] = record{data: r}
+		}
+		return records, nil
+	})
+}
+
+// Branch writes data for which fn returns true to the sink topic. Other data
+// continues through the following stages.
+func (p *Pipeline) Branch(fn func(data []byte) bool, sink string) *Pipeline {
+	return p.add(func(data []byte) ([]record, error) {
+		if fn(data) {
+			return []record{{sink: sink, data: data}}, nil
+		}
+		return []record{{data: data}}, nil
+	})
+}
+
+// To writes all data reaching the end of the pipeline to the sink topic.
+func (p *Pipeline) To(sink string) *Pipeline {
+	return p.add(func(data []byte) ([]record, error) {
+		return []record{{sink: sink, data: data}}, nil
+	})
+}
+
+func (p *Pipeline) add(s stage) *Pipeline {
+	p.stages = append(p.stages, s)
+	return p
+}
+
+// process passes the data through all stages and returns the records routed to sinks.
+func (p *Pipeline) process(data []byte) ([]record, error) {
+	records := []record{{data: data}}
+	for _, s := range p.stages {
+		next := []record{}
+		for _, r := range records {
+			if r.sink != "" {
+				next = append(next, r)
+				continue
+			}
+			results, err := s(r.data)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, results...)
+		}
+		records = next
+	}
+
+	routed := records[:0]
+	for _, r := range records {
+		if r.sink != "" {
+			routed = append(routed, r)
+		}
+	}
+
+	return routed, nil
+}
+
+func (p *Pipeline) valid() bool {
+	if !nameMatcher.MatchString(p.name) || len(p.sources) == 0 {
+		return false
+	}
+	for _, source := range p.sources {
+		if !nameMatcher.MatchString(source) {
+			return false
+		}
+	}
+	return true
+}
+
+var registryLock sync.Mutex
+var registry = map[string]*Pipeline{}
+
+// Register makes the pipeline run inside zathras serve. Binaries embedding
+// pipelines usually register them in an init function.
+func Register(p *Pipeline) {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry[p.name] = p
+}
+
+// Registered returns all registered pipelines sorted by name.
+func Registered() []*Pipeline {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	pipelines := []*Pipeline{}
+	for _, p := range registry {
+		pipelines = append(pipelines, p)
+	}
+	sort.Slice(pipelines, func(i, j int) bool {
+		return pipelines[i].name < pipelines[j].name
+	})
+	return pipelines
+}
@@ -0,0 +1,165 @@
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/draganm/zathras/store"
+)
+
+// checkpoint holds the address of the next unprocessed event of every source.
+type checkpoint struct {
+	Positions map[string]uint64 `json:"positions"`
+}
+
+// CheckpointTopic returns the name of the topic holding checkpoints of the pipeline.
+func CheckpointTopic(name string) string {
+	return "stream-" + name + "-checkpoints"
+}
+
+// maxBatchSize is the maximal number of events processed before a checkpoint.
+const maxBatchSize = 1000
+
+// runner processes events of all sources of a pipeline. Events that are
+// available are processed in batches, each committed with its checkpoint.
+type runner struct {
+	sync.Mutex
+	store    *store.Store
+	pipeline *Pipeline
+	cp       checkpoint
+}
+
+// Run processes events of the sources of the pipeline, starting after the
+// last checkpoint, until the context is done or an error occurs.
+func Run(ctx context.Context, s *store.Store, p *Pipeline) error {
+	if !p.valid() {
+		return ErrInvalidPipeline
+	}
+
+	r := &runner{
+		store:    s,
+		pipeline: p,
+		cp:       checkpoint{Positions: map[string]uint64{}},
+	}
+
+	err := r.loadCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(p.sources))
+	for _, source := range p.sources {
+		go func(source string) {
+			err := r.follow(ctx, source)
+			if err != nil {
+				cancel()
+			}
+			errs <- err
+		}(source)
+	}
+
+	var firstErr error
+	for range p.sources {
+		err := <-errs
+		if err != nil && err != context.Canceled && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+
+	return firstErr
+}
+
+func (r *runner) loadCheckpoint() error {
+	t, err := r.store.Topic(CheckpointTopic(r.pipeline.name))
+	if err != nil {
+		return err
+	}
+
+	last, err := t.Last(1)
+	if err != nil {
+		return err
+	}
+
+	if len(last) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(last[0].Data, &r.cp)
+}
+
+func (r *runner) follow(ctx context.Context, source string) error {
+	t, err := r.store.Topic(source)
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	position, found := r.cp.Positions[source]
+	r.Unlock()
+
+	c := t.NewCursor()
+	if found {
+		c.Seek(position)
+	}
+
+	for c.NextWait(ctx) {
+		records := []record{}
+		for n := 0; ; n++ {
+			results, err := r.pipeline.process(c.Event().Data)
+			if err != nil {
+				return err
+			}
+			records = append(records, results...)
+			position = c.Event().NextAddress
+			if n+1 >= maxBatchSize || !c.Next() {
+				break
+			}
+		}
+
+		err = r.commit(source, position, records)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.Err()
+}
+
+// commit writes the results of a batch of events and the position of the
+// source after the batch in one transaction.
+func (r *runner) commit(source string, nextAddress uint64, records []record) error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.cp.Positions[source] = nextAddress
+	cp, err := json.Marshal(r.cp)
+	if err != nil {
+		return err
+	}
+
+	tx := r.store.Begin()
+	for _, rec := range records {
+		err = tx.WriteEvent(rec.sink, rec.data)
+		if err != nil {
+			tx.Abort()
+			return err
+		}
+	}
+
+	err = tx.WriteEvent(CheckpointTopic(r.pipeline.name), cp)
+	if err != nil {
+		tx.Abort()
+		return err
+	}
+
+	_, err = tx.Commit()
+	return err
+}
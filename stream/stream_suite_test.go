@@ -0,0 +1,335 @@
+package stream_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/draganm/zathras/store"
+	"github.com/draganm/zathras/stream"
+	"github.com/draganm/zathras/topic"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Stream Suite")
+}
+
+var _ = Describe("Run()", func() {
+	var storeDir string
+	var s *store.Store
+	var p *stream.Pipeline
+	var cancel context.CancelFunc
+	var done chan error
+
+	readAll := func(name string) []string {
+		t, err := s.Topic(name)
+		Expect(err).ToNot(HaveOccurred())
+		events := []string{}
+		Expect(t.ReadEvents(func(nextAddress uint64, data []byte) error {
+			events = append(events, string(data))
+			return nil
+		})).To(Succeed())
+		return events
+	}
+
+	write := func(events ...string) {
+		t, err := s.Topic("in")
+		Expect(err).ToNot(HaveOccurred())
+		for _, e := range events {
+			_, err = t.WriteEvent([]byte(e))
+			Expect(err).ToNot(HaveOccurred())
+		}
+	}
+
+	start := func() {
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		done = make(chan error, 1)
+		go func() {
+			done <- stream.Run(ctx, s, p)
+		}()
+	}
+
+	stop := func() {
+		cancel()
+		Eventually(done).Should(Receive(Equal(context.Canceled)))
+	}
+
+	BeforeEach(func() {
+		var err error
+		storeDir, err = ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+		s, err = store.Open(storeDir, 1024)
+		Expect(err).ToNot(HaveOccurred())
+
+		p = stream.From("words", "in").
+			Filter(func(data []byte) bool {
+				return len(data) > 0
+			}).
+			FlatMap(func(data []byte) ([][]byte, error) {
+				return bytes.Fields(data), nil
+			}).
+			Map(func(data []byte) ([]byte, error) {
+				return []byte(strings.ToUpper(string(data))), nil
+			}).
+			Branch(func(data []byte) bool {
+				return len(data) > 3
+			}, "long").
+			To("short")
+
+		write("a bb", "", "cccc")
+		start()
+	})
+
+	AfterEach(func() {
+		stop()
+		Expect(s.Close()).To(Succeed())
+		Expect(os.RemoveAll(storeDir)).To(Succeed())
+	})
+
+	It("Should write results to the sink topics", func() {
+		Eventually(func() []string { return readAll("short") }).Should(Equal([]string{"A", "BB"}))
+		Eventually(func() []string { return readAll("long") }).Should(Equal([]string{"CCCC"}))
+	})
+
+	It("Should checkpoint available events together", func() {
+		Eventually(func() []string { return readAll("long") }).Should(HaveLen(1))
+		Expect(readAll(stream.CheckpointTopic("words"))).To(HaveLen(1))
+	})
+
+	Context("When the pipeline is restarted", func() {
+		BeforeEach(func() {
+			Eventually(func() []string { return readAll("long") }).Should(HaveLen(1))
+			stop()
+			write("dd eeeee")
+			start()
+		})
+
+		It("Should continue after the last checkpoint", func() {
+			Eventually(func() []string { return readAll("short") }).Should(Equal([]string{"A", "BB", "DD"}))
+			Eventually(func() []string { return readAll("long") }).Should(Equal([]string{"CCCC", "EEEEE"}))
+			Consistently(func() []string { return readAll("short") }).Should(HaveLen(3))
+		})
+	})
+
+	Context("When the pipeline has no sources", func() {
+		It("Should return ErrInvalidPipeline", func() {
+			Expect(stream.Run(context.Background(), s, stream.From("x"))).To(Equal(stream.ErrInvalidPipeline))
+		})
+	})
+})
+
+var _ = Describe("RunAggregation()", func() {
+	var storeDir string
+	var s *store.Store
+	var now int64
+	var a *stream.Aggregation
+	var cancel context.CancelFunc
+	var done chan error
+
+	write := func(at time.Duration, key string) {
+		atomic.StoreInt64(&now, int64(at))
+		t, err := s.Topic("in")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = t.WriteEvent([]byte(key))
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	results := func() []string {
+		t, err := s.Topic("out")
+		Expect(err).ToNot(HaveOccurred())
+		r := []string{}
+		Expect(t.ReadEvents(func(nextAddress uint64, data []byte) error {
+			wr := stream.WindowResult{}
+			err := json.Unmarshal(data, &wr)
+			if err != nil {
+				return err
+			}
+			r = append(r, wr.Key+"@"+time.Duration(wr.Start.UnixNano()).String()+"="+string(wr.Value))
+			return nil
+		})).To(Succeed())
+		return r
+	}
+
+	start := func() {
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		done = make(chan error, 1)
+		go func() {
+			done <- stream.RunAggregation(ctx, s, a)
+		}()
+	}
+
+	stop := func() {
+		if cancel == nil {
+			return
+		}
+		cancel()
+		cancel = nil
+		Eventually(done).Should(Receive(Equal(context.Canceled)))
+	}
+
+	BeforeEach(func() {
+		var err error
+		storeDir, err = ioutil.TempDir("", "")
+		Expect(err).ToNot(HaveOccurred())
+		s, err = store.Open(storeDir, 1024*1024, topic.WithClock(func() time.Time {
+			return time.Unix(0, atomic.LoadInt64(&now))
+		}))
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		stop()
+		Expect(s.Close()).To(Succeed())
+		Expect(os.RemoveAll(storeDir)).To(Succeed())
+	})
+
+	key := func(data []byte) string {
+		return string(data)
+	}
+
+	Context("With tumbling windows", func() {
+		BeforeEach(func() {
+			a = stream.Aggregate("counts", "in", stream.Tumbling(10*time.Second), stream.Count()).KeyBy(key).To("out")
+			write(1*time.Second, "a")
+			write(5*time.Second, "b")
+			write(2*time.Second, "a")
+			write(12*time.Second, "a")
+			start()
+		})
+
+		It("Should emit windows passed by the watermark", func() {
+			Eventually(results).Should(Equal([]string{"a@0s=2", "b@0s=1"}))
+		})
+
+		Context("When the aggregation is restarted", func() {
+			BeforeEach(func() {
+				Eventually(results).Should(HaveLen(2))
+				stop()
+				write(25*time.Second, "a")
+				write(3*time.Second, "a")
+				start()
+			})
+
+			It("Should restore the state from the changelog and drop late events", func() {
+				Eventually(results).Should(Equal([]string{"a@0s=2", "b@0s=1", "a@10s=1"}))
+				Consistently(results).Should(HaveLen(3))
+			})
+		})
+	})
+
+	Context("With hopping windows", func() {
+		BeforeEach(func() {
+			a = stream.Aggregate("hops", "in", stream.Hopping(10*time.Second, 5*time.Second), stream.Count()).To("out")
+			write(7*time.Second, "a")
+			write(30*time.Second, "a")
+			start()
+		})
+
+		It("Should add events to all overlapping windows", func() {
+			Eventually(results).Should(Equal([]string{"@0s=1", "@5s=1"}))
+		})
+	})
+
+	Context("When the state is empty at a snapshot", func() {
+		BeforeEach(func() {
+			// events between 5s and 10s are in no window
+			a = stream.Aggregate("gaps", "in", stream.Hopping(5*time.Second, 10*time.Second), stream.Count()).To("out")
+			for i := 0; i < 999; i++ {
+				write(1*time.Second, "a")
+			}
+			write(27*time.Second, "a")
+			start()
+			Eventually(results, 10*time.Second).Should(Equal([]string{"@0s=999"}))
+			stop()
+			write(41*time.Second, "a")
+			write(52*time.Second, "a")
+			start()
+		})
+
+		It("Should restore the empty state", func() {
+			Eventually(results).Should(Equal([]string{"@0s=999", "@40s=1"}))
+			Consistently(results).Should(HaveLen(2))
+		})
+	})
+
+	Context("When the changelog has segments before a snapshot", func() {
+		var changelog *topic.Topic
+		BeforeEach(func() {
+			Expect(s.Close()).To(Succeed())
+			var err error
+			s, err = store.Open(storeDir, 1024, topic.WithClock(func() time.Time {
+				return time.Unix(0, atomic.LoadInt64(&now))
+			}))
+			Expect(err).ToNot(HaveOccurred())
+			changelog, err = s.Topic(stream.ChangelogTopic("compacted"))
+			Expect(err).ToNot(HaveOccurred())
+
+			a = stream.Aggregate("compacted", "in", stream.Tumbling(10*time.Second), stream.Count()).KeyBy(key).To("out")
+			start()
+			// write in rounds, so that every round gets its own changelog entries
+			for i := 0; i < 25; i++ {
+				before := changelog.AppendAddress()
+				for j := 0; j < 40; j++ {
+					write(1*time.Second, "a")
+				}
+				Eventually(changelog.AppendAddress).Should(BeNumerically(">", before))
+				if i == 23 {
+					Expect(changelog.Segments()).ToNot(BeEmpty())
+				}
+			}
+		})
+
+		It("Should delete the changelog segments before the snapshot", func() {
+			Eventually(changelog.Segments).Should(BeEmpty())
+		})
+
+		Context("When the aggregation is restarted", func() {
+			BeforeEach(func() {
+				Eventually(changelog.Segments).Should(BeEmpty())
+				stop()
+				write(12*time.Second, "a")
+				start()
+			})
+
+			It("Should restore the state from the snapshot", func() {
+				Eventually(results).Should(Equal([]string{"a@0s=1000"}))
+			})
+		})
+	})
+
+	Context("With windows without a size", func() {
+		It("Should return ErrInvalidAggregation", func() {
+			for _, w := range []stream.Window{stream.Tumbling(0), stream.Hopping(time.Second, 0), stream.Hopping(0, time.Second), stream.Session(-time.Second)} {
+				a = stream.Aggregate("invalid", "in", w, stream.Count()).To("out")
+				Expect(stream.RunAggregation(context.Background(), s, a)).To(Equal(stream.ErrInvalidAggregation))
+			}
+		})
+	})
+
+	Context("With session windows", func() {
+		BeforeEach(func() {
+			a = stream.Aggregate("sessions", "in", stream.Session(5*time.Second), stream.Count()).KeyBy(key).AllowLateness(5 * time.Second).To("out")
+			write(1*time.Second, "a")
+			write(8*time.Second, "a")
+			write(4*time.Second, "a")
+			write(30*time.Second, "b")
+			start()
+		})
+
+		It("Should merge sessions closer than the gap", func() {
+			Eventually(results).Should(Equal([]string{"a@1s=3"}))
+		})
+	})
+})
@@ -0,0 +1,84 @@
+package stream
+
+import "time"
+
+// Window assigns event times to time windows.
+type Window interface {
+	// windows returns the [start, end) ranges in nanoseconds since epoch
+	// of all windows containing the time.
+	windows(ts int64) []timeRange
+	// valid returns false for windows without a positive size.
+	valid() bool
+}
+
+type timeRange struct {
+	start int64
+	end   int64
+}
+
+type tumbling struct {
+	size int64
+}
+
+// Tumbling returns fixed size, non overlapping windows.
+func Tumbling(size time.Duration) Window {
+	return tumbling{size: int64(size)}
+}
+
+func (w tumbling) valid() bool {
+	return w.size > 0
+}
+
+func (w tumbling) windows(ts int64) []timeRange {
+	start := floor(ts, w.size)
+	return []timeRange{{start: start, end: start + w.size}}
+}
+
+type hopping struct {
+	size    int64
+	advance int64
+}
+
+// Hopping returns fixed size windows starting every advance, so that an event
+// can be in several windows.
+func Hopping(size, advance time.Duration) Window {
+	return hopping{size: int64(size), advance: int64(advance)}
+}
+
+func (w hopping) valid() bool {
+	return w.size > 0 && w.advance > 0
+}
+
+func (w hopping) windows(ts int64) []timeRange {
+	ranges := []timeRange{}
+	for start := floor(ts, w.advance); start > ts-w.size; start -= w.advance {
+		ranges = append([]timeRange{{start: start, end: start + w.size}}, ranges...)
+	}
+	return ranges
+}
+
+type session struct {
+	gap int64
+}
+
+// Session returns windows of activity per key that end after gap without
+// events. Sessions that come close to each other are merged.
+func Session(gap time.Duration) Window {
+	return session{gap: int64(gap)}
+}
+
+func (w session) valid() bool {
+	return w.gap > 0
+}
+
+func (w session) windows(ts int64) []timeRange {
+	return []timeRange{{start: ts, end: ts + w.gap}}
+}
+
+func floor(ts, size int64) int64 {
+	start := ts - ts%size
+	if ts < 0 && ts%size != 0 {
+		start -= size
+	}
+	return start
+}
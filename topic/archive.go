@@ -0,0 +1,373 @@
+package topic
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/draganm/zathras/segment"
+)
+
+// ErrTopicNotEmpty is returned when importing an archive into a dir that already has segments
+var ErrTopicNotEmpty = errors.New("Topic is not empty")
+
+// ErrInvalidArchive is returned when an archive does not match its manifest
+var ErrInvalidArchive = errors.New("Invalid topic archive")
+
+// ErrUnsupportedArchiveVersion is returned when an archive was written by a newer version
+var ErrUnsupportedArchiveVersion = errors.New("Unsupported topic archive version")
+
+const (
+	archiveVersion   = 1
+	manifestFileName = "manifest.json"
+)
+
+// Manifest describes the segments of a topic archive.
+type Manifest struct {
+	Version int `json:"version"`
+	// StartAddress is the address of the first segment, EndAddress the
+	// address after the last event of the archive.
+	StartAddress uint64            `json:"start_address"`
+	EndAddress   uint64            `json:"end_address"`
+	Segments     []ManifestSegment `json:"segments"`
+}
+
+// ManifestSegment is a segment file of a topic archive.
+type ManifestSegment struct {
+	FileName     string `json:"file_name"`
+	StartAddress uint64 `json:"start_address"`
+	Size         uint64 `json:"size"`
+	// Sealed is true when the archive holds the footer of the segment.
+	Sealed bool `json:"sealed"`
+}
+
+// ExportArchive writes the segments holding events with addresses in
+// [from, to) to w as a tar archive: a manifest, the segment files with
+// their footers and the schemas of the topic. Whole segments are exported,
+// so the archive can hold events outside of the range; the last segment is
+// cut after the last committed event. Segment files are streamed, the
+// topic can be written to meanwhile.
+func (t *Topic) ExportArchive(w io.Writer, from, to uint64) (*Manifest, error) {
+	t.RLock()
+	end := t.lastAddress()
+	segments := []ManifestSegment{}
+	// segment files by archive file name, compressed segments are archived uncompressed
+	fileNames := map[string]string{}
+	for _, o := range t.oldSegments {
+		name := filepath.Base(strings.TrimSuffix(o.fileName, compressedSuffix))
+		fileNames[name] = o.fileName
+		segments = append(segments, ManifestSegment{
+			FileName:     name,
+			StartAddress: o.startAddress,
+			Size:         o.info.Size,
+			Sealed:       true,
+		})
+	}
+	segments = append(segments, ManifestSegment{
+		FileName:     filepath.Base(t.currentSegment.Name()),
+		StartAddress: t.currentSegment.startAddress,
+		Size:         t.currentSegment.FileSize(),
+	})
+	t.RUnlock()
+
+	if to > end {
+		to = end
+	}
+
+	m := &Manifest{
+		Version:  archiveVersion,
+		Segments: []ManifestSegment{},
+	}
+
+	for _, s := range segments {
+		if s.StartAddress+s.Size <= from || s.StartAddress >= to {
+			continue
+		}
+		if s.StartAddress+s.Size > end {
+			s.Size = end - s.StartAddress
+			s.Sealed = false
+		}
+		m.Segments = append(m.Segments, s)
+	}
+
+	if len(m.Segments) > 0 {
+		first := m.Segments[0]
+		last := m.Segments[len(m.Segments)-1]
+		m.StartAddress = first.StartAddress
+		m.EndAddress = last.StartAddress + last.Size
+	}
+
+	tw := tar.NewWriter(w)
+
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeArchiveFile(tw, manifestFileName, uint64(len(manifest)), bytes.NewReader(manifest))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range m.Segments {
+		fileName, found := fileNames[s.FileName]
+		if !found {
+			fileName = filepath.Join(t.dir, s.FileName)
+		}
+		err = copySegmentToArchive(tw, s.FileName, fileName, s.Size)
+		if err != nil {
+			return nil, err
+		}
+		if s.Sealed {
+			footer := footerFileName(fileName)
+			fi, err := os.Stat(footer)
+			if err != nil {
+				return nil, err
+			}
+			err = copyToArchive(tw, footer, uint64(fi.Size()))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	t.schemaLock.RLock()
+	schemas := len(t.schemas) > 0
+	t.schemaLock.RUnlock()
+
+	if schemas {
+		fileName := filepath.Join(t.dir, schemasFileName)
+		fi, err := os.Stat(fileName)
+		if err != nil {
+			return nil, err
+		}
+		err = copyToArchive(tw, fileName, uint64(fi.Size()))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// copySegmentToArchive writes the first size bytes of the uncompressed
+// segment as the archive file name. A segment compressed meanwhile is read
+// from its compressed file.
+func copySegmentToArchive(tw *tar.Writer, name, fileName string, size uint64) error {
+	if !isCompressed(fileName) {
+		f, err := os.Open(fileName)
+		if err == nil {
+			defer f.Close()
+			return writeArchiveFile(tw, name, size, f)
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		fileName += compressedSuffix
+	}
+
+	_, data, err := readCompressedSegment(fileName)
+	if err != nil {
+		return err
+	}
+
+	return writeArchiveFile(tw, name, size, bytes.NewReader(data))
+}
+
+func copyToArchive(tw *tar.Writer, fileName string, size uint64) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return writeArchiveFile(tw, filepath.Base(fileName), size, f)
+}
+
+func writeArchiveFile(tw *tar.Writer, name string, size uint64, r io.Reader) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0600,
+		Size:     int64(size),
+	})
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(tw, io.LimitReader(r, int64(size)))
+	if err != nil {
+		return err
+	}
+
+	if uint64(n) != size {
+		return ErrSegmentTruncated
+	}
+
+	return nil
+}
+
+// importDirName is the directory inside the topic dir the archive is
+// extracted to before its files are moved into the topic dir.
+const importDirName = ".import"
+
+// ImportArchive extracts an archive written by ExportArchive into the dir,
+// so that the events keep their addresses. The dir must not have segments.
+// The files are moved into the dir only when the archive is complete, so a
+// failed import can be retried.
+func ImportArchive(r io.Reader, dir string) (*Manifest, error) {
+	existing, err := segmentFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(existing) > 0 {
+		return nil, ErrTopicNotEmpty
+	}
+
+	// left behind by an import that didn't finish
+	importDir := filepath.Join(dir, importDirName)
+	err = os.RemoveAll(importDir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Mkdir(importDir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(importDir)
+
+	m, names, err := extractArchive(r, importDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		err = os.Rename(filepath.Join(importDir, name), filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = segment.SyncDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeFormat(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// extractArchive extracts the files of the archive into the dir and returns
+// the manifest and the names of the files, segments last.
+func extractArchive(r io.Reader, dir string) (*Manifest, []string, error) {
+	tr := tar.NewReader(r)
+
+	h, err := tr.Next()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if h.Name != manifestFileName {
+		return nil, nil, ErrInvalidArchive
+	}
+
+	m := &Manifest{}
+	err = json.NewDecoder(tr).Decode(m)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if m.Version > archiveVersion {
+		return nil, nil, ErrUnsupportedArchiveVersion
+	}
+
+	// sizes of the files the archive may hold
+	sizes := map[string]int64{schemasFileName: -1}
+	for _, s := range m.Segments {
+		if s.FileName != fmt.Sprintf("%016x.seg", s.StartAddress) {
+			return nil, nil, ErrInvalidArchive
+		}
+		sizes[s.FileName] = int64(s.Size)
+		if s.Sealed {
+			sizes[footerFileName(s.FileName)] = -1
+		}
+	}
+
+	names := []string{}
+	segmentNames := []string{}
+	for {
+		h, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		size, found := sizes[h.Name]
+		if !found || h.Typeflag != tar.TypeReg || size >= 0 && h.Size != size {
+			return nil, nil, ErrInvalidArchive
+		}
+		delete(sizes, h.Name)
+
+		err = extractArchiveFile(tr, filepath.Join(dir, h.Name))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if size >= 0 {
+			segmentNames = append(segmentNames, h.Name)
+		} else {
+			names = append(names, h.Name)
+		}
+	}
+
+	// segment files that are missing
+	for _, size := range sizes {
+		if size >= 0 {
+			return nil, nil, ErrInvalidArchive
+		}
+	}
+
+	err = segment.SyncDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return m, append(names, segmentNames...), nil
+}
+
+func extractArchiveFile(r io.Reader, fileName string) error {
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0700)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	return err
+}
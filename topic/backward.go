@@ -0,0 +1,154 @@
+package topic
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/draganm/zathras/segment"
+)
+
+// ErrStop can be returned by callbacks to stop reading without an error
+var ErrStop = errors.New("Stop reading")
+
+// previousRecord returns the address of the record before the address.
+func (t *Topic) previousRecord(address uint64) (uint64, error) {
+	t.RLock()
+	if address > t.currentSegment.startAddress {
+		defer t.RUnlock()
+		previous, err := t.currentSegment.Segment.Previous(address - t.currentSegment.startAddress)
+		if err != nil {
+			return 0, err
+		}
+		return previous + t.currentSegment.startAddress, nil
+	}
+	i := sort.Search(len(t.oldSegments), func(i int) bool {
+		return t.oldSegments[i].nextAddress() >= address
+	})
+	var o *oldSegment
+	if i < len(t.oldSegments) && t.oldSegments[i].startAddress < address {
+		o = t.oldSegments[i]
+	}
+	t.RUnlock()
+
+	if o == nil {
+		return 0, segment.ErrWrongAddress
+	}
+
+	s, lease, err := t.acquireOldSegment(o)
+	if err != nil {
+		return 0, err
+	}
+	defer lease.Release()
+
+	previous, err := s.Previous(address - o.startAddress)
+	if err != nil {
+		return 0, err
+	}
+
+	return previous + o.startAddress, nil
+}
+
+// previousAddress returns the address of the last event before the address,
+// skipping records holding chunks of large events, transaction markers and,
+// unless reading uncommitted events, events of aborted transactions.
+func (t *Topic) previousAddress(address uint64) (uint64, error) {
+	t.RLock()
+	if address > t.lastAddress() {
+		address = t.lastAddress()
+	}
+	t.RUnlock()
+
+	for {
+		previous, err := t.previousRecord(address)
+		if err != nil {
+			return 0, err
+		}
+
+		if !t.readUncommitted {
+			t.RLock()
+			r, aborted := t.abortedRange(previous)
+			t.RUnlock()
+			if aborted {
+				address = r.From
+				continue
+			}
+		}
+
+		record, _, lease, err := t.readRecord(previous)
+		if err != nil {
+			return 0, err
+		}
+		h, err := decodeHeader(record)
+		lease.Release()
+		if err != nil {
+			return 0, err
+		}
+
+		if h.kind == recordEvent || h.kind == recordChunkStart {
+			return previous, nil
+		}
+
+		address = previous
+	}
+}
+
+// ReadBackward calls fn with every event before the from address, starting
+// with the latest one. Events written while reading are not included.
+// When fn returns ErrStop, ReadBackward stops and returns nil.
+func (t *Topic) ReadBackward(from uint64, fn func(address, nextAddress uint64, data []byte) error) error {
+	t.RLock()
+	firstAddress := t.firstAddress()
+	if from > t.lastAddress() {
+		from = t.lastAddress()
+	}
+	t.RUnlock()
+
+	for from > firstAddress {
+		address, err := t.previousAddress(from)
+		if err == segment.ErrWrongAddress {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		err = t.view(address, func(nextAddress uint64, data []byte) error {
+			return fn(address, nextAddress, data)
+		})
+		if err == ErrStop {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		from = address
+	}
+
+	return nil
+}
+
+// Last returns copies of the last n events of the topic, oldest first.
+func (t *Topic) Last(n int) ([]Event, error) {
+	events := []Event{}
+	if n <= 0 {
+		return events, nil
+	}
+
+	err := t.ReadBackward(t.NextAddress(), func(address, nextAddress uint64, data []byte) error {
+		events = append(events, Event{NextAddress: nextAddress, Data: append([]byte(nil), data...)})
+		if len(events) == n {
+			return ErrStop
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+
+	return events, nil
+}
@@ -0,0 +1,507 @@
+package topic
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/draganm/zathras/segment"
+)
+
+// quarantineDirName is the directory of a topic that Repair moves broken segments to.
+const quarantineDirName = "quarantine"
+
+// Report is the result of checking the files of a topic, see Check.
+type Report struct {
+	Segments []SegmentReport `json:"segments"`
+	// Gaps and Overlaps are address ranges between the ends of segments and
+	// the start addresses in the names of the following segment files.
+	Gaps     []AddressRange `json:"gaps,omitempty"`
+	Overlaps []AddressRange `json:"overlaps,omitempty"`
+	// End is the address after the last complete event of the topic.
+	End uint64 `json:"end"`
+	// Problems are problems of the sidecar files of the topic.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// SegmentReport is the result of checking one segment file.
+type SegmentReport struct {
+	FileName     string `json:"file_name"`
+	StartAddress uint64 `json:"start_address"`
+	Size         uint64 `json:"size"`
+	// ValidSize is the size of the complete records at the start of the file.
+	ValidSize uint64 `json:"valid_size"`
+	Records   uint64 `json:"records"`
+	Events    uint64 `json:"events"`
+	// Sealed is true when the segment has a footer.
+	Sealed   bool     `json:"sealed"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+// OK returns true when the check found no problems.
+func (r *Report) OK() bool {
+	if len(r.Gaps) > 0 || len(r.Overlaps) > 0 || len(r.Problems) > 0 {
+		return false
+	}
+	for _, s := range r.Segments {
+		if len(s.Problems) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Check reads all files of a topic without changing them. It checks that
+// the records of every segment fill the segment file, that records decode
+// and chunked events are complete, that sealed segments match their footers
+// and checksums, that segment file names leave no gaps or overlaps of
+// addresses and that the sidecar files don't refer to events past the end
+// of the topic. Encrypted topics need WithEncryption, otherwise Check
+// returns a *segment.KeyNotFoundError. Topics written with another record
+// format are rejected with ErrUnsupportedFormat.
+func Check(dir string, segmentSize uint64, options ...Option) (*Report, error) {
+	t := &Topic{
+		dir:         dir,
+		segmentSize: segmentSize,
+	}
+
+	for _, o := range options {
+		o(t)
+	}
+
+	files, err := segmentFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkFormat(dir, len(files) > 0, true)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		Segments: []SegmentReport{},
+	}
+
+	pendingChunks := uint64(0)
+	for i, o := range files {
+		if i > 0 {
+			end := files[i-1].startAddress + files[i-1].size
+			if o.startAddress > end {
+				report.Gaps = append(report.Gaps, AddressRange{From: end, To: o.startAddress})
+			}
+			if o.startAddress < end {
+				report.Overlaps = append(report.Overlaps, AddressRange{From: o.startAddress, To: end})
+			}
+		}
+
+		r, end, err := t.checkSegment(o, &pendingChunks)
+		if err != nil {
+			return nil, err
+		}
+
+		report.Segments = append(report.Segments, r)
+		report.End = end
+	}
+
+	report.Problems, err = checkSidecars(dir, report.End)
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// checkSegment checks the records and the footer of a segment. It returns
+// the address after the last complete event of the segment. pendingChunks
+// carries the missing size of a chunked event from the previous segment.
+func (t *Topic) checkSegment(o *oldSegment, pendingChunks *uint64) (SegmentReport, uint64, error) {
+	r := SegmentReport{
+		FileName:     filepath.Base(o.fileName),
+		StartAddress: o.startAddress,
+		Size:         o.size,
+	}
+
+	problem := func(format string, args ...interface{}) {
+		r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+	}
+
+	maxSize := t.maxSegmentSize()
+	if o.size > maxSize {
+		maxSize = o.size
+	}
+
+	s, err := openSegmentFile(o.fileName, maxSize, append(t.segmentOptionsAt(o.startAddress), segment.WithReadOnly()))
+	if err != nil {
+		return r, 0, err
+	}
+	defer s.Close()
+
+	if isCompressed(o.fileName) {
+		o.size = s.FileSize()
+		r.Size = o.size
+	}
+
+	r.ValidSize, r.Records = s.ValidSize()
+	if r.ValidSize < r.Size {
+		problem("incomplete record at %d", o.startAddress+r.ValidSize)
+	}
+
+	end := o.startAddress
+	for address := uint64(0); address < r.ValidSize; {
+		record, nextAddress, err := s.Read(address)
+		if _, missingKey := err.(*segment.KeyNotFoundError); missingKey {
+			return r, 0, err
+		}
+		var h recordHeader
+		if err == nil {
+			h, err = decodeHeader(record)
+		}
+		if err != nil {
+			problem("record at %d: %s", o.startAddress+address, err)
+			break
+		}
+
+		size := uint64(len(record) - h.length)
+		switch h.kind {
+		case recordEvent:
+			if *pendingChunks != 0 {
+				problem("event at %d interrupts a chunked event", o.startAddress+address)
+			}
+			*pendingChunks = 0
+			r.Events++
+		case recordChunkStart:
+			if *pendingChunks != 0 {
+				problem("event at %d interrupts a chunked event", o.startAddress+address)
+			}
+			*pendingChunks = 0
+			if size <= h.size {
+				*pendingChunks = h.size - size
+			}
+			r.Events++
+		case recordChunk:
+			if size > *pendingChunks {
+				problem("unexpected chunk at %d", o.startAddress+address)
+				size = *pendingChunks
+			}
+			*pendingChunks -= size
+		}
+
+		address = nextAddress
+		if *pendingChunks == 0 {
+			end = o.startAddress + address
+		}
+	}
+
+	info, err := readFooter(o.fileName)
+	if err != nil {
+		problem("footer: %s", err)
+		return r, end, nil
+	}
+
+	if info == nil {
+		return r, end, nil
+	}
+
+	r.Sealed = true
+
+	if info.StartAddress != o.startAddress {
+		problem("footer has start address %d", info.StartAddress)
+	}
+
+	switch {
+	case info.Size > o.size:
+		problem("%s: footer has size %d", ErrSegmentTruncated, info.Size)
+	case info.Size < o.size:
+		problem("footer has size %d", info.Size)
+	default:
+		checksum, err := fileChecksum(o.fileName, info.Size)
+		if err != nil {
+			return r, 0, err
+		}
+		if checksum != info.Checksum {
+			problem("%s", ErrSegmentChecksumMismatch)
+		}
+	}
+
+	if info.Events != r.Events {
+		problem("footer has %d events", info.Events)
+	}
+
+	return r, end, nil
+}
+
+// checkSidecars returns problems of the hash chain and index files of the
+// topic in the dir, whose last event ends at the end address.
+func checkSidecars(dir string, end uint64) ([]string, error) {
+	problems := []string{}
+
+	next, err := hashChainNext(dir)
+	if err != nil {
+		return nil, err
+	}
+	if next > end {
+		problems = append(problems, fmt.Sprintf("hash chain ends at %d, after the last event", next))
+	}
+
+	names, err := indexNames(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		next, err := indexNext(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		if next > end {
+			problems = append(problems, fmt.Sprintf("index %s ends at %d, after the last event", name, next))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil, nil
+	}
+
+	return problems, nil
+}
+
+// hashChainNext returns the address after the last event of the hash chain
+// in the dir, zero when the topic has no hash chain.
+func hashChainNext(dir string) (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, hashChainFileName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	entries := len(data) / hashEntrySize
+	if entries == 0 {
+		return 0, nil
+	}
+
+	return binary.BigEndian.Uint64(data[(entries-1)*hashEntrySize+8:]), nil
+}
+
+// indexNames returns the names of the indexes with files in the dir.
+func indexNames(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, fi := range files {
+		name := strings.TrimPrefix(fi.Name(), indexFileName(""))
+		if !fi.IsDir() && name != fi.Name() && indexNameMatcher.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// indexNext returns the address after the last event of the index file.
+func indexNext(dir, name string) (uint64, error) {
+	file, err := os.Open(filepath.Join(dir, indexFileName(name)))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	x := &index{
+		file:  file,
+		heads: map[uint64]int64{},
+	}
+
+	_, _, err = x.load()
+	if err != nil {
+		return 0, err
+	}
+
+	return x.next, nil
+}
+
+// RepairResult describes the changes made by Repair.
+type RepairResult struct {
+	// Quarantined are the segment files moved to QuarantineDir.
+	Quarantined   []string `json:"quarantined,omitempty"`
+	QuarantineDir string   `json:"quarantine_dir,omitempty"`
+	// Truncated is the segment file whose incomplete tail was cut off.
+	Truncated string `json:"truncated,omitempty"`
+	// Sidecars are the hash chain and index files that were cut to the end
+	// of the topic or removed, to be rebuilt when the topic is opened.
+	Sidecars []string `json:"sidecars,omitempty"`
+	// Report is the check of the repaired topic.
+	Report *Report `json:"report"`
+}
+
+// Repair fixes the problems found by Check in a topic that is not open. The
+// incomplete tail of the last segment is truncated. A broken segment before
+// the last one, or one after a gap or an overlap of addresses, is moved
+// together with all following segments into a quarantine directory of the
+// topic, because addresses of a topic have to be contiguous. Hash chains
+// are cut to the end of the topic and indexes that are ahead of it are
+// removed, so that they are rebuilt when the topic is opened with them.
+// Addresses after the new end of the topic are reused by new events.
+func Repair(dir string, segmentSize uint64, options ...Option) (*RepairResult, error) {
+	report, err := Check(dir, segmentSize, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RepairResult{}
+
+	broken := len(report.Segments)
+	for i, s := range report.Segments {
+		if i > 0 {
+			previous := report.Segments[i-1]
+			if s.StartAddress != previous.StartAddress+previous.Size {
+				broken = i
+				break
+			}
+		}
+		if i < len(report.Segments)-1 && len(s.Problems) > 0 {
+			broken = i
+			break
+		}
+	}
+
+	if broken < len(report.Segments) {
+		result.QuarantineDir = filepath.Join(dir, quarantineDirName, time.Now().UTC().Format("20060102T150405.000000000"))
+		err = os.MkdirAll(result.QuarantineDir, 0700)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, s := range report.Segments[broken:] {
+			err = quarantine(dir, s.FileName, result.QuarantineDir)
+			if err != nil {
+				return nil, err
+			}
+			result.Quarantined = append(result.Quarantined, s.FileName)
+		}
+
+		// the topic continues at the address of the first quarantined segment
+		if broken == 0 {
+			fileName := filepath.Join(dir, fmt.Sprintf("%016x.seg", report.Segments[0].StartAddress))
+			err = ioutil.WriteFile(fileName, nil, 0700)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		report, err = Check(dir, segmentSize, options...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(report.Segments) > 0 {
+		last := report.Segments[len(report.Segments)-1]
+		fileName := filepath.Join(dir, last.FileName)
+		size := report.End - last.StartAddress
+
+		if size < last.Size {
+			if isCompressed(fileName) {
+				fileName, err = decompressSegmentFile(fileName)
+				if err != nil {
+					return nil, err
+				}
+			}
+			err = os.Truncate(fileName, int64(size))
+			if err != nil {
+				return nil, err
+			}
+			result.Truncated = filepath.Base(fileName)
+		}
+
+		// the footer is written again when the segment is sealed
+		if last.Sealed && (size < last.Size || len(last.Problems) > 0) {
+			err = os.Remove(footerFileName(fileName))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	result.Sidecars, err = repairSidecars(dir, report.End)
+	if err != nil {
+		return nil, err
+	}
+
+	result.Report, err = Check(dir, segmentSize, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// quarantine moves a segment file and its footer to the quarantine dir.
+func quarantine(dir, fileName, quarantineDir string) error {
+	err := os.Rename(filepath.Join(dir, fileName), filepath.Join(quarantineDir, fileName))
+	if err != nil {
+		return err
+	}
+
+	footer := footerFileName(fileName)
+	err = os.Rename(filepath.Join(dir, footer), filepath.Join(quarantineDir, footer))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// repairSidecars cuts the hash chain to the end address and removes indexes
+// that are ahead of it. It returns the names of the changed files.
+func repairSidecars(dir string, end uint64) ([]string, error) {
+	changed := []string{}
+
+	fileName := filepath.Join(dir, hashChainFileName)
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	size := 0
+	for len(data)-size >= hashEntrySize && binary.BigEndian.Uint64(data[size+8:]) <= end {
+		size += hashEntrySize
+	}
+
+	if size < len(data) {
+		err = os.Truncate(fileName, int64(size))
+		if err != nil {
+			return nil, err
+		}
+		changed = append(changed, hashChainFileName)
+	}
+
+	names, err := indexNames(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		next, err := indexNext(dir, name)
+		if err != nil {
+			return nil, err
+		}
+		if next > end {
+			err = os.Remove(filepath.Join(dir, indexFileName(name)))
+			if err != nil {
+				return nil, err
+			}
+			changed = append(changed, indexFileName(name))
+		}
+	}
+
+	return changed, nil
+}
@@ -0,0 +1,233 @@
+package topic
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// ErrUnknownCodec is returned when reading a record compressed with a codec that is not registered
+var ErrUnknownCodec = errors.New("Unknown codec")
+
+// Codec compresses event data. The codec ID is stored in the header of every
+// compressed record, so a codec must keep its ID and format forever.
+type Codec interface {
+	// ID is a number between 1 and 7.
+	ID() byte
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var codecsLock sync.RWMutex
+var codecs = map[byte]Codec{}
+
+// RegisterCodec makes the codec available for reading and writing records.
+// It panics if the ID is out of range or already used.
+func RegisterCodec(c Codec) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	id := c.ID()
+	if id == 0 || id > maxCodecID {
+		panic(fmt.Sprintf("topic: codec ID %d of %s out of range", id, c.Name()))
+	}
+	if _, found := codecs[id]; found {
+		panic(fmt.Sprintf("topic: codec ID %d registered twice", id))
+	}
+	codecs[id] = c
+}
+
+// CodecByName returns the registered codec with the name.
+func CodecByName(name string) (Codec, bool) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+func codecByID(id byte) (Codec, error) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	c, found := codecs[id]
+	if !found {
+		return nil, ErrUnknownCodec
+	}
+	return c, nil
+}
+
+// Flate is the built in DEFLATE codec.
+var Flate Codec = flateCodec{}
+
+// Zstd is the built in Zstandard codec.
+var Zstd Codec = &zstdCodec{}
+
+// Snappy is the built in Snappy codec, using the block format.
+var Snappy Codec = snappyCodec{}
+
+// LZ4 is the built in LZ4 codec, using the frame format.
+var LZ4 Codec = lz4Codec{}
+
+func init() {
+	RegisterCodec(Flate)
+	RegisterCodec(Zstd)
+	RegisterCodec(Snappy)
+	RegisterCodec(LZ4)
+}
+
+type flateCodec struct{}
+
+func (flateCodec) ID() byte {
+	return 1
+}
+
+func (flateCodec) Name() string {
+	return "flate"
+}
+
+func (flateCodec) Compress(data []byte) ([]byte, error) {
+	b := &bytes.Buffer{}
+	w, err := flate.NewWriter(b, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (flateCodec) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// zstdCodec creates the encoder and the decoder on first use, both are safe
+// for concurrent use.
+type zstdCodec struct {
+	once    sync.Once
+	err     error
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func (c *zstdCodec) init() error {
+	c.once.Do(func() {
+		c.encoder, c.err = zstd.NewWriter(nil)
+		if c.err != nil {
+			return
+		}
+		c.decoder, c.err = zstd.NewReader(nil)
+	})
+	return c.err
+}
+
+func (*zstdCodec) ID() byte {
+	return 2
+}
+
+func (*zstdCodec) Name() string {
+	return "zstd"
+}
+
+func (c *zstdCodec) Compress(data []byte) ([]byte, error) {
+	err := c.init()
+	if err != nil {
+		return nil, err
+	}
+	return c.encoder.EncodeAll(data, nil), nil
+}
+
+func (c *zstdCodec) Decompress(data []byte) ([]byte, error) {
+	err := c.init()
+	if err != nil {
+		return nil, err
+	}
+	return c.decoder.DecodeAll(data, nil)
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) ID() byte {
+	return 3
+}
+
+func (snappyCodec) Name() string {
+	return "snappy"
+}
+
+func (snappyCodec) Compress(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data), nil
+}
+
+func (snappyCodec) Decompress(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
+
+type lz4Codec struct{}
+
+func (lz4Codec) ID() byte {
+	return 4
+}
+
+func (lz4Codec) Name() string {
+	return "lz4"
+}
+
+func (lz4Codec) Compress(data []byte) ([]byte, error) {
+	b := &bytes.Buffer{}
+	w := lz4.NewWriter(b)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (lz4Codec) Decompress(data []byte) ([]byte, error) {
+	return ioutil.ReadAll(lz4.NewReader(bytes.NewReader(data)))
+}
+
+// compress returns the data to store and the codec ID of the record.
+// Data that does not get smaller is stored uncompressed.
+func (t *Topic) compress(data []byte) ([]byte, byte, error) {
+	if t.codec == nil {
+		return data, 0, nil
+	}
+	compressed, err := t.codec.Compress(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(compressed) >= len(data) {
+		return data, 0, nil
+	}
+	return compressed, t.codec.ID(), nil
+}
+
+func decompress(codecID byte, data []byte) ([]byte, error) {
+	c, err := codecByID(codecID)
+	if err != nil {
+		return nil, err
+	}
+	return c.Decompress(data)
+}
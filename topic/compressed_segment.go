@@ -0,0 +1,235 @@
+package topic
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/draganm/zathras/segment"
+)
+
+// compressedSuffix is appended to the file name of a sealed segment that is
+// stored compressed as a whole. The file holds the codec ID followed by the
+// compressed segment. The footer keeps the size and the checksum of the
+// uncompressed segment, so events keep their addresses.
+const compressedSuffix = ".z"
+
+func isCompressed(fileName string) bool {
+	return strings.HasSuffix(fileName, compressedSuffix)
+}
+
+// readCompressedSegment returns the codec ID and the uncompressed data of a
+// compressed segment file.
+func readCompressedSegment(fileName string) (byte, []byte, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if len(data) == 0 {
+		return 0, nil, segment.ErrSegmentCorrupted
+	}
+
+	decompressed, err := decompress(data[0], data[1:])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return data[0], decompressed, nil
+}
+
+// openSegmentFile opens a segment file. Compressed segments are decompressed
+// into memory and opened read only.
+func openSegmentFile(fileName string, maxSize uint64, options []segment.Option) (*segment.Segment, error) {
+	if !isCompressed(fileName) {
+		return segment.New(fileName, maxSize, options...)
+	}
+
+	_, data, err := readCompressedSegment(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	return segment.NewFromData(fileName, data, options...), nil
+}
+
+// decompressSegmentFile replaces a compressed segment file with the
+// uncompressed segment, e.g. before it is written to again. It returns the
+// name of the uncompressed file.
+func decompressSegmentFile(fileName string) (string, error) {
+	_, data, err := readCompressedSegment(fileName)
+	if err != nil {
+		return "", err
+	}
+
+	uncompressed := strings.TrimSuffix(fileName, compressedSuffix)
+	err = writeFileSync(uncompressed, data)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Remove(fileName)
+	if err != nil {
+		return "", err
+	}
+
+	return uncompressed, segment.SyncDir(filepath.Dir(fileName))
+}
+
+// recoverCompressed removes the compressed copy of an uncompressed segment,
+// left behind when the topic was closed while compressing the segment.
+func recoverCompressed(fileName string) error {
+	if isCompressed(fileName) {
+		return nil
+	}
+
+	for _, name := range []string{fileName + compressedSuffix, fileName + compressedSuffix + ".tmp"} {
+		err := os.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reencryptCompressedTo re-encrypts the records of a compressed segment file
+// and writes the compressed result to the synced file toFileName. Nothing is
+// written when no record has to be re-encrypted. It returns the number of
+// re-encrypted records and the checksum of the uncompressed segment.
+func reencryptCompressedTo(fileName, toFileName string, startAddress, size uint64, keys segment.KeyProvider) (int, string, error) {
+	codecID, data, err := readCompressedSegment(fileName)
+	if err != nil {
+		return 0, "", err
+	}
+
+	if uint64(len(data)) < size {
+		return 0, "", ErrSegmentTruncated
+	}
+
+	count, err := segment.ReencryptData(data, startAddress, keys)
+	if err != nil || count == 0 {
+		return 0, "", err
+	}
+
+	c, err := codecByID(codecID)
+	if err != nil {
+		return 0, "", err
+	}
+
+	compressed, err := c.Compress(data)
+	if err != nil {
+		return 0, "", err
+	}
+
+	err = writeSyncedFile(toFileName, append([]byte{codecID}, compressed...))
+	if err != nil {
+		return 0, "", err
+	}
+
+	checksum := sha256.Sum256(data[:size])
+
+	return count, hex.EncodeToString(checksum[:]), nil
+}
+
+// CompressSegments stores the sealed segments compressed with the codec as a
+// whole, so that events keep their addresses. Compressed segments are
+// decompressed into memory when opened. Segments that are compressed already,
+// don't get smaller or hold events that are not visible yet are skipped.
+// Data read from the segments before stays valid.
+// It returns the number of compressed segments.
+func (t *Topic) CompressSegments(c Codec) (int, error) {
+	if t.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	t.RLock()
+	oldSegments := append([]*oldSegment(nil), t.oldSegments...)
+	end := t.nextAddress
+	t.RUnlock()
+
+	count := 0
+	for _, o := range oldSegments {
+		if o.nextAddress() > end {
+			break
+		}
+		compressed, err := t.compressOldSegment(o, c)
+		if err != nil {
+			return count, err
+		}
+		if compressed {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// compressOldSegment writes the compressed segment file next to the segment
+// and removes the segment once the topic reads the compressed file.
+// recoverCompressed removes the compressed file when the topic was closed
+// before the segment was removed.
+func (t *Topic) compressOldSegment(o *oldSegment, c Codec) (bool, error) {
+	t.RLock()
+	fileName := o.fileName
+	info := o.info
+	t.RUnlock()
+
+	if isCompressed(fileName) {
+		return false, nil
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return false, err
+	}
+
+	checksum := sha256.Sum256(data)
+	if uint64(len(data)) != info.Size || hex.EncodeToString(checksum[:]) != info.Checksum {
+		return false, ErrSegmentChecksumMismatch
+	}
+
+	compressed, err := c.Compress(data)
+	if err != nil {
+		return false, err
+	}
+
+	if len(compressed)+1 >= len(data) {
+		return false, nil
+	}
+
+	compressedFileName := fileName + compressedSuffix
+	err = writeFileSync(compressedFileName, append([]byte{c.ID()}, compressed...))
+	if err != nil {
+		return false, err
+	}
+
+	t.Lock()
+	t.lruLock.Lock()
+	s := o.segment
+	if s != nil {
+		t.lru.Remove(o.element)
+		o.segment = nil
+		o.element = nil
+	}
+	o.fileName = compressedFileName
+	t.lruLock.Unlock()
+	t.Unlock()
+
+	if s != nil {
+		err = s.Close()
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = os.Remove(fileName)
+	if err != nil {
+		return false, err
+	}
+
+	return true, segment.SyncDir(t.dir)
+}
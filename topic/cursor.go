@@ -0,0 +1,211 @@
+package topic
+
+import (
+	"context"
+	"iter"
+	"math"
+
+	"github.com/draganm/zathras/segment"
+)
+
+// Cursor iterates over events of a topic in the range [from, to), forward or
+// in reverse. Data of the events follows the same rules as data returned by Read.
+//
+//	c := t.NewCursor()
+//	for c.Next() {
+//		e := c.Event()
+//		...
+//	}
+//	if c.Err() != nil {
+//		...
+//	}
+type Cursor struct {
+	topic    *Topic
+	from     uint64
+	to       uint64
+	reverse  bool
+	position uint64
+	address  uint64
+	event    Event
+	err      error
+}
+
+// NewCursor returns a cursor over all events of the topic, including events written later.
+func (t *Topic) NewCursor() *Cursor {
+	t.RLock()
+	from := t.firstAddress()
+	t.RUnlock()
+	return t.NewRangeCursor(from, math.MaxUint64)
+}
+
+// NewRangeCursor returns a cursor over events with addresses in [from, to).
+// A range starting before the first segment of the topic starts at its first event.
+func (t *Topic) NewRangeCursor(from, to uint64) *Cursor {
+	t.RLock()
+	position := t.firstAddress()
+	t.RUnlock()
+	if from > position {
+		position = from
+	}
+	return &Cursor{
+		topic:    t,
+		from:     from,
+		to:       to,
+		position: position,
+	}
+}
+
+// Reverse makes the cursor iterate from the end of the range (or the end of
+// the topic) towards its start.
+func (c *Cursor) Reverse() *Cursor {
+	c.reverse = true
+	end := c.topic.NextAddress()
+	if c.to < end {
+		end = c.to
+	}
+	c.position = end
+	return c
+}
+
+// Seek moves the cursor to the address. Next then returns the event at the
+// address or, in reverse, the event before the address.
+func (c *Cursor) Seek(address uint64) {
+	c.position = address
+	c.err = nil
+}
+
+// Next moves to the next event. It returns false at the end of the range or
+// the topic, or when an error occurred.
+func (c *Cursor) Next() bool {
+	if c.err != nil {
+		return false
+	}
+
+	if c.reverse {
+		return c.previous()
+	}
+
+	position, err := c.topic.eventAddress(c.position, !c.topic.readUncommitted)
+	if err != nil {
+		c.err = err
+		return false
+	}
+	c.position = position
+
+	if c.position >= c.to || c.position >= c.topic.NextAddress() {
+		return false
+	}
+
+	data, nextAddress, err := c.topic.Read(c.position)
+	if err != nil {
+		c.err = err
+		return false
+	}
+
+	c.address = c.position
+	c.event = Event{NextAddress: nextAddress, Data: data}
+	c.position = nextAddress
+
+	return true
+}
+
+func (c *Cursor) previous() bool {
+	if c.position <= c.from {
+		return false
+	}
+
+	address, err := c.topic.previousAddress(c.position)
+	if err == segment.ErrWrongAddress {
+		return false
+	}
+	if err != nil {
+		c.err = err
+		return false
+	}
+
+	if address < c.from {
+		return false
+	}
+
+	data, nextAddress, err := c.topic.Read(address)
+	if err != nil {
+		c.err = err
+		return false
+	}
+
+	c.address = address
+	c.event = Event{NextAddress: nextAddress, Data: data}
+	c.position = address
+
+	return true
+}
+
+// NextWait is like Next, but at the end of the topic it waits for new events
+// until the context is done. It returns false at the end of the range.
+// It does not wait in reverse.
+func (c *Cursor) NextWait(ctx context.Context) bool {
+	for {
+		if c.Next() {
+			return true
+		}
+
+		if c.err != nil || c.reverse || c.position >= c.to {
+			return false
+		}
+
+		c.topic.RLock()
+		limiter := c.topic.limiter
+		c.topic.RUnlock()
+
+		_, err := limiter.WaitContext(ctx, c.position)
+		if err != nil {
+			c.err = err
+			return false
+		}
+	}
+}
+
+// Position returns the address the cursor continues from. After Next
+// returned false at the end of the topic, it is past transaction markers and
+// aborted events at the end.
+func (c *Cursor) Position() uint64 {
+	return c.position
+}
+
+// Address returns the address of the current event.
+func (c *Cursor) Address() uint64 {
+	return c.address
+}
+
+// Event returns the current event.
+func (c *Cursor) Event() Event {
+	return c.event
+}
+
+// Err returns the error that stopped the cursor.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// All returns an iterator over addresses and data of events for range loops.
+// Check Err after the loop.
+func (c *Cursor) All() iter.Seq2[uint64, []byte] {
+	return func(yield func(uint64, []byte) bool) {
+		for c.Next() {
+			if !yield(c.address, c.event.Data) {
+				return
+			}
+		}
+	}
+}
+
+// Live is like All, but keeps waiting for new events until the context is done.
+func (c *Cursor) Live(ctx context.Context) iter.Seq2[uint64, []byte] {
+	return func(yield func(uint64, []byte) bool) {
+		for c.NextWait(ctx) {
+			if !yield(c.address, c.event.Data) {
+				return
+			}
+		}
+	}
+}
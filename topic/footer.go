@@ -0,0 +1,576 @@
+package topic
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/draganm/zathras/segment"
+)
+
+// ErrSegmentTruncated is returned when a sealed segment is shorter than recorded in its footer
+var ErrSegmentTruncated = errors.New("Segment is truncated")
+
+// ErrSegmentChecksumMismatch is returned when a sealed segment does not match the checksum in its footer
+var ErrSegmentChecksumMismatch = errors.New("Segment checksum mismatch")
+
+// ErrUnsupportedFooterVersion is returned when a footer was written by a newer version
+var ErrUnsupportedFooterVersion = errors.New("Unsupported segment footer version")
+
+const footerVersion = 1
+
+// SegmentInfo is the summary of a sealed segment, stored in a footer file next to the segment.
+type SegmentInfo struct {
+	Version      int    `json:"version"`
+	StartAddress uint64 `json:"start_address"`
+	Size         uint64 `json:"size"`
+	// Events is the number of events starting in the segment.
+	Events uint64 `json:"events"`
+	// FirstAddress and LastAddress are addresses of the first and the last event starting in the segment.
+	FirstAddress uint64 `json:"first_address"`
+	LastAddress  uint64 `json:"last_address"`
+	// MinTimestamp and MaxTimestamp are in nanoseconds since epoch, zero when unknown.
+	MinTimestamp int64 `json:"min_timestamp"`
+	MaxTimestamp int64 `json:"max_timestamp"`
+	// Checksum is the hex encoded SHA-256 of the whole segment file.
+	Checksum string `json:"checksum"`
+	// Producers holds the most recent sequence numbers of every producer
+	// written up to the end of the segment.
+	Producers map[string][]ProducerSequence `json:"producers,omitempty"`
+	// Markers is the number of transaction markers in the segment.
+	Markers uint64 `json:"markers,omitempty"`
+	// Aborted holds address ranges of transactions aborted in the segment.
+	Aborted []AddressRange `json:"aborted,omitempty"`
+	// Transaction is the transaction that is still open at the end of the segment.
+	Transaction *OpenTransaction `json:"transaction,omitempty"`
+}
+
+func footerFileName(segmentFileName string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(segmentFileName, compressedSuffix), ".seg") + ".footer"
+}
+
+// summarize reads all records of the segment and returns its summary.
+// Producer sequence numbers are added to the producers of the previous
+// segment, which can be nil.
+func (t *Topic) summarize(s *segment.Segment, startAddress uint64, previous *SegmentInfo) (*SegmentInfo, error) {
+	size := s.FileSize()
+	info := &SegmentInfo{
+		Version:      footerVersion,
+		StartAddress: startAddress,
+		Size:         size,
+	}
+
+	p := producers{}
+	if previous != nil {
+		p = producers(previous.Producers).clone()
+		info.Transaction = previous.Transaction
+	}
+
+	for address := uint64(0); address < size; {
+		record, nextAddress, err := s.Read(address)
+		if err != nil {
+			return nil, err
+		}
+
+		h, err := decodeHeader(record)
+		if err != nil {
+			return nil, err
+		}
+
+		if h.kind == recordMarker {
+			markerType, id, beginAddress, err := decodeMarker(record[h.length:])
+			if err != nil {
+				return nil, err
+			}
+			info.Markers++
+			info.Transaction = nil
+			switch markerType {
+			case markerBegin:
+				info.Transaction = &OpenTransaction{ID: id, Address: startAddress + address}
+			case markerAbort:
+				info.Aborted = append(info.Aborted, AddressRange{From: beginAddress, To: startAddress + nextAddress})
+			}
+		}
+
+		if h.kind == recordEvent || h.kind == recordChunkStart {
+			acceptProducer(p, h, startAddress+address, t.dedupWindow, t.producerExpiry)
+			if info.Events == 0 {
+				info.FirstAddress = startAddress + address
+			}
+			info.LastAddress = startAddress + address
+			info.Events++
+			if h.timestamp != 0 {
+				if info.MinTimestamp == 0 || h.timestamp < info.MinTimestamp {
+					info.MinTimestamp = h.timestamp
+				}
+				if h.timestamp > info.MaxTimestamp {
+					info.MaxTimestamp = h.timestamp
+				}
+			}
+		}
+
+		address = nextAddress
+	}
+
+	checksum, err := fileChecksum(s.Name(), size)
+	if err != nil {
+		return nil, err
+	}
+	info.Checksum = checksum
+
+	t.expireProducers(p, info.MaxTimestamp)
+	if len(p) > 0 {
+		info.Producers = p
+	}
+
+	return info, nil
+}
+
+// fileChecksum returns the checksum of the first size bytes of the segment
+// file, compressed segment files are decompressed first.
+func fileChecksum(fileName string, size uint64) (string, error) {
+	if isCompressed(fileName) {
+		_, data, err := readCompressedSegment(fileName)
+		if err != nil {
+			return "", err
+		}
+		if uint64(len(data)) < size {
+			return "", ErrSegmentTruncated
+		}
+		checksum := sha256.Sum256(data[:size])
+		return hex.EncodeToString(checksum[:]), nil
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, io.LimitReader(f, int64(size)))
+	if err != nil {
+		return "", err
+	}
+	if uint64(n) != size {
+		return "", ErrSegmentTruncated
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// seal syncs the segment and writes its footer.
+func (t *Topic) seal(s *segment.Segment, startAddress uint64, previous *SegmentInfo) (*SegmentInfo, error) {
+	err := s.Sync()
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := t.summarize(s, startAddress, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeFooter(footerFileName(s.Name()), info)
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+func writeFooter(fileName string, info *SegmentInfo) error {
+	tmpFileName := fileName + ".tmp"
+	err := writeFooterFile(tmpFileName, info)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpFileName, fileName)
+	if err != nil {
+		return err
+	}
+
+	return segment.SyncDir(filepath.Dir(fileName))
+}
+
+// writeFooterFile writes the footer to the file and syncs it.
+func writeFooterFile(fileName string, info *SegmentInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0700)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fileName)
+		return err
+	}
+
+	return nil
+}
+
+// recoverFooter finishes or discards a footer that was written to its
+// temporary file when the topic was closed abruptly. The footer is renamed
+// into place if it matches the segment; a re-encrypted segment that was not
+// renamed yet is discarded with its footer.
+func recoverFooter(segmentFileName string) error {
+	err := os.Remove(segmentFileName + ".tmp")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	renamed := err != nil
+
+	tmpFileName := footerFileName(segmentFileName) + ".tmp"
+	data, err := ioutil.ReadFile(tmpFileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	info := &SegmentInfo{}
+	if !renamed || json.Unmarshal(data, info) != nil {
+		return os.Remove(tmpFileName)
+	}
+
+	checksum, err := fileChecksum(segmentFileName, info.Size)
+	if err == ErrSegmentTruncated || err == nil && checksum != info.Checksum {
+		return os.Remove(tmpFileName)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpFileName, footerFileName(segmentFileName))
+	if err != nil {
+		return err
+	}
+
+	return segment.SyncDir(filepath.Dir(segmentFileName))
+}
+
+// readFooter returns the footer of the segment or nil if the segment has no footer.
+func readFooter(segmentFileName string) (*SegmentInfo, error) {
+	data, err := ioutil.ReadFile(footerFileName(segmentFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info := &SegmentInfo{}
+	err = json.Unmarshal(data, info)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Version > footerVersion {
+		return nil, ErrUnsupportedFooterVersion
+	}
+
+	return info, nil
+}
+
+// lastInfo returns the footer of the last sealed segment or nil.
+func (t *Topic) lastInfo() *SegmentInfo {
+	if len(t.oldSegments) == 0 {
+		return nil
+	}
+	return t.oldSegments[len(t.oldSegments)-1].info
+}
+
+// loadState restores producers and the transaction state from the footer of
+// the last sealed segment and the records of the current segment. It returns
+// the address after the last complete event. Records of an event that was
+// not completely written, e.g. because of a crash, are truncated; read only
+// topics ignore them, as another process may still be appending them.
+func (t *Topic) loadState() (uint64, error) {
+	end, err := t.completeEnd()
+	if err != nil {
+		return 0, err
+	}
+
+	if !t.readOnly && end < t.currentSegment.nextAddress() {
+		err = t.truncate(end)
+		if err != nil {
+			return 0, err
+		}
+		// aborted ranges of a reopened segment are applied again below
+		for len(t.aborted) > 0 && t.aborted[len(t.aborted)-1].To > t.currentSegment.startAddress {
+			t.aborted = t.aborted[:len(t.aborted)-1]
+		}
+	}
+
+	t.producers = producers{}
+	t.transaction = nil
+	if info := t.lastInfo(); info != nil {
+		t.producers = producers(info.Producers).clone()
+		t.transaction = info.Transaction
+	}
+
+	for address := t.currentSegment.startAddress; address < end; {
+		record, nextAddress, err := t.currentSegment.Read(address)
+		if err != nil {
+			return 0, err
+		}
+		h, err := decodeHeader(record)
+		if err != nil {
+			return 0, err
+		}
+		t.acceptProducer(h, address)
+		if h.kind == recordMarker {
+			err = t.applyMarker(h, record, address, nextAddress)
+			if err != nil {
+				return 0, err
+			}
+		}
+		address = nextAddress
+	}
+
+	return end, nil
+}
+
+// completeEnd returns the address after the last complete event, skipping a
+// torn record at the end of the current segment and the records of a chunked
+// event whose chunks are missing.
+func (t *Topic) completeEnd() (uint64, error) {
+	pendingChunks, end, err := t.unfinishedChunkedEvent()
+	if err != nil {
+		return 0, err
+	}
+
+	for address := t.currentSegment.startAddress; address < t.currentSegment.nextAddress(); {
+		record, nextAddress, err := t.currentSegment.Read(address)
+		if err == segment.ErrSegmentCorrupted || err == segment.ErrWrongAddress {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		h, err := decodeHeader(record)
+		if err != nil {
+			return 0, err
+		}
+		size := uint64(len(record) - h.length)
+		switch h.kind {
+		case recordChunkStart:
+			pendingChunks = h.size - size
+		case recordChunk:
+			if size > pendingChunks {
+				return 0, segment.ErrSegmentCorrupted
+			}
+			pendingChunks -= size
+		}
+		if pendingChunks == 0 {
+			end = nextAddress
+		}
+		address = nextAddress
+	}
+
+	return end, nil
+}
+
+// unfinishedChunkedEvent returns the size of the chunks missing from a chunked event
+// that started before the current segment, and the address of the event.
+// Only a current segment that is empty or starts with a chunk can continue
+// an event, the sealed segments are read back to its start then.
+func (t *Topic) unfinishedChunkedEvent() (uint64, uint64, error) {
+	start := t.currentSegment.startAddress
+	if len(t.oldSegments) == 0 {
+		return 0, start, nil
+	}
+
+	if t.currentSegment.FileSize() > 0 {
+		record, _, err := t.currentSegment.Read(start)
+		if err == nil && (len(record) == 0 || record[0]&recordKindMask != recordChunk) {
+			return 0, start, nil
+		}
+	}
+
+	chunks := uint64(0)
+	for i := len(t.oldSegments) - 1; i >= 0; i-- {
+		o := t.oldSegments[i]
+		eventAddress, eventSize, segmentChunks, err := t.lastChunkedEvent(o)
+		if err != nil {
+			return 0, 0, err
+		}
+		if eventSize == 0 {
+			chunks += segmentChunks
+			continue
+		}
+		if eventSize > 0 && uint64(eventSize) > segmentChunks+chunks {
+			return uint64(eventSize) - segmentChunks - chunks, eventAddress, nil
+		}
+		break
+	}
+
+	return 0, start, nil
+}
+
+// lastChunkedEvent reads the records of an old segment. When the last event
+// or marker of the segment is a chunk start it returns its address, the event
+// size and the size of the data of the event in the segment. The size is -1
+// when the last event is not chunked and 0 when the segment holds only chunks,
+// the size of the chunks is returned then.
+func (t *Topic) lastChunkedEvent(o *oldSegment) (uint64, int64, uint64, error) {
+	s, lease, err := t.acquireOldSegment(o)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer lease.Release()
+
+	eventAddress := uint64(0)
+	eventSize := int64(0)
+	chunks := uint64(0)
+	for address := uint64(0); address < s.FileSize(); {
+		record, nextAddress, err := s.Read(address)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		h, err := decodeHeader(record)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		size := uint64(len(record) - h.length)
+		switch h.kind {
+		case recordChunkStart:
+			eventAddress = o.startAddress + address
+			eventSize = int64(h.size)
+			chunks = size
+		case recordChunk:
+			chunks += size
+		default:
+			eventSize = -1
+			chunks = 0
+		}
+		address = nextAddress
+	}
+
+	return eventAddress, eventSize, chunks, nil
+}
+
+// loadFooter returns the footer of an old segment. Segments sealed before
+// footers were introduced get one now. A segment that does not have the
+// size recorded in its footer is reported as truncated.
+// Footers of the previous segments must be loaded already.
+func (t *Topic) loadFooter(o *oldSegment, previous *SegmentInfo) error {
+	if !t.readOnly {
+		err := recoverFooter(o.fileName)
+		if err == nil {
+			err = recoverCompressed(o.fileName)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	info, err := readFooter(o.fileName)
+	if err != nil {
+		return err
+	}
+
+	if info == nil && t.readOnly {
+		var s *segment.Segment
+		s, err = openSegmentFile(o.fileName, t.maxSegmentSize(), t.segmentOptionsAt(o.startAddress))
+		if err != nil {
+			return err
+		}
+		info, err = t.summarize(s, o.startAddress, previous)
+		closeErr := s.Close()
+		if err != nil {
+			return err
+		}
+		if closeErr != nil {
+			return closeErr
+		}
+	}
+
+	if info == nil {
+		var s *segment.Segment
+		s, err = openSegmentFile(o.fileName, t.maxSegmentSize(), t.segmentOptionsAt(o.startAddress))
+		if err != nil {
+			return err
+		}
+		info, err = t.seal(s, o.startAddress, previous)
+		closeErr := s.Close()
+		if err != nil {
+			return err
+		}
+		if closeErr != nil {
+			return closeErr
+		}
+	}
+
+	// the size of a compressed segment is checked with its checksum
+	if isCompressed(o.fileName) {
+		o.size = info.Size
+	}
+
+	if o.size < info.Size {
+		return ErrSegmentTruncated
+	}
+
+	if o.size != info.Size {
+		return ErrSegmentChecksumMismatch
+	}
+
+	o.info = info
+
+	return nil
+}
+
+// Segments returns summaries of all sealed segments.
+func (t *Topic) Segments() []SegmentInfo {
+	t.RLock()
+	defer t.RUnlock()
+	infos := []SegmentInfo{}
+	for _, o := range t.oldSegments {
+		infos = append(infos, *o.info)
+	}
+	return infos
+}
+
+// VerifySegments checks all sealed segments against the checksums in their footers.
+func (t *Topic) VerifySegments() error {
+	t.RLock()
+	fileNames := []string{}
+	infos := []*SegmentInfo{}
+	for _, o := range t.oldSegments {
+		fileNames = append(fileNames, o.fileName)
+		infos = append(infos, o.info)
+	}
+	t.RUnlock()
+
+	for i, fileName := range fileNames {
+		checksum, err := fileChecksum(fileName, infos[i].Size)
+		if err != nil {
+			return err
+		}
+		if checksum != infos[i].Checksum {
+			return ErrSegmentChecksumMismatch
+		}
+	}
+
+	return nil
+}
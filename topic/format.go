@@ -0,0 +1,95 @@
+package topic
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/draganm/zathras/segment"
+)
+
+// ErrUnsupportedFormat is returned when opening a topic written with a record format this version can't read.
+// Topics written before records had headers can be converted with Upgrade.
+var ErrUnsupportedFormat = errors.New("Unsupported topic format")
+
+// formatVersion is the version of the record format, stored in the format
+// file of the topic when the topic is created. Version 0 are topics written
+// before records had headers, they have segments but no format file.
+const formatVersion = 1
+
+const formatFileName = "format"
+
+// checkFormat returns ErrUnsupportedFormat when the topic in the dir was
+// written with another record format. The format file of a topic without
+// segments is written unless the topic is opened read only.
+func checkFormat(dir string, hasSegments bool, readOnly bool) error {
+	data, err := ioutil.ReadFile(filepath.Join(dir, formatFileName))
+	if os.IsNotExist(err) {
+		if hasSegments {
+			return ErrUnsupportedFormat
+		}
+		if readOnly {
+			return nil
+		}
+		return writeFormat(dir)
+	}
+	if err != nil {
+		return err
+	}
+
+	version, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || version != formatVersion {
+		return ErrUnsupportedFormat
+	}
+
+	return nil
+}
+
+// writeFormat writes the format file with the current format version.
+func writeFormat(dir string) error {
+	return writeFileSync(filepath.Join(dir, formatFileName), []byte(strconv.Itoa(formatVersion)+"\n"))
+}
+
+// writeFileSync replaces the file with the data so that the file has either
+// the old or the new content after a crash.
+func writeFileSync(fileName string, data []byte) error {
+	tmpFileName := fileName + ".tmp"
+	err := writeSyncedFile(tmpFileName, data)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpFileName, fileName)
+	if err != nil {
+		os.Remove(tmpFileName)
+		return err
+	}
+
+	return segment.SyncDir(filepath.Dir(fileName))
+}
+
+// writeSyncedFile writes the data to the file and syncs it.
+func writeSyncedFile(fileName string, data []byte) error {
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0700)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(fileName)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,330 @@
+package topic
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/draganm/zathras/merkle"
+	"github.com/draganm/zathras/segment"
+)
+
+// ErrNoHashChain is returned when requesting hashes of a topic without the hash chain
+var ErrNoHashChain = errors.New("Topic has no hash chain")
+
+// ErrTreeSizeOutOfRange is returned when a proof is requested for a tree size larger than the topic
+var ErrTreeSizeOutOfRange = errors.New("Tree size out of range")
+
+// HashMismatchError is returned when an event does not match its stored hashes.
+type HashMismatchError struct {
+	Address uint64
+}
+
+func (e *HashMismatchError) Error() string {
+	return fmt.Sprintf("Hash mismatch of the event at %d", e.Address)
+}
+
+const hashChainFileName = "hashes"
+
+// Every entry of the hashes file is [u64 address][u64 next address][leaf hash][chain hash].
+const hashEntrySize = 8 + 8 + sha256.Size + sha256.Size
+
+// hashChain keeps hashes of all events of the topic in a sidecar file. The
+// chain hash of every event is the hash of the previous chain hash and the
+// leaf hash of the event. Leaf hashes are the leaves of a Merkle tree.
+type hashChain struct {
+	sync.Mutex
+	file      *os.File
+	addresses []uint64
+	leaves    [][]byte
+	chain     []byte
+	next      uint64
+}
+
+// HasHashChain returns true when the topic in the dir keeps a hash chain.
+func HasHashChain(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, hashChainFileName))
+	return err == nil
+}
+
+func chainHash(previous, leaf []byte) []byte {
+	h := sha256.New()
+	h.Write(previous)
+	h.Write(leaf)
+	return h.Sum(nil)
+}
+
+func openHashChain(dir string, firstAddress uint64) (*hashChain, error) {
+	file, err := os.OpenFile(filepath.Join(dir, hashChainFileName), os.O_RDWR|os.O_CREATE, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &hashChain{
+		file:  file,
+		chain: make([]byte, sha256.Size),
+		next:  firstAddress,
+	}
+
+	entry := make([]byte, hashEntrySize)
+	size := int64(0)
+	for {
+		_, err = io.ReadFull(file, entry)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		c.addresses = append(c.addresses, binary.BigEndian.Uint64(entry))
+		c.next = binary.BigEndian.Uint64(entry[8:])
+		c.leaves = append(c.leaves, append([]byte(nil), entry[16:16+sha256.Size]...))
+		c.chain = append([]byte(nil), entry[16+sha256.Size:]...)
+		size += hashEntrySize
+	}
+
+	// drop a partially written entry
+	err = file.Truncate(size)
+	if err == nil {
+		_, err = file.Seek(size, 0)
+	}
+	if err == nil {
+		err = segment.SyncDir(dir)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// updateHashes adds hashes of all committed events that have no hashes yet.
+// The hash chain is left unchanged when the hashes can't be written.
+func (t *Topic) updateHashes() error {
+	c := t.hashes
+	if c == nil {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	lastAddress := t.NextAddress()
+	entries := []byte{}
+	addresses := []uint64{}
+	leaves := [][]byte{}
+	chain := c.chain
+	next := c.next
+	for next < lastAddress {
+		address, err := t.eventAddress(next, true)
+		if err != nil {
+			return err
+		}
+		if address >= lastAddress {
+			next = address
+			break
+		}
+		err = t.view(address, func(nextAddress uint64, data []byte) error {
+			leaf := merkle.LeafHash(data)
+			chain = chainHash(chain, leaf)
+
+			entry := make([]byte, 16, hashEntrySize)
+			binary.BigEndian.PutUint64(entry, address)
+			binary.BigEndian.PutUint64(entry[8:], nextAddress)
+			entry = append(entry, leaf...)
+			entry = append(entry, chain...)
+			entries = append(entries, entry...)
+
+			addresses = append(addresses, address)
+			leaves = append(leaves, leaf)
+			next = nextAddress
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(entries) > 0 {
+		_, err := c.file.Write(entries)
+		if err == nil {
+			err = c.file.Sync()
+		}
+		if err != nil {
+			size := int64(len(c.addresses)) * hashEntrySize
+			c.file.Truncate(size)
+			c.file.Seek(size, 0)
+			return err
+		}
+	}
+
+	c.addresses = append(c.addresses, addresses...)
+	c.leaves = append(c.leaves, leaves...)
+	c.chain = chain
+	c.next = next
+
+	return nil
+}
+
+// TreeHead returns the size and the root hash of the Merkle tree over all events of the topic.
+// The timestamp is in milliseconds since epoch.
+func (t *Topic) TreeHead() (*merkle.TreeHead, error) {
+	c := t.hashes
+	if c == nil {
+		return nil, ErrNoHashChain
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	return &merkle.TreeHead{
+		Size:      uint64(len(c.leaves)),
+		RootHash:  merkle.Root(c.leaves),
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+	}, nil
+}
+
+// SignedTreeHead returns the tree head signed with the key.
+func (t *Topic) SignedTreeHead(key ed25519.PrivateKey) (*merkle.TreeHead, error) {
+	h, err := t.TreeHead()
+	if err != nil {
+		return nil, err
+	}
+	h.Sign(key)
+	return h, nil
+}
+
+// InclusionProof returns the index and the leaf hash of the event at the
+// address, together with the proof that it is included in the tree of the size.
+func (t *Topic) InclusionProof(address, treeSize uint64) (uint64, []byte, [][]byte, error) {
+	c := t.hashes
+	if c == nil {
+		return 0, nil, nil, ErrNoHashChain
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if treeSize > uint64(len(c.leaves)) {
+		return 0, nil, nil, ErrTreeSizeOutOfRange
+	}
+
+	index := sort.Search(len(c.addresses), func(i int) bool {
+		return c.addresses[i] >= address
+	})
+	if index >= len(c.addresses) || c.addresses[index] != address {
+		return 0, nil, nil, segment.ErrWrongAddress
+	}
+	if uint64(index) >= treeSize {
+		return 0, nil, nil, ErrTreeSizeOutOfRange
+	}
+
+	proof, err := merkle.InclusionProof(c.leaves[:treeSize], index)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	return uint64(index), c.leaves[index], proof, nil
+}
+
+// ConsistencyProof returns the proof that the tree of the first size is a prefix of the tree of the second size.
+func (t *Topic) ConsistencyProof(first, second uint64) ([][]byte, error) {
+	c := t.hashes
+	if c == nil {
+		return nil, ErrNoHashChain
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if first > second || second > uint64(len(c.leaves)) {
+		return nil, ErrTreeSizeOutOfRange
+	}
+
+	return merkle.ConsistencyProof(c.leaves[:second], int(first))
+}
+
+// VerifyHashChain reads all events and checks them against the stored hashes.
+// It returns a *HashMismatchError for the first event that does not match.
+func (t *Topic) VerifyHashChain() error {
+	c := t.hashes
+	if c == nil {
+		return ErrNoHashChain
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	_, err := c.file.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	defer c.file.Seek(0, 2)
+
+	t.RLock()
+	address := t.firstAddress()
+	t.RUnlock()
+
+	chain := make([]byte, sha256.Size)
+	entry := make([]byte, hashEntrySize)
+
+	for i := range c.leaves {
+		_, err = io.ReadFull(c.file, entry)
+		if err != nil {
+			return err
+		}
+
+		address, err = t.eventAddress(address, true)
+		if err != nil {
+			return err
+		}
+
+		if binary.BigEndian.Uint64(entry) != address {
+			return &HashMismatchError{Address: address}
+		}
+
+		err = t.view(address, func(nextAddress uint64, data []byte) error {
+			leaf := merkle.LeafHash(data)
+			chain = chainHash(chain, leaf)
+			if binary.BigEndian.Uint64(entry[8:]) != nextAddress ||
+				!bytes.Equal(entry[16:16+sha256.Size], leaf) ||
+				!bytes.Equal(entry[16+sha256.Size:], chain) ||
+				!bytes.Equal(c.leaves[i], leaf) {
+				return &HashMismatchError{Address: address}
+			}
+			address = nextAddress
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	address, err = t.eventAddress(address, true)
+	if err != nil {
+		return err
+	}
+
+	if address != t.NextAddress() {
+		return &HashMismatchError{Address: address}
+	}
+
+	return nil
+}
+
+func (c *hashChain) close() error {
+	c.Lock()
+	defer c.Unlock()
+	return c.file.Close()
+}
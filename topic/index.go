@@ -0,0 +1,492 @@
+package topic
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownIndex is returned when querying an index the topic doesn't have
+var ErrUnknownIndex = errors.New("Unknown index")
+
+// ErrInvalidIndexName is returned when the index name can't be used in a file name
+var ErrInvalidIndexName = errors.New("Invalid index name")
+
+// ErrIndexCorrupted is returned when an index file links entries wrongly
+var ErrIndexCorrupted = errors.New("Index corrupted")
+
+var indexNameMatcher = regexp.MustCompile(`^[a-zA-Z0-9_\-]+$`)
+
+// Index files start with the fingerprint of the index version. Every entry
+// is [u64 address][u64 next address][u32 count]([u16 length][value][u64
+// previous])* and holds the values of one event. previous is the offset of
+// the previous entry with a value of the same hash, zero for the first one,
+// so that the entries of a value are found without keeping their addresses
+// in memory.
+const (
+	indexHeaderSize      = sha256.Size
+	indexEntryHeaderSize = 8 + 8 + 4
+	maxIndexValueLength  = 0xffff
+)
+
+// Extractor returns the values under which an event is indexed.
+type Extractor func(data []byte) []string
+
+// indexOption is the version and the extractor of an index.
+type indexOption struct {
+	version string
+	extract Extractor
+}
+
+// index maps values extracted from events to their addresses. It is kept in
+// a sidecar file of the topic and rebuilt from the events when the file is
+// missing or was written with another version of the index. Only the offset
+// of the last entry of every value hash is kept in memory.
+type index struct {
+	sync.Mutex
+	file        *os.File
+	fingerprint []byte
+	extract     Extractor
+	heads       map[uint64]int64
+	size        int64
+	next        uint64
+}
+
+// indexEntry is a decoded entry of an index file.
+type indexEntry struct {
+	address  uint64
+	next     uint64
+	values   []string
+	previous []int64
+	length   int64
+}
+
+func indexFileName(name string) string {
+	return "index-" + name
+}
+
+func indexFingerprint(version string) []byte {
+	fingerprint := sha256.Sum256([]byte(version))
+	return fingerprint[:]
+}
+
+func indexValueHash(value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	return h.Sum64()
+}
+
+// JSONPath returns an extractor of the value at the path in JSON events,
+// e.g. "order.id" or "$.order.id". Strings, numbers and booleans are indexed;
+// arrays on the path are indexed element by element. Events that aren't JSON
+// objects are not indexed.
+func JSONPath(path string) Extractor {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	keys := strings.Split(path, ".")
+	return func(data []byte) []string {
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		var v interface{}
+		err := d.Decode(&v)
+		if err != nil {
+			return nil
+		}
+		return jsonValues(v, keys, nil)
+	}
+}
+
+func jsonValues(v interface{}, keys []string, values []string) []string {
+	if a, isArray := v.([]interface{}); isArray {
+		for _, e := range a {
+			values = jsonValues(e, keys, values)
+		}
+		return values
+	}
+
+	if len(keys) == 0 {
+		switch v := v.(type) {
+		case string:
+			return append(values, v)
+		case json.Number:
+			return append(values, v.String())
+		case bool:
+			if v {
+				return append(values, "true")
+			}
+			return append(values, "false")
+		}
+		return values
+	}
+
+	o, isObject := v.(map[string]interface{})
+	if !isObject {
+		return values
+	}
+
+	return jsonValues(o[keys[0]], keys[1:], values)
+}
+
+func openIndex(dir, name, version string, extract Extractor, firstAddress uint64) (*index, error) {
+	if !indexNameMatcher.MatchString(name) {
+		return nil, ErrInvalidIndexName
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, indexFileName(name)), os.O_RDWR|os.O_CREATE, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	x := &index{
+		file:        file,
+		fingerprint: indexFingerprint(version),
+		extract:     extract,
+		heads:       map[uint64]int64{},
+		next:        firstAddress,
+	}
+
+	fingerprint, size, err := x.load()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if !bytes.Equal(fingerprint, x.fingerprint) {
+		// the index is rebuilt from the events
+		x.heads = map[uint64]int64{}
+		x.next = firstAddress
+		size = indexHeaderSize
+		err = file.Truncate(0)
+		if err == nil {
+			_, err = file.WriteAt(x.fingerprint, 0)
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	// drop a partially written entry
+	err = file.Truncate(size)
+	if err == nil {
+		_, err = file.Seek(size, 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	x.size = size
+
+	return x, nil
+}
+
+// load reads the fingerprint and all complete entries of the file. It
+// returns the fingerprint, nil for an empty file, and the size of the
+// fingerprint and the complete entries.
+func (x *index) load() ([]byte, int64, error) {
+	r := bufio.NewReader(x.file)
+
+	fingerprint := make([]byte, indexHeaderSize)
+	_, err := io.ReadFull(r, fingerprint)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size := int64(indexHeaderSize)
+	for {
+		e, err := readIndexEntry(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fingerprint, size, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, v := range e.values {
+			x.heads[indexValueHash(v)] = size
+		}
+		x.next = e.next
+		size += e.length
+	}
+}
+
+func readIndexEntry(r io.Reader) (indexEntry, error) {
+	e := indexEntry{}
+
+	header := make([]byte, indexEntryHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return e, err
+	}
+	e.address = binary.BigEndian.Uint64(header)
+	e.next = binary.BigEndian.Uint64(header[8:])
+	count := binary.BigEndian.Uint32(header[16:])
+	e.length = indexEntryHeaderSize
+
+	buf := make([]byte, 8)
+	for i := uint32(0); i < count; i++ {
+		_, err = io.ReadFull(r, buf[:2])
+		if err != nil {
+			return e, noEOF(err)
+		}
+		value := make([]byte, binary.BigEndian.Uint16(buf)+8)
+		_, err = io.ReadFull(r, value)
+		if err != nil {
+			return e, noEOF(err)
+		}
+		valueLength := len(value) - 8
+		e.values = append(e.values, string(value[:valueLength]))
+		e.previous = append(e.previous, int64(binary.BigEndian.Uint64(value[valueLength:])))
+		e.length += int64(2 + len(value))
+	}
+
+	return e, nil
+}
+
+// noEOF turns io.EOF in the middle of an entry into io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// appendEntry appends the entry of the event with the values to entries,
+// which are written after the file. heads holds the offsets of the values
+// of entries that are not written yet.
+func (x *index) appendEntry(entries []byte, heads map[uint64]int64, address, next uint64, values []string) []byte {
+	offset := x.size + int64(len(entries))
+
+	header := make([]byte, indexEntryHeaderSize)
+	binary.BigEndian.PutUint64(header, address)
+	binary.BigEndian.PutUint64(header[8:], next)
+	entry := append(entries, header...)
+
+	count := uint32(0)
+	seen := map[string]bool{}
+	linked := map[uint64]bool{}
+	buf := make([]byte, 8)
+	for _, v := range values {
+		// an event is listed once, even when it has the value several times
+		if len(v) > maxIndexValueLength || seen[v] {
+			continue
+		}
+		seen[v] = true
+		count++
+
+		h := indexValueHash(v)
+		previous := int64(0)
+		if !linked[h] {
+			linked[h] = true
+			head, found := heads[h]
+			if !found {
+				head = x.heads[h]
+			}
+			previous = head
+		}
+
+		binary.BigEndian.PutUint16(buf, uint16(len(v)))
+		entry = append(entry, buf[:2]...)
+		entry = append(entry, v...)
+		binary.BigEndian.PutUint64(buf, uint64(previous))
+		entry = append(entry, buf...)
+	}
+
+	binary.BigEndian.PutUint32(entry[len(entries)+16:], count)
+
+	for h := range linked {
+		heads[h] = offset
+	}
+
+	return entry
+}
+
+// addresses returns the addresses of the entries with the value, in the
+// order of the file.
+func (x *index) addresses(value string) ([]uint64, error) {
+	h := indexValueHash(value)
+	addresses := []uint64{}
+	offset := x.heads[h]
+	for offset != 0 {
+		e, err := readIndexEntry(bufio.NewReader(io.NewSectionReader(x.file, offset, x.size-offset)))
+		if err != nil {
+			return nil, err
+		}
+
+		previous := int64(-1)
+		for i, v := range e.values {
+			if indexValueHash(v) != h {
+				continue
+			}
+			if previous < 0 {
+				previous = e.previous[i]
+			}
+			if v == value {
+				addresses = append(addresses, e.address)
+			}
+		}
+
+		// entries only link to entries before them
+		if previous < 0 || previous >= offset {
+			return nil, ErrIndexCorrupted
+		}
+		offset = previous
+	}
+
+	for i, j := 0, len(addresses)-1; i < j; i, j = i+1, j-1 {
+		addresses[i], addresses[j] = addresses[j], addresses[i]
+	}
+
+	return addresses, nil
+}
+
+func (x *index) close() error {
+	x.Lock()
+	defer x.Unlock()
+	return x.file.Close()
+}
+
+// openIndexes opens the indexes of the topic and adds events that are not indexed yet.
+func (t *Topic) openIndexes() error {
+	t.indexes = map[string]*index{}
+	for name, o := range t.indexOptions {
+		x, err := openIndex(t.dir, name, o.version, o.extract, t.firstAddress())
+		if err != nil {
+			return err
+		}
+		t.indexes[name] = x
+	}
+	return t.updateIndexes()
+}
+
+// updateIndexes adds values of all committed events that are not indexed yet.
+func (t *Topic) updateIndexes() error {
+	for _, x := range t.indexes {
+		err := t.updateIndex(x)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateIndex writes the entries of the events that are not indexed yet. The
+// index is left unchanged when the entries can't be written.
+func (t *Topic) updateIndex(x *index) error {
+	x.Lock()
+	defer x.Unlock()
+
+	lastAddress := t.NextAddress()
+	entries := []byte{}
+	heads := map[uint64]int64{}
+	next := x.next
+	for next < lastAddress {
+		address, err := t.eventAddress(next, true)
+		if err != nil {
+			return err
+		}
+		if address >= lastAddress {
+			next = address
+			break
+		}
+		err = t.view(address, func(nextAddress uint64, data []byte) error {
+			entries = x.appendEntry(entries, heads, address, nextAddress, x.extract(data))
+			next = nextAddress
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(entries) > 0 {
+		_, err := x.file.Write(entries)
+		if err != nil {
+			x.file.Truncate(x.size)
+			x.file.Seek(x.size, 0)
+			return err
+		}
+	}
+
+	for h, offset := range heads {
+		x.heads[h] = offset
+	}
+	x.size += int64(len(entries))
+	x.next = next
+
+	return nil
+}
+
+// updateSidecars brings the hash chain and the indexes up to date with the committed events.
+func (t *Topic) updateSidecars() error {
+	err := t.updateHashes()
+	if err != nil {
+		return err
+	}
+	return t.updateIndexes()
+}
+
+// catchUpSidecars updates the sidecars after a write. The topic is synced
+// first, so that the synced sidecars never hold events a crash could lose.
+// A failure doesn't fail the write; the sidecars are brought up to date by
+// the next write or when the topic is opened.
+func (t *Topic) catchUpSidecars() {
+	if t.hashes == nil && len(t.indexes) == 0 {
+		return
+	}
+	err := t.Sync()
+	if err == nil {
+		err = t.updateSidecars()
+	}
+	if err != nil {
+		log.Println("Could not update sidecars of", t.dir, err)
+	}
+}
+
+// IndexedAddresses returns the addresses of all events that have the value
+// in the index, in the order of the topic.
+func (t *Topic) IndexedAddresses(name, value string) ([]uint64, error) {
+	x, found := t.indexes[name]
+	if !found {
+		return nil, ErrUnknownIndex
+	}
+
+	x.Lock()
+	defer x.Unlock()
+
+	return x.addresses(value)
+}
+
+// Query calls fn with the address and data of every event that has the
+// value in the index, in the order of the topic. The data must not be used
+// after fn returns.
+func (t *Topic) Query(name, value string, fn func(address uint64, data []byte) error) error {
+	addresses, err := t.IndexedAddresses(name, value)
+	if err != nil {
+		return err
+	}
+
+	for _, address := range addresses {
+		err = t.view(address, func(nextAddress uint64, data []byte) error {
+			return fn(address, data)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
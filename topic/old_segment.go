@@ -0,0 +1,267 @@
+package topic
+
+import (
+	"container/list"
+	"errors"
+	"log"
+	"os"
+
+	"github.com/draganm/zathras/segment"
+)
+
+// oldSegment is a full segment that is opened on first read and closed
+// again when too many segments are open.
+type oldSegment struct {
+	fileName     string
+	startAddress uint64
+	size         uint64
+	segment      *segment.Segment
+	element      *list.Element
+	info         *SegmentInfo
+}
+
+func (o *oldSegment) nextAddress() uint64 {
+	return o.startAddress + o.size
+}
+
+func (o *oldSegment) containsAddress(a uint64) bool {
+	return a >= o.startAddress && a < o.nextAddress()
+}
+
+// retireCurrentSegment moves the sealed current segment to the old segments.
+// It stays open until evicted.
+func (t *Topic) retireCurrentSegment(info *SegmentInfo) {
+	o := &oldSegment{
+		fileName:     t.currentSegment.Name(),
+		startAddress: t.currentSegment.startAddress,
+		size:         t.currentSegment.FileSize(),
+		segment:      t.currentSegment.Segment,
+		info:         info,
+	}
+	t.oldSegments = append(t.oldSegments, o)
+
+	t.lruLock.Lock()
+	defer t.lruLock.Unlock()
+	o.element = t.lru.PushFront(o)
+	t.evictOldSegments()
+}
+
+// evictOldSegments closes least recently used segments above the limit.
+// Must be called with lruLock held.
+func (t *Topic) evictOldSegments() {
+	if t.maxOpenSegments <= 0 {
+		return
+	}
+	for t.lru.Len() > t.maxOpenSegments {
+		o := t.lru.Remove(t.lru.Back()).(*oldSegment)
+		err := o.segment.Close()
+		if err != nil {
+			log.Println("Could not close segment", o.fileName, err)
+		}
+		o.segment = nil
+		o.element = nil
+	}
+}
+
+// acquireOldSegment opens the segment if needed and returns it with a lease.
+func (t *Topic) acquireOldSegment(o *oldSegment) (*segment.Segment, *segment.Lease, error) {
+	t.lruLock.Lock()
+	defer t.lruLock.Unlock()
+
+	if o.segment == nil {
+		s, err := openSegmentFile(o.fileName, t.maxSegmentSize(), t.segmentOptionsAt(o.startAddress))
+		if err != nil {
+			return nil, nil, err
+		}
+		o.segment = s
+		o.element = t.lru.PushFront(o)
+		t.evictOldSegments()
+	} else {
+		t.lru.MoveToFront(o.element)
+	}
+
+	lease, err := o.segment.Acquire()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return o.segment, lease, nil
+}
+
+func (t *Topic) readOldSegment(o *oldSegment, address uint64) ([]byte, uint64, *segment.Lease, error) {
+	s, lease, err := t.acquireOldSegment(o)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	data, nextAddress, err := s.Read(address - o.startAddress)
+	if err != nil {
+		lease.Release()
+		return nil, 0, nil, err
+	}
+
+	return data, nextAddress + o.startAddress, lease, nil
+}
+
+// OpenSegments returns the number of open old segments.
+func (t *Topic) OpenSegments() int {
+	t.lruLock.Lock()
+	defer t.lruLock.Unlock()
+	return t.lru.Len()
+}
+
+// ErrNoKeyProvider is returned when re-encrypting a topic without encryption
+var ErrNoKeyProvider = errors.New("Topic has no key provider")
+
+// Reencrypt re-encrypts records of all old segments with the current key.
+// Segments are closed while rewritten, data read from them before stays valid.
+// It returns the number of re-encrypted records.
+func (t *Topic) Reencrypt() (int, error) {
+	if t.keys == nil {
+		return 0, ErrNoKeyProvider
+	}
+
+	t.RLock()
+	oldSegments := append([]*oldSegment(nil), t.oldSegments...)
+	t.RUnlock()
+
+	total := 0
+	for _, o := range oldSegments {
+		count, info, err := t.reencryptOldSegment(o)
+		if err != nil {
+			return total, err
+		}
+		if count > 0 {
+			t.Lock()
+			o.info = info
+			t.Unlock()
+		}
+		total += count
+	}
+
+	return total, nil
+}
+
+// reencryptOldSegment rewrites the segment and its footer with the new
+// checksum. Both are written to temporary files first and renamed once
+// synced, recoverFooter completes the renames after a crash.
+func (t *Topic) reencryptOldSegment(o *oldSegment) (int, *SegmentInfo, error) {
+	t.lruLock.Lock()
+	defer t.lruLock.Unlock()
+
+	if o.segment != nil {
+		t.lru.Remove(o.element)
+		err := o.segment.Close()
+		if err != nil {
+			return 0, nil, err
+		}
+		o.segment = nil
+		o.element = nil
+	}
+
+	info := *o.info
+	tmpFileName := o.fileName + ".tmp"
+
+	var count int
+	var err error
+	if isCompressed(o.fileName) {
+		count, info.Checksum, err = reencryptCompressedTo(o.fileName, tmpFileName, o.startAddress, info.Size, t.keys)
+		if err != nil || count == 0 {
+			return 0, nil, err
+		}
+	} else {
+		count, err = segment.ReencryptTo(o.fileName, tmpFileName, o.startAddress, t.keys)
+		if err != nil || count == 0 {
+			return 0, nil, err
+		}
+		info.Checksum, err = fileChecksum(tmpFileName, info.Size)
+	}
+
+	if err == nil {
+		err = writeFooterFile(footerFileName(o.fileName)+".tmp", &info)
+	}
+	if err != nil {
+		os.Remove(tmpFileName)
+		return 0, nil, err
+	}
+
+	err = os.Rename(tmpFileName, o.fileName)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	err = os.Rename(footerFileName(o.fileName)+".tmp", footerFileName(o.fileName))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	err = segment.SyncDir(t.dir)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return count, &info, nil
+}
+
+// DeleteSegmentsBefore removes the sealed segments that end at or before
+// the address, oldest first, and returns their number. The topic then starts
+// at the first remaining segment. Data read from removed segments before
+// stays valid.
+func (t *Topic) DeleteSegmentsBefore(address uint64) (int, error) {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	t.Lock()
+	defer t.Unlock()
+
+	deleted := 0
+	for len(t.oldSegments) > 0 && t.oldSegments[0].nextAddress() <= address {
+		o := t.oldSegments[0]
+
+		t.lruLock.Lock()
+		if o.segment != nil {
+			t.lru.Remove(o.element)
+			err := o.segment.Close()
+			if err != nil {
+				t.lruLock.Unlock()
+				return deleted, err
+			}
+			o.segment = nil
+			o.element = nil
+		}
+		t.lruLock.Unlock()
+
+		err := os.Remove(o.fileName)
+		if err != nil {
+			return deleted, err
+		}
+		t.oldSegments = t.oldSegments[1:]
+		deleted++
+
+		err = os.Remove(footerFileName(o.fileName))
+		if err != nil && !os.IsNotExist(err) {
+			return deleted, err
+		}
+	}
+
+	if deleted == 0 {
+		return 0, nil
+	}
+
+	return deleted, segment.SyncDir(t.dir)
+}
+
+func (t *Topic) closeOldSegments() error {
+	t.lruLock.Lock()
+	defer t.lruLock.Unlock()
+	for t.lru.Len() > 0 {
+		o := t.lru.Remove(t.lru.Front()).(*oldSegment)
+		err := o.segment.Close()
+		if err != nil {
+			return err
+		}
+		o.segment = nil
+		o.element = nil
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package topic
+
+import (
+	"time"
+
+	"github.com/draganm/zathras/segment"
+)
+
+// Option configures optional behaviour of a Topic.
+type Option func(*Topic)
+
+// WithMaxOpenSegments limits the number of old segments that are kept open
+// (and mmaped) at the same time. The least recently read segments are closed
+// first. Zero means no limit.
+func WithMaxOpenSegments(max int) Option {
+	return func(t *Topic) {
+		t.maxOpenSegments = max
+	}
+}
+
+// WithCopyOnRead makes Read return copies of event data, so that the data
+// stays valid after the topic is closed.
+func WithCopyOnRead() Option {
+	return func(t *Topic) {
+		t.copyOnRead = true
+	}
+}
+
+// WithPreallocate reserves disk space for segmentSize bytes when a new
+// segment file is created. Segments growing beyond it are extended as usual.
+func WithPreallocate() Option {
+	return func(t *Topic) {
+		t.segmentOptions = append(t.segmentOptions, segment.WithPreallocate(t.segmentSize))
+	}
+}
+
+// WithMaxEventSize makes WriteEvent reject events larger than max bytes.
+// Zero means no limit.
+func WithMaxEventSize(max uint64) Option {
+	return func(t *Topic) {
+		t.maxEventSize = max
+	}
+}
+
+// WithCompression compresses every written event with the codec. Events that
+// don't get smaller are stored uncompressed. Topics can be read regardless of
+// the option, as long as the codecs used are registered.
+func WithCompression(c Codec) Option {
+	return func(t *Topic) {
+		t.codec = c
+	}
+}
+
+// WithEncryption encrypts new records with the current key of the provider.
+// See segment.WithEncryption.
+func WithEncryption(keys segment.KeyProvider) Option {
+	return func(t *Topic) {
+		t.keys = keys
+		t.segmentOptions = append(t.segmentOptions, segment.WithEncryption(keys))
+	}
+}
+
+// WithHashChain keeps a hash chain and a Merkle tree over all events of the
+// topic, so that it can provide signed tree heads and proofs that history
+// was not rewritten.
+func WithHashChain() Option {
+	return func(t *Topic) {
+		t.hashChain = true
+	}
+}
+
+// WithClock sets the function used to timestamp written events.
+func WithClock(now func() time.Time) Option {
+	return func(t *Topic) {
+		t.now = now
+	}
+}
+
+// WithVerifySegments checks the checksums of all sealed segments when the
+// topic is opened.
+func WithVerifySegments() Option {
+	return func(t *Topic) {
+		t.verifySegments = true
+	}
+}
+
+// WithDeduplicationWindow sets the number of most recent sequence numbers
+// remembered per producer. Retries of older writes are rejected instead of
+// returning the original address. Zero disables deduplication, New returns
+// ErrInvalidDeduplicationWindow for a negative window.
+// See WriteProducerEvent.
+func WithDeduplicationWindow(window int) Option {
+	return func(t *Topic) {
+		t.dedupWindow = window
+	}
+}
+
+// WithProducerExpiry forgets producers that didn't write for longer than d,
+// so that idle producers don't take up memory and footer space. The next
+// write of a forgotten producer starts its sequence anew. Zero keeps
+// producers forever, New returns ErrInvalidProducerExpiry for a negative d.
+func WithProducerExpiry(d time.Duration) Option {
+	return func(t *Topic) {
+		t.producerExpiry = d
+	}
+}
+
+// WithReadUncommitted makes readers see events of aborted transactions.
+// By default only committed events are read.
+func WithReadUncommitted() Option {
+	return func(t *Topic) {
+		t.readUncommitted = true
+	}
+}
+
+// WithIndex keeps a secondary index of the values the extractor returns for
+// every event, so that events can be queried by value. See Query. The
+// version identifies the extractor: the index is rebuilt from the events
+// when the topic is opened with another version, so it has to change
+// whenever the extractor returns other values.
+func WithIndex(name, version string, extract Extractor) Option {
+	return func(t *Topic) {
+		if t.indexOptions == nil {
+			t.indexOptions = map[string]indexOption{}
+		}
+		t.indexOptions[name] = indexOption{version: version, extract: extract}
+	}
+}
+
+// WithReadOnly opens an existing topic for reading only, e.g. while another
+// process writes to it. Nothing is written to the topic directory; writes
+// return ErrReadOnly. Events written after the topic was opened are not
+// visible. It can't be combined with WithHashChain or WithIndex.
+func WithReadOnly() Option {
+	return func(t *Topic) {
+		t.readOnly = true
+		t.segmentOptions = append(t.segmentOptions, segment.WithReadOnly())
+	}
+}
+
+// WithStartAddress makes a new topic start at the address instead of zero,
+// e.g. to import events keeping their addresses. It has no effect on
+// existing topics.
+func WithStartAddress(address uint64) Option {
+	return func(t *Topic) {
+		t.startAddress = address
+	}
+}
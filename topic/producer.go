@@ -0,0 +1,162 @@
+package topic
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/draganm/zathras/segment"
+)
+
+// ErrInvalidProducerID is returned when a producer ID is empty or longer than 255 bytes
+var ErrInvalidProducerID = errors.New("Invalid producer ID")
+
+// ErrOutOfOrderSequence is returned when a producer writes a sequence number
+// that is not newer than the last accepted one and is not a remembered duplicate
+var ErrOutOfOrderSequence = errors.New("Producer sequence number out of order")
+
+// ErrInvalidDeduplicationWindow is returned when opening a topic with a negative deduplication window
+var ErrInvalidDeduplicationWindow = errors.New("Invalid deduplication window")
+
+// ErrInvalidProducerExpiry is returned when opening a topic with a negative producer expiry
+var ErrInvalidProducerExpiry = errors.New("Invalid producer expiry")
+
+const maxProducerIDLength = 255
+
+// defaultDeduplicationWindow is the default number of sequence numbers remembered per producer.
+const defaultDeduplicationWindow = 16
+
+// ProducerSequence is a sequence number accepted from a producer and the
+// address of the event written with it.
+type ProducerSequence struct {
+	Sequence uint64 `json:"sequence"`
+	Address  uint64 `json:"address"`
+	// Timestamp is the time the event was written in nanoseconds since
+	// epoch, zero when unknown.
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+// producers holds the most recent sequence numbers accepted from every
+// producer, oldest first.
+type producers map[string][]ProducerSequence
+
+// lookup returns the address of the event written with the sequence number.
+// found is false when the sequence number is newer than all accepted ones.
+func (p producers) lookup(producerID string, sequence uint64) (uint64, bool, error) {
+	accepted := p[producerID]
+	if len(accepted) == 0 || sequence > accepted[len(accepted)-1].Sequence {
+		return 0, false, nil
+	}
+
+	i := sort.Search(len(accepted), func(i int) bool {
+		return accepted[i].Sequence >= sequence
+	})
+	if accepted[i].Sequence != sequence {
+		return 0, false, ErrOutOfOrderSequence
+	}
+
+	return accepted[i].Address, true, nil
+}
+
+// accept remembers the sequence number, keeping at most window sequence numbers per producer.
+func (p producers) accept(producerID string, sequence, address uint64, timestamp int64, window int) {
+	accepted := append(p[producerID], ProducerSequence{Sequence: sequence, Address: address, Timestamp: timestamp})
+	if len(accepted) > window {
+		accepted = append([]ProducerSequence(nil), accepted[len(accepted)-window:]...)
+	}
+	p[producerID] = accepted
+}
+
+// expireProducer forgets the producer when its last event was written
+// before the time in nanoseconds since epoch. Producers of events without
+// timestamps don't expire.
+func (p producers) expireProducer(producerID string, before int64) {
+	accepted := p[producerID]
+	if len(accepted) == 0 {
+		return
+	}
+	last := accepted[len(accepted)-1].Timestamp
+	if last != 0 && last < before {
+		delete(p, producerID)
+	}
+}
+
+// expire forgets all producers whose last event was written before the time.
+func (p producers) expire(before int64) {
+	for producerID := range p {
+		p.expireProducer(producerID, before)
+	}
+}
+
+func (p producers) clone() producers {
+	c := producers{}
+	for producerID, accepted := range p {
+		c[producerID] = append([]ProducerSequence(nil), accepted...)
+	}
+	return c
+}
+
+// WriteProducerEvent writes the event tagged with the producer ID and the
+// sequence number. Sequence numbers of a producer must increase. A retried
+// write of a sequence number that is still in the deduplication window does
+// not write the event again but returns the address of the original event.
+// Older sequence numbers are rejected with ErrOutOfOrderSequence.
+func (t *Topic) WriteProducerEvent(producerID string, sequence uint64, data []byte) (uint64, error) {
+	if producerID == "" || len(producerID) > maxProducerIDLength {
+		return 0, ErrInvalidProducerID
+	}
+
+	addresses, err := t.writeEvents(writeOptions{producerID: producerID, sequence: sequence}, [][]byte{data})
+	if err != nil {
+		return 0, err
+	}
+	return addresses[0], nil
+}
+
+// acceptProducer remembers the sequence number of the record starting an event.
+func (t *Topic) acceptProducer(h recordHeader, address uint64) {
+	acceptProducer(t.producers, h, address, t.dedupWindow, t.producerExpiry)
+}
+
+// acceptProducer remembers the sequence number of the record in p. A
+// producer that was idle for longer than the expiry before the record was
+// written is forgotten first, so that the record starts its sequence anew.
+func acceptProducer(p producers, h recordHeader, address uint64, window int, expiry time.Duration) {
+	if h.producerID == "" || h.kind != recordEvent && h.kind != recordChunkStart {
+		return
+	}
+	if expiry > 0 && h.timestamp != 0 {
+		p.expireProducer(h.producerID, h.timestamp-int64(expiry))
+	}
+	p.accept(h.producerID, h.sequence, address, h.timestamp, window)
+}
+
+// expireProducers forgets the producers in p that were idle for longer than
+// the producer expiry at the time in nanoseconds since epoch.
+func (t *Topic) expireProducers(p producers, now int64) {
+	if t.producerExpiry > 0 && now != 0 {
+		p.expire(now - int64(t.producerExpiry))
+	}
+}
+
+// Producer returns the producer ID and the sequence number the event at the
+// address was written with. The producer ID is empty for events written
+// without a producer.
+func (t *Topic) Producer(address uint64) (string, uint64, error) {
+	record, _, lease, err := t.readRecord(address)
+	if err != nil {
+		return "", 0, err
+	}
+	defer lease.Release()
+
+	h, err := decodeHeader(record)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if h.kind != recordEvent && h.kind != recordChunkStart {
+		return "", 0, segment.ErrWrongAddress
+	}
+
+	return h.producerID, h.sequence, nil
+}
@@ -0,0 +1,343 @@
+package topic
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/draganm/zathras/segment"
+)
+
+// Every record stored in a segment starts with a one byte header. The lower
+// two bits hold the record kind, the third bit is set when the header is
+// followed by the producer of the event ([u8 length][producer ID][u64
+// sequence]), the fourth bit is set when it is followed by a timestamp (u64
+// nanoseconds since epoch), the next three bits hold the codec ID of
+// compressed data (zero for uncompressed data) and the highest bit is set
+// when it is followed by the u32 ID of the schema the event was validated
+// with. The timestamp comes before the producer, the schema ID after it.
+// An event larger than the segment size is stored as a chunk start record
+// holding the stored event size followed by chunk records. Marker records
+// delimit transactions.
+const (
+	recordEvent byte = iota
+	recordChunkStart
+	recordChunk
+	recordMarker
+)
+
+const (
+	recordKindMask  = 0x03
+	recordProducer  = 0x04
+	recordTimestamp = 0x08
+	codecShift      = 4
+	maxCodecID      = 0x07
+	recordSchema    = 0x80
+)
+
+// maxRecordOverhead is the maximal number of bytes a record needs on top of the event data.
+const maxRecordOverhead = 512
+
+// maxChunkedPrealloc limits the memory reserved up front when assembling a chunked event.
+const maxChunkedPrealloc = 64 * 1024 * 1024
+
+// recordHeader is the decoded header of a record.
+type recordHeader struct {
+	kind    byte
+	codecID byte
+	// timestamp is zero for records written without a timestamp.
+	timestamp int64
+	// producerID is empty for records written without a producer.
+	producerID string
+	sequence   uint64
+	// schemaID is zero for events written without a schema.
+	schemaID uint32
+	// size is the stored event size of chunk start records.
+	size uint64
+	// length is the number of bytes of the header.
+	length int
+}
+
+func encodeHeader(h recordHeader) []byte {
+	header := make([]byte, 1, 30+len(h.producerID))
+	header[0] = h.kind | h.codecID<<codecShift
+	if h.timestamp != 0 {
+		header[0] |= recordTimestamp
+		header = header[:9]
+		binary.BigEndian.PutUint64(header[1:], uint64(h.timestamp))
+	}
+	if h.producerID != "" {
+		header[0] |= recordProducer
+		header = append(header, byte(len(h.producerID)))
+		header = append(header, h.producerID...)
+		header = header[:len(header)+8]
+		binary.BigEndian.PutUint64(header[len(header)-8:], h.sequence)
+	}
+	if h.schemaID != 0 {
+		header[0] |= recordSchema
+		header = header[:len(header)+4]
+		binary.BigEndian.PutUint32(header[len(header)-4:], h.schemaID)
+	}
+	if h.kind == recordChunkStart {
+		header = header[:len(header)+8]
+		binary.BigEndian.PutUint64(header[len(header)-8:], h.size)
+	}
+	return header
+}
+
+func decodeHeader(record []byte) (recordHeader, error) {
+	if len(record) == 0 {
+		return recordHeader{}, segment.ErrSegmentCorrupted
+	}
+
+	h := recordHeader{
+		kind:    record[0] & recordKindMask,
+		codecID: record[0] >> codecShift & maxCodecID,
+		length:  1,
+	}
+
+	if record[0]&recordTimestamp != 0 {
+		if len(record) < h.length+8 {
+			return recordHeader{}, segment.ErrSegmentCorrupted
+		}
+		h.timestamp = int64(binary.BigEndian.Uint64(record[h.length:]))
+		h.length += 8
+	}
+
+	if record[0]&recordProducer != 0 {
+		if len(record) < h.length+1 {
+			return recordHeader{}, segment.ErrSegmentCorrupted
+		}
+		idLength := int(record[h.length])
+		h.length++
+		if idLength == 0 || len(record) < h.length+idLength+8 {
+			return recordHeader{}, segment.ErrSegmentCorrupted
+		}
+		h.producerID = string(record[h.length : h.length+idLength])
+		h.sequence = binary.BigEndian.Uint64(record[h.length+idLength:])
+		h.length += idLength + 8
+	}
+
+	if record[0]&recordSchema != 0 {
+		if len(record) < h.length+4 {
+			return recordHeader{}, segment.ErrSegmentCorrupted
+		}
+		h.schemaID = binary.BigEndian.Uint32(record[h.length:])
+		h.length += 4
+	}
+
+	if h.kind == recordChunkStart {
+		if len(record) < h.length+8 {
+			return recordHeader{}, segment.ErrSegmentCorrupted
+		}
+		h.size = binary.BigEndian.Uint64(record[h.length:])
+		h.length += 8
+	}
+
+	return h, nil
+}
+
+// writeEvent appends records of the event data. The header holds the codec
+// and the producer of the event, events without a timestamp in the header
+// are timestamped with the clock. Must be called with the lock held.
+func (t *Topic) writeEvent(h recordHeader, data []byte) (uint64, uint64, error) {
+	h.kind = recordEvent
+	if h.timestamp == 0 {
+		h.timestamp = t.now().UnixNano()
+	}
+
+	if uint64(len(data)) <= t.segmentSize {
+		return t.append(encodeHeader(h), data)
+	}
+
+	h.kind = recordChunkStart
+	h.size = uint64(len(data))
+
+	address, nextAddress, err := t.append(encodeHeader(h), data[:t.segmentSize])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for rest := data[t.segmentSize:]; len(rest) > 0; {
+		size := uint64(len(rest))
+		if size > t.segmentSize {
+			size = t.segmentSize
+		}
+		_, nextAddress, err = t.append([]byte{recordChunk}, rest[:size])
+		if err != nil {
+			return 0, 0, err
+		}
+		rest = rest[size:]
+	}
+
+	return address, nextAddress, nil
+}
+
+// read returns the event at the address. Data of chunked and compressed events
+// is assembled into a new buffer and returned with a nil lease.
+func (t *Topic) read(address uint64) ([]byte, uint64, *segment.Lease, error) {
+	record, nextAddress, lease, err := t.readRecord(address)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	h, err := decodeHeader(record)
+	if err != nil {
+		lease.Release()
+		return nil, 0, nil, err
+	}
+
+	switch h.kind {
+	case recordEvent:
+		if h.codecID == 0 {
+			return record[h.length:], nextAddress, lease, nil
+		}
+		defer lease.Release()
+		data, err := decompress(h.codecID, record[h.length:])
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		return data, nextAddress, nil, nil
+	case recordChunkStart:
+		return t.readChunks(h, record, nextAddress, lease)
+	}
+
+	lease.Release()
+	return nil, 0, nil, segment.ErrWrongAddress
+}
+
+func (t *Topic) readChunks(h recordHeader, record []byte, nextAddress uint64, lease *segment.Lease) ([]byte, uint64, *segment.Lease, error) {
+	defer lease.Release()
+
+	prealloc := h.size
+	if prealloc > maxChunkedPrealloc {
+		prealloc = maxChunkedPrealloc
+	}
+
+	data := make([]byte, 0, prealloc)
+	data = append(data, record[h.length:]...)
+
+	for uint64(len(data)) < h.size {
+		chunk, chunkNextAddress, chunkLease, err := t.readRecord(nextAddress)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		if len(chunk) == 0 || chunk[0]&recordKindMask != recordChunk {
+			chunkLease.Release()
+			return nil, 0, nil, segment.ErrSegmentCorrupted
+		}
+		data = append(data, chunk[1:]...)
+		chunkLease.Release()
+		nextAddress = chunkNextAddress
+	}
+
+	if uint64(len(data)) != h.size {
+		return nil, 0, nil, segment.ErrSegmentCorrupted
+	}
+
+	if h.codecID != 0 {
+		data, err := decompress(h.codecID, data)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		return data, nextAddress, nil, nil
+	}
+
+	return data, nextAddress, nil, nil
+}
+
+// Timestamp returns the time the event at the address was written.
+// It is the zero time for events written without a timestamp.
+func (t *Topic) Timestamp(address uint64) (time.Time, error) {
+	record, _, lease, err := t.readRecord(address)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer lease.Release()
+
+	h, err := decodeHeader(record)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if h.kind != recordEvent && h.kind != recordChunkStart {
+		return time.Time{}, segment.ErrWrongAddress
+	}
+
+	if h.timestamp == 0 {
+		return time.Time{}, nil
+	}
+
+	return time.Unix(0, h.timestamp), nil
+}
+
+// AppendRecord appends a raw record as returned by ReadRecord, so that
+// a copy of a topic has the same records at the same addresses.
+// Events become visible once all of their records and the end marker of
+// their transaction are appended.
+// It returns the address of the record and the address after it.
+func (t *Topic) AppendRecord(record []byte) (uint64, uint64, error) {
+	h, err := decodeHeader(record)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	address, nextAddress, err := t.appendRecord(h, record)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	t.catchUpSidecars()
+
+	return address, nextAddress, nil
+}
+
+func (t *Topic) appendRecord(h recordHeader, record []byte) (uint64, uint64, error) {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	t.Lock()
+	defer t.Unlock()
+
+	switch h.kind {
+	case recordChunkStart:
+		t.pendingChunks = h.size - uint64(len(record)-h.length)
+	case recordChunk:
+		t.pendingChunks -= uint64(len(record) - h.length)
+	}
+
+	address, nextAddress, err := t.append(record)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	t.acceptProducer(h, address)
+
+	if h.kind == recordMarker {
+		err = t.applyMarker(h, record, address, nextAddress)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if t.pendingChunks == 0 && t.transaction == nil {
+		t.commit(nextAddress)
+	}
+
+	return address, nextAddress, nil
+}
+
+// AppendAddress returns the address the next appended record will get.
+// It is past NextAddress while records of an event are still being appended.
+func (t *Topic) AppendAddress() uint64 {
+	t.RLock()
+	defer t.RUnlock()
+	return t.currentSegment.nextAddress()
+}
+
+// Sync flushes the records of the current segment to disk. Sealed segments
+// are synced when they are sealed.
+func (t *Topic) Sync() error {
+	t.RLock()
+	defer t.RUnlock()
+	return t.currentSegment.Sync()
+}
@@ -0,0 +1,266 @@
+package topic
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/draganm/zathras/schema"
+	"github.com/draganm/zathras/segment"
+)
+
+// ErrUnknownSchema is returned when requesting a schema version the topic doesn't have
+var ErrUnknownSchema = errors.New("Unknown schema")
+
+// ErrSchemasDiverged is returned when replicating a schema history that doesn't continue the history of the topic
+var ErrSchemasDiverged = errors.New("Schema history diverged")
+
+// InvalidEventError is returned when writing an event that does not match
+// the current schema of the topic.
+type InvalidEventError struct {
+	SchemaID uint32
+	// Index is the index of the event among the written events.
+	Index int
+	// Err is the *schema.ValidationError of the event.
+	Err error
+}
+
+func (e *InvalidEventError) Error() string {
+	return fmt.Sprintf("Event %d does not match schema %d: %s", e.Index, e.SchemaID, e.Err)
+}
+
+const schemasFileName = "schemas"
+
+// SchemaVersion is a registered version of the schema of a topic.
+type SchemaVersion struct {
+	ID            uint32               `json:"id"`
+	Type          string               `json:"type"`
+	Definition    []byte               `json:"definition"`
+	Compatibility schema.Compatibility `json:"compatibility"`
+	schema        schema.Schema
+}
+
+// loadSchemas reads the schema history of the topic.
+func (t *Topic) loadSchemas() error {
+	data, err := ioutil.ReadFile(filepath.Join(t.dir, schemasFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	versions := []*SchemaVersion{}
+	err = json.Unmarshal(data, &versions)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range versions {
+		v.schema, err = schema.Parse(v.Type, v.Definition)
+		if err != nil {
+			return err
+		}
+	}
+
+	t.schemas = versions
+
+	return nil
+}
+
+// saveSchemas replaces the schema history file.
+func (t *Topic) saveSchemas(versions []*SchemaVersion) error {
+	data, err := json.Marshal(versions)
+	if err != nil {
+		return err
+	}
+
+	return writeFileSync(filepath.Join(t.dir, schemasFileName), data)
+}
+
+// currentSchema returns the latest schema version, nil when the topic has no schema.
+func (t *Topic) currentSchema() *SchemaVersion {
+	t.schemaLock.RLock()
+	defer t.schemaLock.RUnlock()
+	if len(t.schemas) == 0 {
+		return nil
+	}
+	return t.schemas[len(t.schemas)-1]
+}
+
+// RegisterSchema adds a new version of the schema of the topic and returns
+// its ID. The new version must have the compatibility with the current one,
+// otherwise a *schema.IncompatibleError is returned. Registering the current
+// version again returns its ID. From then on written events must match the
+// new version and carry its ID. RegisterSchema waits for a pending
+// transaction of the topic.
+func (t *Topic) RegisterSchema(schemaType string, definition []byte, c schema.Compatibility) (uint32, error) {
+	if t.readOnly {
+		return 0, ErrReadOnly
+	}
+
+	s, err := schema.Parse(schemaType, definition)
+	if err != nil {
+		return 0, err
+	}
+
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	t.schemaLock.Lock()
+	defer t.schemaLock.Unlock()
+
+	id := uint32(1)
+	if len(t.schemas) > 0 {
+		current := t.schemas[len(t.schemas)-1]
+		if current.Type == schemaType && string(current.Definition) == string(definition) {
+			return current.ID, nil
+		}
+		if current.Type != schemaType && c != schema.None {
+			return 0, &schema.IncompatibleError{Path: "$", Message: "schemas have different types"}
+		}
+		err = schema.Check(c, current.schema, s)
+		if err != nil {
+			return 0, err
+		}
+		id = current.ID + 1
+	}
+
+	version := &SchemaVersion{
+		ID:            id,
+		Type:          schemaType,
+		Definition:    append([]byte(nil), definition...),
+		Compatibility: c,
+		schema:        s,
+	}
+
+	versions := append(t.schemas[:len(t.schemas):len(t.schemas)], version)
+	err = t.saveSchemas(versions)
+	if err != nil {
+		return 0, err
+	}
+
+	t.schemas = versions
+
+	return id, nil
+}
+
+// Schemas returns all versions of the schema of the topic, oldest first.
+func (t *Topic) Schemas() []SchemaVersion {
+	t.schemaLock.RLock()
+	defer t.schemaLock.RUnlock()
+	versions := make([]SchemaVersion, len(t.schemas))
+	for i, v := range t.schemas {
+		versions[i] = *v
+	}
+	return versions
+}
+
+// CurrentSchemaID returns the ID of the latest schema version, zero when the
+// topic has no schema.
+func (t *Topic) CurrentSchemaID() uint32 {
+	current := t.currentSchema()
+	if current == nil {
+		return 0
+	}
+	return current.ID
+}
+
+// ReplicateSchemas adds the versions of the schema history of the leader the
+// topic doesn't have yet. The history of the topic must be a prefix of the
+// versions, otherwise ErrSchemasDiverged is returned.
+func (t *Topic) ReplicateSchemas(versions []SchemaVersion) error {
+	t.schemaLock.Lock()
+	defer t.schemaLock.Unlock()
+
+	if len(versions) < len(t.schemas) {
+		return ErrSchemasDiverged
+	}
+
+	for i, v := range t.schemas {
+		if v.ID != versions[i].ID || v.Type != versions[i].Type || string(v.Definition) != string(versions[i].Definition) {
+			return ErrSchemasDiverged
+		}
+	}
+
+	if len(versions) == len(t.schemas) {
+		return nil
+	}
+
+	replicated := t.schemas[:len(t.schemas):len(t.schemas)]
+	for _, v := range versions[len(t.schemas):] {
+		s, err := schema.Parse(v.Type, v.Definition)
+		if err != nil {
+			return err
+		}
+		version := v
+		version.Definition = append([]byte(nil), v.Definition...)
+		version.schema = s
+		replicated = append(replicated, &version)
+	}
+
+	err := t.saveSchemas(replicated)
+	if err != nil {
+		return err
+	}
+
+	t.schemas = replicated
+
+	return nil
+}
+
+// Schema returns the schema version with the ID.
+func (t *Topic) Schema(id uint32) (SchemaVersion, error) {
+	t.schemaLock.RLock()
+	defer t.schemaLock.RUnlock()
+	for _, v := range t.schemas {
+		if v.ID == id {
+			return *v, nil
+		}
+	}
+	return SchemaVersion{}, ErrUnknownSchema
+}
+
+// SchemaID returns the ID of the schema the event at the address was
+// validated with. It is zero for events written without a schema.
+func (t *Topic) SchemaID(address uint64) (uint32, error) {
+	record, _, lease, err := t.readRecord(address)
+	if err != nil {
+		return 0, err
+	}
+	defer lease.Release()
+
+	h, err := decodeHeader(record)
+	if err != nil {
+		return 0, err
+	}
+
+	if h.kind != recordEvent && h.kind != recordChunkStart {
+		return 0, segment.ErrWrongAddress
+	}
+
+	return h.schemaID, nil
+}
+
+// validateEvents checks the events against the current schema and sets its
+// ID in the headers. Must be called with the write lock held, so that no new
+// schema version is registered before the events are written.
+func (t *Topic) validateEvents(events [][]byte, headers []recordHeader) error {
+	current := t.currentSchema()
+	if current == nil {
+		return nil
+	}
+
+	for i, data := range events {
+		err := current.schema.Validate(data)
+		if err != nil {
+			return &InvalidEventError{SchemaID: current.ID, Index: i, Err: err}
+		}
+		headers[i].schemaID = current.ID
+	}
+
+	return nil
+}
@@ -1,16 +1,20 @@
 package topic
 
 import (
+	"container/list"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
 	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/draganm/zathras/limiter"
 	"github.com/draganm/zathras/segment"
@@ -29,8 +33,8 @@ func (r relativeSegment) containsAddress(a uint64) bool {
 	return a >= r.startAddress && a < r.nextAddress()
 }
 
-func (r relativeSegment) Append(d []byte) (uint64, uint64, error) {
-	a, na, err := r.Segment.Append(d)
+func (r relativeSegment) Append(parts ...[]byte) (uint64, uint64, error) {
+	a, na, err := r.Segment.Append(parts...)
 	if err != nil {
 		return a, na, err
 	}
@@ -45,99 +49,177 @@ func (r relativeSegment) Read(address uint64) ([]byte, uint64, error) {
 	return d, na + r.startAddress, nil
 }
 
-type segmentList []relativeSegment
-
-func (s segmentList) Len() int           { return len(s) }
-func (s segmentList) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
-func (s segmentList) Less(i, j int) bool { return s[i].startAddress < s[j].startAddress }
-
 // Topic represents a Zathras topic
 type Topic struct {
 	sync.RWMutex
-	dir            string
-	segmentSize    uint64
-	oldSegments    segmentList
-	currentSegment relativeSegment
-	subscribers    map[uintptr](chan uint64)
-	nextAddress    uint64
-	limiter        *limiter.Limiter
+	dir             string
+	segmentSize     uint64
+	oldSegments     []*oldSegment
+	currentSegment  relativeSegment
+	subscribers     map[uintptr](chan uint64)
+	nextAddress     uint64
+	limiter         *limiter.Limiter
+	maxOpenSegments int
+	copyOnRead      bool
+	maxEventSize    uint64
+	codec           Codec
+	keys            segment.KeyProvider
+	hashChain       bool
+	hashes          *hashChain
+	schemaLock      sync.RWMutex
+	schemas         []*SchemaVersion
+	indexOptions    map[string]indexOption
+	indexes         map[string]*index
+	now             func() time.Time
+	verifySegments  bool
+	readOnly        bool
+	startAddress    uint64
+	producers       producers
+	dedupWindow     int
+	producerExpiry  time.Duration
+	writeLock       sync.Mutex
+	transaction     *OpenTransaction
+	transactionHeld bool
+	transactional   bool
+	aborted         []AddressRange
+	readUncommitted bool
+	pendingChunks   uint64
+	segmentOptions  []segment.Option
+	lruLock         sync.Mutex
+	lru             *list.List
 }
 
-// ErrTooLargeEvent is returned when event size (plus size of header) is larger
-// than maximal size of a single segment.
-var ErrTooLargeEvent = errors.New("Event can't fit into a signle segment.")
+// ErrTooLargeEvent is returned when event size is larger than the maximal
+// event size of the topic.
+var ErrTooLargeEvent = errors.New("Event is larger than the maximal event size.")
 
-var segmentMatcher = regexp.MustCompile(`^(?P<startAddress>[0-9a-z]{16}).seg$`)
+// ErrReadOnly is returned when writing to a topic opened read only
+var ErrReadOnly = errors.New("Topic is read only")
 
-// New creates a new topic that uses specified directory and max segment size
-func New(dir string, segmentSize uint64) (*Topic, error) {
+// ErrConcurrencyConflict is returned by conditional writes when the topic has a different next address
+var ErrConcurrencyConflict = errors.New("Concurrency conflict")
 
-	files, err := ioutil.ReadDir(dir)
+var segmentMatcher = regexp.MustCompile(`^(?P<startAddress>[0-9a-z]{16}).seg(\.z)?$`)
 
+// New creates a new topic that uses specified directory and segment size.
+// The segment size is a soft limit: a new segment is started once the current
+// one reaches it, so a segment can be larger by up to one event.
+// Only the current segment is opened, older segments are opened when read.
+// Sealed segments are checked against the size in their footers.
+// Topics written with another record format are rejected with ErrUnsupportedFormat.
+func New(dir string, segmentSize uint64, options ...Option) (*Topic, error) {
+
+	segments, err := segmentFiles(dir)
 	if err != nil {
 		return nil, err
 	}
 
-	segments := segmentList{}
+	t := &Topic{
+		dir:         dir,
+		segmentSize: segmentSize,
+		subscribers: map[uintptr](chan uint64){},
+		lru:         list.New(),
+		now:         time.Now,
+		dedupWindow: defaultDeduplicationWindow,
+	}
 
-	for _, fi := range files {
-		if !fi.IsDir() {
-			name := fi.Name()
-			groups := segmentMatcher.FindStringSubmatch(name)
-			if groups != nil {
-				fileName := filepath.Join(dir, name)
-				var startAddress uint64
-				startAddress, err = strconv.ParseUint(groups[1], 16, 64)
-				if err != nil {
-					return nil, err
-				}
-				var s *segment.Segment
-				s, err = segment.New(fileName, segmentSize)
-				if err != nil {
-					return nil, err
-				}
+	for _, o := range options {
+		o(t)
+	}
 
-				segments = append(segments, relativeSegment{s, startAddress})
-			}
-		}
+	if t.dedupWindow < 0 {
+		return nil, ErrInvalidDeduplicationWindow
+	}
+
+	if t.producerExpiry < 0 {
+		return nil, ErrInvalidProducerExpiry
+	}
+
+	err = checkFormat(dir, len(segments) > 0, t.readOnly)
+	if err != nil {
+		return nil, err
 	}
 
 	if len(segments) == 0 {
-		startAddress := uint64(0)
+		segments = append(segments, &oldSegment{
+			fileName:     filepath.Join(dir, fmt.Sprintf("%016x.seg", t.startAddress)),
+			startAddress: t.startAddress,
+		})
+	}
 
-		fileName := filepath.Join(dir, fmt.Sprintf("%016x.seg", startAddress))
+	oldSegments := segments[:len(segments)-1]
+	t.oldSegments = oldSegments
 
-		var s *segment.Segment
+	last := segments[len(segments)-1]
 
-		s, err = segment.New(fileName, segmentSize)
+	var previous *SegmentInfo
+	for _, o := range oldSegments {
+		err = t.loadFooter(o, previous)
 		if err != nil {
 			return nil, err
 		}
+		previous = o.info
+		t.aborted = append(t.aborted, o.info.Aborted...)
+		if o.info.Markers > 0 {
+			t.transactional = true
+		}
+	}
 
-		segments = append(segments, relativeSegment{s, startAddress})
-
+	if t.verifySegments {
+		err = t.VerifySegments()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	sort.Sort(segments)
+	if !t.readOnly {
+		err = recoverCompressed(last.fileName)
+		if err == nil && isCompressed(last.fileName) {
+			last.fileName, err = decompressSegmentFile(last.fileName)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	oldSegments := segments[:len(segments)-1]
+	s, err := openSegmentFile(last.fileName, t.maxSegmentSize(), t.segmentOptionsAt(last.startAddress))
+	if err != nil {
+		return nil, err
+	}
 
-	currentSegment := segments[len(segments)-1]
+	t.currentSegment = relativeSegment{s, last.startAddress}
 
+	end, err := t.loadState()
+	if err == nil {
+		err = t.loadSchemas()
+	}
 	if err != nil {
+		s.Close()
 		return nil, err
 	}
 
-	nextAddress := currentSegment.startAddress + currentSegment.FileSize()
+	// events of a pending transaction stay invisible
+	t.nextAddress = end
+	if t.transaction != nil {
+		t.nextAddress = t.transaction.Address
+	}
+	t.limiter = limiter.New(t.nextAddress)
 
-	t := &Topic{
-		dir:            dir,
-		segmentSize:    segmentSize,
-		currentSegment: currentSegment,
-		oldSegments:    oldSegments,
-		nextAddress:    nextAddress,
-		subscribers:    map[uintptr](chan uint64){},
-		limiter:        limiter.New(nextAddress),
+	if t.hashChain {
+		t.hashes, err = openHashChain(dir, t.firstAddress())
+		if err == nil {
+			err = t.updateHashes()
+		}
+		if err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+
+	err = t.openIndexes()
+	if err != nil {
+		t.Close()
+		return nil, err
 	}
 
 	go t.broadcast()
@@ -145,6 +227,60 @@ func New(dir string, segmentSize uint64) (*Topic, error) {
 	return t, nil
 }
 
+// segmentFiles returns the segment files in the dir ordered by their start
+// address. The size of compressed segments is unknown until they are opened
+// or their footer is read. A segment that is also stored compressed is
+// returned uncompressed.
+func segmentFiles(dir string) ([]*oldSegment, error) {
+	files, err := ioutil.ReadDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []*oldSegment{}
+
+	for _, fi := range files {
+		if !fi.IsDir() {
+			name := fi.Name()
+			groups := segmentMatcher.FindStringSubmatch(name)
+			if groups != nil {
+				var startAddress uint64
+				startAddress, err = strconv.ParseUint(groups[1], 16, 64)
+				if err != nil {
+					return nil, err
+				}
+
+				o := &oldSegment{
+					fileName:     filepath.Join(dir, name),
+					startAddress: startAddress,
+				}
+				if !isCompressed(name) {
+					o.size = uint64(fi.Size())
+				}
+				segments = append(segments, o)
+			}
+		}
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		if segments[i].startAddress == segments[j].startAddress {
+			return !isCompressed(segments[i].fileName)
+		}
+		return segments[i].startAddress < segments[j].startAddress
+	})
+
+	unique := []*oldSegment{}
+	for i, o := range segments {
+		if i > 0 && o.startAddress == segments[i-1].startAddress {
+			continue
+		}
+		unique = append(unique, o)
+	}
+
+	return unique, nil
+}
+
 func (t *Topic) broadcast() {
 	current := uint64(0)
 	for {
@@ -167,35 +303,292 @@ func (t *Topic) broadcast() {
 	}
 }
 
-// WriteEvent writes an event to the topic and returns eventID or error
+// segmentOptionsAt returns the options of a segment starting at the address.
+func (t *Topic) segmentOptionsAt(startAddress uint64) []segment.Option {
+	options := append([]segment.Option{}, t.segmentOptions...)
+	return append(options, segment.WithStartAddress(startAddress))
+}
+
+// maxSegmentSize is the hard limit of a segment file size. It leaves room
+// for the largest record after the segment size has almost been reached.
+func (t *Topic) maxSegmentSize() uint64 {
+	return 2*t.segmentSize + maxRecordOverhead
+}
+
+func (t *Topic) startNewSegment() error {
+	nextAddress := t.currentSegment.nextAddress()
+	fileName := filepath.Join(t.dir, fmt.Sprintf("%016x.seg", nextAddress))
+	info, err := t.seal(t.currentSegment.Segment, t.currentSegment.startAddress, t.lastInfo())
+	if err != nil {
+		return err
+	}
+	ns, err := segment.New(fileName, t.maxSegmentSize(), t.segmentOptionsAt(nextAddress)...)
+	if err != nil {
+		return err
+	}
+	t.retireCurrentSegment(info)
+	t.currentSegment = relativeSegment{ns, nextAddress}
+	// the producers of the footer were expired the same way
+	t.expireProducers(t.producers, info.MaxTimestamp)
+	return nil
+}
+
+// truncate removes all records from the address on, so that the address
+// becomes the append address again. Segments starting after the address are
+// removed and the sealed segment holding it becomes the current segment
+// again. Must be called with the lock held.
+func (t *Topic) truncate(address uint64) error {
+	for t.currentSegment.startAddress > address && len(t.oldSegments) > 0 {
+		fileName := t.currentSegment.Name()
+		err := t.currentSegment.Close()
+		if err != nil {
+			return err
+		}
+		err = os.Remove(fileName)
+		if err != nil {
+			return err
+		}
+
+		o := t.oldSegments[len(t.oldSegments)-1]
+		t.oldSegments = t.oldSegments[:len(t.oldSegments)-1]
+
+		t.lruLock.Lock()
+		s := o.segment
+		if s != nil {
+			t.lru.Remove(o.element)
+			o.segment = nil
+			o.element = nil
+		}
+		t.lruLock.Unlock()
+
+		if isCompressed(o.fileName) {
+			// the segment is written to again
+			if s != nil {
+				err = s.Close()
+				if err != nil {
+					return err
+				}
+				s = nil
+			}
+			fileName, err := decompressSegmentFile(o.fileName)
+			if err != nil {
+				return err
+			}
+			t.lruLock.Lock()
+			o.fileName = fileName
+			t.lruLock.Unlock()
+		}
+
+		if s == nil {
+			s, err = segment.New(o.fileName, t.maxSegmentSize(), t.segmentOptionsAt(o.startAddress)...)
+			if err != nil {
+				return err
+			}
+		}
+
+		t.currentSegment = relativeSegment{s, o.startAddress}
+
+		// the segment is sealed again when it is full
+		err = os.Remove(footerFileName(o.fileName))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if address < t.currentSegment.startAddress {
+		return segment.ErrWrongAddress
+	}
+
+	return t.currentSegment.Truncate(address - t.currentSegment.startAddress)
+}
+
+// rollback truncates records of a failed write starting at the address. Must
+// be called with the lock held.
+func (t *Topic) rollback(address uint64) {
+	err := t.truncate(address)
+	if err != nil {
+		log.Println("Could not roll back failed write of", t.dir, err)
+	}
+}
+
+// append appends a record made of the parts to the current segment,
+// starting a new segment when needed. Must be called with the lock held.
+func (t *Topic) append(parts ...[]byte) (uint64, uint64, error) {
+	if t.readOnly {
+		return 0, 0, ErrReadOnly
+	}
+
+	if t.currentSegment.FileSize() >= t.segmentSize {
+		err := t.startNewSegment()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	address, nextAddress, err := t.currentSegment.Append(parts...)
+
+	// if too large then create a new segment
+	if err == segment.ErrDataTooLarge {
+		err = t.startNewSegment()
+		if err != nil {
+			return 0, 0, err
+		}
+		address, nextAddress, err = t.currentSegment.Append(parts...)
+	}
+
+	return address, nextAddress, err
+}
+
+// commit makes events up to the nextAddress visible to readers and subscribers.
+func (t *Topic) commit(nextAddress uint64) {
+	t.nextAddress = nextAddress
+	t.limiter.UpdateCurrent(nextAddress)
+}
+
+// WriteEvent writes an event to the topic and returns eventID or error.
+// Events larger than the segment size are split into several records.
+// Data is compressed when the topic has a codec.
 func (t *Topic) WriteEvent(data []byte) (uint64, error) {
-	if uint64(len(data)) > t.segmentSize {
-		return 0, ErrTooLargeEvent
+	addresses, err := t.writeEvents(writeOptions{}, [][]byte{data})
+	if err != nil {
+		return 0, err
+	}
+	return addresses[0], nil
+}
+
+// WriteEvents writes the events and returns their addresses. The events
+// become visible to readers at the same time.
+func (t *Topic) WriteEvents(events [][]byte) ([]uint64, error) {
+	return t.writeEvents(writeOptions{}, events)
+}
+
+// WriteEventIfNextAddress writes the event only if the next address of the
+// topic is the expected one, i.e. no other event was written since the
+// caller read the topic. It returns ErrConcurrencyConflict otherwise.
+func (t *Topic) WriteEventIfNextAddress(expected uint64, data []byte) (uint64, error) {
+	addresses, err := t.writeEvents(writeOptions{conditional: true, expected: expected}, [][]byte{data})
+	if err != nil {
+		return 0, err
 	}
+	return addresses[0], nil
+}
+
+// WriteEventsIfNextAddress writes all events only if the next address of the
+// topic is the expected one. See WriteEventIfNextAddress.
+func (t *Topic) WriteEventsIfNextAddress(expected uint64, events [][]byte) ([]uint64, error) {
+	return t.writeEvents(writeOptions{conditional: true, expected: expected}, events)
+}
+
+// writeOptions are the conditions and the producer of a write.
+type writeOptions struct {
+	conditional bool
+	expected    uint64
+	producerID  string
+	sequence    uint64
+}
+
+func (t *Topic) writeEvents(w writeOptions, events [][]byte) ([]uint64, error) {
+	headers, payloads, err := t.encodeEvents(events)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses, err := t.appendEvents(w, events, headers, payloads)
+	if err != nil {
+		return nil, err
+	}
+
+	t.catchUpSidecars()
+
+	return addresses, nil
+}
+
+// encodeEvents checks the size of the events and compresses them. It returns
+// the record headers and the payloads. The events are validated against the
+// schema when they are appended.
+func (t *Topic) encodeEvents(events [][]byte) ([]recordHeader, [][]byte, error) {
+	for _, data := range events {
+		if t.maxEventSize > 0 && uint64(len(data)) > t.maxEventSize {
+			return nil, nil, ErrTooLargeEvent
+		}
+	}
+
+	payloads := make([][]byte, len(events))
+	headers := make([]recordHeader, len(events))
+	for i, data := range events {
+		var err error
+		payloads[i], headers[i].codecID, err = t.compress(data)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return headers, payloads, nil
+}
+
+func (t *Topic) appendEvents(w writeOptions, events [][]byte, headers []recordHeader, payloads [][]byte) ([]uint64, error) {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+
+	err := t.validateEvents(events, headers)
+	if err != nil {
+		return nil, err
+	}
+
 	t.Lock()
 	defer t.Unlock()
-	address, nextAddress, err := t.currentSegment.Append(data)
 
-	// if too large then create a new segment
-	if err == segment.ErrDataTooLarge {
-		nextAddress = t.currentSegment.nextAddress()
-		fileName := filepath.Join(t.dir, fmt.Sprintf("%016x.seg", nextAddress))
-		var ns *segment.Segment
-		ns, err = segment.New(fileName, t.segmentSize)
+	if t.transaction != nil {
+		return nil, ErrTransactionPending
+	}
+
+	if w.conditional && t.nextAddress != w.expected {
+		return nil, ErrConcurrencyConflict
+	}
+
+	// producers are accepted with the timestamp of their events
+	now := t.now().UnixNano()
+
+	if w.producerID != "" {
+		if t.producerExpiry > 0 {
+			t.producers.expireProducer(w.producerID, now-int64(t.producerExpiry))
+		}
+		address, found, err := t.producers.lookup(w.producerID, w.sequence)
 		if err != nil {
-			return 0, err
+			return nil, err
+		}
+		if found {
+			return []uint64{address}, nil
 		}
-		t.oldSegments = append(t.oldSegments, t.currentSegment)
-		t.currentSegment = relativeSegment{ns, nextAddress}
-		address, nextAddress, err = t.currentSegment.Append(data)
+	}
+
+	// the batch is rolled back when any of its events can't be written
+	start := t.currentSegment.nextAddress()
+
+	addresses := make([]uint64, len(payloads))
+	nextAddress := t.nextAddress
+	for i, payload := range payloads {
+		h := headers[i]
+		h.producerID = w.producerID
+		h.sequence = w.sequence
+		h.timestamp = now
+		addresses[i], nextAddress, err = t.writeEvent(h, payload)
 		if err != nil {
-			return 0, err
+			t.rollback(start)
+			return nil, err
 		}
 	}
 
-	t.limiter.UpdateCurrent(nextAddress)
+	for i := range payloads {
+		h := headers[i]
+		h.producerID = w.producerID
+		h.sequence = w.sequence
+		h.timestamp = now
+		t.acceptProducer(h, addresses[i])
+	}
 
-	return address, nil
+	t.commit(nextAddress)
+
+	return addresses, nil
 }
 
 func (t *Topic) firstAddress() uint64 {
@@ -205,23 +598,38 @@ func (t *Topic) firstAddress() uint64 {
 	return t.oldSegments[0].startAddress
 }
 
+// lastAddress returns the address after the last complete event.
 func (t *Topic) lastAddress() uint64 {
-	return t.currentSegment.nextAddress()
+	return t.nextAddress
 }
 
-func (t *Topic) ReadEvents(fn func(uint64, []byte) error) error {
+// NextAddress returns the address the next written event will get.
+func (t *Topic) NextAddress() uint64 {
 	t.RLock()
 	defer t.RUnlock()
+	return t.lastAddress()
+}
+
+// ReadEvents calls fn with data of every event in the topic. The data must
+// not be used after fn returns.
+func (t *Topic) ReadEvents(fn func(uint64, []byte) error) error {
+	t.RLock()
 	lastAddress := t.lastAddress()
-	currentAddres := t.firstAddress()
-	var data []byte
-	var err error
-	for currentAddres < lastAddress {
-		data, currentAddres, err = t.Read(currentAddres)
+	currentAddress := t.firstAddress()
+	t.RUnlock()
+	for currentAddress < lastAddress {
+		var err error
+		currentAddress, err = t.eventAddress(currentAddress, !t.readUncommitted)
 		if err != nil {
 			return err
 		}
-		err = fn(currentAddres, data)
+		if currentAddress >= lastAddress {
+			break
+		}
+		err = t.view(currentAddress, func(nextAddress uint64, data []byte) error {
+			currentAddress = nextAddress
+			return fn(nextAddress, data)
+		})
 		if err != nil {
 			return err
 		}
@@ -234,28 +642,107 @@ func (t *Topic) ReadEvents(fn func(uint64, []byte) error) error {
 func (t *Topic) Close() error {
 	t.Lock()
 	defer t.Unlock()
-	for _, s := range t.oldSegments {
-		err := s.Close()
+	err := t.closeOldSegments()
+	if err != nil {
+		return err
+	}
+	t.limiter.Close()
+	if t.hashes != nil {
+		err = t.hashes.close()
+		if err != nil {
+			return err
+		}
+	}
+	for _, x := range t.indexes {
+		err = x.close()
 		if err != nil {
 			return err
 		}
 	}
-	t.limiter.Close()
 	return t.currentSegment.Close()
 }
 
-func (t *Topic) Read(address uint64) ([]byte, uint64, error) {
+func (t *Topic) readRecord(address uint64) ([]byte, uint64, *segment.Lease, error) {
 	t.RLock()
 	defer t.RUnlock()
 	if t.currentSegment.containsAddress(address) {
-		return t.currentSegment.Read(address)
-	}
-	for _, s := range t.oldSegments {
-		if s.containsAddress(address) {
-			return s.Read(address)
+		lease, err := t.currentSegment.Acquire()
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		data, nextAddress, err := t.currentSegment.Read(address)
+		if err != nil {
+			lease.Release()
+			return nil, 0, nil, err
 		}
+		return data, nextAddress, lease, nil
+	}
+	i := sort.Search(len(t.oldSegments), func(i int) bool {
+		return t.oldSegments[i].nextAddress() > address
+	})
+	if i < len(t.oldSegments) && t.oldSegments[i].containsAddress(address) {
+		return t.readOldSegment(t.oldSegments[i], address)
+	}
+	return nil, 0, nil, segment.ErrWrongAddress
+}
+
+// ReadRecord returns the raw record at the address, as stored in the segment.
+// Large events are stored as several records. The record stays valid until
+// the lease is released.
+func (t *Topic) ReadRecord(address uint64) ([]byte, uint64, *segment.Lease, error) {
+	return t.readRecord(address)
+}
+
+// Read returns data of the event at the address and the address of the next event.
+// Data is copied when the topic copies on read or limits the number of open
+// segments. Otherwise it points into the mapped segment and must not be used
+// after the topic is closed. ReadLease and View read without copying safely.
+func (t *Topic) Read(address uint64) ([]byte, uint64, error) {
+	data, nextAddress, lease, err := t.readFrom(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer lease.Release()
+	if t.copyOnRead || t.maxOpenSegments > 0 {
+		data = append([]byte(nil), data...)
 	}
-	return nil, 0, segment.ErrWrongAddress
+	return data, nextAddress, nil
+}
+
+// ReadLease returns data of the event at the address without copying it.
+// The data stays valid until the lease is released, even when the topic or
+// the segment holding the event is closed in the meantime.
+func (t *Topic) ReadLease(address uint64) ([]byte, uint64, *segment.Lease, error) {
+	return t.readFrom(address)
+}
+
+// readFrom reads the first event at or after the address, skipping
+// transaction markers and events of aborted transactions.
+func (t *Topic) readFrom(address uint64) ([]byte, uint64, *segment.Lease, error) {
+	address, err := t.eventAddress(address, !t.readUncommitted)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return t.read(address)
+}
+
+// View calls fn with data of the event at the address without copying it.
+// The data must not be used after fn returns.
+func (t *Topic) View(address uint64, fn func(nextAddress uint64, data []byte) error) error {
+	address, err := t.eventAddress(address, !t.readUncommitted)
+	if err != nil {
+		return err
+	}
+	return t.view(address, fn)
+}
+
+func (t *Topic) view(address uint64, fn func(nextAddress uint64, data []byte) error) error {
+	data, nextAddress, lease, err := t.read(address)
+	if err != nil {
+		return err
+	}
+	defer lease.Release()
+	return fn(nextAddress, data)
 }
 
 // Subscribe returns two channels: First one is used to read events.
@@ -284,17 +771,18 @@ func (t *Topic) Subscribe(from uint64, s Subscriber) {
 		currentAddress := from
 		for lastAddress := range ac {
 			for currentAddress < lastAddress {
-				data, nextAddress, err := t.Read(currentAddress)
-				if err != nil {
-					log.Println("Subscriber reading error", err)
-					return
+				var err error
+				currentAddress, err = t.eventAddress(currentAddress, !t.readUncommitted)
+				if err == nil && currentAddress < lastAddress {
+					err = t.view(currentAddress, func(nextAddress uint64, data []byte) error {
+						currentAddress = nextAddress
+						return s.OnEvent(nextAddress, data)
+					})
 				}
-				err = s.OnEvent(nextAddress, data)
 				if err != nil {
 					log.Println("Subscriber error", err)
 					return
 				}
-				currentAddress = nextAddress
 			}
 		}
 
@@ -303,6 +791,33 @@ func (t *Topic) Subscribe(from uint64, s Subscriber) {
 }
 
 func (t *Topic) SubscribeFunc(from uint64, f func(nextAddress uint64, data []byte) error) error {
+	return t.SubscribeContext(context.Background(), from, f)
+}
+
+// SubscribeContext calls f for every event starting at the from address,
+// waiting for new events until the context is done or the topic is closed.
+func (t *Topic) SubscribeContext(ctx context.Context, from uint64, f func(nextAddress uint64, data []byte) error) error {
+	return t.follow(ctx, from, true, t.view, f)
+}
+
+// SubscribeRecords is like SubscribeContext, but calls f with every raw record
+// as returned by ReadRecord.
+func (t *Topic) SubscribeRecords(ctx context.Context, from uint64, f func(nextAddress uint64, record []byte) error) error {
+	return t.follow(ctx, from, false, t.viewRecord, f)
+}
+
+func (t *Topic) viewRecord(address uint64, fn func(nextAddress uint64, record []byte) error) error {
+	record, nextAddress, lease, err := t.readRecord(address)
+	if err != nil {
+		return err
+	}
+	defer lease.Release()
+	return fn(nextAddress, record)
+}
+
+// follow calls f with everything view returns from the from address on.
+// When events is set, transaction markers and aborted events are skipped.
+func (t *Topic) follow(ctx context.Context, from uint64, events bool, view func(uint64, func(uint64, []byte) error) error, f func(nextAddress uint64, data []byte) error) error {
 	t.Lock()
 	limiter := t.limiter
 	t.Unlock()
@@ -310,23 +825,29 @@ func (t *Topic) SubscribeFunc(from uint64, f func(nextAddress uint64, data []byt
 	lastAddress := uint64(0)
 	for {
 		var err error
-		lastAddress, err = limiter.WaitForCurrentToBeGreaterThan(lastAddress)
+		lastAddress, err = limiter.WaitContext(ctx, lastAddress)
 		if err != nil {
 			return err
 		}
 
 		for from < lastAddress {
-			data, nextAddress, err := t.Read(from)
-			if err != nil {
-				log.Println("Subscriber reading error", err)
-				return err
+			if events {
+				from, err = t.eventAddress(from, !t.readUncommitted)
+				if err != nil {
+					return err
+				}
+				if from >= lastAddress {
+					break
+				}
 			}
-			err = f(nextAddress, data)
+			err = view(from, func(nextAddress uint64, data []byte) error {
+				from = nextAddress
+				return f(nextAddress, data)
+			})
 			if err != nil {
 				log.Println("Subscriber error", err)
 				return err
 			}
-			from = nextAddress
 		}
 
 	}
@@ -1,10 +1,24 @@
 package topic_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/draganm/zathras/merkle"
+	"github.com/draganm/zathras/schema"
+	"github.com/draganm/zathras/segment"
 	"github.com/draganm/zathras/topic"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -72,17 +86,43 @@ var _ = Describe("Topic", func() {
 			It("Should return that event's data", func() {
 				data, nextAddr, err := t.Read(a)
 				Expect(err).ToNot(HaveOccurred())
-				Expect(nextAddr).To(Equal(uint64(8)))
+				Expect(nextAddr).To(Equal(uint64(21)))
 				Expect(data).To(Equal([]byte("test")))
 			})
 		})
 
 	})
 
+	Describe("Segment size", func() {
+		Context("When an event does not fit into the rest of the current segment", func() {
+			BeforeEach(func() {
+				_, err := t.WriteEvent(make([]byte, 1000))
+				Expect(err).ToNot(HaveOccurred())
+				_, err = t.WriteEvent(make([]byte, 100))
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("Should still append it to the current segment", func() {
+				files, err := filepath.Glob(filepath.Join(topicDir, "*.seg"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(len(files)).To(Equal(1))
+			})
+
+			It("Should start a new segment with the next event", func() {
+				address, err := t.WriteEvent([]byte("test"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(address).To(Equal(uint64(1134)))
+				files, err := filepath.Glob(filepath.Join(topicDir, "*.seg"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(len(files)).To(Equal(2))
+			})
+		})
+	})
+
 	Describe("Multiple segments", func() {
 		Context("When first segment is full", func() {
 			BeforeEach(func() {
-				_, err := t.WriteEvent(make([]byte, 1024-4))
+				_, err := t.WriteEvent(make([]byte, 1024-17))
 				Expect(err).ToNot(HaveOccurred())
 			})
 
@@ -103,7 +143,7 @@ var _ = Describe("Topic", func() {
 				})
 
 				It("Should create a new segment file", func() {
-					files, err := ioutil.ReadDir(topicDir)
+					files, err := filepath.Glob(filepath.Join(topicDir, "*.seg"))
 					Expect(err).ToNot(HaveOccurred())
 					Expect(len(files)).To(Equal(2))
 				})
@@ -144,64 +184,1712 @@ var _ = Describe("Topic", func() {
 		})
 	})
 
-	Describe("Subscribe()", func() {
-		var s chan topic.Event
+	Describe("Large events", func() {
+		var large []byte
+		var address uint64
 		BeforeEach(func() {
-			s = make(chan topic.Event)
+			large = make([]byte, 3000)
+			for i := range large {
+				large[i] = byte(i)
+			}
+			var err error
+			_, err = t.WriteEvent([]byte("before"))
+			Expect(err).ToNot(HaveOccurred())
+			address, err = t.WriteEvent(large)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = t.WriteEvent([]byte("after"))
+			Expect(err).ToNot(HaveOccurred())
 		})
 
-		var subscriber topic.SubscriberFunc
-		BeforeEach(func() {
-			subscriber = topic.SubscriberFunc(func(nextAddress uint64, data []byte) error {
-				s <- topic.Event{NextAddress: nextAddress, Data: data}
+		It("Should read the whole event", func() {
+			data, _, err := t.Read(address)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).To(Equal(large))
+		})
+
+		It("Should return whole events from ReadEvents", func() {
+			events := [][]byte{}
+			Expect(t.ReadEvents(func(a uint64, d []byte) error {
+				events = append(events, append([]byte(nil), d...))
 				return nil
+			})).To(Succeed())
+			Expect(events).To(Equal([][]byte{[]byte("before"), large, []byte("after")}))
+		})
+
+		Context("When the topic is reopened", func() {
+			BeforeEach(func() {
+				Expect(t.Close()).To(Succeed())
+				var err error
+				t, err = topic.New(topicDir, 1024)
+				Expect(err).ToNot(HaveOccurred())
 			})
 
+			It("Should read the whole event", func() {
+				data, _, err := t.Read(address)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(data).To(Equal(large))
+			})
 		})
-		Context("When I unsubscribe", func() {
+		Context("When the last chunks of an event were not written", func() {
 			BeforeEach(func() {
-				t.Unsubscribe(subscriber)
+				Expect(t.Close()).To(Succeed())
+				fileNames, err := filepath.Glob(filepath.Join(topicDir, "*.seg"))
+				Expect(err).ToNot(HaveOccurred())
+				sort.Strings(fileNames)
+				Expect(len(fileNames)).To(BeNumerically(">", 2))
+				// keep the first two chunks of the large event only
+				for _, fileName := range fileNames[2:] {
+					Expect(os.Remove(fileName)).To(Succeed())
+					Expect(os.RemoveAll(strings.TrimSuffix(fileName, ".seg") + ".footer")).To(Succeed())
+				}
+				Expect(os.Remove(strings.TrimSuffix(fileNames[1], ".seg") + ".footer")).To(Succeed())
+				t, err = topic.New(topicDir, 1024)
+				Expect(err).ToNot(HaveOccurred())
 			})
 
-			It("Should not send any notifications to the subscriber", func(done Done) {
-				t.WriteEvent([]byte("test3"))
-				timeout := time.NewTimer(100 * time.Millisecond)
-				select {
-				case <-timeout.C:
-				case <-s:
-					Fail("Should not receive a message")
-				}
-				close(done)
+			It("Should drop the incomplete event", func() {
+				Expect(t.NextAddress()).To(Equal(address))
+				events := [][]byte{}
+				Expect(t.ReadEvents(func(a uint64, d []byte) error {
+					events = append(events, append([]byte(nil), d...))
+					return nil
+				})).To(Succeed())
+				Expect(events).To(Equal([][]byte{[]byte("before")}))
+			})
+
+			It("Should write new events after the last complete event", func() {
+				next, err := t.WriteEvent([]byte("next"))
+				Expect(err).ToNot(HaveOccurred())
+				data, _, err := t.Read(next)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(data).To(Equal([]byte("next")))
+				Expect(t.Close()).To(Succeed())
+				report, err := topic.Check(topicDir, 1024)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(report.OK()).To(BeTrue())
 			})
 		})
+	})
 
-		Context("When there is one event in the topic", func() {
+	Describe("WithCompression()", func() {
+		var verbose []byte
+		BeforeEach(func() {
+			verbose = bytes.Repeat([]byte(`{"name":"zathras","type":"event"}`), 100)
+			_, err := t.WriteEvent([]byte("uncompressed"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(t.Close()).To(Succeed())
+			t, err = topic.New(topicDir, 1024, topic.WithCompression(topic.Flate))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should store compressed events in less space", func() {
+			address, err := t.WriteEvent(verbose)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(t.NextAddress() - address).To(BeNumerically("<", len(verbose)/5))
+		})
+
+		It("Should return mixed compressed and uncompressed events", func() {
+			_, err := t.WriteEvent(verbose)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = t.WriteEvent(bytes.Repeat(verbose, 20))
+			Expect(err).ToNot(HaveOccurred())
+			events := [][]byte{}
+			Expect(t.ReadEvents(func(a uint64, d []byte) error {
+				events = append(events, append([]byte(nil), d...))
+				return nil
+			})).To(Succeed())
+			Expect(events).To(Equal([][]byte{[]byte("uncompressed"), verbose, bytes.Repeat(verbose, 20)}))
+		})
+
+		It("Should read events compressed with every built in codec", func() {
+			for _, name := range []string{"flate", "zstd", "snappy", "lz4"} {
+				codec, found := topic.CodecByName(name)
+				Expect(found).To(BeTrue(), name)
+				Expect(t.Close()).To(Succeed())
+				var err error
+				t, err = topic.New(topicDir, 1024, topic.WithCompression(codec))
+				Expect(err).ToNot(HaveOccurred())
+				address, err := t.WriteEvent(verbose)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(t.NextAddress()-address).To(BeNumerically("<", len(verbose)/5), name)
+				data, _, err := t.Read(address)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(data).To(Equal(verbose), name)
+			}
+		})
+	})
+
+	Describe("CompressSegments()", func() {
+		var before map[uint64]string
+
+		events := func(tp *topic.Topic) map[uint64]string {
+			all := map[uint64]string{}
+			c := tp.NewCursor()
+			for c.Next() {
+				all[c.Address()] = string(c.Event().Data)
+			}
+			Expect(c.Err()).ToNot(HaveOccurred())
+			return all
+		}
+
+		BeforeEach(func() {
+			for i := 0; i < 100; i++ {
+				_, err := t.WriteEvent([]byte(fmt.Sprintf(`{"name":"zathras","type":"event","sequence":%d}`, i)))
+				Expect(err).ToNot(HaveOccurred())
+			}
+			before = events(t)
+		})
+
+		Context("When the sealed segments are compressed", func() {
+			var count int
 			BeforeEach(func() {
-				t.WriteEvent([]byte("test"))
+				var err error
+				count, err = t.CompressSegments(topic.Zstd)
+				Expect(err).ToNot(HaveOccurred())
 			})
-			Context("When I subscribe to the topic", func() {
+
+			It("Should replace the sealed segments with compressed files", func() {
+				Expect(count).To(Equal(len(t.Segments())))
+				compressed, err := filepath.Glob(filepath.Join(topicDir, "*.seg.z"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(compressed).To(HaveLen(count))
+				files, err := filepath.Glob(filepath.Join(topicDir, "*.seg"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(files).To(HaveLen(1))
+			})
+
+			It("Should keep the addresses of the events", func() {
+				Expect(events(t)).To(Equal(before))
+				_, err := t.WriteEvent([]byte("after"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(t.Close()).To(Succeed())
+				t, err = topic.New(topicDir, 1024, topic.WithVerifySegments())
+				Expect(err).ToNot(HaveOccurred())
+				after := events(t)
+				Expect(after).To(HaveLen(len(before) + 1))
+				for address, data := range before {
+					Expect(after[address]).To(Equal(data))
+				}
+			})
+
+			It("Should not compress segments again", func() {
+				count, err := t.CompressSegments(topic.Zstd)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(count).To(BeZero())
+			})
+
+			It("Should pass the check", func() {
+				Expect(t.Close()).To(Succeed())
+				report, err := topic.Check(topicDir, 1024)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(report.OK()).To(BeTrue())
+				var e error
+				t, e = topic.New(topicDir, 1024)
+				Expect(e).ToNot(HaveOccurred())
+			})
+
+			It("Should export archives with uncompressed segments", func() {
+				importDir, err := ioutil.TempDir("", "")
+				Expect(err).ToNot(HaveOccurred())
+				defer os.RemoveAll(importDir)
+				archive := &bytes.Buffer{}
+				_, err = t.ExportArchive(archive, 0, math.MaxUint64)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = topic.ImportArchive(archive, importDir)
+				Expect(err).ToNot(HaveOccurred())
+				imported, err := topic.New(importDir, 1024, topic.WithVerifySegments())
+				Expect(err).ToNot(HaveOccurred())
+				defer imported.Close()
+				Expect(events(imported)).To(Equal(before))
+			})
+
+			Context("When the topic was closed before the uncompressed segment was removed", func() {
 				BeforeEach(func() {
-					t.Subscribe(0, subscriber)
+					Expect(t.Close()).To(Succeed())
+					files, err := filepath.Glob(filepath.Join(topicDir, "*.seg.z"))
+					Expect(err).ToNot(HaveOccurred())
+					original, err := ioutil.ReadFile(files[0])
+					Expect(err).ToNot(HaveOccurred())
+					data, err := topic.Zstd.Decompress(original[1:])
+					Expect(err).ToNot(HaveOccurred())
+					Expect(ioutil.WriteFile(strings.TrimSuffix(files[0], ".z"), data, 0700)).To(Succeed())
+					t, err = topic.New(topicDir, 1024)
+					Expect(err).ToNot(HaveOccurred())
 				})
-				It("The event channel should contain the first event", func(done Done) {
-					Expect(<-s).To(Equal(topic.Event{8, []byte("test")}))
-					close(done)
+
+				It("Should remove the compressed file", func() {
+					files, err := filepath.Glob(filepath.Join(topicDir, "*.seg.z"))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(files).To(HaveLen(count - 1))
+					Expect(events(t)).To(Equal(before))
 				})
-				Context("When another event is written to the topic", func() {
-					BeforeEach(func() {
-						addr, err := t.WriteEvent([]byte("test2"))
-						Expect(err).ToNot(HaveOccurred())
-						Expect(addr).To(Equal(uint64(8)))
-					})
-					It("The event channel should contain both events", func(done Done) {
-						Expect(<-s).To(Equal(topic.Event{8, []byte("test")}))
-						Expect(<-s).To(Equal(topic.Event{17, []byte("test2")}))
-						close(done)
-					})
+			})
+
+			Context("When the last sealed segment becomes the current segment again", func() {
+				BeforeEach(func() {
+					Expect(t.Close()).To(Succeed())
+					files, err := filepath.Glob(filepath.Join(topicDir, "*.seg"))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(os.Remove(files[0])).To(Succeed())
+					compressed, err := filepath.Glob(filepath.Join(topicDir, "*.seg.z"))
+					Expect(err).ToNot(HaveOccurred())
+					sort.Strings(compressed)
+					last := compressed[len(compressed)-1]
+					Expect(os.Remove(strings.TrimSuffix(last, ".seg.z") + ".footer")).To(Succeed())
+					t, err = topic.New(topicDir, 1024)
+					Expect(err).ToNot(HaveOccurred())
+				})
+
+				It("Should decompress it and append to it", func() {
+					files, err := filepath.Glob(filepath.Join(topicDir, "*.seg"))
+					Expect(err).ToNot(HaveOccurred())
+					Expect(files).To(HaveLen(1))
+					address, err := t.WriteEvent([]byte("after"))
+					Expect(err).ToNot(HaveOccurred())
+					data, _, err := t.Read(address)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(data).To(Equal([]byte("after")))
+				})
+			})
+		})
+
+		Context("When a compressed segment holds encrypted records", func() {
+			var keys *segment.Keyring
+			BeforeEach(func() {
+				keys = segment.NewKeyring()
+				_, err := keys.Rotate()
+				Expect(err).ToNot(HaveOccurred())
+				segments := t.Segments()
+				last := segments[len(segments)-1]
+				for t.NextAddress()-last.StartAddress-last.Size < 900 {
+					_, err = t.WriteEvent([]byte("x"))
+					Expect(err).ToNot(HaveOccurred())
+				}
+				Expect(t.Close()).To(Succeed())
+				// the encrypted events seal the segment of mostly unencrypted events
+				t, err = topic.New(topicDir, 1024, topic.WithEncryption(keys))
+				Expect(err).ToNot(HaveOccurred())
+				_, err = t.WriteEvent(bytes.Repeat([]byte("secret"), 30))
+				Expect(err).ToNot(HaveOccurred())
+				_, err = t.WriteEvent([]byte("secret"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(t.Segments()).To(HaveLen(len(segments) + 1))
+				before = events(t)
+			})
+
+			It("Should re-encrypt the compressed segment", func() {
+				Expect(t.CompressSegments(topic.Zstd)).To(BeNumerically(">", 0))
+				_, err := keys.Rotate()
+				Expect(err).ToNot(HaveOccurred())
+				count, err := t.Reencrypt()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(count).To(BeNumerically(">", 0))
+				Expect(t.Reencrypt()).To(BeZero())
+				Expect(events(t)).To(Equal(before))
+				Expect(t.VerifySegments()).To(Succeed())
+				compressed, err := filepath.Glob(filepath.Join(topicDir, "*.seg.z"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(compressed).To(HaveLen(len(t.Segments())))
+			})
+		})
+	})
+
+	Describe("WithEncryption()", func() {
+		var keys *segment.Keyring
+		BeforeEach(func() {
+			Expect(t.Close()).To(Succeed())
+			keys = segment.NewKeyring()
+			_, err := keys.Rotate()
+			Expect(err).ToNot(HaveOccurred())
+			t, err = topic.New(topicDir, 1024, topic.WithEncryption(keys))
+			Expect(err).ToNot(HaveOccurred())
+			for i := 0; i < 3; i++ {
+				_, err = t.WriteEvent(make([]byte, 1000))
+				Expect(err).ToNot(HaveOccurred())
+			}
+		})
+
+		It("Should re-encrypt old segments with the current key", func() {
+			_, err := keys.Rotate()
+			Expect(err).ToNot(HaveOccurred())
+			count, err := t.Reencrypt()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(count).To(Equal(2))
+			keys.Remove(1)
+			_, _, err = t.Read(0)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		Context("When the old segments are re-encrypted", func() {
+			var footer string
+			var oldFooter []byte
+			BeforeEach(func() {
+				footer = filepath.Join(topicDir, "0000000000000000.footer")
+				var err error
+				oldFooter, err = ioutil.ReadFile(footer)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = keys.Rotate()
+				Expect(err).ToNot(HaveOccurred())
+				_, err = t.Reencrypt()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(t.Close()).To(Succeed())
+			})
 
+			It("Should update the footers", func() {
+				report, err := topic.Check(topicDir, 1024, topic.WithEncryption(keys))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(report.OK()).To(BeTrue())
+				t, err = topic.New(topicDir, 1024, topic.WithEncryption(keys), topic.WithVerifySegments())
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			Context("When the footer was not renamed", func() {
+				BeforeEach(func() {
+					Expect(os.Rename(footer, footer+".tmp")).To(Succeed())
+					Expect(ioutil.WriteFile(footer, oldFooter, 0700)).To(Succeed())
+				})
+
+				It("Should rename the footer when the topic is opened", func() {
+					var err error
+					t, err = topic.New(topicDir, 1024, topic.WithEncryption(keys), topic.WithVerifySegments())
+					Expect(err).ToNot(HaveOccurred())
+					_, err = os.Stat(footer + ".tmp")
+					Expect(os.IsNotExist(err)).To(BeTrue())
 				})
 			})
 		})
+
+		It("Should return KeyNotFoundError when the key is missing", func() {
+			keys.Remove(1)
+			_, _, err := t.Read(0)
+			Expect(err).To(Equal(&segment.KeyNotFoundError{KeyID: 1}))
+		})
+
+		Context("When an event of a batch can't be written", func() {
+			var keyProvider *failingKeys
+			var next uint64
+			BeforeEach(func() {
+				Expect(t.Close()).To(Succeed())
+				keyProvider = &failingKeys{Keyring: keys, remaining: 2}
+				var err error
+				t, err = topic.New(topicDir, 1024, topic.WithEncryption(keyProvider))
+				Expect(err).ToNot(HaveOccurred())
+				next = t.NextAddress()
+				_, err = t.WriteEvents([][]byte{[]byte("first"), []byte("second"), []byte("third")})
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("Should not write any event of the batch", func() {
+				Expect(t.NextAddress()).To(Equal(next))
+				keyProvider.remaining = -1
+				address, err := t.WriteEvent([]byte("next"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(address).To(Equal(next))
+				Expect(t.Close()).To(Succeed())
+				t, err = topic.New(topicDir, 1024, topic.WithEncryption(keys))
+				Expect(err).ToNot(HaveOccurred())
+				events := [][]byte{}
+				Expect(t.ReadEvents(func(a uint64, d []byte) error {
+					events = append(events, append([]byte(nil), d...))
+					return nil
+				})).To(Succeed())
+				Expect(events).To(HaveLen(4))
+				Expect(events[3]).To(Equal([]byte("next")))
+			})
+		})
+
+		Context("When a chunk of a large event can't be written", func() {
+			var keyProvider *failingKeys
+			var next uint64
+			BeforeEach(func() {
+				Expect(t.Close()).To(Succeed())
+				keyProvider = &failingKeys{Keyring: keys, remaining: 1}
+				var err error
+				t, err = topic.New(topicDir, 1024, topic.WithEncryption(keyProvider))
+				Expect(err).ToNot(HaveOccurred())
+				next = t.NextAddress()
+				_, err = t.WriteEvent(make([]byte, 3000))
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("Should roll back the written chunks", func() {
+				Expect(t.NextAddress()).To(Equal(next))
+				keyProvider.remaining = -1
+				address, err := t.WriteEvent([]byte("next"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(address).To(Equal(next))
+				Expect(t.Close()).To(Succeed())
+				t, err = topic.New(topicDir, 1024, topic.WithEncryption(keys))
+				Expect(err).ToNot(HaveOccurred())
+				events := 0
+				Expect(t.ReadEvents(func(a uint64, d []byte) error {
+					events++
+					return nil
+				})).To(Succeed())
+				Expect(events).To(Equal(4))
+			})
+		})
 	})
 
-})
+	Describe("WithHashChain()", func() {
+		var addresses []uint64
+		BeforeEach(func() {
+			Expect(t.Close()).To(Succeed())
+			var err error
+			t, err = topic.New(topicDir, 1024, topic.WithHashChain())
+			Expect(err).ToNot(HaveOccurred())
+			addresses = nil
+			for i := 0; i < 5; i++ {
+				address, err := t.WriteEvent([]byte(fmt.Sprintf("event %d", i)))
+				Expect(err).ToNot(HaveOccurred())
+				addresses = append(addresses, address)
+			}
+		})
+
+		It("Should prove inclusion of an event", func() {
+			head, err := t.TreeHead()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(head.Size).To(Equal(uint64(5)))
+			index, leaf, proof, err := t.InclusionProof(addresses[2], head.Size)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(index).To(Equal(uint64(2)))
+			Expect(leaf).To(Equal(merkle.LeafHash([]byte("event 2"))))
+			Expect(merkle.VerifyInclusion(leaf, index, head.Size, proof, head.RootHash)).To(BeTrue())
+		})
+
+		It("Should prove consistency with an older tree head", func() {
+			_, private, err := ed25519.GenerateKey(nil)
+			Expect(err).ToNot(HaveOccurred())
+			old, err := t.SignedTreeHead(private)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = t.WriteEvent([]byte("event 5"))
+			Expect(err).ToNot(HaveOccurred())
+			head, err := t.TreeHead()
+			Expect(err).ToNot(HaveOccurred())
+			proof, err := t.ConsistencyProof(old.Size, head.Size)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(merkle.VerifyConsistency(old.Size, head.Size, old.RootHash, head.RootHash, proof)).To(BeTrue())
+		})
+
+		Context("When the topic is reopened", func() {
+			It("Should keep the tree", func() {
+				head, err := t.TreeHead()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(t.Close()).To(Succeed())
+				t, err = topic.New(topicDir, 1024, topic.WithHashChain())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(t.VerifyHashChain()).To(Succeed())
+				reopened, err := t.TreeHead()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(reopened.RootHash).To(Equal(head.RootHash))
+			})
+		})
+
+		Context("When an event is rewritten", func() {
+			It("Should detect the change", func() {
+				Expect(t.Close()).To(Succeed())
+				segmentFile := topicDir + "/0000000000000000.seg"
+				data, err := ioutil.ReadFile(segmentFile)
+				Expect(err).ToNot(HaveOccurred())
+				copy(data[addresses[3]+13:], "EVENT")
+				Expect(ioutil.WriteFile(segmentFile, data, 0700)).To(Succeed())
+				t, err = topic.New(topicDir, 1024, topic.WithHashChain())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(t.VerifyHashChain()).To(Equal(&topic.HashMismatchError{Address: addresses[3]}))
+			})
+		})
+	})
+
+	Describe("WithIndex()", func() {
+		var addresses []uint64
+		var options []topic.Option
+		BeforeEach(func() {
+			Expect(t.Close()).To(Succeed())
+			options = []topic.Option{
+				topic.WithIndex("order", "1", topic.JSONPath("$.order.id")),
+				topic.WithIndex("tags", "1", topic.JSONPath("tags")),
+			}
+			var err error
+			t, err = topic.New(topicDir, 1024, options...)
+			Expect(err).ToNot(HaveOccurred())
+			addresses = nil
+			for _, e := range []string{
+				`{"order":{"id":123},"tags":["a","b"]}`,
+				`{"order":{"id":456},"tags":["b"]}`,
+				`not json`,
+				`{"order":{"id":123},"tags":["a","a"]}`,
+			} {
+				address, err := t.WriteEvent([]byte(e))
+				Expect(err).ToNot(HaveOccurred())
+				addresses = append(addresses, address)
+			}
+		})
+
+		query := func(index, value string) []string {
+			events := []string{}
+			Expect(t.Query(index, value, func(address uint64, data []byte) error {
+				events = append(events, string(data))
+				return nil
+			})).To(Succeed())
+			return events
+		}
+
+		It("Should return the matching events in order", func() {
+			Expect(query("order", "123")).To(Equal([]string{
+				`{"order":{"id":123},"tags":["a","b"]}`,
+				`{"order":{"id":123},"tags":["a","a"]}`,
+			}))
+			Expect(t.IndexedAddresses("tags", "a")).To(Equal([]uint64{addresses[0], addresses[3]}))
+			Expect(t.IndexedAddresses("tags", "b")).To(Equal([]uint64{addresses[0], addresses[1]}))
+			Expect(t.IndexedAddresses("order", "789")).To(BeEmpty())
+		})
+
+		It("Should reject unknown indexes", func() {
+			_, err := t.IndexedAddresses("customer", "1")
+			Expect(err).To(Equal(topic.ErrUnknownIndex))
+		})
+
+		Context("When the topic is reopened", func() {
+			It("Should load the index", func() {
+				Expect(t.Close()).To(Succeed())
+				var err error
+				t, err = topic.New(topicDir, 1024, options...)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(t.IndexedAddresses("order", "123")).To(Equal([]uint64{addresses[0], addresses[3]}))
+			})
+		})
+
+		Context("When the index file is missing", func() {
+			It("Should rebuild the index", func() {
+				Expect(t.Close()).To(Succeed())
+				Expect(os.Remove(filepath.Join(topicDir, "index-order"))).To(Succeed())
+				var err error
+				t, err = topic.New(topicDir, 1024, options...)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(t.IndexedAddresses("order", "123")).To(Equal([]uint64{addresses[0], addresses[3]}))
+			})
+		})
+
+		Context("When the topic is reopened with another version of the index", func() {
+			It("Should rebuild the index", func() {
+				Expect(t.Close()).To(Succeed())
+				var err error
+				t, err = topic.New(topicDir, 1024, topic.WithIndex("order", "2", topic.JSONPath("tags")))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(t.IndexedAddresses("order", "a")).To(Equal([]uint64{addresses[0], addresses[3]}))
+				Expect(t.IndexedAddresses("order", "123")).To(BeEmpty())
+			})
+		})
+
+		Context("When many events are indexed", func() {
+			It("Should find the events of every value after reopening", func() {
+				expected := map[string][]uint64{}
+				for i := 0; i < 300; i++ {
+					value := fmt.Sprint(i % 7)
+					address, err := t.WriteEvent([]byte(fmt.Sprintf(`{"order":{"id":%s}}`, value)))
+					Expect(err).ToNot(HaveOccurred())
+					expected[value] = append(expected[value], address)
+				}
+				Expect(t.Close()).To(Succeed())
+				var err error
+				t, err = topic.New(topicDir, 1024, options...)
+				Expect(err).ToNot(HaveOccurred())
+				for value, addresses := range expected {
+					Expect(t.IndexedAddresses("order", value)).To(Equal(addresses))
+				}
+			})
+		})
+
+		Context("When a Go function extracts the values", func() {
+			It("Should index events written after the topic is reopened", func() {
+				Expect(t.Close()).To(Succeed())
+				var err error
+				t, err = topic.New(topicDir, 1024, topic.WithIndex("length", "1", func(data []byte) []string {
+					return []string{fmt.Sprint(len(data))}
+				}))
+				Expect(err).ToNot(HaveOccurred())
+				address, err := t.WriteEvent([]byte("12345678"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(t.IndexedAddresses("length", "8")).To(Equal([]uint64{addresses[2], address}))
+			})
+		})
+	})
+
+	Describe("RegisterSchema()", func() {
+		var id uint32
+		BeforeEach(func() {
+			var err error
+			id, err = t.RegisterSchema(schema.JSON, []byte(`{"type": "object", "properties": {"id": {"type": "integer"}}, "required": ["id"]}`), schema.Backward)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(id).To(Equal(uint32(1)))
+		})
+
+		It("Should write valid events with the schema ID", func() {
+			address, err := t.WriteEvent([]byte(`{"id": 1}`))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(t.SchemaID(address)).To(Equal(uint32(1)))
+			data, _, err := t.Read(address)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(Equal(`{"id": 1}`))
+		})
+
+		It("Should reject invalid events", func() {
+			_, err := t.WriteEvents([][]byte{[]byte(`{"id": 1}`), []byte(`{"id": "x"}`)})
+			Expect(err).To(Equal(&topic.InvalidEventError{
+				SchemaID: 1,
+				Index:    1,
+				Err:      &schema.ValidationError{Path: "$.id", Message: "string is not one of the types [integer]"},
+			}))
+			Expect(t.NextAddress()).To(Equal(uint64(0)))
+		})
+
+		It("Should reject incompatible versions", func() {
+			_, err := t.RegisterSchema(schema.JSON, []byte(`{"type": "object", "required": ["id", "name"]}`), schema.Backward)
+			Expect(err).To(Equal(&schema.IncompatibleError{Path: "$", Message: "property name is required"}))
+			Expect(t.Schemas()).To(HaveLen(1))
+		})
+
+		Context("When a compatible version is registered", func() {
+			BeforeEach(func() {
+				var err error
+				id, err = t.RegisterSchema(schema.JSON, []byte(`{"type": "object", "properties": {"id": {"type": "number"}}, "required": ["id"]}`), schema.Backward)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(id).To(Equal(uint32(2)))
+			})
+
+			It("Should validate with the new version", func() {
+				address, err := t.WriteEvent([]byte(`{"id": 1.5}`))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(t.SchemaID(address)).To(Equal(uint32(2)))
+			})
+
+			It("Should keep the history after reopening", func() {
+				Expect(t.Close()).To(Succeed())
+				var err error
+				t, err = topic.New(topicDir, 1024)
+				Expect(err).ToNot(HaveOccurred())
+				versions := t.Schemas()
+				Expect(versions).To(HaveLen(2))
+				Expect(versions[0].ID).To(Equal(uint32(1)))
+				Expect(versions[1].Compatibility).To(Equal(schema.Backward))
+				v, err := t.Schema(2)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(v.Type).To(Equal(schema.JSON))
+				_, err = t.WriteEvent([]byte(`{}`))
+				Expect(err).To(BeAssignableToTypeOf(&topic.InvalidEventError{}))
+			})
+		})
+
+		It("Should reject replicated histories that don't continue its history", func() {
+			err := t.ReplicateSchemas([]topic.SchemaVersion{{ID: 1, Type: schema.JSON, Definition: []byte(`{}`)}})
+			Expect(err).To(Equal(topic.ErrSchemasDiverged))
+		})
+
+		It("Should add replicated versions", func() {
+			versions := t.Schemas()
+			versions = append(versions, topic.SchemaVersion{ID: 2, Type: schema.JSON, Definition: []byte(`{"type": "object"}`)})
+			Expect(t.ReplicateSchemas(versions)).To(Succeed())
+			Expect(t.CurrentSchemaID()).To(Equal(uint32(2)))
+			address, err := t.WriteEvent([]byte(`{}`))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(t.SchemaID(address)).To(Equal(uint32(2)))
+		})
+
+		Context("When the event is compressed and larger than a segment", func() {
+			It("Should keep the schema ID", func() {
+				Expect(t.Close()).To(Succeed())
+				var err error
+				t, err = topic.New(topicDir, 1024, topic.WithCompression(topic.Flate))
+				Expect(err).ToNot(HaveOccurred())
+				note := make([]byte, 4096)
+				_, err = rand.Read(note)
+				Expect(err).ToNot(HaveOccurred())
+				data := []byte(`{"id": 1, "note": "` + hex.EncodeToString(note) + `"}`)
+				address, err := t.WriteEvent(data)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(t.SchemaID(address)).To(Equal(uint32(1)))
+				read, _, err := t.Read(address)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(read).To(Equal(data))
+			})
+		})
+	})
+
+	Describe("Sealed segments", func() {
+		var firstSegment string
+		BeforeEach(func() {
+			Expect(t.Close()).To(Succeed())
+			now := time.Unix(1000, 0)
+			clock := func() time.Time {
+				now = now.Add(time.Second)
+				return now
+			}
+			var err error
+			t, err = topic.New(topicDir, 1024, topic.WithClock(clock))
+			Expect(err).ToNot(HaveOccurred())
+			for i := 0; i < 3; i++ {
+				_, err = t.WriteEvent(make([]byte, 500))
+				Expect(err).ToNot(HaveOccurred())
+			}
+			firstSegment = filepath.Join(topicDir, "0000000000000000.seg")
+		})
+
+		It("Should summarize the sealed segment", func() {
+			infos := t.Segments()
+			Expect(infos).To(HaveLen(1))
+			Expect(infos[0].Events).To(Equal(uint64(2)))
+			Expect(infos[0].FirstAddress).To(Equal(uint64(0)))
+			Expect(infos[0].LastAddress).To(Equal(uint64(517)))
+			Expect(infos[0].Size).To(Equal(uint64(1034)))
+			Expect(infos[0].MinTimestamp).To(Equal(time.Unix(1001, 0).UnixNano()))
+			Expect(infos[0].MaxTimestamp).To(Equal(time.Unix(1002, 0).UnixNano()))
+		})
+
+		It("Should return timestamps of events", func() {
+			ts, err := t.Timestamp(517)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ts.Equal(time.Unix(1002, 0))).To(BeTrue())
+		})
+
+		Context("When the sealed segments before an address are deleted", func() {
+			It("Should keep the segments ending after the address", func() {
+				n, err := t.DeleteSegmentsBefore(1033)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(n).To(Equal(0))
+				Expect(t.Segments()).To(HaveLen(1))
+			})
+
+			It("Should remove the segments and their footers", func() {
+				n, err := t.DeleteSegmentsBefore(1034)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(n).To(Equal(1))
+				Expect(t.Segments()).To(BeEmpty())
+				_, err = os.Stat(firstSegment)
+				Expect(os.IsNotExist(err)).To(BeTrue())
+				_, err = os.Stat(filepath.Join(topicDir, "0000000000000000.footer"))
+				Expect(os.IsNotExist(err)).To(BeTrue())
+
+				Expect(t.Close()).To(Succeed())
+				t, err = topic.New(topicDir, 1024)
+				Expect(err).ToNot(HaveOccurred())
+				data, _, err := t.Read(1034)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(data).To(HaveLen(500))
+			})
+		})
+
+		Context("When a sealed segment has no footer", func() {
+			It("Should write the footer when opened", func() {
+				Expect(t.Close()).To(Succeed())
+				Expect(os.Remove(filepath.Join(topicDir, "0000000000000000.footer"))).To(Succeed())
+				var err error
+				t, err = topic.New(topicDir, 1024)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(t.Segments()[0].Events).To(Equal(uint64(2)))
+			})
+		})
+
+		Context("When a sealed segment is truncated", func() {
+			It("Should fail to open the topic", func() {
+				Expect(t.Close()).To(Succeed())
+				Expect(os.Truncate(firstSegment, 1000)).To(Succeed())
+				_, err := topic.New(topicDir, 1024)
+				Expect(err).To(Equal(topic.ErrSegmentTruncated))
+				Expect(os.Truncate(firstSegment, 1034)).To(Succeed())
+				t, err = topic.New(topicDir, 1024)
+				Expect(err).ToNot(HaveOccurred())
+			})
+		})
+
+		Context("When a sealed segment is changed", func() {
+			It("Should fail the verification", func() {
+				Expect(t.Close()).To(Succeed())
+				data, err := ioutil.ReadFile(firstSegment)
+				Expect(err).ToNot(HaveOccurred())
+				data[100] = 1
+				Expect(ioutil.WriteFile(firstSegment, data, 0700)).To(Succeed())
+				_, err = topic.New(topicDir, 1024, topic.WithVerifySegments())
+				Expect(err).To(Equal(topic.ErrSegmentChecksumMismatch))
+				t, err = topic.New(topicDir, 1024)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(t.VerifySegments()).To(Equal(topic.ErrSegmentChecksumMismatch))
+			})
+		})
+	})
+
+	Describe("Cursor", func() {
+		var addresses []uint64
+		BeforeEach(func() {
+			addresses = nil
+			for i := 0; i < 5; i++ {
+				address, err := t.WriteEvent(bytes.Repeat([]byte{byte('a' + i)}, 400))
+				Expect(err).ToNot(HaveOccurred())
+				addresses = append(addresses, address)
+			}
+			address, err := t.WriteEvent(make([]byte, 3000))
+			Expect(err).ToNot(HaveOccurred())
+			addresses = append(addresses, address)
+		})
+
+		readAll := func(c *topic.Cursor) []uint64 {
+			result := []uint64{}
+			for address := range c.All() {
+				result = append(result, address)
+			}
+			Expect(c.Err()).ToNot(HaveOccurred())
+			return result
+		}
+
+		It("Should iterate over all events", func() {
+			Expect(readAll(t.NewCursor())).To(Equal(addresses))
+		})
+
+		It("Should iterate over a range", func() {
+			Expect(readAll(t.NewRangeCursor(addresses[1], addresses[3]))).To(Equal(addresses[1:3]))
+		})
+
+		It("Should iterate in reverse across segments and chunked events", func() {
+			reversed := []uint64{}
+			for i := len(addresses) - 1; i >= 0; i-- {
+				reversed = append(reversed, addresses[i])
+			}
+			Expect(readAll(t.NewCursor().Reverse())).To(Equal(reversed))
+		})
+
+		It("Should seek to an address", func() {
+			c := t.NewCursor()
+			c.Seek(addresses[4])
+			Expect(c.Next()).To(BeTrue())
+			Expect(c.Address()).To(Equal(addresses[4]))
+			Expect(c.Event().Data).To(Equal(bytes.Repeat([]byte{'e'}, 400)))
+		})
+
+		It("Should wait for new events", func() {
+			c := t.NewCursor()
+			c.Seek(addresses[5])
+			Expect(c.Next()).To(BeTrue())
+			go func() {
+				defer GinkgoRecover()
+				time.Sleep(10 * time.Millisecond)
+				_, err := t.WriteEvent([]byte("live"))
+				Expect(err).ToNot(HaveOccurred())
+			}()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			Expect(c.NextWait(ctx)).To(BeTrue())
+			Expect(c.Event().Data).To(Equal([]byte("live")))
+			ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			Expect(c.NextWait(ctx)).To(BeFalse())
+			Expect(c.Err()).To(Equal(context.DeadlineExceeded))
+		})
+	})
+
+	Describe("Last()", func() {
+		BeforeEach(func() {
+			for i := 0; i < 10; i++ {
+				_, err := t.WriteEvent(bytes.Repeat([]byte{byte('a' + i)}, 300))
+				Expect(err).ToNot(HaveOccurred())
+			}
+		})
+
+		It("Should return the last events across segments, oldest first", func() {
+			events, err := t.Last(5)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(events).To(HaveLen(5))
+			for i, e := range events {
+				Expect(e.Data).To(Equal(bytes.Repeat([]byte{byte('f' + i)}, 300)))
+			}
+		})
+
+		It("Should return all events when there are fewer", func() {
+			events, err := t.Last(50)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(events).To(HaveLen(10))
+			Expect(events[9].NextAddress).To(Equal(t.NextAddress()))
+		})
+
+		It("Should not include events written while reading", func() {
+			count := 0
+			Expect(t.ReadBackward(t.NextAddress(), func(address, nextAddress uint64, data []byte) error {
+				if count == 0 {
+					_, err := t.WriteEvent([]byte("new"))
+					Expect(err).ToNot(HaveOccurred())
+				}
+				count++
+				return nil
+			})).To(Succeed())
+			Expect(count).To(Equal(10))
+		})
+	})
+
+	Describe("WithMaxEventSize()", func() {
+		It("Should reject larger events", func() {
+			Expect(t.Close()).To(Succeed())
+			var err error
+			t, err = topic.New(topicDir, 1024, topic.WithMaxEventSize(2000))
+			Expect(err).ToNot(HaveOccurred())
+			_, err = t.WriteEvent(make([]byte, 2001))
+			Expect(err).To(Equal(topic.ErrTooLargeEvent))
+		})
+	})
+
+	Describe("WriteEventsIfNextAddress()", func() {
+		BeforeEach(func() {
+			_, err := t.WriteEvent([]byte("test"))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		Context("When the expected next address is current", func() {
+			It("Should write all events", func() {
+				addresses, err := t.WriteEventsIfNextAddress(21, [][]byte{[]byte("a"), []byte("b")})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(addresses).To(Equal([]uint64{21, 39}))
+				Expect(t.NextAddress()).To(Equal(uint64(57)))
+			})
+		})
+
+		Context("When another event was written", func() {
+			It("Should return ErrConcurrencyConflict and write nothing", func() {
+				_, err := t.WriteEventsIfNextAddress(0, [][]byte{[]byte("a"), []byte("b")})
+				Expect(err).To(Equal(topic.ErrConcurrencyConflict))
+				_, err = t.WriteEventIfNextAddress(0, []byte("a"))
+				Expect(err).To(Equal(topic.ErrConcurrencyConflict))
+				Expect(t.NextAddress()).To(Equal(uint64(21)))
+			})
+		})
+	})
+
+	Describe("WriteProducerEvent()", func() {
+		BeforeEach(func() {
+			for i := uint64(1); i <= 40; i++ {
+				address, err := t.WriteProducerEvent("p1", i, []byte("test"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(address).To(Equal((i - 1) * 32))
+			}
+		})
+
+		It("Should return the original address of a retried write", func() {
+			address, err := t.WriteProducerEvent("p1", 40, []byte("test"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(address).To(Equal(uint64(39 * 32)))
+			Expect(t.NextAddress()).To(Equal(uint64(40 * 32)))
+		})
+
+		It("Should reject sequence numbers older than the window", func() {
+			_, err := t.WriteProducerEvent("p1", 2, []byte("test"))
+			Expect(err).To(Equal(topic.ErrOutOfOrderSequence))
+		})
+
+		It("Should reject an empty producer ID", func() {
+			_, err := t.WriteProducerEvent("", 1, []byte("test"))
+			Expect(err).To(Equal(topic.ErrInvalidProducerID))
+		})
+
+		Context("When the topic is reopened", func() {
+			BeforeEach(func() {
+				Expect(t.Close()).To(Succeed())
+				var err error
+				t, err = topic.New(topicDir, 1024)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("Should remember sequence numbers of sealed and current segments", func() {
+				Expect(t.Segments()).To(HaveLen(1))
+				address, err := t.WriteProducerEvent("p1", 30, []byte("test"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(address).To(Equal(uint64(29 * 32)))
+				address, err = t.WriteProducerEvent("p1", 40, []byte("test"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(address).To(Equal(uint64(39 * 32)))
+				address, err = t.WriteProducerEvent("p1", 41, []byte("test"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(address).To(Equal(uint64(40 * 32)))
+			})
+		})
+
+		Context("When the producer expires", func() {
+			var now time.Time
+			BeforeEach(func() {
+				Expect(t.Close()).To(Succeed())
+				now = time.Unix(1000, 0)
+				var err error
+				t, err = topic.New(topicDir, 1024, topic.WithClock(func() time.Time { return now }), topic.WithProducerExpiry(time.Minute))
+				Expect(err).ToNot(HaveOccurred())
+				_, err = t.WriteProducerEvent("p2", 1, []byte("test"))
+				Expect(err).ToNot(HaveOccurred())
+				now = now.Add(2 * time.Minute)
+			})
+
+			It("Should start the sequence of the producer anew", func() {
+				address, err := t.WriteProducerEvent("p2", 1, []byte("test"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(address).To(Equal(uint64(41 * 32)))
+			})
+
+			It("Should forget the producer after reopening", func() {
+				Expect(t.Close()).To(Succeed())
+				var err error
+				t, err = topic.New(topicDir, 1024, topic.WithClock(func() time.Time { return now }), topic.WithProducerExpiry(time.Minute))
+				Expect(err).ToNot(HaveOccurred())
+				address, err := t.WriteProducerEvent("p2", 1, []byte("test"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(address).To(Equal(uint64(41 * 32)))
+			})
+		})
+
+		It("Should reject a negative deduplication window", func() {
+			Expect(t.Close()).To(Succeed())
+			_, err := topic.New(topicDir, 1024, topic.WithDeduplicationWindow(-1))
+			Expect(err).To(Equal(topic.ErrInvalidDeduplicationWindow))
+			t, err = topic.New(topicDir, 1024)
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Describe("PrepareTransaction()", func() {
+		var addresses []uint64
+
+		readAll := func() []string {
+			events := []string{}
+			Expect(t.ReadEvents(func(nextAddress uint64, data []byte) error {
+				events = append(events, string(data))
+				return nil
+			})).To(Succeed())
+			return events
+		}
+
+		BeforeEach(func() {
+			var err error
+			addresses, err = t.PrepareTransaction(1, [][]byte{[]byte("a"), []byte("b")})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("Should not make the events visible", func() {
+			Expect(addresses).To(Equal([]uint64{34, 52}))
+			Expect(t.NextAddress()).To(Equal(uint64(0)))
+			id, pending := t.PendingTransaction()
+			Expect(pending).To(BeTrue())
+			Expect(id).To(Equal(uint64(1)))
+		})
+
+		It("Should keep the transaction pending when finishing another ID", func() {
+			Expect(t.AbortTransaction(2)).To(Equal(topic.ErrUnknownTransaction))
+			Expect(t.CommitTransaction(2)).To(Equal(topic.ErrUnknownTransaction))
+			Expect(t.CommitTransaction(1)).To(Succeed())
+			_, err := t.WriteEvent([]byte("c"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(readAll()).To(Equal([]string{"a", "b", "c"}))
+		})
+
+		Context("When the transaction is committed", func() {
+			BeforeEach(func() {
+				Expect(t.CommitTransaction(1)).To(Succeed())
+				_, err := t.WriteEvent([]byte("c"))
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("Should return the events without markers", func() {
+				Expect(t.NextAddress()).To(Equal(uint64(122)))
+				Expect(readAll()).To(Equal([]string{"a", "b", "c"}))
+				data, nextAddress, err := t.Read(0)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(data)).To(Equal("a"))
+				Expect(nextAddress).To(Equal(uint64(52)))
+				events, err := t.Last(3)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(events).To(HaveLen(3))
+				Expect(string(events[0].Data)).To(Equal("a"))
+			})
+		})
+
+		Context("When the transaction is aborted", func() {
+			BeforeEach(func() {
+				Expect(t.AbortTransaction(1)).To(Succeed())
+				_, err := t.WriteEvent([]byte("c"))
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("Should skip the events of the transaction", func() {
+				Expect(readAll()).To(Equal([]string{"c"}))
+				c := t.NewCursor()
+				Expect(c.Next()).To(BeTrue())
+				Expect(c.Address()).To(Equal(uint64(104)))
+				Expect(c.Next()).To(BeFalse())
+				events, err := t.Last(3)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(events).To(HaveLen(1))
+			})
+
+			Context("When the topic reads uncommitted events", func() {
+				BeforeEach(func() {
+					Expect(t.Close()).To(Succeed())
+					var err error
+					t, err = topic.New(topicDir, 1024, topic.WithReadUncommitted())
+					Expect(err).ToNot(HaveOccurred())
+				})
+
+				It("Should return the events of the aborted transaction", func() {
+					Expect(readAll()).To(Equal([]string{"a", "b", "c"}))
+				})
+			})
+		})
+
+		Context("When an aborted transaction spans several segments", func() {
+			BeforeEach(func() {
+				Expect(t.AbortTransaction(1)).To(Succeed())
+				_, err := t.PrepareTransaction(2, [][]byte{make([]byte, 800), make([]byte, 800), make([]byte, 800)})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(t.AbortTransaction(2)).To(Succeed())
+				_, err = t.WriteEvent([]byte("c"))
+				Expect(err).ToNot(HaveOccurred())
+				// seal the segment holding the abort marker
+				_, err = t.WriteEvent(make([]byte, 1000))
+				Expect(err).ToNot(HaveOccurred())
+				_, err = t.WriteEvent([]byte("d"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(t.Close()).To(Succeed())
+				t, err = topic.New(topicDir, 1024)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("Should skip the events after reopening", func() {
+				Expect(len(t.Segments())).To(BeNumerically(">", 1))
+				events := readAll()
+				Expect(events).To(HaveLen(3))
+				Expect(events[0]).To(Equal("c"))
+				Expect(events[2]).To(Equal("d"))
+			})
+		})
+
+		Context("When the topic is reopened before the transaction is finished", func() {
+			BeforeEach(func() {
+				Expect(t.Close()).To(Succeed())
+				var err error
+				t, err = topic.New(topicDir, 1024)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("Should keep the transaction pending", func() {
+				id, pending := t.PendingTransaction()
+				Expect(pending).To(BeTrue())
+				Expect(id).To(Equal(uint64(1)))
+				Expect(t.NextAddress()).To(Equal(uint64(0)))
+				_, err := t.WriteEvent([]byte("c"))
+				Expect(err).To(Equal(topic.ErrTransactionPending))
+			})
+
+			It("Should never return events of the aborted transaction", func() {
+				Expect(t.AbortTransaction(1)).To(Succeed())
+				Expect(readAll()).To(BeEmpty())
+				_, err := t.WriteEvent([]byte("c"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(readAll()).To(Equal([]string{"c"}))
+			})
+		})
+	})
+
+	Describe("ReadLease()", func() {
+		Context("When the topic is closed while the lease is held", func() {
+			It("Should keep the data valid until the lease is released", func() {
+				_, err := t.WriteEvent([]byte("test"))
+				Expect(err).ToNot(HaveOccurred())
+				data, nextAddress, lease, err := t.ReadLease(0)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nextAddress).To(Equal(uint64(21)))
+				Expect(t.Close()).To(Succeed())
+				Expect(data).To(Equal([]byte("test")))
+				Expect(lease.Release()).To(Succeed())
+				t, err = topic.New(topicDir, 1024)
+				Expect(err).ToNot(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("WithCopyOnRead()", func() {
+		It("Should return data that stays valid after the topic is closed", func() {
+			Expect(t.Close()).To(Succeed())
+			var err error
+			t, err = topic.New(topicDir, 1024, topic.WithCopyOnRead())
+			Expect(err).ToNot(HaveOccurred())
+			_, err = t.WriteEvent([]byte("test"))
+			Expect(err).ToNot(HaveOccurred())
+			data, _, err := t.Read(0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(t.Close()).To(Succeed())
+			Expect(data).To(Equal([]byte("test")))
+			t, err = topic.New(topicDir, 1024)
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Describe("WithReadOnly()", func() {
+		It("Should read the events of a topic open for writing without changing its directory", func() {
+			for i := 0; i < 100; i++ {
+				_, err := t.WriteEvent([]byte(fmt.Sprintf("event %d", i)))
+				Expect(err).ToNot(HaveOccurred())
+			}
+
+			files, err := ioutil.ReadDir(topicDir)
+			Expect(err).ToNot(HaveOccurred())
+
+			ro, err := topic.New(topicDir, 1024, topic.WithReadOnly())
+			Expect(err).ToNot(HaveOccurred())
+			defer ro.Close()
+
+			Expect(ro.NextAddress()).To(Equal(t.NextAddress()))
+
+			c := ro.NewCursor()
+			count := 0
+			for c.Next() {
+				Expect(c.Event().Data).To(Equal([]byte(fmt.Sprintf("event %d", count))))
+				count++
+			}
+			Expect(c.Err()).ToNot(HaveOccurred())
+			Expect(count).To(Equal(100))
+
+			_, err = ro.WriteEvent([]byte("test"))
+			Expect(err).To(Equal(topic.ErrReadOnly))
+
+			after, err := ioutil.ReadDir(topicDir)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(len(after)).To(Equal(len(files)))
+		})
+	})
+
+	Describe("Check() and Repair()", func() {
+		var end uint64
+		var segments []topic.SegmentInfo
+
+		BeforeEach(func() {
+			Expect(t.Close()).To(Succeed())
+			var err error
+			t, err = topic.New(topicDir, 1024, topic.WithHashChain())
+			Expect(err).ToNot(HaveOccurred())
+			for i := 0; i < 100; i++ {
+				_, err = t.WriteEvent([]byte(fmt.Sprintf("event %d", i)))
+				Expect(err).ToNot(HaveOccurred())
+			}
+			end = t.NextAddress()
+			segments = t.Segments()
+			Expect(len(segments)).To(BeNumerically(">", 1))
+			Expect(t.Close()).To(Succeed())
+			t = nil
+		})
+
+		AfterEach(func() {
+			if t != nil {
+				Expect(t.Close()).To(Succeed())
+			}
+		})
+
+		segmentFile := func(startAddress uint64) string {
+			return filepath.Join(topicDir, fmt.Sprintf("%016x.seg", startAddress))
+		}
+
+		It("Should not find problems in a healthy topic", func() {
+			report, err := topic.Check(topicDir, 1024)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(report.OK()).To(BeTrue())
+			Expect(report.End).To(Equal(end))
+			Expect(len(report.Segments)).To(Equal(len(segments) + 1))
+			Expect(report.Segments[0].Sealed).To(BeTrue())
+			Expect(report.Segments[0].Events).To(Equal(segments[0].Events))
+		})
+
+		Context("When the last segment has a torn record", func() {
+			BeforeEach(func() {
+				f, err := os.OpenFile(segmentFile(segments[len(segments)-1].StartAddress+segments[len(segments)-1].Size), os.O_WRONLY|os.O_APPEND, 0700)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = f.Write([]byte{0x40, 0, 0, 20, 0})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(f.Close()).To(Succeed())
+			})
+
+			It("Should report the incomplete record", func() {
+				report, err := topic.Check(topicDir, 1024)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(report.OK()).To(BeFalse())
+				Expect(report.End).To(Equal(end))
+				Expect(report.Segments[len(report.Segments)-1].Problems).To(Equal([]string{fmt.Sprintf("incomplete record at %d", end)}))
+			})
+
+			It("Should truncate the segment", func() {
+				result, err := topic.Repair(topicDir, 1024)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result.Truncated).ToNot(BeEmpty())
+				Expect(result.Quarantined).To(BeEmpty())
+				Expect(result.Report.OK()).To(BeTrue())
+				t, err = topic.New(topicDir, 1024, topic.WithHashChain())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(t.NextAddress()).To(Equal(end))
+				_, err = t.WriteEvent([]byte("test"))
+				Expect(err).ToNot(HaveOccurred())
+			})
+		})
+
+		Context("When a sealed segment is corrupted", func() {
+			BeforeEach(func() {
+				f, err := os.OpenFile(segmentFile(segments[1].StartAddress), os.O_WRONLY, 0700)
+				Expect(err).ToNot(HaveOccurred())
+				_, err = f.WriteAt([]byte("x"), int64(segments[1].Size-6))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(f.Close()).To(Succeed())
+			})
+
+			It("Should report the checksum mismatch", func() {
+				report, err := topic.Check(topicDir, 1024)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(report.Segments[1].Problems).To(Equal([]string{topic.ErrSegmentChecksumMismatch.Error()}))
+			})
+
+			It("Should quarantine the segment and all following segments", func() {
+				result, err := topic.Repair(topicDir, 1024)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(len(result.Quarantined)).To(Equal(len(segments)))
+				Expect(result.Sidecars).To(Equal([]string{"hashes"}))
+				Expect(result.Report.OK()).To(BeTrue())
+				_, err = os.Stat(filepath.Join(result.QuarantineDir, fmt.Sprintf("%016x.seg", segments[1].StartAddress)))
+				Expect(err).ToNot(HaveOccurred())
+
+				t, err = topic.New(topicDir, 1024, topic.WithHashChain())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(t.NextAddress()).To(Equal(segments[1].StartAddress))
+				Expect(t.VerifyHashChain()).To(Succeed())
+			})
+		})
+
+		Context("When a segment file is missing", func() {
+			BeforeEach(func() {
+				Expect(os.Remove(segmentFile(segments[1].StartAddress))).To(Succeed())
+			})
+
+			It("Should report the gap", func() {
+				report, err := topic.Check(topicDir, 1024)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(report.Gaps).To(Equal([]topic.AddressRange{{From: segments[1].StartAddress, To: segments[1].StartAddress + segments[1].Size}}))
+			})
+		})
+	})
+
+	Describe("Record format", func() {
+		var dir string
+
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(dir)).To(Succeed())
+		})
+
+		Context("When the segments were written before records had headers", func() {
+			BeforeEach(func() {
+				s, err := segment.New(filepath.Join(dir, "0000000000000000.seg"), 1024)
+				Expect(err).ToNot(HaveOccurred())
+				_, _, err = s.Append([]byte("test"))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(s.Close()).To(Succeed())
+			})
+
+			It("Should return ErrUnsupportedFormat", func() {
+				_, err := topic.New(dir, 1024)
+				Expect(err).To(Equal(topic.ErrUnsupportedFormat))
+				_, err = topic.Check(dir, 1024)
+				Expect(err).To(Equal(topic.ErrUnsupportedFormat))
+			})
+		})
+
+		Context("When the topic is upgraded from format 0", func() {
+			BeforeEach(func() {
+				legacy := []byte{0, 0, 0, 4, 't', 'e', 's', 't', 0, 0, 0, 1, 'x', 0, 0}
+				Expect(ioutil.WriteFile(filepath.Join(dir, "0000000000000000.seg"), legacy, 0700)).To(Succeed())
+				count, err := topic.Upgrade(dir, 1024)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(count).To(Equal(uint64(2)))
+			})
+
+			AfterEach(func() {
+				Expect(os.RemoveAll(dir + ".format0")).To(Succeed())
+			})
+
+			It("Should convert the events to the current format", func() {
+				nt, err := topic.New(dir, 1024)
+				Expect(err).ToNot(HaveOccurred())
+				defer nt.Close()
+				events := []string{}
+				Expect(nt.ReadEvents(func(nextAddress uint64, data []byte) error {
+					events = append(events, string(data))
+					return nil
+				})).To(Succeed())
+				Expect(events).To(Equal([]string{"test", "x"}))
+			})
+
+			It("Should keep the old segments", func() {
+				_, err := os.Stat(filepath.Join(dir+".format0", "0000000000000000.seg"))
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("Should not change the topic again", func() {
+				count, err := topic.Upgrade(dir, 1024)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(count).To(Equal(uint64(0)))
+			})
+		})
+
+		Context("When the topic was written with a newer format", func() {
+			BeforeEach(func() {
+				nt, err := topic.New(dir, 1024)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nt.Close()).To(Succeed())
+				Expect(ioutil.WriteFile(filepath.Join(dir, "format"), []byte("2\n"), 0700)).To(Succeed())
+			})
+
+			It("Should return ErrUnsupportedFormat", func() {
+				_, err := topic.New(dir, 1024)
+				Expect(err).To(Equal(topic.ErrUnsupportedFormat))
+			})
+		})
+	})
+
+	Describe("WithStartAddress()", func() {
+		It("Should start a new topic at the address", func() {
+			dir, err := ioutil.TempDir("", "")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(dir)
+			nt, err := topic.New(dir, 1024, topic.WithStartAddress(1000))
+			Expect(err).ToNot(HaveOccurred())
+			defer nt.Close()
+			Expect(nt.WriteEvent([]byte("test"))).To(Equal(uint64(1000)))
+			data, _, err := nt.Read(1000)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).To(Equal([]byte("test")))
+			c := nt.NewRangeCursor(0, math.MaxUint64)
+			Expect(c.Next()).To(BeTrue())
+			Expect(c.Address()).To(Equal(uint64(1000)))
+		})
+	})
+
+	Describe("ExportArchive() and ImportArchive()", func() {
+		var importDir string
+		var segments []topic.SegmentInfo
+
+		BeforeEach(func() {
+			for i := 0; i < 100; i++ {
+				_, err := t.WriteEvent([]byte(fmt.Sprintf("event %d", i)))
+				Expect(err).ToNot(HaveOccurred())
+			}
+			segments = t.Segments()
+			Expect(len(segments)).To(BeNumerically(">", 1))
+			var err error
+			importDir, err = ioutil.TempDir("", "")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			Expect(os.RemoveAll(importDir)).To(Succeed())
+		})
+
+		events := func(tp *topic.Topic) map[uint64]string {
+			all := map[uint64]string{}
+			c := tp.NewCursor()
+			for c.Next() {
+				all[c.Address()] = string(c.Event().Data)
+			}
+			Expect(c.Err()).ToNot(HaveOccurred())
+			return all
+		}
+
+		It("Should copy the topic keeping the addresses", func() {
+			archive := &bytes.Buffer{}
+			m, err := t.ExportArchive(archive, 0, math.MaxUint64)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m.EndAddress).To(Equal(t.NextAddress()))
+			Expect(len(m.Segments)).To(Equal(len(segments) + 1))
+
+			_, err = topic.ImportArchive(archive, importDir)
+			Expect(err).ToNot(HaveOccurred())
+
+			imported, err := topic.New(importDir, 1024)
+			Expect(err).ToNot(HaveOccurred())
+			defer imported.Close()
+			Expect(imported.NextAddress()).To(Equal(t.NextAddress()))
+			Expect(events(imported)).To(Equal(events(t)))
+		})
+
+		It("Should export the segments of the range", func() {
+			archive := &bytes.Buffer{}
+			m, err := t.ExportArchive(archive, segments[1].StartAddress, segments[1].StartAddress+1)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(m.StartAddress).To(Equal(segments[1].StartAddress))
+			Expect(m.EndAddress).To(Equal(segments[1].StartAddress + segments[1].Size))
+
+			_, err = topic.ImportArchive(archive, importDir)
+			Expect(err).ToNot(HaveOccurred())
+
+			imported, err := topic.New(importDir, 1024)
+			Expect(err).ToNot(HaveOccurred())
+			defer imported.Close()
+			all := events(imported)
+			Expect(len(all)).To(Equal(int(segments[1].Events)))
+			Expect(all[segments[1].FirstAddress]).To(Equal(events(t)[segments[1].FirstAddress]))
+		})
+
+		Context("When an import fails", func() {
+			It("Should leave no files behind so that it can be retried", func() {
+				archive := &bytes.Buffer{}
+				_, err := t.ExportArchive(archive, 0, math.MaxUint64)
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = topic.ImportArchive(bytes.NewReader(archive.Bytes()[:archive.Len()-2048]), importDir)
+				Expect(err).To(HaveOccurred())
+				files, err := ioutil.ReadDir(importDir)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(files).To(BeEmpty())
+
+				_, err = topic.ImportArchive(archive, importDir)
+				Expect(err).ToNot(HaveOccurred())
+				imported, err := topic.New(importDir, 1024)
+				Expect(err).ToNot(HaveOccurred())
+				defer imported.Close()
+				Expect(events(imported)).To(Equal(events(t)))
+			})
+		})
+
+		It("Should not import into a topic with segments", func() {
+			archive := &bytes.Buffer{}
+			_, err := t.ExportArchive(archive, 0, math.MaxUint64)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = topic.ImportArchive(archive, topicDir)
+			Expect(err).To(Equal(topic.ErrTopicNotEmpty))
+		})
+	})
+
+	Describe("WithMaxOpenSegments()", func() {
+		BeforeEach(func() {
+			Expect(t.Close()).To(Succeed())
+			var err error
+			t, err = topic.New(topicDir, 1024, topic.WithMaxOpenSegments(1))
+			Expect(err).ToNot(HaveOccurred())
+			for i := 0; i < 4; i++ {
+				_, err = t.WriteEvent([]byte{byte(i)})
+				Expect(err).ToNot(HaveOccurred())
+				_, err = t.WriteEvent(make([]byte, 1024-17-18))
+				Expect(err).ToNot(HaveOccurred())
+			}
+		})
+
+		It("Should keep at most one old segment open", func() {
+			Expect(t.OpenSegments()).To(Equal(1))
+			count := 0
+			Expect(t.ReadEvents(func(a uint64, d []byte) error {
+				count++
+				return nil
+			})).To(Succeed())
+			Expect(count).To(Equal(8))
+			Expect(t.OpenSegments()).To(Equal(1))
+		})
+
+		It("Should keep data valid after its segment is closed", func() {
+			data, _, err := t.Read(0)
+			Expect(err).ToNot(HaveOccurred())
+			_, _, err = t.Read(1024)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).To(Equal([]byte{0}))
+		})
+
+		Context("When the topic is reopened", func() {
+			BeforeEach(func() {
+				Expect(t.Close()).To(Succeed())
+				var err error
+				t, err = topic.New(topicDir, 1024, topic.WithMaxOpenSegments(1))
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("Should not open old segments until they are read", func() {
+				Expect(t.OpenSegments()).To(Equal(0))
+				data, _, err := t.Read(2048)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(data).To(Equal([]byte{2}))
+				Expect(t.OpenSegments()).To(Equal(1))
+			})
+		})
+	})
+
+	Describe("Subscribe()", func() {
+		var s chan topic.Event
+		BeforeEach(func() {
+			s = make(chan topic.Event)
+		})
+
+		var subscriber topic.SubscriberFunc
+		BeforeEach(func() {
+			subscriber = topic.SubscriberFunc(func(nextAddress uint64, data []byte) error {
+				s <- topic.Event{NextAddress: nextAddress, Data: data}
+				return nil
+			})
+
+		})
+		Context("When I unsubscribe", func() {
+			BeforeEach(func() {
+				t.Unsubscribe(subscriber)
+			})
+
+			It("Should not send any notifications to the subscriber", func(done Done) {
+				t.WriteEvent([]byte("test3"))
+				timeout := time.NewTimer(100 * time.Millisecond)
+				select {
+				case <-timeout.C:
+				case <-s:
+					Fail("Should not receive a message")
+				}
+				close(done)
+			})
+		})
+
+		Context("When there is one event in the topic", func() {
+			BeforeEach(func() {
+				t.WriteEvent([]byte("test"))
+			})
+			Context("When I subscribe to the topic", func() {
+				BeforeEach(func() {
+					t.Subscribe(0, subscriber)
+				})
+				It("The event channel should contain the first event", func(done Done) {
+					Expect(<-s).To(Equal(topic.Event{21, []byte("test")}))
+					close(done)
+				})
+				Context("When another event is written to the topic", func() {
+					BeforeEach(func() {
+						addr, err := t.WriteEvent([]byte("test2"))
+						Expect(err).ToNot(HaveOccurred())
+						Expect(addr).To(Equal(uint64(21)))
+					})
+					It("The event channel should contain both events", func(done Done) {
+						Expect(<-s).To(Equal(topic.Event{21, []byte("test")}))
+						Expect(<-s).To(Equal(topic.Event{43, []byte("test2")}))
+						close(done)
+					})
+
+				})
+			})
+		})
+	})
+
+})
+
+// failingKeys is a key provider that fails after a number of encrypted records.
+type failingKeys struct {
+	*segment.Keyring
+	remaining int
+}
+
+func (k *failingKeys) CurrentKey() (uint32, []byte, error) {
+	if k.remaining == 0 {
+		return 0, nil, errors.New("key provider failed")
+	}
+	k.remaining--
+	return k.Keyring.CurrentKey()
+}
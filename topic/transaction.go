@@ -0,0 +1,266 @@
+package topic
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+
+	"github.com/draganm/zathras/segment"
+)
+
+// ErrTransactionPending is returned when writing to a topic holding a
+// transaction that was neither committed nor aborted
+var ErrTransactionPending = errors.New("Topic has a pending transaction")
+
+// ErrUnknownTransaction is returned when committing or aborting a transaction that is not pending
+var ErrUnknownTransaction = errors.New("Unknown transaction")
+
+// Transaction markers are records of the recordMarker kind holding
+// [u8 marker type][u64 transaction ID][u64 address of the begin marker].
+// Events of a transaction are stored between its begin marker and its
+// commit or abort marker.
+const (
+	markerBegin byte = iota + 1
+	markerCommit
+	markerAbort
+)
+
+const markerSize = 17
+
+// AddressRange is the range of addresses [From, To).
+type AddressRange struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+// OpenTransaction is a transaction that was prepared but neither committed nor aborted.
+type OpenTransaction struct {
+	ID uint64 `json:"id"`
+	// Address is the address of the begin marker.
+	Address uint64 `json:"address"`
+}
+
+func encodeMarker(markerType byte, id, beginAddress uint64) []byte {
+	marker := make([]byte, markerSize)
+	marker[0] = markerType
+	binary.BigEndian.PutUint64(marker[1:], id)
+	binary.BigEndian.PutUint64(marker[9:], beginAddress)
+	return marker
+}
+
+func decodeMarker(payload []byte) (byte, uint64, uint64, error) {
+	if len(payload) != markerSize || payload[0] < markerBegin || payload[0] > markerAbort {
+		return 0, 0, 0, segment.ErrSegmentCorrupted
+	}
+	return payload[0], binary.BigEndian.Uint64(payload[1:]), binary.BigEndian.Uint64(payload[9:]), nil
+}
+
+// appendMarker appends a transaction marker. Must be called with the lock held.
+func (t *Topic) appendMarker(markerType byte, id, beginAddress uint64) (uint64, uint64, error) {
+	h := recordHeader{
+		kind:      recordMarker,
+		timestamp: t.now().UnixNano(),
+	}
+	return t.append(encodeHeader(h), encodeMarker(markerType, id, beginAddress))
+}
+
+// applyMarker updates the transaction state with the marker record at the
+// address. Must be called with the lock held.
+func (t *Topic) applyMarker(h recordHeader, record []byte, address, nextAddress uint64) error {
+	markerType, id, beginAddress, err := decodeMarker(record[h.length:])
+	if err != nil {
+		return err
+	}
+
+	t.transactional = true
+
+	switch markerType {
+	case markerBegin:
+		t.transaction = &OpenTransaction{ID: id, Address: address}
+	case markerCommit:
+		t.transaction = nil
+	case markerAbort:
+		t.transaction = nil
+		t.aborted = append(t.aborted, AddressRange{From: beginAddress, To: nextAddress})
+	}
+
+	return nil
+}
+
+// PrepareTransaction writes a begin marker and the events of the
+// transaction without making them visible. Other writes wait until the
+// transaction is committed or aborted.
+func (t *Topic) PrepareTransaction(id uint64, events [][]byte) ([]uint64, error) {
+	headers, payloads, err := t.encodeEvents(events)
+	if err != nil {
+		return nil, err
+	}
+
+	t.writeLock.Lock()
+	err = t.validateEvents(events, headers)
+	if err != nil {
+		t.writeLock.Unlock()
+		return nil, err
+	}
+
+	addresses, err := t.prepare(id, headers, payloads)
+	if err != nil {
+		t.writeLock.Unlock()
+		return nil, err
+	}
+
+	return addresses, nil
+}
+
+func (t *Topic) prepare(id uint64, headers []recordHeader, payloads [][]byte) ([]uint64, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.transaction != nil {
+		return nil, ErrTransactionPending
+	}
+
+	beginAddress, _, err := t.appendMarker(markerBegin, id, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	t.transactional = true
+	t.transaction = &OpenTransaction{ID: id, Address: beginAddress}
+
+	addresses := make([]uint64, len(payloads))
+	for i, payload := range payloads {
+		addresses[i], _, err = t.writeEvent(headers[i], payload)
+		if err != nil {
+			t.transaction = nil
+			t.rollback(beginAddress)
+			return nil, err
+		}
+	}
+
+	t.transactionHeld = true
+
+	return addresses, nil
+}
+
+// CommitTransaction writes the commit marker of the pending transaction and
+// makes its events visible.
+func (t *Topic) CommitTransaction(id uint64) error {
+	return t.finishTransaction(markerCommit, id)
+}
+
+// AbortTransaction writes the abort marker of the pending transaction. Its
+// events are never returned to readers of read committed topics.
+func (t *Topic) AbortTransaction(id uint64) error {
+	return t.finishTransaction(markerAbort, id)
+}
+
+// finishTransaction ends the pending transaction and releases the write lock
+// taken by PrepareTransaction. The lock stays held when the transaction
+// can't be finished, e.g. because of a wrong ID, so that it can be retried.
+func (t *Topic) finishTransaction(markerType byte, id uint64) error {
+	t.Lock()
+	held := t.transactionHeld
+	_, err := t.finish(markerType, id)
+	if err == nil {
+		t.transactionHeld = false
+	}
+	t.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if held {
+		t.writeLock.Unlock()
+	}
+
+	t.catchUpSidecars()
+
+	return nil
+}
+
+// finish appends the marker ending the pending transaction and commits it.
+// Must be called with the lock held.
+func (t *Topic) finish(markerType byte, id uint64) (uint64, error) {
+	if t.transaction == nil || t.transaction.ID != id {
+		return 0, ErrUnknownTransaction
+	}
+
+	beginAddress := t.transaction.Address
+	address, nextAddress, err := t.appendMarker(markerType, id, beginAddress)
+	if err != nil {
+		return 0, err
+	}
+
+	t.transaction = nil
+	if markerType == markerAbort {
+		t.aborted = append(t.aborted, AddressRange{From: beginAddress, To: nextAddress})
+	}
+
+	t.commit(nextAddress)
+
+	return address, nil
+}
+
+// PendingTransaction returns the ID of the transaction that was prepared but
+// neither committed nor aborted, e.g. because the process crashed.
+func (t *Topic) PendingTransaction() (uint64, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	if t.transaction == nil {
+		return 0, false
+	}
+	return t.transaction.ID, true
+}
+
+// abortedRange returns the range of the aborted transaction containing the address.
+// Must be called with the read lock held.
+func (t *Topic) abortedRange(address uint64) (AddressRange, bool) {
+	i := sort.Search(len(t.aborted), func(i int) bool {
+		return t.aborted[i].To > address
+	})
+	if i < len(t.aborted) && t.aborted[i].From <= address {
+		return t.aborted[i], true
+	}
+	return AddressRange{}, false
+}
+
+// eventAddress returns the address of the first event at or after the
+// address, skipping transaction markers and, when committed is set, events of
+// aborted transactions. It returns the next address of the topic when no
+// event follows.
+func (t *Topic) eventAddress(address uint64, committed bool) (uint64, error) {
+	for {
+		t.RLock()
+		transactional := t.transactional
+		lastAddress := t.lastAddress()
+		r, aborted := t.abortedRange(address)
+		t.RUnlock()
+
+		if !transactional || address >= lastAddress {
+			return address, nil
+		}
+
+		if committed && aborted {
+			address = r.To
+			continue
+		}
+
+		record, nextAddress, lease, err := t.readRecord(address)
+		if err != nil {
+			return 0, err
+		}
+		h, err := decodeHeader(record)
+		lease.Release()
+		if err != nil {
+			return 0, err
+		}
+
+		if h.kind != recordMarker {
+			return address, nil
+		}
+
+		address = nextAddress
+	}
+}
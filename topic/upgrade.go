@@ -0,0 +1,143 @@
+package topic
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/draganm/zathras/segment"
+)
+
+// upgradeSuffix is appended to the dir of a topic to get the dir the
+// upgraded topic is written to before it replaces the topic.
+const upgradeSuffix = ".upgrade"
+
+// format0Suffix is appended to the dir of a topic to get the dir the
+// segments of an upgraded topic are kept in.
+const format0Suffix = ".format0"
+
+// Upgrade converts the topic in the dir written before records had headers
+// (format 0) to the current format and returns the number of its events.
+// The events are written to a new topic next to the dir that then replaces
+// the dir; the old topic is kept in the dir with the ".format0" suffix until
+// it is removed by hand. Events get new addresses, as every record grows by
+// its header. Topics in the current format are not changed. An interrupted
+// upgrade is completed or started over by calling Upgrade again.
+func Upgrade(dir string, segmentSize uint64, options ...Option) (uint64, error) {
+	upgradeDir := dir + upgradeSuffix
+	format0Dir := dir + format0Suffix
+
+	_, err := os.Stat(dir)
+	if os.IsNotExist(err) && exists(upgradeDir) && exists(format0Dir) {
+		// interrupted after the old topic was moved away
+		return 0, replaceDir(upgradeDir, dir)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	segments, err := segmentFiles(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	if exists(filepath.Join(dir, formatFileName)) || len(segments) == 0 {
+		return 0, checkFormat(dir, len(segments) > 0, true)
+	}
+
+	err = os.RemoveAll(upgradeDir)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := copyFormat0(segments, upgradeDir, segmentSize, options)
+	if err != nil {
+		os.RemoveAll(upgradeDir)
+		return 0, err
+	}
+
+	err = os.Rename(dir, format0Dir)
+	if err != nil {
+		os.RemoveAll(upgradeDir)
+		return 0, err
+	}
+
+	return count, replaceDir(upgradeDir, dir)
+}
+
+// copyFormat0 writes the events of the format 0 segments to a new topic in the dir.
+func copyFormat0(segments []*oldSegment, dir string, segmentSize uint64, options []Option) (uint64, error) {
+	err := os.Mkdir(dir, 0700)
+	if err != nil {
+		return 0, err
+	}
+
+	t, err := New(dir, segmentSize, options...)
+	if err != nil {
+		return 0, err
+	}
+
+	count := uint64(0)
+	for _, o := range segments {
+		if isCompressed(o.fileName) {
+			t.Close()
+			return 0, ErrUnsupportedFormat
+		}
+		var n uint64
+		n, err = copySegment(t, o)
+		count += n
+		if err != nil {
+			t.Close()
+			return 0, err
+		}
+	}
+
+	err = t.Sync()
+	if err != nil {
+		t.Close()
+		return 0, err
+	}
+
+	return count, t.Close()
+}
+
+// copySegment writes the records of a format 0 segment as events to the topic.
+func copySegment(t *Topic, o *oldSegment) (uint64, error) {
+	if o.size == 0 {
+		return 0, nil
+	}
+
+	s, err := segment.New(o.fileName, o.size, segment.WithReadOnly())
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+
+	size, count := s.ValidSize()
+	for address := uint64(0); address < size; {
+		var data []byte
+		data, address, err = s.Read(address)
+		if err != nil {
+			return 0, err
+		}
+		_, err = t.WriteEvent(data)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return count, nil
+}
+
+// replaceDir moves the from dir to the to dir and syncs their parent.
+func replaceDir(from, to string) error {
+	err := os.Rename(from, to)
+	if err != nil {
+		return err
+	}
+	return segment.SyncDir(filepath.Dir(to))
+}
+
+func exists(fileName string) bool {
+	_, err := os.Stat(fileName)
+	return err == nil
+}
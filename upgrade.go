@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/draganm/zathras/topic"
+)
+
+// upgrade converts a stopped topic written before records had headers to
+// the current record format. Events get new addresses.
+func upgrade(args []string) error {
+	flags := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	dir := flags.String("dir", "", "directory of the topic")
+	segmentSize := flags.Uint64("segment-size", 64*1024*1024, "size of a segment file after which a new segment is started")
+	flags.Parse(args)
+
+	if *dir == "" {
+		return errors.New("-dir is required")
+	}
+
+	count, err := topic.Upgrade(*dir, *segmentSize)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("upgraded %d events, the old segments are kept in %s.format0\n", count, *dir)
+	return nil
+}
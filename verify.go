@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/draganm/zathras/merkle"
+	"github.com/draganm/zathras/segment"
+	"github.com/draganm/zathras/topic"
+)
+
+// verify checks all segment files of a topic offline and prints a report,
+// as JSON with -json. When the files are intact it checks the segments
+// against their footers and all events against the hash chain, if the topic
+// has one. When a signed tree head is given, it also checks that the topic
+// still contains the tree described by the head.
+func verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	dir := flags.String("dir", "", "directory of the topic, can also be given as argument")
+	segmentSize := flags.Uint64("segment-size", 64*1024*1024, "size of a segment file after which a new segment is started")
+	treeHeadFile := flags.String("tree-head", "", "JSON file with a signed tree head to check")
+	publicKeyFile := flags.String("public-key", "", "file with the base64 encoded ed25519 public key that signed the tree head")
+	keyringFile := flags.String("keyring", "", "keyring file of an encrypted topic")
+	jsonReport := flags.Bool("json", false, "print the report as JSON")
+	flags.Parse(args)
+
+	if *dir == "" && flags.NArg() == 1 {
+		*dir = flags.Arg(0)
+	}
+
+	if *dir == "" {
+		return errors.New("-dir is required")
+	}
+
+	options, err := keyringOptions(*keyringFile)
+	if err != nil {
+		return err
+	}
+
+	report, err := topic.Check(*dir, *segmentSize, options...)
+	if err != nil {
+		return err
+	}
+
+	// with -json only the report goes to stdout
+	out := io.Writer(os.Stdout)
+	if *jsonReport {
+		out = os.Stderr
+		err = printJSON(report)
+	} else {
+		printReport(report)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !report.OK() {
+		return errors.New("Topic has problems, see zathras repair")
+	}
+
+	hashChain := topic.HasHashChain(*dir)
+
+	options = append(options, topic.WithVerifySegments())
+	if hashChain {
+		options = append(options, topic.WithHashChain())
+	}
+
+	t, err := topic.New(*dir, *segmentSize, options...)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+
+	fmt.Fprintf(out, "%d sealed segments verified\n", len(t.Segments()))
+
+	if !hashChain {
+		if *treeHeadFile != "" {
+			return topic.ErrNoHashChain
+		}
+		return nil
+	}
+
+	err = t.VerifyHashChain()
+	if err != nil {
+		return err
+	}
+
+	head, err := t.TreeHead()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "hash chain of %d events verified, root hash %x\n", head.Size, head.RootHash)
+
+	if *treeHeadFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(*treeHeadFile)
+	if err != nil {
+		return err
+	}
+
+	signed := &merkle.TreeHead{}
+	err = json.Unmarshal(data, signed)
+	if err != nil {
+		return err
+	}
+
+	if *publicKeyFile != "" {
+		data, err = ioutil.ReadFile(*publicKeyFile)
+		if err != nil {
+			return err
+		}
+		publicKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return err
+		}
+		if len(publicKey) != ed25519.PublicKeySize || !signed.Verify(ed25519.PublicKey(publicKey)) {
+			return errors.New("Invalid tree head signature")
+		}
+	}
+
+	proof, err := t.ConsistencyProof(signed.Size, head.Size)
+	if err != nil {
+		return err
+	}
+
+	if !merkle.VerifyConsistency(signed.Size, head.Size, signed.RootHash, head.RootHash, proof) {
+		return errors.New("Topic is not consistent with the tree head")
+	}
+
+	fmt.Fprintf(out, "topic is consistent with the tree head of %d events\n", signed.Size)
+
+	return nil
+}
+
+// repair fixes the problems verify finds in a stopped topic: it truncates
+// an incomplete tail, quarantines broken segments and cuts or removes
+// sidecar files, see topic.Repair.
+func repair(args []string) error {
+	flags := flag.NewFlagSet("repair", flag.ExitOnError)
+	dir := flags.String("dir", "", "directory of the stopped topic, can also be given as argument")
+	segmentSize := flags.Uint64("segment-size", 64*1024*1024, "size of a segment file after which a new segment is started")
+	keyringFile := flags.String("keyring", "", "keyring file of an encrypted topic")
+	jsonReport := flags.Bool("json", false, "print the result as JSON")
+	flags.Parse(args)
+
+	if *dir == "" && flags.NArg() == 1 {
+		*dir = flags.Arg(0)
+	}
+
+	if *dir == "" {
+		return errors.New("-dir is required")
+	}
+
+	options, err := keyringOptions(*keyringFile)
+	if err != nil {
+		return err
+	}
+
+	result, err := topic.Repair(*dir, *segmentSize, options...)
+	if err != nil {
+		return err
+	}
+
+	if *jsonReport {
+		err = printJSON(result)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, fileName := range result.Quarantined {
+			fmt.Printf("quarantined %s in %s\n", fileName, result.QuarantineDir)
+		}
+		if result.Truncated != "" {
+			fmt.Printf("truncated %s\n", result.Truncated)
+		}
+		for _, fileName := range result.Sidecars {
+			fmt.Printf("repaired %s\n", fileName)
+		}
+		printReport(result.Report)
+	}
+
+	if !result.Report.OK() {
+		return errors.New("Topic still has problems")
+	}
+
+	return nil
+}
+
+func keyringOptions(keyringFile string) ([]topic.Option, error) {
+	if keyringFile == "" {
+		return nil, nil
+	}
+
+	keys, err := segment.LoadKeyring(keyringFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return []topic.Option{topic.WithEncryption(keys)}, nil
+}
+
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+func printReport(report *topic.Report) {
+	for _, s := range report.Segments {
+		for _, p := range s.Problems {
+			fmt.Printf("%s: %s\n", s.FileName, p)
+		}
+	}
+	for _, r := range report.Gaps {
+		fmt.Printf("no segment holds addresses %d to %d\n", r.From, r.To)
+	}
+	for _, r := range report.Overlaps {
+		fmt.Printf("several segments hold addresses %d to %d\n", r.From, r.To)
+	}
+	for _, p := range report.Problems {
+		fmt.Println(p)
+	}
+	fmt.Printf("%d segments checked, last event ends at %d\n", len(report.Segments), report.End)
+}